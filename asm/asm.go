@@ -0,0 +1,405 @@
+// Package asm 4bitCPU td4用のアセンブラ
+// ソースコードの前処理(マクロ・INCLUDE・条件付きアセンブル)、2パスのアセンブル、
+// 診断情報・リスト・シンボル表の出力を行う。コマンドラインの処理は td4asm 等の各コマンドで行う。
+package asm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// InstructionSet TD4の命令セット定義 (書式表 Instructions と疑似命令の表から生成する)
+var InstructionSet = func() map[string]bool {
+	set := make(map[string]bool)
+	for name := range Instructions {
+		set[name] = true
+	}
+	for name := range PseudoInstructions {
+		set[name] = true
+	}
+	return set
+}()
+
+// ROMSize TD4のROM容量 (バイト)
+const ROMSize = 16
+
+// SymbolKind シンボルの種類
+type SymbolKind int
+
+const (
+	SymbolLabel SymbolKind = iota // ラベル (値はアドレス)
+	SymbolConst                   // EQU / .define で定義した定数
+)
+
+// Symbol ラベルまたは定数
+type Symbol struct {
+	Name  string
+	Value int
+	Kind  SymbolKind
+	Def   *SourceLine   // 定義した行
+	Col   int           // 定義した桁位置
+	Refs  []*SourceLine // 参照している行 (-xref 用)
+}
+
+// SymbolTable ラベル・定数名とシンボルの対応表
+type SymbolTable map[string]*Symbol
+
+// SourceLine ソースコード1行分の情報
+type SourceLine struct {
+	File     string      // ファイル名
+	Line     int         // 行番号 (1から始まる)
+	Text     string      // 行の内容
+	CallSite *SourceLine // マクロ展開で生成された行の場合、呼び出した行
+	Macro    string      // マクロ展開で生成された行の場合、マクロ名
+
+	IncludedFrom *SourceLine // INCLUDEで取り込んだ行の場合、INCLUDEを記述した行
+}
+
+// Token ソースコード中の単語と、その桁位置
+type Token struct {
+	Text string
+	Col  int // 桁位置 (1から始まる)
+}
+
+// Assembler アセンブラ構造体
+type Assembler struct {
+	source       []SourceLine // 読み込んだソースコード
+	lines        []SourceLine // マクロを展開した後のソースコード
+	macros       map[string]*Macro
+	expansions   int      // マクロを展開した回数 (ラベルを固有の名前にするために使用)
+	IncludeDirs  []string // INCLUDEするファイルを探すディレクトリ (-I)
+	IncludeRoot  string   // 空でなければ、INCLUDEできるファイルをこのディレクトリの中に限る
+	WarnUnused   bool     // 参照されていないラベルを警告する (-Wunused)
+	includeStack []string // 取り込み中のファイル (循環参照の検出用)
+	symbolTable  SymbolTable
+	binaries     []uint8
+	addresses    []int         // バイナリを配置するアドレス (binariesと対応)
+	debugLines   []string      // バイナリに対応するソースコード表示用
+	srcLines     []*SourceLine // バイナリを生成したソースコードの行
+	usedAddr     map[int]*SourceLine
+	lineAddr     []int                // 各行の配置開始アドレス (Pass1で決定)
+	lineSize     []int                // 各行のバイト数 (Pass1で決定)
+	predefined   map[int]bool         // 前処理で定義済みの定数の行 (linesのインデックス)
+	pseudoLines  map[*SourceLine]bool // 疑似命令を展開した行 (リスト表示用)
+	pc           int                  // 処理中の行のアドレス (式の $ の値。未確定の場合は-1)
+	scope        string               // 処理中の行のグローバルラベル (ローカルラベルの範囲)
+	anonLabels   []int                // 無名ラベルのアドレス (定義順)
+	anonCount    int                  // 処理中の行までに定義された無名ラベルの数
+	lineScope    []string             // 各行のグローバルラベル (Pass1で決定)
+	lineAnon     []int                // 各行までに定義された無名ラベルの数 (Pass1で決定)
+	curLine      *SourceLine          // 処理中の行 (シンボルの参照の記録用)
+	Diags        Diagnostics
+}
+
+// NewAssembler ファイル名とソースコードの行スライスを受け取る
+func NewAssembler(fileName string, lines []string) *Assembler {
+	src := make([]SourceLine, len(lines))
+	for i, line := range lines {
+		src[i] = SourceLine{File: fileName, Line: i + 1, Text: line}
+	}
+	return &Assembler{
+		source:      src,
+		macros:      make(map[string]*Macro),
+		symbolTable: make(SymbolTable),
+		binaries:    make([]uint8, 0),
+		addresses:   make([]int, 0),
+		debugLines:  make([]string, 0),
+		srcLines:    make([]*SourceLine, 0),
+		usedAddr:    make(map[int]*SourceLine),
+		predefined:  make(map[int]bool),
+		pseudoLines: make(map[*SourceLine]bool),
+		pc:          -1,
+	}
+}
+
+// CleanLine コメント除去と空白の正規化を行い、トークン（単語）のリストを返す
+func (asm *Assembler) CleanLine(line string) []string {
+	// 1. コメント(;)以降を削除
+	if idx := strings.Index(line, ";"); idx != -1 {
+		line = line[:idx]
+	}
+	// 2. カンマをスペースに置換
+	line = strings.ReplaceAll(line, ",", " ")
+
+	// 3. 空白で分割
+	fields := strings.Fields(line)
+	return fields
+}
+
+// operandError オペランドに起因するエラー。エラー位置の表示に使用する。
+type operandError struct {
+	tok Token
+	msg string
+}
+
+func (e *operandError) Error() string { return e.msg }
+
+// reportError エラーを Diags に記録する。位置が不明な場合は pos の位置とする。
+func (asm *Assembler) reportError(src *SourceLine, pos Token, err error) {
+	if oe, ok := err.(*operandError); ok {
+		pos = oe.tok
+	}
+	asm.Diags.Errorf(src, pos.Col, len(pos.Text), "%v", err)
+}
+
+// defineSymbol シンボルを登録する。重複やレジスタ名の場合はエラーを記録する。
+// ローカルラベルは、グローバルラベルを付けた名前で登録する。
+func (asm *Assembler) defineSymbol(src *SourceLine, tok Token, kind SymbolKind, value int) {
+	name := asm.qualify(tok.Text)
+	if isRegisterName(name) {
+		asm.Diags.Errorf(src, tok.Col, len(tok.Text), "register name %s cannot be used as a label", name)
+		return
+	}
+	if !isIdentifier(tok.Text) {
+		asm.Diags.Errorf(src, tok.Col, len(tok.Text), "invalid label or constant name: %s", tok.Text)
+		return
+	}
+	if _, exists := asm.symbolTable[name]; exists {
+		if kind == SymbolLabel {
+			asm.Diags.Errorf(src, tok.Col, len(tok.Text), "duplicate label: %s", name)
+		} else {
+			asm.Diags.Errorf(src, tok.Col, len(tok.Text), "duplicate symbol: %s", name)
+		}
+		return
+	}
+	asm.symbolTable[name] = &Symbol{Name: name, Value: value, Kind: kind, Def: src, Col: tok.Col}
+}
+
+// constOperands EQU / .define の行から定数名と式を取り出す
+func constOperands(st Statement) (name, expr Token, err error) {
+	name, args := st.Label, st.Operands
+	if st.Op() == ".DEFINE" {
+		if st.Label.Text != "" {
+			return name, expr, &operandError{st.Label, "label is not allowed before .define"}
+		}
+		if len(args) != 2 {
+			return name, expr, &operandError{st.Mnemonic, ".define requires a name and a value"}
+		}
+		name, args = args[0], args[1:]
+	} else if name.Text == "" {
+		return name, expr, &operandError{st.Mnemonic, "EQU requires a name: NAME EQU value"}
+	}
+	if len(args) != 1 {
+		return name, expr, &operandError{st.Mnemonic, fmt.Sprintf("%s requires 1 value", st.Mnemonic.Text)}
+	}
+	return name, args[0], nil
+}
+
+// defineConst EQU / .define による定数を定義する
+// 定数の式は Pass1 の時点で評価するため、それより前に定義されたシンボルのみ参照できる。
+func (asm *Assembler) defineConst(src *SourceLine, st Statement) {
+	name, expr, err := constOperands(st)
+	if err != nil {
+		asm.reportError(src, st.Mnemonic, err)
+		return
+	}
+	val, _, err := asm.evalExpr(expr)
+	if err != nil {
+		asm.reportError(src, expr, err)
+		return
+	}
+	asm.defineSymbol(src, name, SymbolConst, val)
+}
+
+// predefineConst 前処理の時点で値の決まる定数を定義する (IFの条件で参照できるようにする)
+// ラベルを参照する等、まだ値の決まらない定数は Pass1 で定義する。
+func (asm *Assembler) predefineConst(src *SourceLine, st Statement) bool {
+	name, expr, err := constOperands(st)
+	if err != nil || isLocalLabel(name.Text) {
+		return false // ローカルな定数は、グローバルラベルの決まる Pass1 で定義する
+	}
+	val, _, err := asm.evalExpr(expr)
+	if err != nil {
+		return false
+	}
+	asm.defineSymbol(src, name, SymbolConst, val)
+	return true
+}
+
+// Pass1 マクロを展開し、ラベルのアドレスと定数の値を解決する
+// 各行の配置アドレスとバイト数もここで決定する。
+// エラーは Diags に蓄積し、1件以上あればエラーを返す。
+func (asm *Assembler) Pass1() error {
+	errCount := asm.Diags.ErrorCount()
+	asm.lines = asm.preprocess(asm.source)
+	asm.lineAddr = make([]int, len(asm.lines))
+	asm.lineSize = make([]int, len(asm.lines))
+	asm.lineScope = make([]string, len(asm.lines))
+	asm.lineAnon = make([]int, len(asm.lines))
+	pc, overflow := 0, false
+	for i := range asm.lines {
+		src := &asm.lines[i]
+		st := asm.ParseLine(src.Text)
+		asm.pc, asm.curLine = pc, src
+		if op := st.Op(); st.Label.Text != "" && op != "EQU" && op != ".DEFINE" {
+			asm.setScope(src, st.Label.Text)
+		}
+		asm.lineScope[i] = asm.scope
+
+		switch st.Op() {
+		case "EQU", ".DEFINE":
+			if !asm.predefined[i] {
+				asm.defineConst(src, st)
+			}
+			continue
+		}
+		// 配置アドレスとバイト数の決定
+		// ラベルのみの行の場合は、PCをインクリメントしない。
+		addr, size := pc, 0
+		if layoutDirectives[st.Op()] {
+			addr, size = asm.layoutDirective(src, st, pc)
+		} else if ps := asm.pseudoFor(st); ps != nil {
+			size = len(ps.Expand)
+		} else if st.Mnemonic.Text != "" {
+			size = 1
+		}
+		// ラベル定義 (ORGと同じ行の場合は、ORGで指定したアドレスになる)
+		if st.Label.Text == anonLabel {
+			asm.defineAnon(addr)
+		} else if st.Label.Text != "" {
+			asm.defineSymbol(src, st.Label, SymbolLabel, addr)
+		}
+		asm.lineAnon[i] = asm.anonCount
+		asm.lineAddr[i], asm.lineSize[i] = addr, size
+		pc = addr + size
+		// ROMに収まらない最初の行だけをエラーとする (以降の行はすべてはみ出すため)
+		if size > 0 && pc > ROMSize && !overflow {
+			asm.Diags.Errorf(src, st.Mnemonic.Col, len(st.Mnemonic.Text), "address %d is past the end of the %d-byte ROM", pc-1, ROMSize)
+			overflow = true
+		}
+	}
+	if n := asm.Diags.ErrorCount() - errCount; n > 0 {
+		return fmt.Errorf("%d error(s)", n)
+	}
+	return nil
+}
+
+// Pass2 機械語を生成し、表示用文字列も保存する
+// エラーが発生しても最後の行まで処理を続け、すべてのエラーを Diags に蓄積する。
+func (asm *Assembler) Pass2() error {
+	errCount := asm.Diags.ErrorCount()
+	for i := range asm.lines {
+		src := &asm.lines[i]
+		st := asm.ParseLine(src.Text)
+		// ラベルのみの行、定数定義の行
+		switch st.Op() {
+		case "", "EQU", ".DEFINE":
+			continue
+		}
+		pc := asm.lineAddr[i]
+		asm.pc, asm.scope, asm.anonCount = pc, asm.lineScope[i], asm.lineAnon[i]
+		asm.curLine = src
+		if layoutDirectives[st.Op()] {
+			asm.emitDirective(src, st, pc, asm.lineSize[i])
+			continue
+		}
+		if ps := asm.pseudoFor(st); ps != nil {
+			asm.expandPseudo(src, st, ps, pc)
+			continue
+		}
+
+		// 機械語生成
+		code, err := asm.generateCode(src, st.Op(), st.Operands, pc)
+		if err != nil {
+			// エラー位置は、原因となったオペランド、なければニーモニックとする
+			asm.reportError(src, st.Mnemonic, err)
+		}
+
+		// 結果を保存 (エラー時もアドレスがずれないように仮の値を保存する)
+		asm.emit(src, pc, code, statementText(st))
+	}
+	asm.curLine = nil
+	if asm.WarnUnused {
+		asm.checkUnused()
+	}
+	if n := asm.Diags.ErrorCount() - errCount; n > 0 {
+		return fmt.Errorf("%d error(s)", n)
+	}
+	return nil
+}
+
+// statementText 表示用に整形したソースコードを返す (例: "MOV A, B")
+// 引数の間にカンマを入れて読みやすくする
+func statementText(st Statement) string {
+	args := make([]string, len(st.Operands))
+	for i, arg := range st.Operands {
+		args[i] = arg.Text
+	}
+	return fmt.Sprintf("%s %s", st.Op(), strings.Join(args, ", "))
+}
+
+// fileName アセンブル対象のファイル名を返す
+func (asm *Assembler) fileName() string {
+	if len(asm.source) == 0 {
+		return ""
+	}
+	return asm.source[0].File
+}
+
+// generateCode 命令と引数からバイナリ(1byte)を生成
+// エラーの原因がオペランドにある場合は *operandError を返す。
+// src が nil の場合は警告を記録しない (疑似命令の展開時)。
+func (asm *Assembler) generateCode(src *SourceLine, mnemonic string, args []Token, currentPC int) (uint8, error) {
+	_, isInst := Instructions[mnemonic]
+	if _, isPseudo := PseudoInstructions[mnemonic]; !isInst && !isPseudo {
+		return 0, fmt.Errorf("unknown instruction: %s", mnemonic)
+	}
+	// オペランドをレジスタ・即値に分類し、書式表と照合する
+	ops := make([]Operand, len(args))
+	for i, arg := range args {
+		if arg.Text == "" {
+			return 0, &operandError{Token{" ", arg.Col}, "missing operand"}
+		}
+		op, err := asm.parseOperand(arg)
+		if err != nil {
+			return 0, err
+		}
+		ops[i] = op
+	}
+	// 疑似命令の書式もエラーメッセージに含める (疑似命令に当てはまる場合はここに来ない)
+	forms := append(append([]Form{}, Instructions[mnemonic]...), pseudoForms(mnemonic)...)
+	form, err := matchForm(mnemonic, forms, ops)
+	if err != nil {
+		return 0, err
+	}
+	// 即値を取る書式では、下位4bitに即値を加える
+	code := form.Opcode
+	for _, op := range ops {
+		if op.Kind == OperandImm {
+			im, err := asm.parseImm(src, op.Tok)
+			if err != nil {
+				return 0, err
+			}
+			code |= im
+		}
+	}
+	return code, nil
+}
+
+// parseImm 即値(数値・ラベル・定数式)を評価し、4bitの値に変換する
+// 範囲のチェックは式を評価した後に行う。
+func (asm *Assembler) parseImm(src *SourceLine, tok Token) (uint8, error) {
+	val, bareLabel, err := asm.evalExpr(tok)
+	if err != nil {
+		return 0, err
+	}
+	// ラベル1つだけの場合は、アドレスの下位4bitを使用する
+	if bareLabel && val > 15 {
+		if src != nil {
+			asm.Diags.Warnf(src, tok.Col, len(tok.Text), "label %s address %d is truncated to 4 bits (%d)", strings.ToUpper(tok.Text), val, val&0x0F)
+		}
+		return uint8(val & 0x0F), nil
+	}
+	if val < 0 {
+		return 0, &operandError{tok, fmt.Sprintf("immediate out of range (0-15): %d (use %d & 0xF or NEG(%d) for a 4-bit two's complement)", val, val, -val)}
+	}
+	if val > 15 {
+		return 0, &operandError{tok, fmt.Sprintf("immediate out of range (0-15): %d", val)}
+	}
+	return uint8(val), nil
+}
+
+// CodeSize 生成した機械語のバイト数を返す
+func (asm *Assembler) CodeSize() int {
+	return len(asm.binaries)
+}
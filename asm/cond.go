@@ -0,0 +1,156 @@
+package asm
+
+// 条件付きアセンブル (マクロ展開・INCLUDEと同じ前処理で行う)
+//
+//   IF 式          式の値が0以外であれば、以降の行をアセンブルする
+//   IFDEF 名前     定数が定義されていれば、以降の行をアセンブルする
+//   IFNDEF 名前    定数が定義されていなければ、以降の行をアセンブルする
+//   ELSE           条件が成り立たなかった場合にアセンブルする行の始まり
+//   ENDIF          条件付きアセンブルの終わり
+//
+// 条件の判定は前処理の時点で行うため、参照できるのはそれより前に定義した定数と
+// -D オプションで定義した名前だけとなる。ラベルは参照できない。
+
+import (
+	"fmt"
+	"strings"
+)
+
+func init() {
+	for _, name := range []string{"IF", "IFDEF", "IFNDEF", "ELSE", "ENDIF"} {
+		Directives[name] = true
+	}
+}
+
+// condBlock IF～ENDIF の1ブロック分の状態
+type condBlock struct {
+	src      *SourceLine // IFを記述した行
+	op       string      // IF, IFDEF, IFNDEF のいずれか
+	outer    bool        // 外側のブロックが有効であればtrue
+	active   bool        // 現在の行をアセンブルする場合はtrue
+	taken    bool        // 条件が成り立ったブロックがあればtrue
+	seenElse bool        // ELSEを処理済みであればtrue
+}
+
+// condStack 入れ子になった IF～ENDIF の状態
+type condStack []*condBlock
+
+// active 現在の行をアセンブルする場合はtrueを返す
+func (cs condStack) active() bool {
+	return len(cs) == 0 || cs[len(cs)-1].active
+}
+
+// conditional 条件付きアセンブルのディレクティブを処理する
+// 処理した場合はtrueを返す。
+func (asm *Assembler) conditional(src *SourceLine, st Statement, cs *condStack) bool {
+	op := st.Op()
+	switch op {
+	case "IF", "IFDEF", "IFNDEF", "ELSE", "ENDIF":
+	default:
+		return false
+	}
+	if st.Label.Text != "" {
+		asm.Diags.Errorf(src, st.Label.Col, len(st.Label.Text), "label is not allowed before %s", op)
+	}
+
+	switch op {
+	case "IF", "IFDEF", "IFNDEF":
+		block := &condBlock{src: src, op: op, outer: cs.active()}
+		// 無効なブロックの中では条件を評価しない (未定義の名前によるエラーを避ける)
+		if block.outer {
+			block.active = asm.evalCondition(src, st)
+			block.taken = block.active
+		}
+		*cs = append(*cs, block)
+	case "ELSE":
+		if len(*cs) == 0 {
+			asm.Diags.Errorf(src, st.Mnemonic.Col, len(st.Mnemonic.Text), "ELSE without IF")
+			return true
+		}
+		block := (*cs)[len(*cs)-1]
+		if block.seenElse {
+			asm.Diags.Errorf(src, st.Mnemonic.Col, len(st.Mnemonic.Text), "duplicate ELSE for IF at line %d", block.src.Line)
+			return true
+		}
+		block.seenElse = true
+		block.active = block.outer && !block.taken
+		block.taken = true
+	case "ENDIF":
+		if len(*cs) == 0 {
+			asm.Diags.Errorf(src, st.Mnemonic.Col, len(st.Mnemonic.Text), "ENDIF without IF")
+			return true
+		}
+		*cs = (*cs)[:len(*cs)-1]
+	}
+	if op == "ELSE" || op == "ENDIF" {
+		if len(st.Operands) > 0 {
+			arg := st.Operands[0]
+			asm.Diags.Errorf(src, arg.Col, len(arg.Text), "%s takes no operands", op)
+		}
+	}
+	return true
+}
+
+// evalCondition IF / IFDEF / IFNDEF の条件を判定する
+// エラーの場合は、条件が成り立たなかったものとして扱う。
+func (asm *Assembler) evalCondition(src *SourceLine, st Statement) bool {
+	op := st.Op()
+	if op == "IF" {
+		expr := restOfLine(src.Text, st)
+		if expr.Text == "" {
+			asm.Diags.Errorf(src, st.Mnemonic.Col, len(st.Mnemonic.Text), "IF requires an expression")
+			return false
+		}
+		val, _, err := asm.evalExpr(expr)
+		if err != nil {
+			asm.reportError(src, expr, err)
+			return false
+		}
+		return val != 0
+	}
+
+	if len(st.Operands) != 1 || !isIdentifier(st.Operands[0].Text) {
+		asm.Diags.Errorf(src, st.Mnemonic.Col, len(st.Mnemonic.Text), "%s requires 1 name", op)
+		return false
+	}
+	_, defined := asm.symbolTable[strings.ToUpper(st.Operands[0].Text)]
+	return defined == (op == "IFDEF")
+}
+
+// restOfLine ニーモニックより後ろ、コメントより前の文字列を1つのトークンとして返す
+func restOfLine(line string, st Statement) Token {
+	if idx := strings.Index(line, ";"); idx != -1 {
+		line = line[:idx]
+	}
+	start := st.Mnemonic.Col - 1 + len(st.Mnemonic.Text)
+	return trimToken(line[start:], start+1)
+}
+
+// checkConditions ファイル(またはマクロ本体)の終わりで、閉じていない IF を報告する
+func (asm *Assembler) checkConditions(cs condStack) {
+	for _, block := range cs {
+		asm.Diags.Errorf(block.src, 0, 0, "%s has no matching ENDIF", block.op)
+	}
+}
+
+// Define -D オプションで指定された "名前=値" または "名前" を定数として定義する
+// 値を省略した場合は1とする。
+func (asm *Assembler) Define(def string) error {
+	name, value := def, "1"
+	if idx := strings.Index(def, "="); idx != -1 {
+		name, value = def[:idx], def[idx+1:]
+	}
+	if !isIdentifier(name) || isKeyword(name) || isRegisterName(name) {
+		return fmt.Errorf("invalid name: %s", name)
+	}
+	val, _, err := asm.evalExpr(Token{value, 1})
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	name = strings.ToUpper(name)
+	if _, exists := asm.symbolTable[name]; exists {
+		return fmt.Errorf("duplicate symbol: %s", name)
+	}
+	asm.symbolTable[name] = &Symbol{Name: name, Value: val, Kind: SymbolConst, Def: &SourceLine{File: "<command line>"}}
+	return nil
+}
@@ -0,0 +1,134 @@
+package asm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// assembleDefined -D の定義を加えてアセンブルする
+func assembleDefined(t *testing.T, src string, defs ...string) *Assembler {
+	t.Helper()
+	asm := NewAssembler("test.td4", strings.Split(src, "\n"))
+	for _, def := range defs {
+		if err := asm.Define(def); err != nil {
+			t.Fatalf("Define(%q): %v", def, err)
+		}
+	}
+	asm.Pass1()
+	asm.Pass2()
+	asm.Diags.Sort()
+	return asm
+}
+
+func TestConditional(t *testing.T) {
+	const nested = `IF MODE == 1
+    OUT 1
+    IFDEF FAST
+        OUT 2
+    ELSE
+        OUT 3
+    ENDIF
+ELSE
+    IF MODE > 2
+        OUT 4
+    ELSE
+        OUT 5
+    ENDIF
+ENDIF`
+	tests := []struct {
+		src  string
+		defs []string
+		code []uint8
+	}{
+		// 入れ子の IF / ELSE / ENDIF
+		{nested, []string{"MODE=1", "FAST"}, []uint8{0xB1, 0xB2}},
+		{nested, []string{"MODE=1"}, []uint8{0xB1, 0xB3}},
+		{nested, []string{"MODE=3", "FAST"}, []uint8{0xB4}},
+		{nested, []string{"MODE=0"}, []uint8{0xB5}},
+		{"MODE EQU 1\n" + nested, nil, []uint8{0xB1, 0xB3}},
+
+		{"IFDEF DEBUG\n    OUT 1\nENDIF\n    OUT 0", []string{"DEBUG"}, []uint8{0xB1, 0xB0}},
+		{"IFDEF DEBUG\n    OUT 1\nENDIF\n    OUT 0", nil, []uint8{0xB0}},
+		{"IFNDEF DEBUG\n    OUT 1\nELSE\n    OUT 2\nENDIF", nil, []uint8{0xB1}},
+		{"ifndef debug\n    OUT 1\nelse\n    OUT 2\nendif", []string{"DEBUG"}, []uint8{0xB2}},
+		{"IF 0 ; コメント\n    OUT 1\nENDIF", nil, []uint8{}},
+		// 無効なブロックの中の条件は評価しない
+		{"IF 0\n    IF UNDEFINED\n    ENDIF\nENDIF", nil, []uint8{}},
+		// マクロの本体でも使える
+		{"MACRO M x\n    IF x\n    OUT x\n    ENDIF\nENDM\n    M 0\n    M 2", nil, []uint8{0xB2}},
+	}
+	for _, tt := range tests {
+		asm := assembleDefined(t, tt.src, tt.defs...)
+		if errs := errorText(asm); errs != "" || !bytes.Equal(asm.binaries, tt.code) {
+			t.Errorf("%q with -D %v = % X %q, want % X", tt.src, tt.defs, asm.binaries, errs, tt.code)
+		}
+	}
+}
+
+func TestConditionalErrors(t *testing.T) {
+	tests := []struct {
+		src, err string
+	}{
+		{"ELSE", "test.td4:1:1: error: ELSE without IF"},
+		{"ENDIF", "test.td4:1:1: error: ENDIF without IF"},
+		{"IF 1\n    NOP\nENDIF\nENDIF", "test.td4:4:1: error: ENDIF without IF"},
+		{"IF 1\n    NOP", "test.td4:1: error: IF has no matching ENDIF"},
+		{"IF 1\nIFDEF X\nENDIF", "test.td4:1: error: IF has no matching ENDIF"},
+		{"IF 1\nELSE\nELSE\nENDIF", "test.td4:3:1: error: duplicate ELSE for IF at line 1"},
+		{"IF 1\nENDIF 1", "test.td4:2:7: error: ENDIF takes no operands"},
+		{"IF\nENDIF", "IF requires an expression"},
+		{"IF LOOP\nENDIF\nLOOP:", "undefined label or constant: LOOP"}, // ラベルは参照できない
+		{"IFDEF\nENDIF", "IFDEF requires 1 name"},
+		{"IFNDEF 1\nENDIF", "IFNDEF requires 1 name"},
+		{"L: IF 1\nENDIF", "label is not allowed before IF"},
+		{"MACRO M\n    IF 1\nENDM\n    M", "IF has no matching ENDIF"},
+	}
+	for _, tt := range tests {
+		if errs := errorText(assemble(tt.src)); !strings.Contains(errs, tt.err) {
+			t.Errorf("%q errors = %q, want %q", tt.src, errs, tt.err)
+		}
+	}
+}
+
+func TestDefine(t *testing.T) {
+	for def, want := range map[string]int{"DEBUG": 1, "N=5": 5, "mode=0x0F": 15, "X=1+2*3": 7, "Y=": 0} {
+		asm := NewAssembler("test.td4", nil)
+		err := asm.Define(def)
+		if def == "Y=" {
+			if err == nil {
+				t.Errorf("Define(%q) succeeded, want an error for an empty value", def)
+			}
+			continue
+		}
+		name := strings.ToUpper(strings.SplitN(def, "=", 2)[0])
+		if sym := asm.symbolTable[name]; err != nil || sym == nil || sym.Value != want || sym.Kind != SymbolConst {
+			t.Errorf("Define(%q) = %v, symbol %+v; want %d", def, err, sym, want)
+		}
+	}
+
+	for def, want := range map[string]string{
+		"1X":      "invalid name: 1X",
+		"A=1":     "invalid name: A",
+		"MOV":     "invalid name: MOV",
+		"=3":      "invalid name: ",
+		"N=FOO":   "N: undefined label or constant: FOO",
+		"N=(1":    "N: missing ')' in expression",
+		"N=1 + /": "N: unexpected character '/' in expression",
+	} {
+		if err := NewAssembler("test.td4", nil).Define(def); err == nil || err.Error() != want {
+			t.Errorf("Define(%q) = %v, want %q", def, err, want)
+		}
+	}
+
+	asm := NewAssembler("test.td4", nil)
+	asm.Define("N=1")
+	if err := asm.Define("n=2"); err == nil || err.Error() != "duplicate symbol: N" {
+		t.Errorf("second Define = %v, want a duplicate symbol error", err)
+	}
+	// -D で定義した名前を、ソースで再定義するとエラーになる
+	asm = assembleDefined(t, "N EQU 2", "N=1")
+	if errs := errorText(asm); !strings.Contains(errs, "duplicate symbol: N") {
+		t.Errorf("redefinition errors = %q", errs)
+	}
+}
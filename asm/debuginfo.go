@@ -0,0 +1,60 @@
+package asm
+
+// デバッグ情報ファイルの出力 (-dbg)
+//
+// エミュレータでソースコードを表示しながらデバッグするためのテキストファイル。
+// タブ区切りで、先頭の項目によって次の2種類の行を出力する。";" で始まる行はコメント。
+//   LINE  アドレス  ファイル名  行番号  ラベル  ソースコード
+//   SYM   名前  値  種類(label/const)  ファイル名  行番号
+// アドレスと値は10進数。ラベルはそのアドレスに定義されたラベル (なければ空)。
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// addrLabels アドレスとラベル名の対応表を返す
+func (asm *Assembler) addrLabels() map[int]string {
+	return AddrLabels(asm.sortedSymbols())
+}
+
+// AddrLabels シンボルの一覧 (Symbols や ReadSymFile の結果) から、アドレスとラベル名の対応表を作る
+// 同じアドレスに複数のラベルがある場合は、マクロの展開で生成されたもの以外を優先し、その中では先のものとする。
+func AddrLabels(syms []*Symbol) map[int]string {
+	found := make(map[int]*Symbol)
+	for _, sym := range syms {
+		if sym.Kind != SymbolLabel {
+			continue
+		}
+		if prev, exists := found[sym.Value]; !exists || prev.Def.Macro != "" && sym.Def.Macro == "" {
+			found[sym.Value] = sym
+		}
+	}
+	labels := make(map[int]string)
+	for addr, sym := range found {
+		labels[addr] = sym.Name
+	}
+	return labels
+}
+
+// WriteDebugInfo デバッグ情報を出力する
+func (asm *Assembler) WriteDebugInfo(w io.Writer) error {
+	tab := func(s string) string { return strings.ReplaceAll(s, "\t", " ") }
+	if _, err := fmt.Fprintf(w, "; td4asm debug info: %s\n; LINE\taddr\tfile\tline\tlabel\ttext\n; SYM\tname\tvalue\tkind\tfile\tline\n", asm.fileName()); err != nil {
+		return err
+	}
+	labels := asm.addrLabels()
+	for i, addr := range asm.addresses {
+		src := asm.srcLines[i]
+		if _, err := fmt.Fprintf(w, "LINE\t%d\t%s\t%d\t%s\t%s\n", addr, tab(src.File), src.Line, labels[addr], tab(codeText(src.Text))); err != nil {
+			return err
+		}
+	}
+	for _, sym := range asm.sortedSymbols() {
+		if _, err := fmt.Fprintf(w, "SYM\t%s\t%d\t%s\t%s\t%d\n", sym.Name, sym.Value, sym.Kind, tab(sym.Def.File), sym.Def.Line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
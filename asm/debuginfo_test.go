@@ -0,0 +1,27 @@
+package asm
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteDebugInfo(t *testing.T) {
+	asm := assemble("MACRO WAIT\nW:\n    ADD A, 1\nENDM\nN EQU 3\nSTART:\n    WAIT\n    OUT N\t; コメント\n    JMP START")
+	var buf bytes.Buffer
+	if err := asm.WriteDebugInfo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	// マクロの展開で生成されたラベル (W@1) より、ソースに書いたラベル (START) を優先する
+	want := "; td4asm debug info: test.td4\n" +
+		"; LINE\taddr\tfile\tline\tlabel\ttext\n" +
+		"; SYM\tname\tvalue\tkind\tfile\tline\n" +
+		"LINE\t0\ttest.td4\t3\tSTART\tADD A, 1\n" +
+		"LINE\t1\ttest.td4\t8\t\tOUT N\n" +
+		"LINE\t2\ttest.td4\t9\t\tJMP START\n" +
+		"SYM\tSTART\t0\tlabel\ttest.td4\t6\n" +
+		"SYM\tW@1\t0\tlabel\ttest.td4\t2\n" +
+		"SYM\tN\t3\tconst\ttest.td4\t5\n"
+	if buf.String() != want {
+		t.Errorf("debug info =\n%s\nwant\n%s", buf.String(), want)
+	}
+}
@@ -0,0 +1,233 @@
+package asm
+
+// アセンブル時のエラー・警告（診断情報）を収集し、表示するための処理
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Severity 診断情報の重要度
+type Severity int
+
+const (
+	SeverityWarning Severity = iota // 警告 (アセンブルは継続し、出力も行う)
+	SeverityError                   // エラー (出力は行わない)
+)
+
+// String 重要度の表示名を返す
+func (s Severity) String() string {
+	if s == SeverityError {
+		return "error"
+	}
+	return "warning"
+}
+
+// Diagnostic 1件分の診断情報
+type Diagnostic struct {
+	Severity Severity
+	File     string // ソースファイル名
+	Line     int    // 行番号 (1から始まる)
+	Col      int    // 桁位置 (1から始まる。0は桁位置不明)
+	Len      int    // 下線を引く文字数
+	Message  string // メッセージ本文
+	Source   string // 該当行のソースコード (抜粋表示用)
+	Notes    []Note // 補足情報 (マクロの呼び出し元など)
+}
+
+// Note 診断情報に付ける補足情報
+type Note struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+}
+
+// String GCC形式 "ファイル名:行: note: メッセージ" の文字列を返す
+func (n Note) String() string {
+	return fmt.Sprintf("%s:%d: note: %s", n.File, n.Line, n.Message)
+}
+
+// String GCC形式 "ファイル名:行:桁: 重要度: メッセージ" の文字列を返す
+func (d Diagnostic) String() string {
+	if d.Line <= 0 { // ファイル全体に関する診断情報
+		return fmt.Sprintf("%s: %s: %s", d.File, d.Severity, d.Message)
+	}
+	if d.Col > 0 {
+		return fmt.Sprintf("%s:%d:%d: %s: %s", d.File, d.Line, d.Col, d.Severity, d.Message)
+	}
+	return fmt.Sprintf("%s:%d: %s: %s", d.File, d.Line, d.Severity, d.Message)
+}
+
+// maxNotes 1件の診断情報に付ける補足情報の上限
+const maxNotes = 4
+
+// Diagnostics 診断情報の収集器
+type Diagnostics struct {
+	List   []Diagnostic
+	Werror bool // trueの場合、警告もエラーとして扱う (-Werror)
+}
+
+// add 診断情報を1件追加する
+func (ds *Diagnostics) add(sev Severity, src *SourceLine, col, length int, format string, args ...interface{}) {
+	if ds.Werror && sev == SeverityWarning {
+		sev = SeverityError
+	}
+	d := Diagnostic{
+		Severity: sev,
+		Col:      col,
+		Len:      length,
+		Message:  fmt.Sprintf(format, args...),
+	}
+	if src != nil {
+		d.File = src.File
+		d.Line = src.Line
+		d.Source = src.Text
+		// マクロ展開で生成された行であれば、呼び出し元をたどって補足する
+		// 再帰呼び出し等で深くなった場合は、内側の数件と最も外側の呼び出しだけを表示する。
+		var notes []Note
+		outer := src
+		for ; outer.CallSite != nil; outer = outer.CallSite {
+			notes = append(notes, Note{outer.CallSite.File, outer.CallSite.Line, "in expansion of macro " + outer.Macro})
+		}
+		if len(notes) > maxNotes {
+			omitted := Note{notes[maxNotes-1].File, notes[maxNotes-1].Line, fmt.Sprintf("... %d more macro expansion(s)", len(notes)-maxNotes)}
+			notes = append(notes[:maxNotes-1], omitted, notes[len(notes)-1])
+		}
+		// INCLUDEで取り込んだ行であれば、取り込み元のファイルをたどって補足する
+		for s := outer.IncludedFrom; s != nil; s = s.IncludedFrom {
+			notes = append(notes, Note{s.File, s.Line, "included from here"})
+		}
+		d.Notes = notes
+	}
+	ds.List = append(ds.List, d)
+}
+
+// Errorf エラーを追加する
+func (ds *Diagnostics) Errorf(src *SourceLine, col, length int, format string, args ...interface{}) {
+	ds.add(SeverityError, src, col, length, format, args...)
+}
+
+// Warnf 警告を追加する
+func (ds *Diagnostics) Warnf(src *SourceLine, col, length int, format string, args ...interface{}) {
+	ds.add(SeverityWarning, src, col, length, format, args...)
+}
+
+// ErrorCount エラーの件数を返す
+func (ds *Diagnostics) ErrorCount() int {
+	n := 0
+	for _, d := range ds.List {
+		if d.Severity == SeverityError {
+			n++
+		}
+	}
+	return n
+}
+
+// WarningCount 警告の件数を返す
+func (ds *Diagnostics) WarningCount() int {
+	return len(ds.List) - ds.ErrorCount()
+}
+
+// HasErrors エラーが1件以上あればtrueを返す
+func (ds *Diagnostics) HasErrors() bool {
+	return ds.ErrorCount() > 0
+}
+
+// Sort 診断情報をファイル・行・桁の順に並べ替える
+// ファイルの順序は、最初に診断情報が記録された順とする。
+func (ds *Diagnostics) Sort() {
+	fileOrder := make(map[string]int)
+	for _, d := range ds.List {
+		if _, ok := fileOrder[d.File]; !ok {
+			fileOrder[d.File] = len(fileOrder)
+		}
+	}
+	sort.SliceStable(ds.List, func(i, j int) bool {
+		a, b := ds.List[i], ds.List[j]
+		if a.File != b.File {
+			return fileOrder[a.File] < fileOrder[b.File]
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Col < b.Col
+	})
+}
+
+// DiagFormats 指定可能な出力形式
+var DiagFormats = []string{"text", "gcc", "json"}
+
+// Write 診断情報を指定した形式で出力する
+// text : GCC形式の1行に加え、該当箇所のソースを下線付きで表示する
+// gcc  : GCC形式の1行のみ (エディタのエラージャンプ用)
+// json : JSON配列 (エディタ等の外部ツール連携用)
+func (ds *Diagnostics) Write(w io.Writer, format string) error {
+	switch format {
+	case "json":
+		type jsonDiag struct {
+			Severity string `json:"severity"`
+			File     string `json:"file"`
+			Line     int    `json:"line"`
+			Column   int    `json:"column"`
+			Length   int    `json:"length"`
+			Message  string `json:"message"`
+			Notes    []Note `json:"notes,omitempty"`
+		}
+		out := make([]jsonDiag, 0, len(ds.List))
+		for _, d := range ds.List {
+			out = append(out, jsonDiag{d.Severity.String(), d.File, d.Line, d.Col, d.Len, d.Message, d.Notes})
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(out)
+	case "gcc", "text", "":
+		for _, d := range ds.List {
+			if _, err := fmt.Fprintln(w, d.String()); err != nil {
+				return err
+			}
+			if format != "gcc" {
+				if _, err := fmt.Fprint(w, d.excerpt()); err != nil {
+					return err
+				}
+			}
+			for _, n := range d.Notes {
+				if _, err := fmt.Fprintln(w, n.String()); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown diagnostics format: %s", format)
+}
+
+// excerpt 該当行のソースと、桁位置を示す下線(^~~~)を返す
+func (d Diagnostic) excerpt() string {
+	if d.Source == "" || d.Line <= 0 {
+		return ""
+	}
+	src := strings.TrimRight(d.Source, "\r\n")
+	var sb strings.Builder
+	fmt.Fprintf(&sb, " %4d | %s\n", d.Line, src)
+	if d.Col <= 0 || d.Col > len(src)+1 {
+		return sb.String()
+	}
+	// 下線の位置をソースに合わせる。タブはタブのまま残し、それ以外は空白に置換える。
+	var pad strings.Builder
+	for _, r := range src[:d.Col-1] {
+		if r == '\t' {
+			pad.WriteRune('\t')
+		} else {
+			pad.WriteRune(' ')
+		}
+	}
+	length := d.Len
+	if length < 1 {
+		length = 1
+	}
+	fmt.Fprintf(&sb, "      | %s^%s\n", pad.String(), strings.Repeat("~", length-1))
+	return sb.String()
+}
@@ -0,0 +1,75 @@
+package asm
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// testDiagnostics 警告とエラーを1件ずつ含む診断情報を作成する
+func testDiagnostics() *Diagnostics {
+	var ds Diagnostics
+	src := &SourceLine{File: "test.td4", Line: 3, Text: "\tMOV C, 1\n"}
+	ds.Errorf(src, 6, 1, "unknown operand: %s", "C")
+	ds.Warnf(&SourceLine{File: "test.td4", Line: 1, Text: "LOOP:"}, 1, 4, "unused label: LOOP")
+	ds.Sort()
+	return &ds
+}
+
+func TestDiagnosticsWrite(t *testing.T) {
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"gcc", "test.td4:1:1: warning: unused label: LOOP\n" +
+			"test.td4:3:6: error: unknown operand: C\n"},
+		{"text", "test.td4:1:1: warning: unused label: LOOP\n" +
+			"    1 | LOOP:\n" +
+			"      | ^~~~\n" +
+			"test.td4:3:6: error: unknown operand: C\n" +
+			"    3 | \tMOV C, 1\n" +
+			"      | \t    ^\n"},
+	}
+	for _, tt := range tests {
+		var sb strings.Builder
+		if err := testDiagnostics().Write(&sb, tt.format); err != nil {
+			t.Fatalf("Write(%s): %v", tt.format, err)
+		}
+		if sb.String() != tt.want {
+			t.Errorf("Write(%s) =\n%s\nwant\n%s", tt.format, sb.String(), tt.want)
+		}
+	}
+
+	var sb strings.Builder
+	if err := testDiagnostics().Write(&sb, "json"); err != nil {
+		t.Fatal(err)
+	}
+	var got []map[string]interface{}
+	if err := json.Unmarshal([]byte(sb.String()), &got); err != nil {
+		t.Fatalf("json output is not valid: %v\n%s", err, sb.String())
+	}
+	if len(got) != 2 || got[1]["severity"] != "error" || got[1]["line"] != 3.0 || got[1]["column"] != 6.0 || got[1]["message"] != "unknown operand: C" {
+		t.Errorf("json output = %v", got)
+	}
+
+	// 診断情報がなくても、JSON形式では空の配列を出力する
+	sb.Reset()
+	var empty Diagnostics
+	if err := empty.Write(&sb, "json"); err != nil || strings.TrimSpace(sb.String()) != "[]" {
+		t.Errorf("empty json = %q, %v", sb.String(), err)
+	}
+	if err := empty.Write(&sb, "xml"); err == nil {
+		t.Error("unknown format was accepted")
+	}
+}
+
+func TestDiagnosticsWerror(t *testing.T) {
+	ds := Diagnostics{Werror: true}
+	ds.Warnf(nil, 0, 0, "unused label: X")
+	if ds.ErrorCount() != 1 || ds.WarningCount() != 0 {
+		t.Errorf("with Werror: %d error(s), %d warning(s)", ds.ErrorCount(), ds.WarningCount())
+	}
+	if s := ds.List[0].String(); s != ": error: unused label: X" {
+		t.Errorf("String() = %q", s)
+	}
+}
@@ -0,0 +1,166 @@
+package asm
+
+// アドレスの配置とデータの埋め込みを行うディレクティブ (ORG, DB/DATA, FILL, ALIGN)
+//   ORG addr          以降のコードを addr 番地から配置する
+//   DB byte, ...      1バイトの値をそのまま埋め込む (DATA も同じ)
+//   FILL n [, value]  value (省略時は0) を n バイト埋め込む
+//   ALIGN n [, value] アドレスが n の倍数になるまで value (省略時は0) で埋める
+
+import (
+	"fmt"
+	"strings"
+)
+
+// layoutDirectives アドレスを変更する、またはデータを埋め込むディレクティブ
+var layoutDirectives = map[string]bool{
+	"ORG": true, "DB": true, "DATA": true, "FILL": true, "ALIGN": true,
+}
+
+func init() {
+	for name := range layoutDirectives {
+		Directives[name] = true
+	}
+}
+
+// evalCount Pass1 でサイズやアドレスを決める式を評価する
+// 値はPass1の時点で確定している必要があるため、前方参照のラベルは使えない。
+// ROM容量を超える値は、巨大なイメージを作らないようにエラーとする。
+func (asm *Assembler) evalCount(src *SourceLine, tok Token, min int) (int, bool) {
+	val, _, err := asm.evalExpr(tok)
+	if err != nil {
+		asm.reportError(src, tok, err)
+		return 0, false
+	}
+	if val < min || val > ROMSize {
+		asm.Diags.Errorf(src, tok.Col, len(tok.Text), "value out of range (%d-%d): %d", min, ROMSize, val)
+		return 0, false
+	}
+	return val, true
+}
+
+// layoutDirective Pass1 でディレクティブを処理し、配置開始アドレスとバイト数を返す
+func (asm *Assembler) layoutDirective(src *SourceLine, st Statement, pc int) (addr, size int) {
+	op, args := st.Op(), st.Operands
+	switch op {
+	case "ORG":
+		if len(args) != 1 {
+			asm.Diags.Errorf(src, st.Mnemonic.Col, len(st.Mnemonic.Text), "ORG requires 1 address")
+			return pc, 0
+		}
+		if val, ok := asm.evalCount(src, args[0], 0); ok {
+			return val, 0
+		}
+	case "DB", "DATA":
+		if len(args) == 0 {
+			asm.Diags.Errorf(src, st.Mnemonic.Col, len(st.Mnemonic.Text), "%s requires at least 1 value", op)
+			return pc, 0
+		}
+		return pc, len(args)
+	case "FILL":
+		if len(args) < 1 || len(args) > 2 {
+			asm.Diags.Errorf(src, st.Mnemonic.Col, len(st.Mnemonic.Text), "FILL requires a count and an optional value: FILL n, value")
+			return pc, 0
+		}
+		if n, ok := asm.evalCount(src, args[0], 0); ok {
+			return pc, n
+		}
+	case "ALIGN":
+		if len(args) < 1 || len(args) > 2 {
+			asm.Diags.Errorf(src, st.Mnemonic.Col, len(st.Mnemonic.Text), "ALIGN requires a boundary and an optional value: ALIGN n, value")
+			return pc, 0
+		}
+		if n, ok := asm.evalCount(src, args[0], 1); ok {
+			return pc, (n - pc%n) % n
+		}
+	}
+	return pc, 0
+}
+
+// emitDirective Pass2 でデータを埋め込む
+// addr, size は Pass1 の layoutDirective で決めた値を使用する。
+func (asm *Assembler) emitDirective(src *SourceLine, st Statement, addr, size int) {
+	op, args := st.Op(), st.Operands
+	switch op {
+	case "DB", "DATA":
+		for i, arg := range args {
+			val, err := asm.evalByte(arg)
+			if err != nil {
+				asm.reportError(src, arg, err)
+			}
+			asm.emit(src, addr+i, val, fmt.Sprintf("%s %s", op, arg.Text))
+		}
+	case "FILL", "ALIGN":
+		var val uint8
+		if len(args) > 1 {
+			v, err := asm.evalByte(args[1])
+			if err != nil {
+				asm.reportError(src, args[1], err)
+			}
+			val = v
+		}
+		argTexts := make([]string, len(args))
+		for i, arg := range args {
+			argTexts[i] = arg.Text
+		}
+		text := fmt.Sprintf("%s %s", op, strings.Join(argTexts, ", "))
+		for i := 0; i < size; i++ {
+			asm.emit(src, addr+i, val, text)
+			text = "" // 2バイト目以降はソースを表示しない
+		}
+	}
+}
+
+// evalByte DB等で埋め込む1バイトの値を評価する
+// 未定義命令を含む任意のオペコードを書けるよう、範囲は 0～255 とする。
+func (asm *Assembler) evalByte(tok Token) (uint8, error) {
+	val, _, err := asm.evalExpr(tok)
+	if err != nil {
+		return 0, err
+	}
+	if val < 0 || val > 0xFF {
+		return 0, &operandError{tok, fmt.Sprintf("byte value out of range (0-255): %d", val)}
+	}
+	return uint8(val), nil
+}
+
+// emit 1バイト分の機械語を、アドレス・表示用ソースと共に保存する
+func (asm *Assembler) emit(src *SourceLine, addr int, code uint8, text string) {
+	if prev, used := asm.usedAddr[addr]; used {
+		asm.Diags.Errorf(src, 0, 0, "address %d is already used by line %d", addr, prev.Line)
+	} else {
+		asm.usedAddr[addr] = src
+	}
+	asm.binaries = append(asm.binaries, code)
+	asm.addresses = append(asm.addresses, addr)
+	asm.debugLines = append(asm.debugLines, text)
+	asm.srcLines = append(asm.srcLines, src)
+}
+
+// Image アセンブル結果をROMイメージとして返す
+// start は先頭のアドレス。コードのない番地は0(NOP)で埋める。
+// pad がtrueの場合は、0番地からROM容量いっぱいまでのイメージを返す。
+func (asm *Assembler) Image(pad bool) (start int, data []uint8) {
+	if len(asm.binaries) == 0 && !pad {
+		return 0, nil
+	}
+	start, end := -1, 0
+	for _, addr := range asm.addresses {
+		if start < 0 || addr < start {
+			start = addr
+		}
+		if addr+1 > end {
+			end = addr + 1
+		}
+	}
+	if pad {
+		start = 0
+		if end < ROMSize {
+			end = ROMSize
+		}
+	}
+	data = make([]uint8, end-start)
+	for i, code := range asm.binaries {
+		data[asm.addresses[i]-start] = code
+	}
+	return start, data
+}
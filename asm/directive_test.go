@@ -0,0 +1,79 @@
+package asm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDirectives(t *testing.T) {
+	tests := []struct {
+		name  string
+		src   string
+		start int
+		image []uint8
+	}{
+		{"ORG", "ORG 4\nOUT 1\nJMP 4", 4, []uint8{0xB1, 0xF4}},
+		{"ORG label", "ORG 2\nSTART: OUT 1\nORG 5\nJMP START", 2, []uint8{0xB1, 0x00, 0x00, 0xF2}},
+		{"ORG end of ROM", "NOP\nORG 16", 0, []uint8{0x00}},
+		{"DB", "DB 0xC3, 255, 1+1", 0, []uint8{0xC3, 0xFF, 0x02}},
+		{"DATA", "DATA 7", 0, []uint8{0x07}},
+		{"FILL", "FILL 3, 0xF0\nNOP", 0, []uint8{0xF0, 0xF0, 0xF0, 0x00}},
+		{"FILL default", "N EQU 2\nFILL N\nOUT 1", 0, []uint8{0x00, 0x00, 0xB1}},
+		{"FILL whole ROM", "FILL 16, 1", 0, bytes.Repeat([]uint8{1}, 16)},
+		{"ALIGN", "NOP\nALIGN 4, 0xE0\nOUT 2", 0, []uint8{0x00, 0xE0, 0xE0, 0xE0, 0xB2}},
+		{"ALIGN aligned", "ORG 8\nALIGN 4\nNOP", 8, []uint8{0x00}},
+	}
+	for _, tt := range tests {
+		asm := assemble(tt.src)
+		start, image := asm.Image(false)
+		if errs := errorText(asm); errs != "" || start != tt.start || !bytes.Equal(image, tt.image) {
+			t.Errorf("%s: %q = %d: % X %q, want %d: % X", tt.name, tt.src, start, image, errs, tt.start, tt.image)
+		}
+	}
+
+	// -pad では、0番地からROM容量いっぱいまで埋める
+	start, image := assemble("ORG 14\nJMP 0").Image(true)
+	if want := append(make([]uint8, 14), 0xF0, 0x00); start != 0 || !bytes.Equal(image, want) {
+		t.Errorf("padded image = %d: % X, want 0: % X", start, image, want)
+	}
+}
+
+func TestDirectiveErrors(t *testing.T) {
+	tests := []struct {
+		src, err string
+	}{
+		{"ORG", "ORG requires 1 address"},
+		{"ORG 20", "test.td4:1:5: error: value out of range (0-16): 20"},
+		{"ORG 0x7fffffff", "value out of range (0-16): 2147483647"},
+		{"ORG -1", "value out of range (0-16): -1"},
+		{"ORG LATER\nLATER:", "undefined label or constant: LATER"}, // 前方参照はできない
+		{"DB", "DB requires at least 1 value"},
+		{"DB 256", "byte value out of range (0-255): 256"},
+		{"FILL 2000000000", "value out of range (0-16): 2000000000"},
+		{"FILL 1, 2, 3", "FILL requires a count and an optional value"},
+		{"FILL 2, 300", "byte value out of range (0-255): 300"},
+		{"ALIGN 0", "value out of range (1-16): 0"},
+		{"ALIGN 100", "value out of range (1-16): 100"},
+		{"ALIGN", "ALIGN requires a boundary and an optional value"},
+		{"NOP\nORG 0\nOUT 1", "test.td4:3: error: address 0 is already used by line 1"},
+
+		// ROMに収まらないコード
+		{"ORG 15\nDB 1, 2", "test.td4:2:1: error: address 16 is past the end of the 16-byte ROM"},
+		{"ORG 10\nFILL 7", "test.td4:2:1: error: address 16 is past the end of the 16-byte ROM"},
+		{"ORG 16\nNOP", "test.td4:2:1: error: address 16 is past the end of the 16-byte ROM"},
+		{"ORG 12\nALIGN 16\nNOP", "test.td4:3:1: error: address 16 is past the end of the 16-byte ROM"},
+		{strings.Repeat("NOP\n", 17), "test.td4:17:1: error: address 16 is past the end of the 16-byte ROM"},
+	}
+	for _, tt := range tests {
+		asm := assemble(tt.src)
+		if errs := errorText(asm); !strings.Contains(errs, tt.err) {
+			t.Errorf("%q errors = %q, want %q", tt.src, errs, tt.err)
+		}
+	}
+
+	// ROMからはみ出したことは、最初の行で1回だけ報告する
+	if n := assemble(strings.Repeat("NOP\n", 20)).Diags.ErrorCount(); n != 1 {
+		t.Errorf("20 NOPs: %d error(s), want 1", n)
+	}
+}
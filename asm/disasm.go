@@ -0,0 +1,64 @@
+package asm
+
+// 逆アセンブル (機械語1バイトを命令の表記に戻す)
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// disasmTable オペコードと命令の表記の対応表 (書式表 Instructions から生成する)
+var disasmTable = func() map[uint8]string {
+	table := make(map[uint8]string)
+	names := make([]string, 0, len(Instructions))
+	for name := range Instructions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, f := range Instructions[name] {
+			imm := false
+			for _, k := range f.Operands {
+				imm = imm || k == OperandImm
+			}
+			for v := 0; v < 16; v++ {
+				if !imm && v > 0 {
+					break
+				}
+				op := f.Opcode | uint8(v)
+				if _, exists := table[op]; exists && name != "NOP" {
+					continue // 0x00 は ADD A, 0 ではなく NOP とする
+				}
+				ops := make([]string, len(f.Operands))
+				for i, k := range f.Operands {
+					ops[i] = k.String()
+					if k == OperandImm {
+						ops[i] = fmt.Sprint(v)
+					}
+				}
+				table[op] = strings.TrimSpace(name + " " + strings.Join(ops, ", "))
+			}
+		}
+	}
+	return table
+}()
+
+// Disassemble 機械語1バイトを "MOV A, 3" のような命令の表記で返す
+// TD4の命令にないオペコードは "DB 0x21" の形式で返す。
+func Disassemble(b uint8) string {
+	if text, ok := disasmTable[b]; ok {
+		return text
+	}
+	return fmt.Sprintf("DB 0x%02X", b)
+}
+
+// DisassembleLabel Disassemble と同じだが、JMP・JNC の飛び先にラベルがあれば、数値の代わりにラベル名で返す
+// labels はアドレスとラベル名の対応表 (AddrLabels の結果)。
+func DisassembleLabel(b uint8, labels map[int]string) string {
+	text := Disassemble(b)
+	if name, ok := labels[int(b&0x0F)]; ok && (strings.HasPrefix(text, "JMP ") || strings.HasPrefix(text, "JNC ")) {
+		return text[:len("JMP ")] + name
+	}
+	return text
+}
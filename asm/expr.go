@@ -0,0 +1,323 @@
+package asm
+
+// オペランドに記述された定数式の評価
+// 使用できる演算子 (優先順位の高い順)
+//   単項 + - ~
+//   *
+//   + -
+//   << >>
+//   < <= > >=   (比較の結果は 真:1 偽:0)
+//   == !=
+//   &
+//   ^
+//   |
+// $ は現在の命令のアドレス、:- :+ は直前・直後の無名ラベルのアドレスを表す。
+// 関数: LOW4(x) 下位4bitを取り出す, NEG(x) 4bitの2の補数 (xを引く代わりに加算する値)
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// exprToken 式を構成する字句
+type exprToken struct {
+	text string
+	pos  int  // 式の先頭からの位置 (バイト)
+	kind byte // 'n':数値 'i':名前 'o':演算子 0:終端
+}
+
+// exprFuncs 式の中で使用できる関数
+var exprFuncs = map[string]func(int) int{
+	"LOW4": func(x int) int { return x & 0x0F },
+	"NEG":  func(x int) int { return -x & 0x0F },
+}
+
+// exprEval 式の評価器
+type exprEval struct {
+	asm      *Assembler
+	tok      Token // 式全体のトークン (エラー位置の計算に使用)
+	toks     []exprToken
+	i        int
+	labelRef bool // ラベルを参照したらtrue
+}
+
+// isIdentStart 名前の先頭に使える文字であればtrueを返す
+func isIdentStart(c byte) bool {
+	return c == '_' || c == '.' || c == '@' || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
+}
+
+// isIdentChar 名前に使える文字であればtrueを返す
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || (c >= '0' && c <= '9')
+}
+
+// lexExpr 式を字句に分割する
+func lexExpr(tok Token) ([]exprToken, error) {
+	s := tok.Text
+	var toks []exprToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(s) && isIdentChar(s[j]) {
+				j++
+			}
+			toks = append(toks, exprToken{s[i:j], i, 'n'})
+			i = j
+		case c == ':' && i+1 < len(s) && (s[i+1] == '-' || s[i+1] == '+'):
+			// 無名ラベルの参照 (":-", ":++" 等)
+			j := i + 1
+			for j < len(s) && s[j] == s[i+1] {
+				j++
+			}
+			toks = append(toks, exprToken{s[i:j], i, 'i'})
+			i = j
+		case c == '$':
+			toks = append(toks, exprToken{"$", i, 'i'})
+			i++
+		case isIdentStart(c):
+			j := i
+			for j < len(s) && isIdentChar(s[j]) {
+				j++
+			}
+			toks = append(toks, exprToken{s[i:j], i, 'i'})
+			i = j
+		case i+1 < len(s) && isTwoCharOp(s[i:i+2]):
+			toks = append(toks, exprToken{s[i : i+2], i, 'o'})
+			i += 2
+		case strings.IndexByte("+-*&|^~()<>", c) >= 0:
+			toks = append(toks, exprToken{s[i : i+1], i, 'o'})
+			i++
+		default:
+			return nil, &operandError{Token{s[i : i+1], tok.Col + i}, fmt.Sprintf("unexpected character '%c' in expression", c)}
+		}
+	}
+	return append(toks, exprToken{"", len(s), 0}), nil
+}
+
+// isTwoCharOp 2文字の演算子であればtrueを返す
+func isTwoCharOp(s string) bool {
+	switch s {
+	case "<<", ">>", "<=", ">=", "==", "!=":
+		return true
+	}
+	return false
+}
+
+// evalExpr オペランドの式を評価する
+// 式がラベル1つだけの場合は bareLabel にtrueを返す。
+func (asm *Assembler) evalExpr(tok Token) (val int, bareLabel bool, err error) {
+	if tok.Text == "" {
+		return 0, false, &operandError{tok, "missing operand"}
+	}
+	toks, err := lexExpr(tok)
+	if err != nil {
+		return 0, false, err
+	}
+	e := &exprEval{asm: asm, tok: tok, toks: toks}
+	val, err = e.binary(0)
+	if err != nil {
+		return 0, false, err
+	}
+	if t := e.peek(); t.kind != 0 {
+		return 0, false, e.errorAt(t, fmt.Sprintf("unexpected '%s' in expression", t.text))
+	}
+	bareLabel = e.labelRef && len(toks) == 2
+	return val, bareLabel, nil
+}
+
+// binaryLevels 2項演算子の優先順位 (低い順)
+var binaryLevels = [][]string{
+	{"|"},
+	{"^"},
+	{"&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">="},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*"},
+}
+
+func (e *exprEval) peek() exprToken { return e.toks[e.i] }
+
+func (e *exprEval) next() exprToken {
+	t := e.toks[e.i]
+	if t.kind != 0 {
+		e.i++
+	}
+	return t
+}
+
+// errorAt 字句の位置を示すエラーを返す
+func (e *exprEval) errorAt(t exprToken, msg string) error {
+	text := t.text
+	if text == "" {
+		text = " "
+	}
+	return &operandError{Token{text, e.tok.Col + t.pos}, msg}
+}
+
+// binary 優先順位 level 以上の2項演算を評価する
+func (e *exprEval) binary(level int) (int, error) {
+	if level >= len(binaryLevels) {
+		return e.unary()
+	}
+	left, err := e.binary(level + 1)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		t := e.peek()
+		matched := false
+		if t.kind == 'o' {
+			for _, op := range binaryLevels[level] {
+				if t.text == op {
+					matched = true
+				}
+			}
+		}
+		if !matched {
+			return left, nil
+		}
+		e.next()
+		right, err := e.binary(level + 1)
+		if err != nil {
+			return 0, err
+		}
+		switch t.text {
+		case "|":
+			left |= right
+		case "^":
+			left ^= right
+		case "&":
+			left &= right
+		case "<<", ">>":
+			if right < 0 || right > 31 {
+				return 0, e.errorAt(t, fmt.Sprintf("invalid shift count: %d", right))
+			}
+			if t.text == "<<" {
+				left <<= uint(right)
+			} else {
+				left >>= uint(right)
+			}
+		case "==", "!=", "<", "<=", ">", ">=":
+			left = compare(t.text, left, right)
+		case "+":
+			left += right
+		case "-":
+			left -= right
+		case "*":
+			left *= right
+		}
+	}
+}
+
+// compare 比較演算を行い、真なら1、偽なら0を返す
+func compare(op string, left, right int) int {
+	var result bool
+	switch op {
+	case "==":
+		result = left == right
+	case "!=":
+		result = left != right
+	case "<":
+		result = left < right
+	case "<=":
+		result = left <= right
+	case ">":
+		result = left > right
+	case ">=":
+		result = left >= right
+	}
+	if result {
+		return 1
+	}
+	return 0
+}
+
+// unary 単項演算子と、数値・名前・括弧・関数呼び出しを評価する
+func (e *exprEval) unary() (int, error) {
+	t := e.next()
+	switch t.kind {
+	case 'o':
+		switch t.text {
+		case "-", "+", "~":
+			v, err := e.unary()
+			if err != nil {
+				return 0, err
+			}
+			if t.text == "-" {
+				return -v, nil
+			}
+			if t.text == "~" {
+				return ^v, nil
+			}
+			return v, nil
+		case "(":
+			v, err := e.binary(0)
+			if err != nil {
+				return 0, err
+			}
+			if c := e.next(); c.text != ")" {
+				return 0, e.errorAt(c, "missing ')' in expression")
+			}
+			return v, nil
+		}
+		return 0, e.errorAt(t, fmt.Sprintf("unexpected '%s' in expression", t.text))
+	case 'n':
+		v, err := strconv.ParseInt(t.text, 0, 32)
+		if err != nil {
+			return 0, e.errorAt(t, fmt.Sprintf("invalid number: %s", t.text))
+		}
+		return int(v), nil
+	case 'i':
+		name := strings.ToUpper(t.text)
+		if f, ok := exprFuncs[name]; ok && e.peek().text == "(" {
+			e.next()
+			v, err := e.binary(0)
+			if err != nil {
+				return 0, err
+			}
+			if c := e.next(); c.text != ")" {
+				return 0, e.errorAt(c, "missing ')' in expression")
+			}
+			return f(v), nil
+		}
+		if name == "$" {
+			// 現在の命令のアドレス (ラベルと同じく扱う)
+			if e.asm.pc < 0 {
+				return 0, e.errorAt(t, "'$' (current address) cannot be used here")
+			}
+			e.labelRef = true
+			return e.asm.pc, nil
+		}
+		if strings.HasPrefix(name, anonLabel) {
+			addr, err := e.asm.anonRef(name)
+			if err != nil {
+				return 0, e.errorAt(t, err.Error())
+			}
+			e.labelRef = true
+			return addr, nil
+		}
+		if isRegisterName(name) {
+			return 0, e.errorAt(t, fmt.Sprintf("register %s cannot be used in an expression", name))
+		}
+		sym, ok := e.asm.symbolTable[e.asm.qualify(name)]
+		if !ok && isLocalLabel(name) {
+			return 0, e.errorAt(t, fmt.Sprintf("undefined local label: %s (searched as %s)", t.text, e.asm.qualify(name)))
+		}
+		if !ok {
+			return 0, e.errorAt(t, fmt.Sprintf("undefined label or constant: %s", t.text))
+		}
+		if sym.Kind == SymbolLabel {
+			e.labelRef = true
+		}
+		e.asm.addRef(sym)
+		return sym.Value, nil
+	}
+	return 0, e.errorAt(t, "missing operand in expression")
+}
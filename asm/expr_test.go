@@ -0,0 +1,95 @@
+package asm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestExpressions(t *testing.T) {
+	tests := []struct {
+		src  string
+		code []uint8
+	}{
+		{"N EQU 5\nMOV A, N", []uint8{0x35}},
+		{"N EQU 5\nM EQU N*2\nMOV A, M-1", []uint8{0x39}},
+		{".define X 3\nMOV A, X*2", []uint8{0x36}},
+		{"MOV A, 1+2*3", []uint8{0x37}},
+		{"MOV A, (1+2)*3", []uint8{0x39}},
+		{"MOV A, 10-3-2", []uint8{0x35}}, // 左結合
+		{"MOV A, 0xF & ~1", []uint8{0x3E}},
+		{"MOV A, 1 << 3", []uint8{0x38}},
+		{"MOV A, 0x10 >> 1", []uint8{0x38}},
+		{"MOV A, 6 | 1", []uint8{0x37}},
+		{"MOV A, 7 ^ 2", []uint8{0x35}},
+		{"MOV A, 0b1010", []uint8{0x3A}},
+		{"MOV A, 20-5", []uint8{0x3F}}, // 範囲のチェックは評価した後に行う
+		{"ADD A, -1 & 0xF", []uint8{0x0F}},
+		{"ADD A, NEG(1)", []uint8{0x0F}},
+		{"MOV A, LOW4(0x37)", []uint8{0x37}},
+		{"LOOP:\nJMP LOOP+1\nNOP", []uint8{0xF1, 0x00}},
+		{"JMP END\nEND:", []uint8{0xF1}}, // 後方で定義したラベル
+	}
+	for _, tt := range tests {
+		asm := assemble(tt.src)
+		if errs := errorText(asm); errs != "" || !bytes.Equal(asm.binaries, tt.code) {
+			t.Errorf("%q = % X %q, want % X", tt.src, asm.binaries, errs, tt.code)
+		}
+	}
+}
+
+func TestExpressionErrors(t *testing.T) {
+	tests := []struct {
+		src, err string
+	}{
+		{"MOV A, -1", "immediate out of range (0-15): -1 (use -1 & 0xF or NEG(1)"},
+		{"MOV A, 4*4", "immediate out of range (0-15): 16"},
+		{"MOV A, 7/2", "test.td4:1:9: error: unexpected character '/' in expression"},
+		{"MOV A, (1+2", "missing ')' in expression"},
+		{"MOV A, FOO", "test.td4:1:8: error: undefined label or constant: FOO"},
+		{"N EQU 3\nN EQU 4", "test.td4:2:1: error: duplicate symbol: N"},
+		{"A EQU 1", "register name A cannot be used as a label"},
+	}
+	for _, tt := range tests {
+		if errs := errorText(assemble(tt.src)); !strings.Contains(errs, tt.err) {
+			t.Errorf("%q errors = %q, want %q", tt.src, errs, tt.err)
+		}
+	}
+}
+
+func TestEvalExpr(t *testing.T) {
+	asm := assemble("N EQU 5\nNOP\nNOP\nNOP\nLOOP:\n    NOP")
+	tests := []struct {
+		expr      string
+		val       int
+		bareLabel bool
+	}{
+		{"N", 5, false},
+		{"LOOP", 3, true},
+		{"loop", 3, true},
+		{"LOOP+1", 4, false},
+		{"(LOOP)", 3, false},
+		{"100", 100, false}, // 評価の結果は4bitに切り詰めない
+		{"-N", -5, false},
+		{"NEG(N)", 11, false},
+		{"~0 & 0xF", 15, false},
+	}
+	for _, tt := range tests {
+		val, bare, err := asm.evalExpr(Token{tt.expr, 1})
+		if err != nil || val != tt.val || bare != tt.bareLabel {
+			t.Errorf("evalExpr(%q) = %d, %v, %v; want %d, %v", tt.expr, val, bare, err, tt.val, tt.bareLabel)
+		}
+	}
+}
+
+func TestLabelTruncated(t *testing.T) {
+	// ROMの末尾 (16番地) のラベルは、下位4bitに切り詰めて警告する
+	src := "JMP FAR" + strings.Repeat("\nNOP", 15) + "\nFAR:"
+	asm := assemble(src)
+	if errorText(asm) != "" || len(asm.binaries) != 16 || asm.binaries[0] != 0xF0 {
+		t.Errorf("JMP FAR = % X %q, want F0 first", asm.binaries, errorText(asm))
+	}
+	if d := asm.Diags.List; len(d) != 1 || d[0].String() != "test.td4:1:5: warning: label FAR address 16 is truncated to 4 bits (0)" {
+		t.Errorf("diagnostics = %v, want a truncation warning", d)
+	}
+}
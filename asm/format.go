@@ -0,0 +1,307 @@
+package asm
+
+// ソースコードの整形 (td4fmt)
+//
+//   - ラベルは1桁目にコロン付きで置き、命令は4桁インデントする。
+//   - ニーモニックは3文字幅にそろえ、オペランドの桁をそろえる。オペランドは ", " で区切る。
+//   - EQU の定数名、行末のコメントは、空行で区切られたブロックごとに桁をそろえる。
+//   - 命令・ディレクティブ・レジスタ名・関数名は大文字 (または小文字) に統一する。
+//   - ラベル・定数・マクロの名前は、定義したときの綴りに統一する。
+//   - 数値は 0x (16進数は大文字)・0b・0o の接頭辞に統一する。"012" のような旧形式の8進数は 0o12 とする。
+//
+// 整形は1行ずつ行うので、行の数と順序は変わらない。
+
+import (
+	"strconv"
+	"strings"
+)
+
+const (
+	fmtIndent     = 4  // 命令のインデント
+	fmtOpWidth    = 3  // ニーモニックの幅 (これより長いものは空白1つでオペランドを続ける)
+	fmtTabWidth   = 4  // コメントの桁をそろえる単位
+	fmtMaxCodeCol = 40 // これより長い行はコメントの桁そろえの対象外とする
+)
+
+// FormatOptions 整形の設定
+type FormatOptions struct {
+	Lower bool // 命令・レジスタ名などを小文字にする (デフォルトは大文字)
+}
+
+// fmtLine 整形途中の1行
+type fmtLine struct {
+	label   string // ラベル (コロンを含む)
+	equName string // EQU で定義する定数名
+	code    string // ラベル以降のコード (インデントを除く)
+	block   bool   // MACRO・IF などのブロックを構成する行 (1桁目に置く)
+	comment string
+	topCmt  bool // 1桁目から始まるコメントだけの行
+}
+
+// Format ソースコードの各行を整形して返す
+func Format(lines []string, opt FormatOptions) []string {
+	f := &formatter{
+		asm:      NewAssembler("", lines),
+		opt:      opt,
+		spelling: make(map[string]string),
+	}
+	f.collectNames(lines)
+
+	parsed := make([]fmtLine, len(lines))
+	for i, line := range lines {
+		parsed[i] = f.formatLine(line)
+	}
+
+	out := make([]string, len(lines))
+	for start := 0; start < len(lines); {
+		end := start
+		for end < len(lines) && strings.TrimSpace(lines[end]) != "" {
+			end++
+		}
+		f.layoutBlock(parsed[start:end], out[start:end])
+		if end == start {
+			end++ // 空行
+		}
+		start = end
+	}
+	return out
+}
+
+// formatter 整形の状態
+type formatter struct {
+	asm      *Assembler
+	opt      FormatOptions
+	spelling map[string]string // 名前(大文字)と定義したときの綴り
+}
+
+// keyword 命令・レジスタ名などを設定に従って大文字または小文字にする
+func (f *formatter) keyword(s string) string {
+	if f.opt.Lower {
+		return strings.ToLower(s)
+	}
+	return strings.ToUpper(s)
+}
+
+// define 名前の綴りを登録する (最初の定義を優先する)
+func (f *formatter) define(name string) {
+	u := strings.ToUpper(name)
+	if _, exists := f.spelling[u]; !exists && name != anonLabel {
+		f.spelling[u] = name
+	}
+}
+
+// collectNames ラベル・定数・マクロ・マクロ引数の名前と綴りを集める
+func (f *formatter) collectNames(lines []string) {
+	a := f.asm
+	for i, line := range lines {
+		st := a.ParseLine(line)
+		switch op := st.Op(); {
+		case op == "MACRO":
+			def := a.parseMacroHeader(&a.source[i], st)
+			if def.Name != "" && a.macros[def.Name] == nil {
+				a.macros[def.Name] = def
+			}
+			for _, field := range f.macroFields(line, st) {
+				f.define(field)
+			}
+		case op == ".DEFINE" && len(st.Operands) > 0:
+			if name := strings.Fields(st.Operands[0].Text); len(name) > 0 { // ".define , 5" のように名前が空の場合は飛ばす
+				f.define(name[0])
+			}
+		case st.Label.Text != "":
+			f.define(st.Label.Text)
+		}
+	}
+	a.Diags = Diagnostics{} // 整形ではエラーを報告しない
+}
+
+// macroFields MACRO行の名前と引数名を返す
+func (f *formatter) macroFields(line string, st Statement) []string {
+	rest := restOfLine(line, st).Text
+	return strings.Fields(strings.ReplaceAll(rest, ",", " "))
+}
+
+// formatLine 1行を整形する (桁そろえはlayoutBlockで行う)
+func (f *formatter) formatLine(line string) fmtLine {
+	st := f.asm.ParseLine(line)
+	fl := fmtLine{comment: st.Comment.Text}
+	if st.Label.Text == "" && st.Mnemonic.Text == "" {
+		fl.topCmt = st.Comment.Col == 1
+		return fl
+	}
+
+	op := st.Op()
+	if op == "EQU" {
+		fl.equName = f.name(st.Label.Text)
+	} else if st.Label.Text != "" {
+		fl.label = f.name(st.Label.Text)
+		if st.Label.Text != anonLabel {
+			fl.label += ":"
+		}
+	}
+	if st.Mnemonic.Text == "" {
+		return fl
+	}
+
+	var mnemonic string
+	switch {
+	case isKeyword(op):
+		mnemonic = f.keyword(op)
+	default:
+		mnemonic = f.name(st.Mnemonic.Text) // マクロ呼び出し
+	}
+
+	var operands string
+	switch op {
+	case "INCLUDE":
+		operands = restOfLine(line, st).Text
+	case "IF", "IFDEF", "IFNDEF":
+		operands = f.expr(restOfLine(line, st).Text)
+	case "MACRO":
+		fields := f.macroFields(line, st)
+		if len(fields) > 0 {
+			operands = fields[0]
+			if len(fields) > 1 {
+				operands += " " + strings.Join(fields[1:], ", ")
+			}
+		}
+	default:
+		ops := make([]string, len(st.Operands))
+		for i, o := range st.Operands {
+			ops[i] = f.expr(o.Text)
+		}
+		sep := ", "
+		if op == ".DEFINE" && ops[0] != "" { // 名前が空の場合は、カンマを残して元の書き方を変えない
+			sep = " "
+		}
+		operands = strings.Join(ops, sep)
+	}
+
+	switch op {
+	case "MACRO", "ENDM", "IF", "IFDEF", "IFNDEF", "ELSE", "ENDIF":
+		fl.block = true
+	}
+	fl.code = mnemonic
+	if operands != "" {
+		if len(mnemonic) < fmtOpWidth {
+			mnemonic += strings.Repeat(" ", fmtOpWidth-len(mnemonic))
+		}
+		fl.code = mnemonic + " " + operands
+	}
+	return fl
+}
+
+// name 名前を定義したときの綴りにする (定義が見つからなければそのまま)
+func (f *formatter) name(s string) string {
+	if sp, ok := f.spelling[strings.ToUpper(s)]; ok {
+		return sp
+	}
+	return s
+}
+
+// expr 式の中の名前・数値を整形する
+func (f *formatter) expr(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		c := s[i]
+		j := i + 1
+		switch {
+		case c >= '0' && c <= '9':
+			for j < len(s) && isIdentChar(s[j]) {
+				j++
+			}
+			b.WriteString(normalizeNumber(s[i:j]))
+		case isIdentStart(c):
+			for j < len(s) && isIdentChar(s[j]) {
+				j++
+			}
+			word := s[i:j]
+			if u := strings.ToUpper(word); isRegisterName(u) || exprFuncs[u] != nil {
+				b.WriteString(f.keyword(word))
+			} else {
+				b.WriteString(f.name(word))
+			}
+		case c == '"' || c == '\'':
+			for j < len(s) && s[j] != c {
+				j++
+			}
+			if j < len(s) {
+				j++
+			}
+			b.WriteString(s[i:j])
+		default:
+			b.WriteByte(c)
+		}
+		i = j
+	}
+	return b.String()
+}
+
+// normalizeNumber 数値の表記を 0x・0b・0o の接頭辞に統一する
+// 解釈できない表記はそのまま返す。
+func normalizeNumber(s string) string {
+	if _, err := strconv.ParseInt(s, 0, 64); err != nil {
+		return s
+	}
+	lower := strings.ToLower(s)
+	switch {
+	case strings.HasPrefix(lower, "0x"):
+		return "0x" + strings.ToUpper(s[2:])
+	case strings.HasPrefix(lower, "0b"), strings.HasPrefix(lower, "0o"):
+		return lower
+	case len(s) > 1 && s[0] == '0' && strings.Trim(s, "0_") != "":
+		return "0o" + strings.TrimLeft(s[1:], "_")
+	}
+	return s
+}
+
+// layoutBlock 空行で区切られたブロックの定数名とコメントの桁をそろえて out に格納する
+func (f *formatter) layoutBlock(block []fmtLine, out []string) {
+	equWidth := 0
+	for _, fl := range block {
+		equWidth = max(equWidth, len(fl.equName))
+	}
+
+	codes := make([]string, len(block))
+	commentCol := 0
+	for i, fl := range block {
+		var code string
+		switch {
+		case fl.equName != "":
+			code = fl.equName + strings.Repeat(" ", equWidth-len(fl.equName)+1) + fl.code
+		case fl.block:
+			code = fl.code
+		case fl.label != "" && fl.code != "":
+			if len(fl.label) < fmtIndent {
+				code = fl.label + strings.Repeat(" ", fmtIndent-len(fl.label)) + fl.code
+			} else {
+				code = fl.label + " " + fl.code
+			}
+		case fl.label != "":
+			code = fl.label
+		case fl.code != "":
+			code = strings.Repeat(" ", fmtIndent) + fl.code
+		}
+		codes[i] = code
+		if code != "" && fl.comment != "" && len(code) < fmtMaxCodeCol {
+			commentCol = max(commentCol, len(code)+1)
+		}
+	}
+	commentCol = (commentCol + fmtTabWidth - 1) / fmtTabWidth * fmtTabWidth
+
+	for i, fl := range block {
+		code := codes[i]
+		switch {
+		case fl.comment == "":
+			out[i] = code
+		case code == "" && fl.topCmt:
+			out[i] = fl.comment
+		case code == "":
+			out[i] = strings.Repeat(" ", fmtIndent) + fl.comment
+		case len(code) < commentCol:
+			out[i] = code + strings.Repeat(" ", commentCol-len(code)) + fl.comment
+		default:
+			out[i] = code + " " + fl.comment
+		}
+	}
+}
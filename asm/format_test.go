@@ -0,0 +1,104 @@
+package asm
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// formatInputs 整形のテストに使う、書き方の揃っていないソースコード
+var formatInputs = []string{
+	"start:\tmov a,0XF ; c\n\tJMP\tstart\t;\tloop\nN equ 012\n  .loop: add a , n\n;top\nMACRO  blink x\n out x\n endm\n",
+	"loop:\n\tadd a,1\n\tjnc loop\n\n\n\tout\t0b0001 ;comment\n\tout 0b0010\t\t; another\n",
+	"IFDEF PICO\n  OUT 1\nELSE\n  out 2\nENDIF\nX EQU LOW4(0x37)+1\nLONGNAME EQU 3 ; aligned\n  mov b, X ; ok\n",
+	":\n  jnc :+\n  jmp :-\n:\n  halt\n",
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"start:\tmov a,0XF ; c", "start: MOV A, 0xF   ; c"},
+		{"\tJMP\tstart", "    JMP start"},
+		{"N equ 012", "N EQU 0o12"},
+		{"  .loop: add a , n\nN EQU 1", ".loop: ADD A, N\nN EQU 1"},
+		{"  MACRO  blink x\n out x\n endm", "MACRO blink x\n    OUT x\nENDM"},
+		{"\tout 0b0101 ; long\n\tnop ; x", "    OUT 0b0101  ; long\n    NOP         ; x"}, // ブロックごとにコメントの桁をそろえる
+		{"\tout 0B0101\n\tnop\t\t; x", "    OUT 0b0101\n    NOP ; x"},
+		{".define , 5", "    .DEFINE , 5"}, // 名前のない .define でも止まらない
+	}
+	for _, tt := range tests {
+		got := strings.Join(Format(strings.Split(tt.in, "\n"), FormatOptions{}), "\n")
+		if got != tt.want {
+			t.Errorf("Format(%q) =\n%s\nwant\n%s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSplitLines(t *testing.T) {
+	tests := map[string][]string{
+		"":                 nil,
+		"NOP":              {"NOP"},
+		"NOP\n":            {"NOP"},
+		"NOP\r\nOUT 1\r\n": {"NOP", "OUT 1"},
+		"NOP\n\nOUT 1":     {"NOP", "", "OUT 1"},
+		"\n":               {""},
+	}
+	for in, want := range tests {
+		if got := SplitLines([]byte(in)); strings.Join(got, "|") != strings.Join(want, "|") || len(got) != len(want) {
+			t.Errorf("SplitLines(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// TestFormatIdempotent 整形したソースコードをもう一度整形しても変わらず、アセンブル結果も変わらないことを確かめる
+func TestFormatIdempotent(t *testing.T) {
+	inputs := append([]string{}, formatInputs...)
+	samples, _ := filepath.Glob("../samples/*.td4")
+	for _, name := range samples {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inputs = append(inputs, string(data))
+	}
+	if len(inputs) == len(formatInputs) {
+		t.Fatal("no sample sources found")
+	}
+	for i, in := range inputs {
+		lines := strings.Split(strings.ReplaceAll(in, "\r\n", "\n"), "\n")
+		for _, opt := range []FormatOptions{{}, {Lower: true}} {
+			once := Format(lines, opt)
+			twice := Format(once, opt)
+			if strings.Join(once, "\n") != strings.Join(twice, "\n") {
+				t.Errorf("Format is not idempotent (Lower=%v):\n%s\n--- again ---\n%s", opt.Lower, strings.Join(once, "\n"), strings.Join(twice, "\n"))
+				continue
+			}
+			if len(once) != len(lines) {
+				t.Errorf("Format changed the number of lines: %d to %d", len(lines), len(once))
+			}
+			before, ok := assembleLines(lines)
+			if !ok && i >= len(formatInputs) {
+				t.Errorf("sample %d does not assemble", i-len(formatInputs))
+			}
+			after, _ := assembleLines(once)
+			if !bytes.Equal(before, after) {
+				t.Errorf("Format changed the code (Lower=%v): % X to % X\n%s", opt.Lower, before, after, strings.Join(once, "\n"))
+			}
+		}
+	}
+}
+
+// assembleLines samples ディレクトリのファイルとしてアセンブルして、ROMイメージを返す (エラーがあれば false)
+func assembleLines(lines []string) ([]uint8, bool) {
+	a := NewAssembler("../samples/test.td4", lines)
+	a.Define("PICO")
+	if a.Pass1() != nil || a.Pass2() != nil {
+		return nil, false
+	}
+	_, image := a.Image(false)
+	return image, true
+}
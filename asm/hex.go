@@ -0,0 +1,58 @@
+package asm
+
+// HEXファイル (エミュレータが読み込む16進数テキスト形式) の読み書き
+//   S 0x00 0xB1 0xB2 ...
+// 行の先頭の S に続けて、書き込み開始アドレスと、各番地のデータを空白(またはカンマ)で区切って並べる。
+// ";" で始まる行と空行は読み飛ばし、最初の S の行だけを使う。
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// WriteHex ROMイメージをHEXファイルの形式で出力する
+func WriteHex(w io.Writer, start int, image []uint8) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "S 0x%02X ", start)
+	for _, b := range image {
+		fmt.Fprintf(bw, "0x%02X ", b)
+	}
+	return bw.Flush()
+}
+
+// ReadHex HEXファイルの形式のROMイメージを読み込む
+func ReadHex(r io.Reader) (start int, image []uint8, err error) {
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(strings.ReplaceAll(scanner.Text(), ",", " "))
+		if line == "" || line[0] == ';' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if !strings.EqualFold(fields[0], "S") {
+			continue
+		}
+		if len(fields) < 2 {
+			return 0, nil, fmt.Errorf("line %d: missing start address", n)
+		}
+		adr, err := strconv.ParseUint(fields[1], 0, 8)
+		if err != nil || adr >= ROMSize {
+			return 0, nil, fmt.Errorf("line %d: invalid start address %q", n, fields[1])
+		}
+		for _, f := range fields[2:] {
+			v, err := strconv.ParseUint(f, 0, 8)
+			if err != nil {
+				return 0, nil, fmt.Errorf("line %d: invalid data %q", n, f)
+			}
+			image = append(image, uint8(v))
+		}
+		return int(adr), image, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, nil, err
+	}
+	return 0, nil, fmt.Errorf("no S record found")
+}
@@ -0,0 +1,151 @@
+package asm
+
+// INCLUDE によるファイルの取り込み (マクロ展開と同じ前処理で行う)
+//
+//   INCLUDE "ファイル名"
+//
+// ファイルは、取り込む側のファイルと同じディレクトリ、-I で指定したディレクトリの順に探す。
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxIncludeDepth INCLUDE の入れ子の上限
+const maxIncludeDepth = 16
+
+func init() {
+	Directives["INCLUDE"] = true
+}
+
+// ReadLines テキストファイルを読み込み、行のスライスを返す
+func ReadLines(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return SplitLines(data), nil
+}
+
+// SplitLines ファイルの内容を行に分ける (行末の "\r\n" と "\n" を取り除く)
+func SplitLines(data []byte) []string {
+	text := string(data)
+	if text == "" {
+		return nil
+	}
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+	return lines
+}
+
+// includeName INCLUDE 行からファイル名を取り出す
+// ファイル名は "..." または <...> で囲む。囲まない場合は空白までをファイル名とする。
+func includeName(line string, st Statement) (Token, error) {
+	start := st.Mnemonic.Col - 1 + len(st.Mnemonic.Text)
+	rest := line[start:]
+	trimmed := strings.TrimLeft(rest, " \t")
+	col := start + 1 + len(rest) - len(trimmed)
+	if trimmed == "" || trimmed[0] == ';' {
+		return Token{}, fmt.Errorf("INCLUDE requires a file name")
+	}
+	if open := trimmed[0]; open == '"' || open == '<' {
+		close := byte('"')
+		if open == '<' {
+			close = '>'
+		}
+		end := strings.IndexByte(trimmed[1:], close)
+		if end < 0 {
+			return Token{}, &operandError{Token{trimmed[:1], col}, "missing closing quote in INCLUDE"}
+		}
+		return Token{trimmed[1 : end+1], col + 1}, nil
+	}
+	if idx := strings.IndexAny(trimmed, " \t;"); idx != -1 {
+		trimmed = trimmed[:idx]
+	}
+	return Token{trimmed, col}, nil
+}
+
+// findInclude 取り込むファイルを探し、見つかったパスを返す
+func (asm *Assembler) findInclude(from *SourceLine, name string) (string, bool) {
+	if filepath.IsAbs(name) {
+		_, err := os.Stat(name)
+		return name, err == nil
+	}
+	dirs := append([]string{filepath.Dir(from.File)}, asm.IncludeDirs...)
+	for _, dir := range dirs {
+		path := filepath.Join(dir, name)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// insideDir ファイル path がディレクトリ dir の中にあればtrueを返す
+// シンボリックリンクは実際のパスに直してから比べる。
+func insideDir(dir, path string) bool {
+	real := func(p string) (string, error) {
+		if r, err := filepath.EvalSymlinks(p); err == nil {
+			p = r
+		}
+		return filepath.Abs(p)
+	}
+	d, err1 := real(dir)
+	p, err2 := real(path)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	rel, err := filepath.Rel(d, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// includeFile INCLUDE 行を処理し、取り込んだファイルの行を前処理して out に追加する
+func (asm *Assembler) includeFile(src *SourceLine, st Statement, depth int, out *[]SourceLine) {
+	name, err := includeName(src.Text, st)
+	if err != nil {
+		asm.reportError(src, st.Mnemonic, err)
+		return
+	}
+	path, ok := asm.findInclude(src, name.Text)
+	if !ok {
+		asm.Diags.Errorf(src, name.Col, len(name.Text), "include file not found: %s", name.Text)
+		return
+	}
+	if asm.IncludeRoot != "" && !insideDir(asm.IncludeRoot, path) {
+		asm.Diags.Errorf(src, name.Col, len(name.Text), "include file is outside of %s: %s", asm.IncludeRoot, name.Text)
+		return
+	}
+	// 循環参照のチェック (取り込み中のファイルを再び取り込もうとしていないか)
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = filepath.Clean(path)
+	}
+	for _, f := range asm.includeStack {
+		if f == abs {
+			asm.Diags.Errorf(src, name.Col, len(name.Text), "circular include: %s", name.Text)
+			return
+		}
+	}
+	if len(asm.includeStack) > maxIncludeDepth {
+		asm.Diags.Errorf(src, name.Col, len(name.Text), "includes nested too deeply")
+		return
+	}
+
+	lines, err := ReadLines(path)
+	if err != nil {
+		asm.Diags.Errorf(src, name.Col, len(name.Text), "failed to read include file: %v", err)
+		return
+	}
+	from := *src
+	included := make([]SourceLine, len(lines))
+	for i, line := range lines {
+		included[i] = SourceLine{File: path, Line: i + 1, Text: line, IncludedFrom: &from}
+	}
+	asm.includeStack = append(asm.includeStack, abs)
+	asm.expandLines(included, depth, out)
+	asm.includeStack = asm.includeStack[:len(asm.includeStack)-1]
+}
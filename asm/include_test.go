@@ -0,0 +1,173 @@
+package asm
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFiles ディレクトリ dir にファイルを作成する (キーは dir からの相対パス)
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, text := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// assembleFile ファイルを読み込み、-I のディレクトリを指定してアセンブルする
+func assembleFile(t *testing.T, path string, includeDirs ...string) *Assembler {
+	t.Helper()
+	lines, err := ReadLines(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	asm := NewAssembler(path, lines)
+	asm.IncludeDirs = includeDirs
+	asm.Pass1()
+	asm.Pass2()
+	asm.Diags.Sort()
+	return asm
+}
+
+func TestIncludeSearchOrder(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"src/main.td4":   "INCLUDE \"lib.td4\"\nINCLUDE <sub.td4>",
+		"lib1/lib.td4":   "OUT 1\nINCLUDE \"near.td4\"",
+		"lib1/near.td4":  "OUT 3",
+		"lib2/lib.td4":   "OUT 2",
+		"lib2/near.td4":  "OUT 4",
+		"lib2/sub.td4":   "OUT 5",
+		"local/main.td4": "INCLUDE lib.td4 ; 引用符なし",
+		"local/lib.td4":  "OUT 6",
+	})
+	lib1, lib2 := filepath.Join(dir, "lib1"), filepath.Join(dir, "lib2")
+	tests := []struct {
+		file string
+		dirs []string
+		code []uint8
+	}{
+		// -I は指定した順に探す。取り込んだファイルからの INCLUDE は、そのファイルのディレクトリを先に探す。
+		{"src/main.td4", []string{lib1, lib2}, []uint8{0xB1, 0xB3, 0xB5}},
+		{"src/main.td4", []string{lib2, lib1}, []uint8{0xB2, 0xB5}},
+		// 取り込む側のファイルと同じディレクトリが -I より優先される
+		{"local/main.td4", []string{lib1}, []uint8{0xB6}},
+	}
+	for _, tt := range tests {
+		asm := assembleFile(t, filepath.Join(dir, tt.file), tt.dirs...)
+		if errs := errorText(asm); errs != "" || !bytes.Equal(asm.binaries, tt.code) {
+			t.Errorf("%s with -I %v = % X %q, want % X", tt.file, tt.dirs, asm.binaries, errs, tt.code)
+		}
+	}
+
+	asm := assembleFile(t, filepath.Join(dir, "src/main.td4"))
+	if errs := errorText(asm); !strings.Contains(errs, "main.td4:1:10: error: include file not found: lib.td4") {
+		t.Errorf("without -I: %q", errs)
+	}
+}
+
+func TestIncludeCircular(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.td4":    "OUT 1\nINCLUDE \"b.td4\"",
+		"b.td4":    "INCLUDE \"a.td4\"",
+		"self.td4": "INCLUDE \"self.td4\"",
+	})
+	for file, want := range map[string]string{
+		"a.td4":    "b.td4:1:10: error: circular include: a.td4",
+		"self.td4": "self.td4:1:10: error: circular include: self.td4",
+	} {
+		asm := assembleFile(t, filepath.Join(dir, file))
+		if errs := errorText(asm); asm.Diags.ErrorCount() != 1 || !strings.Contains(errs, want) {
+			t.Errorf("%s errors = %q, want %q", file, errs, want)
+		}
+	}
+}
+
+func TestIncludeNotes(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"main.td4":  "NOP\nINCLUDE \"outer.td4\"",
+		"outer.td4": "INCLUDE \"inner.td4\"",
+		"inner.td4": "MOV A, 16",
+	})
+	asm := assembleFile(t, filepath.Join(dir, "main.td4"))
+	var sb strings.Builder
+	asm.Diags.Write(&sb, "gcc")
+	want := filepath.Join(dir, "inner.td4") + ":1:8: error: immediate out of range (0-15): 16\n" +
+		filepath.Join(dir, "outer.td4") + ":1: note: included from here\n" +
+		filepath.Join(dir, "main.td4") + ":2: note: included from here\n"
+	if sb.String() != want {
+		t.Errorf("diagnostics =\n%s\nwant\n%s", sb.String(), want)
+	}
+}
+
+func TestIncludeErrors(t *testing.T) {
+	tests := []struct {
+		src, err string
+	}{
+		{"INCLUDE", "test.td4:1:1: error: INCLUDE requires a file name"},
+		{"INCLUDE ; comment", "INCLUDE requires a file name"},
+		{"INCLUDE \"lib.td4", "test.td4:1:9: error: missing closing quote in INCLUDE"},
+		{"INCLUDE <lib.td4", "missing closing quote in INCLUDE"},
+		{"INCLUDE \"no such file.td4\"", "test.td4:1:10: error: include file not found: no such file.td4"},
+	}
+	for _, tt := range tests {
+		if errs := errorText(assemble(tt.src)); !strings.Contains(errs, tt.err) {
+			t.Errorf("%q errors = %q, want %q", tt.src, errs, tt.err)
+		}
+	}
+}
+
+func TestIncludeRoot(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"src/main.td4":    "INCLUDE \"sub/lib.td4\"",
+		"src/sub/lib.td4": "OUT 1",
+		"src/up.td4":      "INCLUDE \"../secret.td4\"",
+		"src/abs.td4":     "INCLUDE \"" + filepath.Join(dir, "secret.td4") + "\"",
+		"src/dirs.td4":    "INCLUDE \"other.td4\"",
+		"secret.td4":      "OUT 2",
+		"lib/other.td4":   "OUT 3",
+	})
+	src := filepath.Join(dir, "src")
+	tests := []struct {
+		file string
+		err  string
+	}{
+		{"main.td4", ""},
+		{"up.td4", "include file is outside of " + src + ": ../secret.td4"},
+		{"abs.td4", "include file is outside of " + src + ": " + filepath.Join(dir, "secret.td4")},
+		{"dirs.td4", "include file is outside of " + src + ": other.td4"}, // -I のディレクトリも対象
+	}
+	for _, tt := range tests {
+		lines, err := ReadLines(filepath.Join(src, tt.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		asm := NewAssembler(filepath.Join(src, tt.file), lines)
+		asm.IncludeDirs = []string{filepath.Join(dir, "lib")}
+		asm.IncludeRoot = src
+		asm.Pass1()
+		asm.Pass2()
+		if errs := errorText(asm); !strings.Contains(errs, tt.err) || tt.err == "" && errs != "" {
+			t.Errorf("%s errors = %q, want %q", tt.file, errs, tt.err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(dir, "secret.td4"), filepath.Join(src, "link.td4")); err == nil {
+		asm := NewAssembler(filepath.Join(src, "main.td4"), []string{"INCLUDE \"link.td4\""})
+		asm.IncludeRoot = src
+		asm.Pass1()
+		if errs := errorText(asm); !strings.Contains(errs, "include file is outside of") {
+			t.Errorf("symlink errors = %q, want outside error", errs)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package asm
+
+// ローカルラベルと無名ラベル
+//
+//   .loop:     直前のグローバルラベルの中だけで有効なラベル。
+//              "START:" の後に定義した ".loop" は "START.LOOP" という名前で登録する。
+//   :          無名ラベル。":-" で直前の、":+" で直後の無名ラベルを参照する。
+//              ":--" ":++" のように記号を重ねると、2つ前、2つ後の無名ラベルを参照する。
+//
+// マクロの展開で生成されたラベルは、グローバルラベルの範囲を変更しない。
+
+import (
+	"fmt"
+	"strings"
+)
+
+// anonLabel 無名ラベルの名前
+const anonLabel = ":"
+
+// isLocalLabel ローカルラベルの名前であればtrueを返す
+func isLocalLabel(name string) bool {
+	return len(name) > 1 && name[0] == '.'
+}
+
+// qualify ローカルラベルの名前を、グローバルラベルを付けた名前 (大文字) に変換する
+func (asm *Assembler) qualify(name string) string {
+	name = strings.ToUpper(name)
+	if isLocalLabel(name) {
+		return asm.scope + name
+	}
+	return name
+}
+
+// setScope ラベルの定義に合わせて、ローカルラベルの範囲を更新する
+func (asm *Assembler) setScope(src *SourceLine, label string) {
+	if label == anonLabel || isLocalLabel(label) || src.Macro != "" {
+		return
+	}
+	asm.scope = strings.ToUpper(label)
+}
+
+// defineAnon 無名ラベルを定義する
+func (asm *Assembler) defineAnon(addr int) {
+	asm.anonLabels = append(asm.anonLabels, addr)
+	asm.anonCount = len(asm.anonLabels)
+}
+
+// anonRef ":-" ":+" 等が参照する無名ラベルのアドレスを返す
+// ":+" は、処理中の行より後で最初に定義された無名ラベルを指す。
+func (asm *Assembler) anonRef(ref string) (int, error) {
+	n := len(ref) - 1
+	idx := asm.anonCount - n // ":-" の場合
+	if ref[1] == '+' {
+		idx = asm.anonCount + n - 1
+	}
+	if idx < 0 || idx >= len(asm.anonLabels) {
+		return 0, fmt.Errorf("no anonymous label for %s", ref)
+	}
+	return asm.anonLabels[idx], nil
+}
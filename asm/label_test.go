@@ -0,0 +1,70 @@
+package asm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestLocalLabels(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		code []uint8
+	}{
+		// 同じ名前のローカルラベルを、グローバルラベルごとに定義できる
+		{"scoped", "A1:\n.loop:\n    JMP .loop\nB1:\n.loop:\n    JMP .loop", []uint8{0xF0, 0xF1}},
+		{"qualified", "A1:\n    NOP\n.loop:\n    JMP .loop\nB1:\n    JMP A1.loop", []uint8{0x00, 0xF1, 0xF1}},
+		{"forward", "A1:\n    JMP .END\n.end:", []uint8{0xF1}},
+		{"before global", ".x:\n    JMP .x", []uint8{0xF0}},
+		// マクロの本体で定義したラベルは、ローカルラベルの範囲を変更しない
+		{"macro", "MACRO M\nG:\n    NOP\nENDM\nA1:\n.l:\n    M\n    JMP .l", []uint8{0x00, 0xF0}},
+	}
+	for _, tt := range tests {
+		asm := assemble(tt.src)
+		if errs := errorText(asm); errs != "" || !bytes.Equal(asm.binaries, tt.code) {
+			t.Errorf("%s: % X %q, want % X", tt.name, asm.binaries, errs, tt.code)
+		}
+	}
+
+	// ローカルラベルは "グローバルラベル.名前" として登録する
+	asm := assemble("A1:\n.loop:\n    NOP\nB1:\n.loop:\n    JMP .loop")
+	for name, want := range map[string]int{"A1.LOOP": 0, "B1.LOOP": 1} {
+		if sym := asm.symbolTable[name]; sym == nil || sym.Value != want {
+			t.Errorf("symbol %s = %+v, want address %d", name, sym, want)
+		}
+	}
+}
+
+func TestAnonymousLabels(t *testing.T) {
+	tests := []struct {
+		src  string
+		code []uint8
+	}{
+		{":\n    ADD A, 1\n    JNC :-\n    JMP :+\n    NOP\n:\n    HALT", []uint8{0x01, 0xE0, 0xF4, 0x00, 0xF4}},
+		{":\n    NOP\n:\n    JMP :--", []uint8{0x00, 0xF0}},
+		{"    JMP :++\n:\n    NOP\n:", []uint8{0xF2, 0x00}},
+		{":\n    JMP :-\n:\n    JMP :-", []uint8{0xF0, 0xF1}}, // 直前の無名ラベルは、位置によって変わる
+	}
+	for _, tt := range tests {
+		asm := assemble(tt.src)
+		if errs := errorText(asm); errs != "" || !bytes.Equal(asm.binaries, tt.code) {
+			t.Errorf("%q = % X %q, want % X", tt.src, asm.binaries, errs, tt.code)
+		}
+	}
+}
+
+func TestLabelErrors(t *testing.T) {
+	for src, want := range map[string]string{
+		"A1:\n.loop:\n.loop:":             "test.td4:3:1: error: duplicate label: A1.LOOP",
+		"A1:\n    JMP .nope":              "test.td4:2:9: error: undefined local label: .nope (searched as A1.NOPE)",
+		"A1:\n.loop:\nB1:\n    JMP .loop": "undefined local label: .loop (searched as B1.LOOP)",
+		"    JMP :-":                      "test.td4:1:9: error: no anonymous label for :-",
+		"    JMP :+":                      "no anonymous label for :+",
+		":\n    JMP :---":                 "no anonymous label for :---",
+	} {
+		if errs := errorText(assemble(src)); !strings.Contains(errs, want) {
+			t.Errorf("%q errors = %q, want %q", src, errs, want)
+		}
+	}
+}
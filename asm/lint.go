@@ -0,0 +1,231 @@
+package asm
+
+// 静的解析 (td4lint)
+//
+// アセンブル結果の16バイトのROMイメージから制御フローグラフを作り、TD4のプログラムによくある誤りを警告する。
+//   - どの経路でも ADD を実行せずに到達する JNC (キャリーフラグが常に0で、必ずジャンプする)
+//   - 到達できない命令
+//   - 使用する前に上書きされる IN の結果
+//   - 一度も実行されない OUT (何も出力しないプログラム)
+//   - JMP なしで15番地を越え、0番地に戻る実行の流れ
+//
+// キャリーフラグは td4emu と同じく、ADD で変化し、JMP・JNC で0になり、それ以外の命令では保持されるものとする。
+// コードのない番地は 0x00 (ADD A, 0 = NOP) として扱う。
+
+import "fmt"
+
+// 解析に使うレジスタのビット
+const (
+	regA = 1 << iota
+	regB
+)
+
+// lintProgram 解析対象のROMイメージ
+type lintProgram struct {
+	rom       [ROMSize]uint8
+	src       [ROMSize]*SourceLine // 各番地のコードを生成した行 (コードがなければnil)
+	reachable [ROMSize]bool
+}
+
+// succ 番地 adr の命令の次に実行する可能性のある番地を返す
+func (p *lintProgram) succ(adr int) []int {
+	next := (adr + 1) % ROMSize
+	im := int(p.rom[adr] & 0x0F)
+	switch p.rom[adr] >> 4 {
+	case 0xF: // JMP
+		return []int{im}
+	case 0xE: // JNC
+		return []int{next, im}
+	}
+	return []int{next}
+}
+
+// useDef 番地 adr の命令が値を読むレジスタと、書き込むレジスタを返す
+// 0を加算する ADD (NOP, CLC) は値を変えないので、どちらにも含めない。
+func (p *lintProgram) useDef(adr int) (use, def int) {
+	im := p.rom[adr] & 0x0F
+	switch p.rom[adr] >> 4 {
+	case 0x0: // ADD A, Im
+		if im != 0 {
+			return regA, regA
+		}
+	case 0x5: // ADD B, Im
+		if im != 0 {
+			return regB, regB
+		}
+	case 0x1: // MOV A, B
+		return regB, regA
+	case 0x4: // MOV B, A
+		return regA, regB
+	case 0x2, 0x3: // IN A, MOV A, Im
+		return 0, regA
+	case 0x6, 0x7: // IN B, MOV B, Im
+		return 0, regB
+	case 0x9: // OUT B
+		return regB, 0
+	}
+	return 0, 0
+}
+
+// Lint アセンブル結果を解析し、誤りの可能性がある箇所を警告として Diags に追加する
+// Pass2 がエラーなく終了した後に呼び出す。
+func (asm *Assembler) Lint() {
+	p := &lintProgram{}
+	first := -1
+	for i, adr := range asm.addresses {
+		if adr < 0 || adr >= ROMSize {
+			continue
+		}
+		p.rom[adr] = asm.binaries[i]
+		p.src[adr] = asm.srcLines[i]
+		if first < 0 || adr < first {
+			first = adr
+		}
+	}
+	if first < 0 {
+		return // コードがない
+	}
+
+	// 到達可能な番地 (0番地から実行を開始する)
+	work := []int{0}
+	p.reachable[0] = true
+	for len(work) > 0 {
+		adr := work[len(work)-1]
+		work = work[:len(work)-1]
+		for _, s := range p.succ(adr) {
+			if !p.reachable[s] {
+				p.reachable[s] = true
+				work = append(work, s)
+			}
+		}
+	}
+
+	asm.lintUnreachable(p)
+	asm.lintCarry(p)
+	asm.lintInput(p)
+	asm.lintWrap(p)
+
+	executed := false
+	for adr := range p.rom {
+		if op := p.rom[adr] >> 4; p.reachable[adr] && p.src[adr] != nil && (op == 0x9 || op == 0xB) {
+			executed = true
+		}
+	}
+	if !executed {
+		asm.Diags.Warnf(p.src[first], 0, 0, "OUT is never executed; the program produces no output")
+	}
+}
+
+// lintUnreachable 到達できない命令を、連続する番地ごとにまとめて警告する
+func (asm *Assembler) lintUnreachable(p *lintProgram) {
+	for adr := 0; adr < ROMSize; adr++ {
+		if p.reachable[adr] || p.src[adr] == nil {
+			continue
+		}
+		end := adr
+		for end+1 < ROMSize && !p.reachable[end+1] && p.src[end+1] != nil {
+			end++
+		}
+		if end == adr {
+			asm.Diags.Warnf(p.src[adr], 0, 0, "unreachable code at address %d", adr)
+		} else {
+			asm.Diags.Warnf(p.src[adr], 0, 0, "unreachable code at addresses %d-%d", adr, end)
+		}
+		adr = end
+	}
+}
+
+// lintCarry ADD を実行せずに到達する JNC を警告する
+// 各番地の実行前に、キャリーフラグが1の可能性があるかを順方向に伝播して求める。
+func (asm *Assembler) lintCarry(p *lintProgram) {
+	var carry [ROMSize]bool // 実行前にキャリーフラグが1の可能性がある
+	for changed := true; changed; {
+		changed = false
+		for adr := 0; adr < ROMSize; adr++ {
+			if !p.reachable[adr] {
+				continue
+			}
+			out := carry[adr]
+			switch p.rom[adr] >> 4 {
+			case 0x0, 0x5: // ADD
+				out = p.rom[adr]&0x0F != 0
+			case 0xE, 0xF: // JNC, JMP
+				out = false
+			}
+			for _, s := range p.succ(adr) {
+				if out && !carry[s] {
+					carry[s] = true
+					changed = true
+				}
+			}
+		}
+	}
+	for adr := 0; adr < ROMSize; adr++ {
+		if p.reachable[adr] && p.src[adr] != nil && p.rom[adr]>>4 == 0xE && !carry[adr] {
+			asm.Diags.Warnf(p.src[adr], 0, 0, "JNC always jumps: no ADD can set the carry flag on any path to address %d", adr)
+		}
+	}
+}
+
+// lintInput 使用する前に上書きされる IN の結果を警告する
+// レジスタの生存区間を逆方向に伝播して求める。
+func (asm *Assembler) lintInput(p *lintProgram) {
+	var liveIn, liveOut [ROMSize]int
+	for changed := true; changed; {
+		changed = false
+		for adr := ROMSize - 1; adr >= 0; adr-- {
+			if !p.reachable[adr] {
+				continue
+			}
+			out := 0
+			for _, s := range p.succ(adr) {
+				out |= liveIn[s]
+			}
+			use, def := p.useDef(adr)
+			in := use | out&^def
+			if in != liveIn[adr] || out != liveOut[adr] {
+				liveIn[adr], liveOut[adr] = in, out
+				changed = true
+			}
+		}
+	}
+	for adr := 0; adr < ROMSize; adr++ {
+		if !p.reachable[adr] || p.src[adr] == nil {
+			continue
+		}
+		reg, bit := "", 0
+		switch p.rom[adr] >> 4 {
+		case 0x2:
+			reg, bit = "A", regA
+		case 0x6:
+			reg, bit = "B", regB
+		default:
+			continue
+		}
+		if liveOut[adr]&bit == 0 {
+			asm.Diags.Warnf(p.src[adr], 0, 0, "value read by IN %s is overwritten before it is used", reg)
+		}
+	}
+}
+
+// lintWrap JMP なしで15番地を越えて0番地に戻る命令を警告する
+// コードのない番地 (NOP) を通り抜けて15番地を越える場合も含める。
+func (asm *Assembler) lintWrap(p *lintProgram) {
+	for adr := 0; adr < ROMSize; adr++ {
+		if !p.reachable[adr] || p.src[adr] == nil || p.rom[adr]>>4 == 0xF {
+			continue
+		}
+		next := adr + 1
+		for next < ROMSize && p.src[next] == nil {
+			next++
+		}
+		if next < ROMSize {
+			continue
+		}
+		msg := "execution falls off address 15 and wraps to address 0 without JMP"
+		if adr != ROMSize-1 {
+			msg = fmt.Sprintf("execution runs through empty ROM from address %d and wraps to address 0 without JMP", adr+1)
+		}
+		asm.Diags.Warnf(p.src[adr], 0, 0, "%s", msg)
+	}
+}
@@ -0,0 +1,89 @@
+package asm
+
+import (
+	"strings"
+	"testing"
+)
+
+// lintWarnings ソースコードをアセンブルして Lint を実行し、警告をGCC形式で返す
+func lintWarnings(t *testing.T, src string) []string {
+	t.Helper()
+	a := NewAssembler("test.td4", strings.Split(src, "\n"))
+	if a.Pass1() != nil || a.Pass2() != nil {
+		t.Fatalf("%q does not assemble: %v", src, a.Diags.List)
+	}
+	a.Lint()
+	a.Diags.Sort()
+	var warnings []string
+	for _, d := range a.Diags.List {
+		warnings = append(warnings, d.String())
+	}
+	return warnings
+}
+
+func TestLint(t *testing.T) {
+	tests := []struct {
+		name     string
+		src      string
+		warnings []string
+	}{
+		{"clean", "START:\n    IN A\n    ADD A, 1\n    JNC START\n    OUT B\n    JMP START", nil},
+
+		// キャリーフラグ
+		{"JNC without ADD", "LOOP:\n    OUT 1\n    MOV A, 3\n    JNC LOOP\n    JMP LOOP", []string{
+			"test.td4:4: warning: JNC always jumps: no ADD can set the carry flag on any path to address 2",
+		}},
+		{"JNC after JMP", "    OUT 1\n    JMP NEXT\nNEXT:\n    JNC 0\n    JMP 0", []string{
+			"test.td4:4: warning: JNC always jumps: no ADD can set the carry flag on any path to address 2",
+		}},
+		{"JNC after CLC", "LOOP:\n    OUT 1\n    ADD A, 0\n    JNC LOOP\n    JMP LOOP", []string{
+			"test.td4:4: warning: JNC always jumps: no ADD can set the carry flag on any path to address 2",
+		}},
+		// MOV・OUT はキャリーフラグを保持する
+		{"carry kept by MOV", "LOOP:\n    ADD A, 5\n    MOV B, A\n    OUT B\n    JNC LOOP\n    JMP LOOP", nil},
+
+		// 到達できない命令
+		{"unreachable range", "LOOP:\n    OUT 1\n    JMP LOOP\n    OUT 2\n    OUT 3\n    NOP", []string{
+			"test.td4:4: warning: unreachable code at addresses 2-4",
+		}},
+
+		// 使用する前に上書きされる IN
+		{"IN overwritten", "LOOP:\n    IN A\n    MOV A, 1\n    MOV B, A\n    OUT B\n    JMP LOOP", []string{
+			"test.td4:2: warning: value read by IN A is overwritten before it is used",
+		}},
+		{"IN B overwritten", "LOOP:\n    IN B\n    MOV B, 2\n    OUT B\n    JMP LOOP", []string{
+			"test.td4:2: warning: value read by IN B is overwritten before it is used",
+		}},
+		{"IN used on one path", "LOOP:\n    IN A\n    ADD A, 1\n    JNC SKIP\n    MOV A, 0\nSKIP:\n    MOV B, A\n    OUT B\n    JMP LOOP", nil},
+		{"IN never used", "    IN A\n    OUT 1\n    HALT", []string{
+			"test.td4:1: warning: value read by IN A is overwritten before it is used",
+		}},
+
+		// 15番地を越える実行の流れ
+		{"wrap at 15", strings.Repeat("NOP\n", 15) + "OUT 1", []string{
+			"test.td4:16: warning: execution falls off address 15 and wraps to address 0 without JMP",
+		}},
+		{"wrap through empty ROM", "    OUT 1", []string{
+			"test.td4:1: warning: execution runs through empty ROM from address 1 and wraps to address 0 without JMP",
+		}},
+		{"JMP at 15", strings.Repeat("NOP\n", 14) + "OUT 1\nJMP 0", nil},
+
+		// 一度も実行されない OUT
+		{"no OUT", "LOOP:\n    ADD A, 1\n    JMP LOOP", []string{
+			"test.td4:2: warning: OUT is never executed; the program produces no output",
+		}},
+		{"OUT unreachable", "LOOP:\n    ADD A, 1\n    JMP LOOP\n    OUT A", []string{
+			"test.td4:2: warning: OUT is never executed; the program produces no output",
+			"test.td4:4: warning: unreachable code at addresses 2-3",
+		}},
+		{"no code", "N EQU 1", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := lintWarnings(t, tt.src)
+			if strings.Join(got, "\n") != strings.Join(tt.warnings, "\n") {
+				t.Errorf("warnings:\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.warnings, "\n"))
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package asm
+
+// アセンブル結果のリスト表示 (-list)
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// macroDepth マクロ展開の入れ子の深さを返す (展開されていない行は0)
+func macroDepth(src *SourceLine) int {
+	depth := 0
+	for s := src; s != nil && s.CallSite != nil; s = s.CallSite {
+		depth++
+	}
+	return depth
+}
+
+// codeText 行からコメントを除き、前後の空白を除いた文字列を返す
+func codeText(line string) string {
+	if idx := strings.Index(line, ";"); idx != -1 {
+		line = line[:idx]
+	}
+	return strings.TrimSpace(line)
+}
+
+// listingColumn リスト表示のアドレス・機械語の欄 " 02 [0010] | 1011_0001 |  B1" を返す
+func listingColumn(adr int, b uint8) string {
+	return fmt.Sprintf(" %02X [%04b] | %04b_%04b |  %02X", adr, adr, b>>4, b&0x0f, b)
+}
+
+// WriteListing アドレス・機械語・ソースコードの対応表を出力する
+// マクロ・疑似命令で展開された命令は、呼び出し行を表示した後に "+" を付けて表示する。
+func (asm *Assembler) WriteListing(w io.Writer) {
+	// テーブル形式で出力
+	fmt.Fprintln(w, "\n ADDR      | BINARY    | HEX | SOURCE CODE")
+	fmt.Fprintln(w, "-----------|-----------|-----|----------------")
+	shown := make(map[*SourceLine]bool) // 表示済みのマクロ呼び出し行
+	for i, b := range asm.binaries {
+		src := asm.srcLines[i]
+		// まだ表示していないマクロ呼び出し行を、外側から順に表示する
+		var sites []*SourceLine
+		for s := src; s.CallSite != nil; s = s.CallSite {
+			if !shown[s.CallSite] {
+				sites = append([]*SourceLine{s.CallSite}, sites...)
+			}
+		}
+		for _, site := range sites {
+			shown[site] = true
+			fmt.Fprintf(w, "           |           |     | %s%s\n", strings.Repeat("+ ", macroDepth(site)), codeText(site.Text))
+		}
+		depth := macroDepth(src)
+		if asm.pseudoLines[src] {
+			// 疑似命令は、元の行を表示してから展開した命令を表示する
+			if !shown[src] {
+				shown[src] = true
+				fmt.Fprintf(w, "           |           |     | %s%s\n", strings.Repeat("+ ", depth), codeText(src.Text))
+			}
+			depth++
+		}
+		// debugLinesスライスから対応するソース文字列を取得
+		sourceCode := ""
+		if i < len(asm.debugLines) {
+			sourceCode = asm.debugLines[i]
+		}
+		if sourceCode != "" {
+			sourceCode = strings.Repeat("+ ", depth) + sourceCode
+		}
+		adr := asm.addresses[i]
+		fmt.Fprintf(w, "%s | %s\n", listingColumn(adr, b), sourceCode)
+	}
+	fmt.Fprintf(w, "\nSuccess! Generated %d bytes.\n", len(asm.binaries))
+}
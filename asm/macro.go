@@ -0,0 +1,249 @@
+package asm
+
+// マクロの定義と展開 (Pass1の前に行う前処理)
+//
+//   MACRO 名前 引数1, 引数2, ...
+//       本体 (引数名は呼び出し時の値に置換えられる)
+//   ENDM
+//
+// マクロの本体で定義したラベルは、展開ごとに "ラベル名@番号" へ名前を変えるので、
+// 同じマクロを何度呼び出してもラベルが重複しない。
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// maxMacroDepth マクロ呼び出しの入れ子の上限 (再帰呼び出しの検出用)
+const maxMacroDepth = 16
+
+// Macro マクロ定義
+type Macro struct {
+	Name   string
+	Params []string     // 引数名 (大文字)
+	Body   []SourceLine // 本体の行
+	Def    *SourceLine  // MACROを定義した行
+}
+
+func init() {
+	Directives["MACRO"] = true
+	Directives["ENDM"] = true
+}
+
+// preprocess ソースコードの行を前処理し、マクロを展開した行を返す
+func (asm *Assembler) preprocess(lines []SourceLine) []SourceLine {
+	var out []SourceLine
+	if abs, err := filepath.Abs(asm.fileName()); err == nil {
+		asm.includeStack = []string{abs}
+	}
+	asm.expandLines(lines, 0, &out)
+	return out
+}
+
+// expandLines 行を順に処理し、マクロの定義を登録、呼び出しを展開して out に追加する
+func (asm *Assembler) expandLines(lines []SourceLine, depth int, out *[]SourceLine) {
+	var def *Macro // 定義中のマクロ
+	var cs condStack
+	for i := range lines {
+		src := lines[i]
+		st := asm.ParseLine(src.Text)
+		op := st.Op()
+		asm.curLine = &src
+
+		if def == nil && asm.conditional(&src, st, &cs) {
+			continue
+		}
+		if !cs.active() {
+			continue // 条件が成り立たないブロックの行は読み飛ばす
+		}
+		if def != nil {
+			switch op {
+			case "ENDM":
+				asm.macros[def.Name] = def
+				def = nil
+			case "MACRO":
+				asm.Diags.Errorf(&src, st.Mnemonic.Col, len(st.Mnemonic.Text), "MACRO cannot be defined inside macro %s", def.Name)
+			default:
+				def.Body = append(def.Body, src)
+			}
+			continue
+		}
+
+		switch op {
+		case "MACRO":
+			if depth > 0 {
+				asm.Diags.Errorf(&src, st.Mnemonic.Col, len(st.Mnemonic.Text), "MACRO cannot be defined inside a macro expansion")
+				continue
+			}
+			def = asm.parseMacroHeader(&src, st)
+		case "ENDM":
+			asm.Diags.Errorf(&src, st.Mnemonic.Col, len(st.Mnemonic.Text), "ENDM without MACRO")
+		case "INCLUDE":
+			asm.includeFile(&src, st, depth, out)
+		case "EQU", ".DEFINE":
+			if asm.predefineConst(&src, st) {
+				asm.predefined[len(*out)] = true
+			}
+			*out = append(*out, src)
+		default:
+			if m, ok := asm.macros[op]; ok {
+				asm.expandMacro(&src, st, m, depth, out)
+				continue
+			}
+			*out = append(*out, src)
+		}
+	}
+	if def != nil {
+		asm.Diags.Errorf(def.Def, 0, 0, "MACRO %s has no matching ENDM", def.Name)
+	}
+	asm.checkConditions(cs)
+}
+
+// parseMacroHeader "MACRO 名前 引数, ..." の行を解析する
+// エラーの場合も、ENDMまでを読み飛ばすためにマクロ定義を返す。
+func (asm *Assembler) parseMacroHeader(src *SourceLine, st Statement) *Macro {
+	def := &Macro{Def: src}
+	if st.Label.Text != "" {
+		asm.Diags.Errorf(src, st.Label.Col, len(st.Label.Text), "label is not allowed before MACRO")
+	}
+	code := src.Text
+	if idx := strings.Index(code, ";"); idx != -1 {
+		code = code[:idx]
+	}
+	start := st.Mnemonic.Col - 1 + len(st.Mnemonic.Text)
+	fields := splitFields(strings.ReplaceAll(code[start:], ",", " "), start+1)
+	if len(fields) == 0 {
+		asm.Diags.Errorf(src, st.Mnemonic.Col, len(st.Mnemonic.Text), "MACRO requires a name")
+		return def
+	}
+	name := fields[0]
+	def.Name = strings.ToUpper(name.Text)
+	switch {
+	case !isIdentifier(name.Text):
+		asm.Diags.Errorf(src, name.Col, len(name.Text), "invalid macro name: %s", name.Text)
+	case isKeyword(name.Text) || isRegisterName(name.Text):
+		asm.Diags.Errorf(src, name.Col, len(name.Text), "macro name %s is reserved", def.Name)
+	case asm.macros[def.Name] != nil:
+		asm.Diags.Errorf(src, name.Col, len(name.Text), "duplicate macro: %s", def.Name)
+	}
+	for _, p := range fields[1:] {
+		if !isIdentifier(p.Text) || isRegisterName(p.Text) {
+			asm.Diags.Errorf(src, p.Col, len(p.Text), "invalid macro parameter name: %s", p.Text)
+			continue
+		}
+		def.Params = append(def.Params, strings.ToUpper(p.Text))
+	}
+	return def
+}
+
+// expandMacro マクロ呼び出しを展開する
+func (asm *Assembler) expandMacro(call *SourceLine, st Statement, m *Macro, depth int, out *[]SourceLine) {
+	if depth >= maxMacroDepth {
+		asm.Diags.Errorf(call, st.Mnemonic.Col, len(st.Mnemonic.Text), "macro %s nested too deeply (recursive call?)", m.Name)
+		return
+	}
+	if len(st.Operands) != len(m.Params) {
+		asm.Diags.Errorf(call, st.Mnemonic.Col, len(st.Mnemonic.Text), "macro %s requires %d argument(s), got %d", m.Name, len(m.Params), len(st.Operands))
+		return
+	}
+	// 呼び出し行にラベルがあれば、展開結果の先頭のアドレスを指すラベルとして残す
+	if st.Label.Text != "" {
+		label := *call
+		label.Text = st.Label.Text + ":"
+		*out = append(*out, label)
+	}
+
+	// 置換表: 引数名 -> 呼び出し時の値、本体のラベル -> 展開ごとに固有の名前
+	asm.expansions++
+	subst := make(map[string]string)
+	for i, p := range m.Params {
+		arg := st.Operands[i].Text
+		if !isRegisterName(arg) && !enclosed(arg) && strings.ContainsAny(arg, " \t+-*&|^~<>()") {
+			arg = "(" + arg + ")" // 式は括弧で囲み、演算子の優先順位が変わらないようにする
+		}
+		subst[p] = arg
+	}
+	for _, line := range m.Body {
+		if label := asm.ParseLine(line.Text).Label.Text; label != "" && label != anonLabel {
+			subst[strings.ToUpper(label)] = fmt.Sprintf("%s@%d", label, asm.expansions)
+		}
+	}
+
+	site := *call
+	body := make([]SourceLine, len(m.Body))
+	for i, line := range m.Body {
+		body[i] = SourceLine{
+			File:     line.File,
+			Line:     line.Line,
+			Text:     substitute(line.Text, subst),
+			CallSite: &site,
+			Macro:    m.Name,
+
+			IncludedFrom: line.IncludedFrom,
+		}
+	}
+	asm.expandLines(body, depth+1, out)
+}
+
+// substitute コメントより前の部分の名前を置換表に従って置換える
+func substitute(line string, subst map[string]string) string {
+	code, comment := line, ""
+	if idx := strings.Index(line, ";"); idx != -1 {
+		code, comment = line[:idx], line[idx:]
+	}
+	var sb strings.Builder
+	for i := 0; i < len(code); {
+		c := code[i]
+		if !isIdentChar(c) {
+			sb.WriteByte(c)
+			i++
+			continue
+		}
+		j := i
+		for j < len(code) && isIdentChar(code[j]) {
+			j++
+		}
+		word := code[i:j]
+		if rep, ok := subst[strings.ToUpper(word)]; ok && isIdentStart(c) {
+			sb.WriteString(rep)
+		} else {
+			sb.WriteString(word) // 数値 (0x0F等) はそのまま
+		}
+		i = j
+	}
+	return sb.String() + comment
+}
+
+// enclosed 文字列全体が1組の括弧で囲まれていればtrueを返す
+func enclosed(s string) bool {
+	if !strings.HasPrefix(s, "(") || !strings.HasSuffix(s, ")") {
+		return false
+	}
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 && i != len(s)-1 {
+				return false // 先頭の括弧が途中で閉じている (例: "(1)+(2)")
+			}
+		}
+	}
+	return depth == 0
+}
+
+// isIdentifier 名前として正しい文字列であればtrueを返す
+func isIdentifier(s string) bool {
+	if s == "" || !isIdentStart(s[0]) {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		if !isIdentChar(s[i]) {
+			return false
+		}
+	}
+	return true
+}
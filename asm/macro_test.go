@@ -0,0 +1,91 @@
+package asm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMacroExpansion(t *testing.T) {
+	tests := map[string]struct {
+		src  string
+		code []uint8
+	}{
+		"params":    {"MACRO BLINK n\n    OUT n\n    OUT 0\nENDM\n    BLINK 3\n    BLINK 0xF", []uint8{0xB3, 0xB0, 0xBF, 0xB0}},
+		"two args":  {"MACRO SET x, y\n    MOV A, x\n    MOV B, y\nENDM\n    SET 1, 2", []uint8{0x31, 0x72}},
+		"lowercase": {"macro blink n\n    OUT n\nendm\n    Blink 1", []uint8{0xB1}},
+		// 本体で定義したラベルは、展開ごとに別のラベルになる
+		"local labels": {"MACRO WAIT\nW:\n    ADD A, 1\n    JNC W\nENDM\n    WAIT\n    WAIT", []uint8{0x01, 0xE0, 0x01, 0xE2}},
+		// 入れ子の呼び出しと、引数の式
+		"nested": {"MACRO INNER x\n    OUT x\nENDM\nMACRO OUTER y\n    INNER y\n    INNER y+1\nENDM\n    OUTER 2", []uint8{0xB2, 0xB3}},
+		"empty":  {"MACRO EMPTY\nENDM\n    EMPTY\n    NOP", []uint8{0x00}},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			asm := assemble(tt.src)
+			if errs := errorText(asm); errs != "" || !bytes.Equal(asm.binaries, tt.code) {
+				t.Errorf("% X %q, want % X", asm.binaries, errs, tt.code)
+			}
+		})
+	}
+}
+
+func TestMacroErrors(t *testing.T) {
+	tests := []struct {
+		src, err string
+	}{
+		{"MACRO R\n    R\nENDM\n    R", "test.td4:2:5: error: macro R nested too deeply (recursive call?)"},
+		{"MACRO M x, y\n    ADD x, y\nENDM\n    M 3", "test.td4:4:5: error: macro M requires 2 argument(s), got 1"},
+		{"MACRO M a\nENDM", "invalid macro parameter name: a"},
+		{"MACRO M x\n    OUT x", "test.td4:1: error: MACRO M has no matching ENDM"},
+		{"ENDM", "ENDM without MACRO"},
+		{"MACRO M\nENDM\nMACRO M\nENDM", "test.td4:3:7: error: duplicate macro: M"},
+		{"MACRO MOV\nENDM", "macro name MOV is reserved"},
+		{"L: MACRO M\nENDM", "label is not allowed before MACRO"},
+		{"MACRO M\nMACRO N\nENDM\nENDM", "MACRO cannot be defined inside macro M"},
+	}
+	for _, tt := range tests {
+		if errs := errorText(assemble(tt.src)); !strings.Contains(errs, tt.err) {
+			t.Errorf("%q errors = %q, want %q", tt.src, errs, tt.err)
+		}
+	}
+}
+
+func TestSubstitute(t *testing.T) {
+	subst := map[string]string{"N": "3", "X": "(1+2)"}
+	tests := map[string]string{
+		"    OUT n":       "    OUT 3",
+		"    ADD A, X*2":  "    ADD A, (1+2)*2",
+		"    MOV A, NX":   "    MOV A, NX",   // 名前の一部は置換えない
+		"    MOV A, 0xN":  "    MOV A, 0xN",  // 数値の一部も置換えない
+		"    OUT N ; N回目": "    OUT 3 ; N回目", // コメントはそのまま
+	}
+	for line, want := range tests {
+		if got := substitute(line, subst); got != want {
+			t.Errorf("substitute(%q) = %q, want %q", line, got, want)
+		}
+	}
+}
+
+func TestMacroListing(t *testing.T) {
+	asm := assemble("MACRO BLINK n\n    OUT n\n    OUT 0\nENDM\nSTART:\n    BLINK 3\n    JMP START")
+	var buf bytes.Buffer
+	asm.WriteListing(&buf)
+	want := []string{
+		"           |           |     | BLINK 3",
+		" 00 [0000] | 1011_0011 |  B3 | + OUT 3",
+		" 01 [0001] | 1011_0000 |  B0 | + OUT 0",
+		" 02 [0010] | 1111_0000 |  F0 | JMP START",
+	}
+	if got := buf.String(); !strings.Contains(got, strings.Join(want, "\n")) {
+		t.Errorf("listing does not show the call site and the expansion:\n%s", got)
+	}
+}
+
+func TestMacroErrorNote(t *testing.T) {
+	asm := assemble("MACRO M x\n    MOV A, x\nENDM\n    M 16")
+	d := asm.Diags.List
+	if len(d) != 1 || d[0].Line != 2 || len(d[0].Notes) != 1 || d[0].Notes[0].String() != "test.td4:4: note: in expansion of macro M" {
+		t.Fatalf("diagnostics = %+v, want an error in the macro body with a note at the call site", d)
+	}
+}
@@ -0,0 +1,202 @@
+package asm
+
+// オペランドの解析と、命令ごとのオペランド書式(シグネチャ)の定義
+
+import (
+	"fmt"
+	"strings"
+)
+
+// OperandKind オペランドの種類
+type OperandKind int
+
+const (
+	OperandRegA OperandKind = iota // Aレジスタ
+	OperandRegB                    // Bレジスタ
+	OperandImm                     // 即値 (数値またはラベル)
+)
+
+// String シグネチャ表記での名前を返す
+func (k OperandKind) String() string {
+	switch k {
+	case OperandRegA:
+		return "A"
+	case OperandRegB:
+		return "B"
+	}
+	return "Im"
+}
+
+// Operand 解析済みのオペランド
+type Operand struct {
+	Kind OperandKind
+	Tok  Token // 元のトークン (エラー位置の表示用)
+}
+
+// describe エラーメッセージ用の説明を返す
+func (op Operand) describe() string {
+	if op.Kind == OperandImm {
+		return "immediate " + op.Tok.Text
+	}
+	return "register " + op.Kind.String()
+}
+
+// Form 命令の書式1つ分 (オペランドの並びと、対応するオペコード)
+type Form struct {
+	Operands []OperandKind
+	Opcode   uint8 // 上位4bit。即値を取る書式では下位4bitに即値を加える。
+}
+
+// format 書式を "ADD A, Im" の形式で返す
+func (f Form) format(mnemonic string) string {
+	names := make([]string, len(f.Operands))
+	for i, k := range f.Operands {
+		names[i] = k.String()
+	}
+	return strings.TrimSpace(mnemonic + " " + strings.Join(names, ", "))
+}
+
+// Instructions TD4の命令ごとのオペランド書式表
+var Instructions = map[string][]Form{
+	"ADD": {
+		{[]OperandKind{OperandRegA, OperandImm}, 0x00}, // レジスタに即値を加算
+		{[]OperandKind{OperandRegB, OperandImm}, 0x50},
+	},
+	"MOV": {
+		{[]OperandKind{OperandRegA, OperandRegB}, 0x10}, // AレジスタにBレジスタの内容を転送
+		{[]OperandKind{OperandRegB, OperandRegA}, 0x40}, // BレジスタにAレジスタの内容を転送
+		{[]OperandKind{OperandRegA, OperandImm}, 0x30},  // Aレジスタに即値を代入
+		{[]OperandKind{OperandRegB, OperandImm}, 0x70},  // Bレジスタに即値を代入
+	},
+	"JMP": {{[]OperandKind{OperandImm}, 0xF0}}, // 指定アドレスへジャンプ
+	"JNC": {{[]OperandKind{OperandImm}, 0xE0}}, // Cフラグが0なら指定アドレスへジャンプ
+	"IN": {
+		{[]OperandKind{OperandRegA}, 0x20}, // Aレジスタに入力ポートの内容を転送
+		{[]OperandKind{OperandRegB}, 0x60}, // Bレジスタに入力ポートの内容を転送
+	},
+	"OUT": {
+		{[]OperandKind{OperandRegB}, 0x90}, // Bレジスタの内容を出力ポートへ転送
+		{[]OperandKind{OperandImm}, 0xB0},  // 即値を出力ポートへ転送
+	},
+	"NOP": {{nil, 0x00}}, // 何もしない
+}
+
+// operandHints よくある誤りに対する説明。キーは "ニーモニック オペランド書式"。
+var operandHints = map[string]string{
+	"ADD A, B":  "ADD cannot add two registers; only ADD A, Im and ADD B, Im exist",
+	"ADD B, A":  "ADD cannot add two registers; only ADD A, Im and ADD B, Im exist",
+	"ADD A, A":  "ADD cannot add two registers; only ADD A, Im and ADD B, Im exist",
+	"ADD B, B":  "ADD cannot add two registers; only ADD A, Im and ADD B, Im exist",
+	"ADD Im, A": "ADD takes the register first: ADD A, Im",
+	"ADD Im, B": "ADD takes the register first: ADD B, Im",
+	"MOV A, A":  "MOV A, A is not an instruction; only MOV A, B and MOV B, A copy between registers",
+	"MOV B, B":  "MOV B, B is not an instruction; only MOV A, B and MOV B, A copy between registers",
+	"MOV Im, A": "MOV takes the destination register first: MOV B, A or MOV A, Im",
+	"MOV Im, B": "MOV takes the destination register first: MOV A, B or MOV B, Im",
+	"JMP A":     "JMP does not accept a register; the jump address must be an immediate or a label",
+	"JMP B":     "JMP does not accept a register; the jump address must be an immediate or a label",
+	"JNC A":     "JNC does not accept a register; the jump address must be an immediate or a label",
+	"JNC B":     "JNC does not accept a register; the jump address must be an immediate or a label",
+	"IN Im":     "IN reads the input port into a register: IN A or IN B",
+}
+
+// nonOperandRegs オペランドとして使えないレジスタ名と、その説明
+var nonOperandRegs = map[string]string{
+	"C":   "C is the carry flag and cannot be used as an operand; only registers A and B can",
+	"PC":  "PC cannot be used as an operand; use JMP to change the program counter",
+	"IN":  "the input port cannot be used as an operand; use IN A or IN B",
+	"OUT": "the output port cannot be used as an operand; use OUT B or OUT Im",
+}
+
+// isRegisterName A/Bレジスタの名前であればtrueを返す (大文字小文字は区別しない)
+func isRegisterName(s string) bool {
+	u := strings.ToUpper(s)
+	return u == "A" || u == "B"
+}
+
+// parseOperand トークンをレジスタ・即値のいずれかに分類する
+// ラベルとして定義されていないC等のレジスタ名はエラーとする。
+func (asm *Assembler) parseOperand(tok Token) (Operand, error) {
+	name := strings.ToUpper(tok.Text)
+	switch name {
+	case "A":
+		return Operand{OperandRegA, tok}, nil
+	case "B":
+		return Operand{OperandRegB, tok}, nil
+	}
+	if msg, ok := nonOperandRegs[name]; ok {
+		if _, isLabel := asm.symbolTable[name]; !isLabel {
+			return Operand{}, &operandError{tok, msg}
+		}
+	}
+	return Operand{OperandImm, tok}, nil
+}
+
+// matchForm オペランドに一致する書式を forms から探す
+// 一致する書式がない場合は、原因をできるだけ具体的に示すエラーを返す。
+func matchForm(mnemonic string, forms []Form, ops []Operand) (Form, error) {
+	arityOK := false
+	for _, f := range forms {
+		if len(f.Operands) != len(ops) {
+			continue
+		}
+		arityOK = true
+		ok := true
+		for i, k := range f.Operands {
+			if ops[i].Kind != k {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return f, nil
+		}
+	}
+
+	// 書式の一覧 (エラーメッセージ用)
+	valid := make([]string, len(forms))
+	for i, f := range forms {
+		valid[i] = f.format(mnemonic)
+	}
+	if !arityOK {
+		n := len(forms[0].Operands)
+		if n == 0 {
+			return Form{}, fmt.Errorf("%s takes no operands", mnemonic)
+		}
+		if n == 1 {
+			return Form{}, fmt.Errorf("%s requires 1 operand (%s)", mnemonic, strings.Join(valid, " | "))
+		}
+		return Form{}, fmt.Errorf("%s requires %d operands (%s)", mnemonic, n, strings.Join(valid, " | "))
+	}
+
+	kinds := make([]OperandKind, len(ops))
+	for i, op := range ops {
+		kinds[i] = op.Kind
+	}
+	given := Form{Operands: kinds}.format(mnemonic)
+
+	// 書式のどの位置にも当てはまらないオペランドを、エラー位置とする
+	blame := ops[0].Tok
+	for i, op := range ops {
+		accepted := false
+		for _, f := range forms {
+			if len(f.Operands) == len(ops) && f.Operands[i] == op.Kind {
+				accepted = true
+				break
+			}
+		}
+		if !accepted {
+			blame = op.Tok
+			break
+		}
+	}
+	if hint, ok := operandHints[given]; ok {
+		return Form{}, &operandError{blame, hint}
+	}
+	descs := make([]string, len(ops))
+	for i, op := range ops {
+		descs[i] = op.describe()
+	}
+	return Form{}, &operandError{blame, fmt.Sprintf("%s does not accept %s; valid forms: %s",
+		mnemonic, strings.Join(descs, ", "), strings.Join(valid, " | "))}
+}
@@ -0,0 +1,91 @@
+package asm
+
+import (
+	"strings"
+	"testing"
+)
+
+// assemble ソースコード (1行ごとに "\n" で区切る) を2パスでアセンブルする
+func assemble(src string) *Assembler {
+	asm := NewAssembler("test.td4", strings.Split(src, "\n"))
+	asm.Pass1()
+	asm.Pass2()
+	asm.Diags.Sort()
+	return asm
+}
+
+// errorText エラーだけをGCC形式で改行区切りにして返す
+func errorText(asm *Assembler) string {
+	var errs []string
+	for _, d := range asm.Diags.List {
+		if d.Severity == SeverityError {
+			errs = append(errs, d.String())
+		}
+	}
+	return strings.Join(errs, "\n")
+}
+
+func TestOperandForms(t *testing.T) {
+	tests := map[string]uint8{
+		"ADD A, 1":   0x01,
+		"MOV A, B":   0x10,
+		"IN A":       0x20,
+		"MOV A, 3":   0x33,
+		"MOV B, A":   0x40,
+		"ADD B, 2":   0x52,
+		"IN B":       0x60,
+		"MOV B, 0xF": 0x7F,
+		"OUT B":      0x90,
+		"OUT 5":      0xB5,
+		"JNC 4":      0xE4,
+		"JMP 3":      0xF3,
+		"NOP":        0x00,
+		// ニーモニックもレジスタ名も、大文字小文字を区別しない
+		"mov a, b": 0x10,
+		"Mov B, a": 0x40,
+		"in b":     0x60,
+		"MOV A,B":  0x10,
+	}
+	for src, want := range tests {
+		asm := assemble(src)
+		if errs := errorText(asm); errs != "" || len(asm.binaries) != 1 || asm.binaries[0] != want {
+			t.Errorf("%q = % X %q, want %02X", src, asm.binaries, errs, want)
+		}
+	}
+}
+
+func TestOperandErrors(t *testing.T) {
+	tests := []struct {
+		src, err string
+	}{
+		{"MOV C, 3", "test.td4:1:5: error: C is the carry flag"},
+		{"MOV PC, 3", "PC cannot be used as an operand"},
+		{"IN 3", "test.td4:1:4: error: IN reads the input port into a register"},
+		{"MOV A", "MOV requires 2 operands (MOV A, B | MOV B, A | MOV A, Im | MOV B, Im)"},
+		{"ADD B, A", "test.td4:1:8: error: ADD cannot add two registers"},
+		{"MOV 3, A", "MOV takes the destination register first"},
+		{"JMP A", "JMP does not accept a register"},
+		{"NOP 1", "NOP takes no operands"},
+		{"OUT", "OUT requires 1 operand (OUT B | OUT Im | OUT A)"},
+		{"MOV A, 16", "test.td4:1:8: error: immediate out of range (0-15): 16"},
+		{"LOOP: FOO 1", "test.td4:1:7: error: unknown instruction: FOO"},
+	}
+	for _, tt := range tests {
+		if errs := errorText(assemble(tt.src)); !strings.Contains(errs, tt.err) {
+			t.Errorf("%q errors = %q, want %q", tt.src, errs, tt.err)
+		}
+	}
+	// エラーがあっても最後の行まで処理し、すべてのエラーを報告する
+	asm := assemble("MOV C, 1\nADD A, B\nJMP 3")
+	if n := asm.Diags.ErrorCount(); n != 2 || len(asm.binaries) != 3 || asm.binaries[2] != 0xF3 {
+		t.Errorf("got %d error(s) and % X", n, asm.binaries)
+	}
+}
+
+func TestOperandLabelNamedLikeRegister(t *testing.T) {
+	// C 等はラベルとして定義されていれば、即値として使える
+	asm := assemble("JMP C\nC: OUT 1")
+	if errs := errorText(asm); errs != "" || asm.binaries[0] != 0xF1 {
+		t.Errorf("JMP C = % X %q", asm.binaries, errs)
+	}
+}
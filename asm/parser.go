@@ -0,0 +1,162 @@
+package asm
+
+// ソースコード1行分の構文解析 (ラベル・命令・オペランドへの分割)
+
+import (
+	"strings"
+)
+
+// Directives 命令以外にアセンブラが解釈する疑似命令(ディレクティブ)
+var Directives = map[string]bool{
+	"EQU":     true, // NAME EQU 式      定数の定義
+	".DEFINE": true, // .define NAME 式  定数の定義 (EQUと同じ)
+}
+
+// Statement 1行分の構文解析結果
+type Statement struct {
+	Label    Token   // ラベルまたは定数名 (なければ Text が空)
+	Mnemonic Token   // 命令またはディレクティブ (なければ Text が空)
+	Operands []Token // オペランド。式の場合は式全体が1つのトークンになる。
+	Comment  Token   // ";" から行末までのコメント (なければ Text が空)
+}
+
+// Op 大文字に変換したニーモニックを返す
+func (st Statement) Op() string {
+	return strings.ToUpper(st.Mnemonic.Text)
+}
+
+// isKeyword 命令またはディレクティブであればtrueを返す
+func isKeyword(word string) bool {
+	w := strings.ToUpper(word)
+	return InstructionSet[w] || Directives[w]
+}
+
+// isKeyword 命令・ディレクティブ・定義済みのマクロ名であればtrueを返す
+func (asm *Assembler) isKeyword(word string) bool {
+	return isKeyword(word) || asm.macros[strings.ToUpper(word)] != nil
+}
+
+// ParseLine 1行をラベル・ニーモニック・オペランドに分割する
+// コメント(;)以降は Comment に格納する。ラベルは末尾のコロン(:)がなくても認識する。
+func (asm *Assembler) ParseLine(line string) Statement {
+	var st Statement
+	if idx := strings.Index(line, ";"); idx != -1 {
+		st.Comment = Token{strings.TrimRight(line[idx:], " \t\r"), idx + 1}
+		line = line[:idx]
+	}
+	fields := splitFields(line, 1)
+	if len(fields) == 0 {
+		return st
+	}
+
+	rest := 0 // ニーモニックの位置 (fieldsのインデックス)
+	first := fields[0]
+	switch {
+	case first.Text == anonLabel:
+		// 無名ラベル
+		st.Label = first
+		rest = 1
+	case strings.HasSuffix(first.Text, ":"):
+		// コロン付きのラベル
+		st.Label = Token{strings.TrimSuffix(first.Text, ":"), first.Col}
+		rest = 1
+	case asm.isKeyword(first.Text):
+		// 命令から始まる行
+	case len(fields) > 1 && !asm.isKeyword(fields[1].Text):
+		// 2語目も命令でなければ、ラベルではなく、1語目を誤った命令とみなす
+	default:
+		// コロンなしのラベル
+		st.Label = first
+		rest = 1
+	}
+	if rest >= len(fields) {
+		return st
+	}
+	st.Mnemonic = fields[rest]
+
+	// ニーモニック以降をオペランドとして分割する
+	start := st.Mnemonic.Col - 1 + len(st.Mnemonic.Text)
+	st.Operands = splitOperands(line[start:], start+1)
+	return st
+}
+
+// splitFields 空白・タブで区切られた単語と、その桁位置を返す
+// col は s の先頭の桁位置。
+func splitFields(s string, col int) []Token {
+	var fields []Token
+	start := -1
+	for i := 0; i <= len(s); i++ {
+		if i < len(s) && s[i] != ' ' && s[i] != '\t' && s[i] != '\r' {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			fields = append(fields, Token{s[start:i], col + start})
+			start = -1
+		}
+	}
+	return fields
+}
+
+// splitOperands オペランドの並びを分割する
+// カンマがあればカンマで区切る。カンマがなければ空白で区切るが、
+// 演算子の前後で区切られた単語は1つの式としてまとめる (例: "LOOP + 1")。
+func splitOperands(s string, col int) []Token {
+	var ops []Token
+	depth := 0
+	hasComma := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				hasComma = true
+				ops = append(ops, trimToken(s[start:i], col+start))
+				start = i + 1
+			}
+		}
+	}
+	if hasComma {
+		return append(ops, trimToken(s[start:], col+start))
+	}
+
+	// カンマなし: 空白で区切り、式の途中で区切られたものを結合する
+	fields := splitFields(s, col)
+	for _, f := range fields {
+		if n := len(ops); n > 0 && joinsExpr(ops[n-1].Text, f.Text) {
+			prev := ops[n-1]
+			end := f.Col - col + len(f.Text)
+			ops[n-1] = Token{s[prev.Col-col : end], prev.Col}
+			continue
+		}
+		ops = append(ops, f)
+	}
+	return ops
+}
+
+// joinsExpr 空白で区切られた2つの単語が、1つの式の一部であればtrueを返す
+func joinsExpr(prev, next string) bool {
+	if strings.Count(prev, "(") > strings.Count(prev, ")") {
+		return true // 括弧が閉じていない
+	}
+	if strings.ContainsAny(prev[len(prev)-1:], "+-*&|^~<>(") {
+		return true // 演算子で終わっている
+	}
+	if next == "-" {
+		return true // 単独の "-" は2項演算子とみなす
+	}
+	return strings.ContainsAny(next[:1], "+*&|^<>)")
+}
+
+// trimToken 前後の空白を除いたトークンを返す
+func trimToken(s string, col int) Token {
+	trimmed := strings.TrimLeft(s, " \t\r")
+	col += len(s) - len(trimmed)
+	return Token{strings.TrimRight(trimmed, " \t\r"), col}
+}
@@ -0,0 +1,111 @@
+package asm
+
+// 疑似命令 (TD4の命令の組み合わせに展開される命令)
+// 展開後の命令数だけアドレスを使用する。-list では展開結果の機械語を表示する。
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Pseudo 疑似命令の書式1つ分 (オペランドの並びと、展開する命令)
+type Pseudo struct {
+	Operands []OperandKind
+	Expand   []string // 展開する命令。{1}, {2} は1番目、2番目のオペランドに置換える。
+}
+
+// PseudoInstructions 疑似命令の書式と展開結果の表
+// OUT のように命令と同じ名前の場合は、命令の書式に当てはまらないときに疑似命令として扱う。
+var PseudoInstructions = map[string][]Pseudo{
+	"SUB": {
+		{[]OperandKind{OperandRegA, OperandImm}, []string{"ADD A, NEG({2})"}}, // 16-n を加算する (借りがなければCフラグが1)
+		{[]OperandKind{OperandRegB, OperandImm}, []string{"ADD B, NEG({2})"}},
+	},
+	"HALT": {{nil, []string{"JMP $"}}},    // 自分自身へのジャンプで停止する
+	"CLC":  {{nil, []string{"ADD A, 0"}}}, // 0を加算してCフラグを0にする (Aは変化しない)
+	"OUT": {
+		{[]OperandKind{OperandRegA}, []string{"MOV B, A", "OUT B"}}, // Bレジスタの内容は失われる
+	},
+	"JC": {{[]OperandKind{OperandImm}, []string{"JNC LOW4($+2)", "JMP {1}"}}}, // Cフラグが1ならジャンプ (15番地の次は0番地)
+}
+
+// pseudoForms 疑似命令の書式を、エラーメッセージ用に Form の形式で返す
+func pseudoForms(mnemonic string) []Form {
+	var forms []Form
+	for _, ps := range PseudoInstructions[mnemonic] {
+		forms = append(forms, Form{Operands: ps.Operands})
+	}
+	return forms
+}
+
+// pseudoFor 疑似命令として展開する行であれば、該当する書式を返す
+func (asm *Assembler) pseudoFor(st Statement) *Pseudo {
+	mnemonic := st.Op()
+	pseudos, ok := PseudoInstructions[mnemonic]
+	if !ok {
+		return nil
+	}
+	ops := make([]Operand, len(st.Operands))
+	for i, arg := range st.Operands {
+		op, err := asm.parseOperand(arg)
+		if err != nil || arg.Text == "" {
+			return nil
+		}
+		ops[i] = op
+	}
+	// 命令の書式に当てはまる場合は、疑似命令ではない
+	if forms, ok := Instructions[mnemonic]; ok {
+		if _, err := matchForm(mnemonic, forms, ops); err == nil {
+			return nil
+		}
+	}
+	for i, ps := range pseudos {
+		if len(ps.Operands) != len(ops) {
+			continue
+		}
+		ok := true
+		for j, k := range ps.Operands {
+			if ops[j].Kind != k {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return &pseudos[i]
+		}
+	}
+	return nil
+}
+
+// expandPseudo 疑似命令を展開し、機械語を生成する
+// オペランドの誤りは、展開前のオペランドの位置で報告する。
+func (asm *Assembler) expandPseudo(src *SourceLine, st Statement, ps *Pseudo, pc int) {
+	failed := false
+	for i, k := range ps.Operands {
+		if k != OperandImm {
+			continue
+		}
+		if _, err := asm.parseImm(src, st.Operands[i]); err != nil {
+			asm.reportError(src, st.Operands[i], err)
+			failed = true
+		}
+	}
+	asm.pseudoLines[src] = true
+	for i, tmpl := range ps.Expand {
+		text := tmpl
+		for j, arg := range st.Operands {
+			text = strings.ReplaceAll(text, fmt.Sprintf("{%d}", j+1), arg.Text)
+		}
+		est := asm.ParseLine(text)
+		var code uint8
+		if !failed {
+			asm.pc = pc + i
+			c, err := asm.generateCode(nil, est.Op(), est.Operands, pc+i)
+			if err != nil {
+				asm.Diags.Errorf(src, st.Mnemonic.Col, len(st.Mnemonic.Text), "%v (in expansion of %s)", err, st.Op())
+			}
+			code = c
+		}
+		asm.emit(src, pc+i, code, statementText(est))
+	}
+}
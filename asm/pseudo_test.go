@@ -0,0 +1,105 @@
+package asm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"main/td4"
+)
+
+func TestPseudoInstructions(t *testing.T) {
+	tests := []struct {
+		src  string
+		code []uint8
+	}{
+		{"SUB A, 1", []uint8{0x0F}},
+		{"SUB B, 3", []uint8{0x5D}},
+		{"sub a, 0", []uint8{0x00}},
+		{"HALT", []uint8{0xF0}},
+		{"NOP\nHALT", []uint8{0x00, 0xF1}},
+		{"CLC", []uint8{0x00}},
+		{"OUT A", []uint8{0x40, 0x90}},
+		{"OUT B", []uint8{0x90}}, // 命令の書式に当てはまれば展開しない
+		{"L:\nJC L", []uint8{0xE2, 0xF0}},
+		{"JC END\nEND:", []uint8{0xE2, 0xF2}}, // 展開後の命令数だけアドレスを使う
+		// 14番地の JC は、JNC で16番地 (0番地) へ飛ぶ
+		{strings.Repeat("NOP\n", 14) + "JC 3", append(make([]uint8, 14), 0xE0, 0xF3)},
+	}
+	for _, tt := range tests {
+		asm := assemble(tt.src)
+		if errs := errorText(asm); errs != "" || !bytes.Equal(asm.binaries, tt.code) {
+			t.Errorf("%q = % X %q, want % X", tt.src, asm.binaries, errs, tt.code)
+		}
+	}
+}
+
+func TestPseudoErrors(t *testing.T) {
+	for src, want := range map[string]string{
+		"SUB A, 16": "test.td4:1:8: error: immediate out of range (0-15): 16",
+		"JC A":      "JC does not accept register A; valid forms: JC Im",
+		"OUT":       "OUT requires 1 operand (OUT B | OUT Im | OUT A)",
+		"HALT 1":    "HALT takes no operands",
+		// 15番地の JC は、JMP がROMからはみ出す
+		strings.Repeat("NOP\n", 15) + "JC 3": "test.td4:16:1: error: address 16 is past the end of the 16-byte ROM",
+	} {
+		if errs := errorText(assemble(src)); !strings.Contains(errs, want) {
+			t.Errorf("%q errors = %q, want %q", src, errs, want)
+		}
+	}
+}
+
+func TestPseudoListing(t *testing.T) {
+	asm := assemble("START:\n    OUT A\n    JC START")
+	var buf bytes.Buffer
+	asm.WriteListing(&buf)
+	want := []string{
+		"           |           |     | OUT A",
+		" 00 [0000] | 0100_0000 |  40 | + MOV B, A",
+		" 01 [0001] | 1001_0000 |  90 | + OUT B",
+		"           |           |     | JC START",
+		" 02 [0010] | 1110_0100 |  E4 | + JNC LOW4($+2)",
+		" 03 [0011] | 1111_0000 |  F0 | + JMP START",
+	}
+	if got := buf.String(); !strings.Contains(got, strings.Join(want, "\n")) {
+		t.Errorf("listing does not show the expansion:\n%s", got)
+	}
+}
+
+// TestPseudoRun 展開した命令を実行して、疑似命令の意味どおりに動くことを確かめる
+func TestPseudoRun(t *testing.T) {
+	// JC を14番地に置く: 0: JMP 3 / 1: OUT 2 / 2: HALT / 3: MOV A, x / MOV B, 0 ×9 / 13: ADD A, 15 / 14: JC 1
+	jc14 := func(x string) string {
+		return "    JMP 3\nYES:\n    OUT 2\n    HALT\n    MOV A, " + x + "\n" + strings.Repeat("    MOV B, 0\n", 9) + "    ADD A, 15\n    JC YES"
+	}
+	tests := []struct {
+		name string
+		src  string
+		out  uint8
+	}{
+		{"SUB", "MOV A, 7\nSUB A, 3\nOUT A\nHALT", 4},
+		{"JC taken", "MOV A, 1\nADD A, 15\nJC YES\nOUT 1\nHALT\nYES:\nOUT 2\nHALT", 2},
+		{"JC not taken", "MOV A, 1\nADD A, 1\nJC YES\nOUT 1\nHALT\nYES:\nOUT 2\nHALT", 1},
+		{"CLC", "MOV A, 1\nADD A, 15\nCLC\nJC YES\nOUT 1\nHALT\nYES:\nOUT 2\nHALT", 1},
+		{"JC at 14 taken", jc14("1"), 2},
+		{"JC at 14 not taken", jc14("0"), 0}, // JNC で0番地に戻り、OUT 2 を実行しない
+	}
+	for _, tt := range tests {
+		a := assemble(tt.src)
+		if errs := errorText(a); errs != "" {
+			t.Fatalf("%s: %s", tt.name, errs)
+		}
+		_, image := a.Image(false)
+		for _, v := range []td4.Variant{td4.VariantEmu, td4.VariantHardware} { // 疑似命令はどちらの命令セットでも同じに動く
+			cpu := td4.NewCPU()
+			cpu.Variant = v
+			copy(cpu.ROM[:], image)
+			for i := 0; i < 40; i++ {
+				cpu.Step()
+			}
+			if cpu.OutPort != tt.out {
+				t.Errorf("%s (%v): OUT = %d, want %d", tt.name, v, cpu.OutPort, tt.out)
+			}
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package asm
+
+// エディタ連携 (td4-lsp) 用の問い合わせ
+// アセンブル結果から、ソースコードの行に対応する機械語や、名前に対応するシンボルを取り出す。
+
+import "strings"
+
+// Code アセンブル結果の1バイト分
+type Code struct {
+	Addr int
+	Byte uint8
+	Text string // 生成した命令 (マクロ・疑似命令は展開後の命令)
+}
+
+// ListingColumn -list と同じ "アドレス | 2進数 | 16進数" の形式の文字列を返す
+func (c Code) ListingColumn() string {
+	return listingColumn(c.Addr, c.Byte)
+}
+
+// origins 行と、その行を生成したマクロの呼び出し行・INCLUDEの行を順に返す
+func origins(src *SourceLine) []*SourceLine {
+	var list []*SourceLine
+	outer := src
+	for ; outer != nil; outer = outer.CallSite {
+		list = append(list, outer)
+		if outer.CallSite == nil {
+			break
+		}
+	}
+	for s := outer.IncludedFrom; s != nil; s = s.IncludedFrom {
+		list = append(list, s)
+	}
+	return list
+}
+
+// CodeAt 指定したファイル・行から生成した機械語を返す
+// マクロの呼び出し行・INCLUDEの行を指定した場合は、展開・取り込みで生成した機械語をすべて返す。
+func (asm *Assembler) CodeAt(file string, line int) []Code {
+	var codes []Code
+	for i, src := range asm.srcLines {
+		for _, s := range origins(src) {
+			if s.Line == line && s.File == file {
+				codes = append(codes, Code{asm.addresses[i], asm.binaries[i], asm.debugLines[i]})
+				break
+			}
+		}
+	}
+	return codes
+}
+
+// Symbols ラベル(アドレス順)、定数(名前順)の順に、すべてのシンボルを返す
+func (asm *Assembler) Symbols() []*Symbol {
+	return asm.sortedSymbols()
+}
+
+// LookupSymbol 指定したファイル・行に書かれた名前が参照するシンボルを返す
+// ローカルラベルは、その行のグローバルラベルの範囲で探す。見つからなければnilを返す。
+func (asm *Assembler) LookupSymbol(name, file string, line int) *Symbol {
+	key := strings.ToUpper(name)
+	if isLocalLabel(key) {
+		scope := ""
+		for i := range asm.lines {
+			if src := &asm.lines[i]; src.CallSite == nil && src.Line == line && src.File == file && i < len(asm.lineScope) {
+				scope = asm.lineScope[i]
+				break
+			}
+		}
+		key = scope + key
+	}
+	return asm.symbolTable[key]
+}
+
+// MacroDef マクロを定義した行を返す (定義されていなければnil)
+func (asm *Assembler) MacroDef(name string) *SourceLine {
+	if m := asm.macros[strings.ToUpper(name)]; m != nil {
+		return m.Def
+	}
+	return nil
+}
+
+// MacroNames 定義済みのマクロ名 (大文字) を返す
+func (asm *Assembler) MacroNames() []string {
+	var names []string
+	for name := range asm.macros {
+		names = append(names, name)
+	}
+	return names
+}
+
+// UsedBytes ROMのうち、コードを配置した番地の数を返す
+func (asm *Assembler) UsedBytes() int {
+	return len(asm.usedAddr)
+}
@@ -0,0 +1,149 @@
+package asm
+
+// シンボル表・相互参照の出力 (-sym, -xref) と、シンボルファイル (-symfile) の出力
+//
+// シンボルファイルは、エミュレータや逆アセンブラでラベル名を表示するためのテキストファイル。
+// 1行に1シンボルを、タブ区切りで 名前・値(10進数)・種類(label/const)・ファイル名・行番号 の順に出力する。
+// ";" で始まる行はコメント。td4emu と td4 dis は ReadSymFile で読み込んで、ラベル名を表示する。
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// String シンボルの種類の名前を返す
+func (k SymbolKind) String() string {
+	if k == SymbolConst {
+		return "const"
+	}
+	return "label"
+}
+
+// addRef 処理中の行からシンボルへの参照を記録する (同じ行からの参照は1回だけ記録する)
+func (asm *Assembler) addRef(sym *Symbol) {
+	src := asm.curLine
+	if src == nil {
+		return
+	}
+	for _, ref := range sym.Refs {
+		if ref.File == src.File && ref.Line == src.Line {
+			return
+		}
+	}
+	sym.Refs = append(sym.Refs, src)
+}
+
+// checkUnused 参照されていないラベルを警告する
+// マクロの展開で生成されたラベルは、展開ごとに警告が重複するため対象外とする。
+func (asm *Assembler) checkUnused() {
+	for _, sym := range asm.sortedSymbols() {
+		if sym.Kind != SymbolLabel || len(sym.Refs) > 0 || sym.Def.Macro != "" {
+			continue
+		}
+		asm.Diags.Warnf(sym.Def, sym.Col, len(sym.Name), "label %s is defined but never used", sym.Name)
+	}
+}
+
+// sortedSymbols シンボルを、ラベル(アドレス順)、定数(名前順)の順に並べて返す
+func (asm *Assembler) sortedSymbols() []*Symbol {
+	syms := make([]*Symbol, 0, len(asm.symbolTable))
+	for _, sym := range asm.symbolTable {
+		syms = append(syms, sym)
+	}
+	sort.Slice(syms, func(i, j int) bool {
+		a, b := syms[i], syms[j]
+		if a.Kind != b.Kind {
+			return a.Kind == SymbolLabel
+		}
+		if a.Kind == SymbolLabel && a.Value != b.Value {
+			return a.Value < b.Value
+		}
+		return a.Name < b.Name
+	})
+	return syms
+}
+
+// location シンボルを定義した位置を "ファイル名:行番号" の形式で返す
+func location(src *SourceLine) string {
+	if src.Line == 0 {
+		return src.File // -D で定義した定数
+	}
+	return fmt.Sprintf("%s:%d", src.File, src.Line)
+}
+
+// WriteSymbols シンボル表を出力する
+// xref がtrueの場合は、各シンボルを参照している行も出力する。
+func (asm *Assembler) WriteSymbols(w io.Writer, xref bool) {
+	fmt.Fprintln(w, "\n SYMBOL               | KIND  | VALUE     | DEFINED AT")
+	fmt.Fprintln(w, "----------------------|-------|-----------|----------------")
+	for _, sym := range asm.sortedSymbols() {
+		value := fmt.Sprintf("%02X [%04b]", sym.Value, sym.Value)
+		if sym.Kind == SymbolConst {
+			value = fmt.Sprintf("%-9d", sym.Value)
+		}
+		fmt.Fprintf(w, " %-20s | %-5s | %s | %s\n", sym.Name, sym.Kind, value, location(sym.Def))
+		if !xref {
+			continue
+		}
+		if len(sym.Refs) == 0 {
+			fmt.Fprintf(w, " %-20s |       |           |   (not referenced)\n", "")
+		}
+		for _, ref := range sym.Refs {
+			fmt.Fprintf(w, " %-20s |       |           |   <- %s  %s\n", "", location(ref), codeText(ref.Text))
+		}
+	}
+	fmt.Fprintf(w, "\n%d symbol(s).\n", len(asm.symbolTable))
+}
+
+// WriteSymFile 機械で読み取るためのシンボルファイルを出力する
+func (asm *Assembler) WriteSymFile(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "; td4asm symbol file: %s\n; name\tvalue\tkind\tfile\tline\n", asm.fileName()); err != nil {
+		return err
+	}
+	for _, sym := range asm.sortedSymbols() {
+		file := strings.ReplaceAll(sym.Def.File, "\t", " ")
+		if _, err := fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%d\n", sym.Name, sym.Value, sym.Kind, file, sym.Def.Line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadSymFile シンボルファイル (WriteSymFile の出力) を読み込む
+// デバッグ情報ファイル (-dbg) の SYM 行も読み込めるので、どちらのファイルでもシンボルを取り出せる (LINE 行は読み飛ばす)。
+// name はエラー表示に使う名前。
+func ReadSymFile(r io.Reader, name string) ([]*Symbol, error) {
+	var syms []*Symbol
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if line == "" || line[0] == ';' { // 空行とコメントは読み飛ばす。
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if fields[0] == "LINE" && len(fields) == 6 {
+			continue
+		}
+		if fields[0] == "SYM" && len(fields) == 6 {
+			fields = fields[1:]
+		}
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("%s:%d: invalid symbol record", name, n)
+		}
+		val, err1 := strconv.Atoi(fields[1])
+		num, err2 := strconv.Atoi(fields[4])
+		if err1 != nil || err2 != nil || fields[2] != "label" && fields[2] != "const" {
+			return nil, fmt.Errorf("%s:%d: invalid symbol record", name, n)
+		}
+		kind := SymbolLabel
+		if fields[2] == "const" {
+			kind = SymbolConst
+		}
+		syms = append(syms, &Symbol{Name: fields[0], Value: val, Kind: kind, Def: &SourceLine{File: fields[3], Line: num}})
+	}
+	return syms, scanner.Err()
+}
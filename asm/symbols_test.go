@@ -0,0 +1,146 @@
+package asm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const symSource = `N EQU 3
+START:
+    OUT 1
+LOOP:
+    ADD A, N
+    JNC LOOP
+UNUSED:
+    JMP START`
+
+func TestWriteSymbols(t *testing.T) {
+	asm := assemble(symSource)
+	var buf bytes.Buffer
+	asm.WriteSymbols(&buf, true)
+	want := []string{
+		" START                | label | 00 [0000] | test.td4:2",
+		"                      |       |           |   <- test.td4:8  JMP START",
+		" LOOP                 | label | 01 [0001] | test.td4:4",
+		"                      |       |           |   <- test.td4:6  JNC LOOP",
+		" UNUSED               | label | 03 [0011] | test.td4:7",
+		"                      |       |           |   (not referenced)",
+		" N                    | const | 3         | test.td4:1",
+		"                      |       |           |   <- test.td4:5  ADD A, N",
+		"",
+		"4 symbol(s).",
+	}
+	if got := buf.String(); !strings.Contains(got, strings.Join(want, "\n")) {
+		t.Errorf("-xref output:\n%s", got)
+	}
+
+	// -sym では、参照している行を出力しない
+	buf.Reset()
+	asm.WriteSymbols(&buf, false)
+	if got := buf.String(); strings.Contains(got, "<-") || !strings.Contains(got, " N                    | const | 3         | test.td4:1\n\n") {
+		t.Errorf("-sym output:\n%s", got)
+	}
+}
+
+func TestWriteSymFile(t *testing.T) {
+	asm := assemble(symSource)
+	var buf bytes.Buffer
+	if err := asm.WriteSymFile(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := "; td4asm symbol file: test.td4\n" +
+		"; name\tvalue\tkind\tfile\tline\n" +
+		"START\t0\tlabel\ttest.td4\t2\n" +
+		"LOOP\t1\tlabel\ttest.td4\t4\n" +
+		"UNUSED\t3\tlabel\ttest.td4\t7\n" +
+		"N\t3\tconst\ttest.td4\t1\n"
+	if buf.String() != want {
+		t.Errorf("symbol file =\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestWarnUnused(t *testing.T) {
+	tests := []struct {
+		src      string
+		warnings []string
+	}{
+		{symSource, []string{"test.td4:7:1: warning: label UNUSED is defined but never used"}},
+		{"START:\n    JMP START", nil},
+		{"N EQU 1\n    NOP", nil}, // 定数は対象外
+		// マクロの展開で生成されたラベルは対象外
+		{"MACRO M\nL:\n    NOP\nENDM\n    M", nil},
+	}
+	for _, tt := range tests {
+		asm := NewAssembler("test.td4", strings.Split(tt.src, "\n"))
+		asm.WarnUnused = true
+		asm.Pass1()
+		asm.Pass2()
+		var got []string
+		for _, d := range asm.Diags.List {
+			got = append(got, d.String())
+		}
+		if strings.Join(got, "\n") != strings.Join(tt.warnings, "\n") {
+			t.Errorf("%q diagnostics = %q, want %q", tt.src, got, tt.warnings)
+		}
+	}
+	// -Wunused を指定しなければ警告しない
+	if asm := assemble(symSource); len(asm.Diags.List) != 0 {
+		t.Errorf("without -Wunused: %v", asm.Diags.List)
+	}
+}
+
+func TestReadSymFile(t *testing.T) {
+	asm := assemble(symSource)
+	for _, write := range []func(w *bytes.Buffer) error{
+		func(w *bytes.Buffer) error { return asm.WriteSymFile(w) },
+		func(w *bytes.Buffer) error { return asm.WriteDebugInfo(w) }, // SYM 行だけを読む
+	} {
+		var buf bytes.Buffer
+		if err := write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		syms, err := ReadSymFile(&buf, "test.sym")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := asm.Symbols()
+		if len(syms) != len(want) {
+			t.Fatalf("read %d symbols, want %d", len(syms), len(want))
+		}
+		for i, sym := range syms {
+			w := want[i]
+			if sym.Name != w.Name || sym.Value != w.Value || sym.Kind != w.Kind || sym.Def.File != w.Def.File || sym.Def.Line != w.Def.Line {
+				t.Errorf("symbol %d = %+v %+v, want %+v %+v", i, *sym, *sym.Def, *w, *w.Def)
+			}
+		}
+		labels := AddrLabels(syms)
+		if len(labels) != 3 || labels[0] != "START" || labels[1] != "LOOP" || labels[3] != "UNUSED" {
+			t.Errorf("AddrLabels = %v", labels)
+		}
+	}
+	for _, text := range []string{"START\t0\tlabel\ttest.td4\n", "START\tx\tlabel\ttest.td4\t1\n", "START\t0\tmacro\ttest.td4\t1\n"} {
+		if _, err := ReadSymFile(strings.NewReader(text), "bad.sym"); err == nil || !strings.HasPrefix(err.Error(), "bad.sym:1:") {
+			t.Errorf("ReadSymFile(%q) = %v, want an error at line 1", text, err)
+		}
+	}
+}
+
+func TestDisassembleLabel(t *testing.T) {
+	labels := map[int]string{0: "START", 1: "LOOP"}
+	tests := []struct {
+		b    uint8
+		want string
+	}{
+		{0xF0, "JMP START"},
+		{0xE1, "JNC LOOP"},
+		{0xF2, "JMP 2"},
+		{0xB1, "OUT 1"}, // ジャンプ以外の即値はラベルにしない
+		{0x01, "ADD A, 1"},
+	}
+	for _, tt := range tests {
+		if got := DisassembleLabel(tt.b, labels); got != tt.want {
+			t.Errorf("DisassembleLabel(0x%02X) = %q, want %q", tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+// 開いている文書のアセンブルと、LSPの各機能の結果の作成
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	"main/asm"
+)
+
+// document エディタで開いている文書と、そのアセンブル結果
+type document struct {
+	uri   string
+	path  string // ファイルのパス (INCLUDE の検索とエラーの位置の照合に使う)
+	lines []string
+	asm   *asm.Assembler
+	ok    bool // エラーなくアセンブルできた
+}
+
+// newDocument 文書をアセンブルする
+// エラーがなければ、td4lint と同じ検査も行う。
+func newDocument(uri, text string, includeDirs []string) *document {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	doc := &document{uri: uri, path: uriToPath(uri), lines: strings.Split(text, "\n")}
+	a := asm.NewAssembler(doc.path, doc.lines)
+	a.IncludeDirs = includeDirs
+	err1 := a.Pass1()
+	err2 := a.Pass2()
+	doc.ok = err1 == nil && err2 == nil
+	if doc.ok {
+		a.Lint()
+	}
+	doc.asm = a
+	return doc
+}
+
+// uriToPath "file://" のURIをファイルのパスに変換する
+func uriToPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return uri
+	}
+	path := u.Path
+	if runtime.GOOS == "windows" && len(path) >= 3 && path[0] == '/' && path[2] == ':' {
+		path = path[1:] // "/C:/..." -> "C:/..."
+	}
+	return filepath.FromSlash(path)
+}
+
+// pathToURI ファイルのパスを "file://" のURIに変換する
+func pathToURI(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	path = filepath.ToSlash(path)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path // Windowsのドライブ名
+	}
+	return (&url.URL{Scheme: "file", Path: path}).String()
+}
+
+// line 行の内容を返す (範囲外は空文字列)
+func (doc *document) line(n int) string {
+	if n < 0 || n >= len(doc.lines) {
+		return ""
+	}
+	return doc.lines[n]
+}
+
+// utf16Col 行の先頭からのバイト数を、UTF-16の桁数に変換する
+func utf16Col(line string, bytes int) int {
+	if bytes > len(line) {
+		bytes = len(line)
+	}
+	n := 0
+	for _, r := range line[:bytes] {
+		n += utf16.RuneLen(r)
+	}
+	return n
+}
+
+// byteCol UTF-16の桁数を、行の先頭からのバイト数に変換する
+func byteCol(line string, col int) int {
+	n := 0
+	for i, r := range line {
+		if n >= col {
+			return i
+		}
+		n += utf16.RuneLen(r)
+	}
+	return len(line)
+}
+
+// isWordChar 名前に使える文字であればtrueを返す
+func isWordChar(c byte) bool {
+	return c == '_' || c == '.' || c == '@' || c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z'
+}
+
+// wordAt 指定した位置の名前を返す。コメントの中と数値は対象外とする。
+func (doc *document) wordAt(pos Position) string {
+	line := doc.line(pos.Line)
+	i := byteCol(line, pos.Character)
+	if idx := strings.Index(line, ";"); idx != -1 && i >= idx {
+		return ""
+	}
+	start, end := i, i
+	for start > 0 && isWordChar(line[start-1]) {
+		start--
+	}
+	for end < len(line) && isWordChar(line[end]) {
+		end++
+	}
+	word := line[start:end]
+	if word == "" || word[0] >= '0' && word[0] <= '9' {
+		return "" // 数値
+	}
+	return word
+}
+
+// diagnostics アセンブル時のエラー・警告をLSPの形式で返す
+// INCLUDE したファイルのエラーは、INCLUDE を記述した行に表示する。
+func (doc *document) diagnostics() []Diagnostic {
+	diags := []Diagnostic{}
+	for _, d := range doc.asm.Diags.List {
+		line, col, length, msg := d.Line, d.Col, d.Len, d.Message
+		if d.File != doc.path {
+			line, col = 0, 0
+			for _, note := range d.Notes {
+				if note.File == doc.path {
+					line = note.Line
+					break
+				}
+			}
+			msg = fmt.Sprintf("%s:%d: %s", filepath.Base(d.File), d.Line, d.Message)
+		}
+		if line <= 0 {
+			line = 1 // ファイル全体に関するものは先頭行に表示する
+		}
+		text := doc.line(line - 1)
+		r := Range{Position{line - 1, 0}, Position{line - 1, utf16Col(text, len(text))}}
+		if col > 0 {
+			r.Start.Character = utf16Col(text, col-1)
+			r.End.Character = utf16Col(text, col-1+max(length, 1))
+		}
+		sev := severityWarning
+		if d.Severity == asm.SeverityError {
+			sev = severityError
+		}
+		diags = append(diags, Diagnostic{r, sev, "td4asm", msg})
+	}
+	return diags
+}
+
+// hover 名前の値と、行から生成した機械語を -list と同じ形式で返す
+func (doc *document) hover(pos Position) *Hover {
+	var b strings.Builder
+	if word := doc.wordAt(pos); word != "" {
+		if sym := doc.asm.LookupSymbol(word, doc.path, pos.Line+1); sym != nil {
+			fmt.Fprintf(&b, "**%s** (%s) = %d (0x%X, 0b%04b)  \n", sym.Name, sym.Kind, sym.Value, sym.Value, sym.Value)
+			fmt.Fprintf(&b, "defined at %s:%d\n\n", filepath.Base(sym.Def.File), sym.Def.Line)
+		} else if def := doc.asm.MacroDef(word); def != nil {
+			fmt.Fprintf(&b, "**%s** (macro)  \n", strings.ToUpper(word))
+			fmt.Fprintf(&b, "defined at %s:%d  \n`%s`\n\n", filepath.Base(def.File), def.Line, strings.TrimSpace(def.Text))
+		}
+	}
+	if codes := doc.asm.CodeAt(doc.path, pos.Line+1); len(codes) > 0 {
+		b.WriteString("```\n ADDR      | BINARY    | HEX | CODE\n")
+		for _, c := range codes {
+			fmt.Fprintf(&b, "%s | %s\n", c.ListingColumn(), c.Text)
+		}
+		b.WriteString("```\n")
+	}
+	if b.Len() == 0 {
+		return nil
+	}
+	return &Hover{MarkupContent{"markdown", b.String()}}
+}
+
+// definition ラベル・定数・マクロを定義した位置を返す
+func (doc *document) definition(pos Position) []Location {
+	word := doc.wordAt(pos)
+	if word == "" {
+		return nil
+	}
+	if sym := doc.asm.LookupSymbol(word, doc.path, pos.Line+1); sym != nil {
+		return []Location{doc.location(sym.Def, sym.Col, len(word))}
+	}
+	if def := doc.asm.MacroDef(word); def != nil {
+		return []Location{doc.location(def, 0, 0)}
+	}
+	return nil
+}
+
+// location ソースコードの行と桁位置をLSPの形式で返す
+func (doc *document) location(src *asm.SourceLine, col, length int) Location {
+	uri := doc.uri
+	if src.File != doc.path {
+		uri = pathToURI(src.File)
+	}
+	text := src.Text
+	r := Range{Position{src.Line - 1, 0}, Position{src.Line - 1, 0}}
+	if col > 0 {
+		r.Start.Character = utf16Col(text, col-1)
+		r.End.Character = utf16Col(text, col-1+length)
+	}
+	return Location{uri, r}
+}
+
+// registers 入力補完に使うレジスタ名
+var registers = []string{"A", "B"}
+
+// completion 命令・ディレクティブ・レジスタ名・マクロ・ラベル・定数の一覧を返す
+func (doc *document) completion() []CompletionItem {
+	var items []CompletionItem
+	for name := range asm.InstructionSet {
+		items = append(items, CompletionItem{name, kindKeyword, "instruction"})
+	}
+	for name := range asm.Directives {
+		items = append(items, CompletionItem{name, kindKeyword, "directive"})
+	}
+	for _, name := range doc.asm.MacroNames() {
+		items = append(items, CompletionItem{name, kindFunction, "macro"})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Label < items[j].Label })
+	for _, reg := range registers {
+		items = append(items, CompletionItem{reg, kindVariable, "register"})
+	}
+	for _, sym := range doc.asm.Symbols() {
+		if sym.Def.Macro != "" || strings.Contains(sym.Name, "@") {
+			continue // マクロの展開で生成されたラベル
+		}
+		name := sym.Name
+		if i := strings.Index(name, "."); i > 0 {
+			name = name[i:] // ローカルラベルは "." からの名前にする
+		}
+		kind := kindReference
+		if sym.Kind == asm.SymbolConst {
+			kind = kindConstant
+		}
+		items = append(items, CompletionItem{name, kind, fmt.Sprintf("%s = %d", sym.Kind, sym.Value)})
+	}
+	return items
+}
+
+// codeLens 先頭行に、ROMの使用量と残りのバイト数を表示する
+// ROMからはみ出した場合のエラーは、Pass1 がその行に報告する。
+func (doc *document) codeLens() []CodeLens {
+	used := doc.asm.UsedBytes()
+	title := fmt.Sprintf("ROM: %d/%d bytes used, %d bytes free", used, asm.ROMSize, max(asm.ROMSize-used, 0))
+	if !doc.ok {
+		title += " (assembly has errors)"
+	}
+	return []CodeLens{{Range{Position{0, 0}, Position{0, 0}}, &Command{title, ""}}}
+}
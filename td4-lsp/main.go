@@ -0,0 +1,198 @@
+package main
+
+// 4bitCPU td4用の Language Server
+// 標準入出力で Language Server Protocol (LSP) を話し、VS Code などのエディタに
+// エラー・警告の表示、ホバー、定義へのジャンプ、入力補完、ROMの残り容量の表示を提供します。
+// > go build -o td4-lsp.exe .
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// stringList 複数回指定できるオプションの値
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// server Language Server の状態
+type server struct {
+	conn        *conn
+	docs        map[string]*document // URIと開いている文書の対応
+	includeDirs []string
+	shutdown    bool // shutdown 要求を受け取った
+}
+
+func main() {
+	var includeDirs stringList
+	flag.Var(&includeDirs, "I", "INCLUDEするファイルを探すディレクトリ (複数指定可)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "TD4 Language Server\n")
+		fmt.Fprintf(os.Stderr, "エディタから起動され、標準入出力で Language Server Protocol を使って通信します。\n\n")
+		fmt.Fprintf(os.Stderr, "使い方:\n")
+		fmt.Fprintf(os.Stderr, "td4-lsp [オプション]\n\n")
+		fmt.Fprintf(os.Stderr, "オプション:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	// 標準出力はLSPのメッセージに使うので、ログは標準エラー出力へ出す。
+	log.SetOutput(os.Stderr)
+	log.SetPrefix("td4-lsp: ")
+
+	s := &server{
+		conn:        newConn(os.Stdin, os.Stdout),
+		docs:        make(map[string]*document),
+		includeDirs: includeDirs,
+	}
+	os.Exit(s.run())
+}
+
+// run メッセージを読み込んで処理する。終了コードを返す。
+func (s *server) run() int {
+	for {
+		msg, err := s.conn.read()
+		if err != nil {
+			if rerr, ok := err.(*responseError); ok { // JSONの誤りは応答して続ける
+				s.conn.write(&errorResponse{"2.0", nil, rerr})
+				continue
+			}
+			if err != io.EOF {
+				log.Printf("read error: %v", err)
+			}
+			return 1
+		}
+		if msg.Method == "exit" {
+			if s.shutdown {
+				return 0
+			}
+			return 1
+		}
+		result, rerr := s.handle(msg)
+		if msg.ID == nil {
+			if rerr != nil {
+				log.Printf("%s: %v", msg.Method, rerr)
+			}
+			continue // 通知には応答しない
+		}
+		if rerr != nil {
+			err = s.conn.write(&errorResponse{"2.0", msg.ID, rerr})
+		} else {
+			err = s.conn.write(&response{"2.0", msg.ID, result})
+		}
+		if err != nil {
+			log.Printf("write error: %v", err)
+			return 1
+		}
+	}
+}
+
+// handle 要求・通知を処理し、応答の結果を返す
+func (s *server) handle(msg *message) (interface{}, *responseError) {
+	// params 要求のパラメータを読み込む
+	params := func(v interface{}) *responseError {
+		if err := json.Unmarshal(msg.Params, v); err != nil {
+			return &responseError{codeInvalidParams, err.Error()}
+		}
+		return nil
+	}
+
+	switch msg.Method {
+	case "initialize":
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync":   1, // 変更のたびに文書全体を受け取る
+				"hoverProvider":      true,
+				"definitionProvider": true,
+				"completionProvider": map[string]interface{}{},
+				"codeLensProvider":   map[string]interface{}{"resolveProvider": false},
+			},
+			"serverInfo": map[string]string{"name": "td4-lsp"},
+		}, nil
+	case "initialized":
+		return nil, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+
+	case "textDocument/didOpen":
+		var p DidOpenParams
+		if err := params(&p); err != nil {
+			return nil, err
+		}
+		s.update(p.TextDocument.URI, p.TextDocument.Text)
+		return nil, nil
+	case "textDocument/didChange":
+		var p DidChangeParams
+		if err := params(&p); err != nil {
+			return nil, err
+		}
+		if n := len(p.ContentChanges); n > 0 {
+			s.update(p.TextDocument.URI, p.ContentChanges[n-1].Text)
+		}
+		return nil, nil
+	case "textDocument/didClose":
+		var p DidCloseParams
+		if err := params(&p); err != nil {
+			return nil, err
+		}
+		delete(s.docs, p.TextDocument.URI)
+		s.publish(p.TextDocument.URI, []Diagnostic{})
+		return nil, nil
+
+	case "textDocument/hover", "textDocument/definition", "textDocument/completion":
+		var p TextDocumentPositionParams
+		if err := params(&p); err != nil {
+			return nil, err
+		}
+		doc := s.docs[p.TextDocument.URI]
+		if doc == nil {
+			return nil, nil
+		}
+		switch msg.Method {
+		case "textDocument/hover":
+			return doc.hover(p.Position), nil
+		case "textDocument/definition":
+			return doc.definition(p.Position), nil
+		default:
+			return doc.completion(), nil
+		}
+	case "textDocument/codeLens":
+		var p CodeLensParams
+		if err := params(&p); err != nil {
+			return nil, err
+		}
+		if doc := s.docs[p.TextDocument.URI]; doc != nil {
+			return doc.codeLens(), nil
+		}
+		return []CodeLens{}, nil
+	}
+	if msg.ID == nil || strings.HasPrefix(msg.Method, "$/") {
+		return nil, nil // 対応していない通知は無視する
+	}
+	return nil, &responseError{codeMethodNotFound, "method not found: " + msg.Method}
+}
+
+// update 文書を更新してアセンブルし、エラー・警告をエディタに送る
+func (s *server) update(uri, text string) {
+	doc := newDocument(uri, text, s.includeDirs)
+	s.docs[uri] = doc
+	s.publish(uri, doc.diagnostics())
+}
+
+// publish エラー・警告をエディタに送る
+func (s *server) publish(uri string, diags []Diagnostic) {
+	if err := s.conn.write(&notification{"2.0", "textDocument/publishDiagnostics", PublishDiagnosticsParams{uri, diags}}); err != nil {
+		log.Printf("write error: %v", err)
+	}
+}
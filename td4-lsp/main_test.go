@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testServer テスト用のサーバーを作成する。送信したメッセージは out に書き込まれる。
+func testServer() (*server, *bytes.Buffer) {
+	out := &bytes.Buffer{}
+	return &server{conn: newConn(strings.NewReader(""), out), docs: make(map[string]*document)}, out
+}
+
+// call 要求を処理し、結果をJSONにして返す
+func call(t *testing.T, s *server, method string, params interface{}) string {
+	t.Helper()
+	raw, err := json.Marshal(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := json.RawMessage("1")
+	result, rerr := s.handle(&message{ID: &id, Method: method, Params: raw})
+	if rerr != nil {
+		t.Fatalf("%s: %v", method, rerr)
+	}
+	body, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+// readMessages サーバーが送信したメッセージをすべて読み込む
+func readMessages(t *testing.T, out *bytes.Buffer) []map[string]json.RawMessage {
+	t.Helper()
+	c := newConn(out, io.Discard)
+	var msgs []map[string]json.RawMessage
+	for {
+		header, err := c.r.ReadMIMEHeader()
+		if err == io.EOF {
+			return msgs
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		var n int
+		fmt.Sscan(header.Get("Content-Length"), &n)
+		body := make([]byte, n)
+		if _, err := io.ReadFull(c.r.R, body); err != nil {
+			t.Fatal(err)
+		}
+		var msg map[string]json.RawMessage
+		if err := json.Unmarshal(body, &msg); err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+	}
+}
+
+// open 文書を開き、送られたエラー・警告を返す
+func open(t *testing.T, s *server, out *bytes.Buffer, uri, text string) []Diagnostic {
+	t.Helper()
+	out.Reset()
+	call(t, s, "textDocument/didOpen", DidOpenParams{TextDocumentItem{uri, text}})
+	msgs := readMessages(t, out)
+	if len(msgs) != 1 {
+		t.Fatalf("got %d messages, want 1", len(msgs))
+	}
+	var p PublishDiagnosticsParams
+	if err := json.Unmarshal(msgs[0]["params"], &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.URI != uri {
+		t.Errorf("diagnostics for %q, want %q", p.URI, uri)
+	}
+	return p.Diagnostics
+}
+
+// testURI テストに使う文書のURI
+var testURI = pathToURI(filepath.Join("testdata", "test.td4"))
+
+const testSource = `N EQU 3
+START:
+    MOV A, N
+.LOOP:
+    ADD A, 1
+    JNC .LOOP
+    OUT B
+    JMP START`
+
+func TestDiagnostics(t *testing.T) {
+	s, out := testServer()
+	if diags := open(t, s, out, testURI, testSource); len(diags) != 0 {
+		t.Errorf("diagnostics = %+v, want none", diags)
+	}
+
+	diags := open(t, s, out, testURI, "    MOV A, 1\n    FOO B\n    JMP 0")
+	want := []Diagnostic{{Range{Position{1, 4}, Position{1, 7}}, severityError, "td4asm", "unknown instruction: FOO"}}
+	if fmt.Sprint(diags) != fmt.Sprint(want) {
+		t.Errorf("diagnostics = %+v, want %+v", diags, want)
+	}
+
+	// エラーがなければ td4lint の検査も行う
+	diags = open(t, s, out, testURI, "LOOP:\n    ADD A, 1\n    JMP LOOP")
+	if len(diags) != 1 || diags[0].Severity != severityWarning || !strings.Contains(diags[0].Message, "OUT is never executed") {
+		t.Errorf("diagnostics = %+v, want OUT warning", diags)
+	}
+
+	out.Reset()
+	call(t, s, "textDocument/didClose", DidCloseParams{TextDocumentIdentifier{testURI}})
+	msgs := readMessages(t, out)
+	if len(msgs) != 1 || string(msgs[0]["params"]) != fmt.Sprintf(`{"uri":%q,"diagnostics":[]}`, testURI) {
+		t.Errorf("didClose sent %v, want empty diagnostics", msgs)
+	}
+}
+
+func TestHover(t *testing.T) {
+	s, out := testServer()
+	open(t, s, out, testURI, testSource)
+	tests := []struct {
+		pos  Position
+		want []string
+	}{
+		{Position{2, 12}, []string{"**N** (const) = 3 (0x3, 0b0011)", "defined at test.td4:1", " 00 [0000] | 0011_0011 |  33 | MOV A, N"}},
+		{Position{5, 10}, []string{"**START.LOOP** (label) = 1", " 02 [0010] | 1110_0001 |  E1 | JNC .LOOP"}},
+		{Position{6, 4}, []string{" 03 [0011] | 1001_0000 |  90 | OUT B"}},
+	}
+	for _, tt := range tests {
+		got := call(t, s, "textDocument/hover", TextDocumentPositionParams{TextDocumentIdentifier{testURI}, tt.pos})
+		var h Hover
+		if err := json.Unmarshal([]byte(got), &h); err != nil {
+			t.Fatal(err)
+		}
+		for _, w := range tt.want {
+			if !strings.Contains(h.Contents.Value, w) {
+				t.Errorf("hover at %v = %q, want %q", tt.pos, h.Contents.Value, w)
+			}
+		}
+	}
+	if got := call(t, s, "textDocument/hover", TextDocumentPositionParams{TextDocumentIdentifier{testURI}, Position{20, 0}}); got != "null" {
+		t.Errorf("hover past the end = %s, want null", got)
+	}
+}
+
+func TestDefinition(t *testing.T) {
+	s, out := testServer()
+	open(t, s, out, testURI, testSource)
+	tests := []struct {
+		pos  Position
+		want string
+	}{
+		{Position{2, 12}, fmt.Sprintf(`[{"uri":%q,"range":{"start":{"line":0,"character":0},"end":{"line":0,"character":1}}}]`, testURI)},
+		{Position{5, 10}, fmt.Sprintf(`[{"uri":%q,"range":{"start":{"line":3,"character":0},"end":{"line":3,"character":5}}}]`, testURI)},
+		{Position{7, 10}, fmt.Sprintf(`[{"uri":%q,"range":{"start":{"line":1,"character":0},"end":{"line":1,"character":5}}}]`, testURI)},
+		{Position{4, 11}, "null"}, // 数値
+		{Position{6, 4}, "null"},  // 命令
+	}
+	for _, tt := range tests {
+		got := call(t, s, "textDocument/definition", TextDocumentPositionParams{TextDocumentIdentifier{testURI}, tt.pos})
+		if got != tt.want {
+			t.Errorf("definition at %v = %s, want %s", tt.pos, got, tt.want)
+		}
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	s, out := testServer()
+	open(t, s, out, testURI, "MACRO INC r\n    ADD r, 1\nENDM\n"+testSource)
+	got := call(t, s, "textDocument/completion", TextDocumentPositionParams{TextDocumentIdentifier{testURI}, Position{0, 0}})
+	var items []CompletionItem
+	if err := json.Unmarshal([]byte(got), &items); err != nil {
+		t.Fatal(err)
+	}
+	labels := make(map[string]CompletionItem)
+	for _, item := range items {
+		labels[item.Label] = item
+	}
+	want := []CompletionItem{
+		{"MOV", kindKeyword, "instruction"},
+		{"ORG", kindKeyword, "directive"},
+		{"INC", kindFunction, "macro"},
+		{"A", kindVariable, "register"},
+		{"N", kindConstant, "const = 3"},
+		{"START", kindReference, "label = 0"},
+		{".LOOP", kindReference, "label = 1"},
+	}
+	for _, w := range want {
+		if labels[w.Label] != w {
+			t.Errorf("completion %q = %+v, want %+v", w.Label, labels[w.Label], w)
+		}
+	}
+}
+
+func TestCodeLens(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		title  string
+		errors int
+	}{
+		{"used", testSource, "ROM: 5/16 bytes used, 11 bytes free", 0},
+		{"full", strings.Repeat("NOP\n", 15) + "JMP 0", "ROM: 16/16 bytes used, 0 bytes free", 0},
+		{"overflow", strings.Repeat("NOP\n", 17) + "JMP 0", "ROM: 18/16 bytes used, 0 bytes free (assembly has errors)", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, out := testServer()
+			diags := open(t, s, out, testURI, tt.src)
+			errors := 0
+			for _, d := range diags {
+				if d.Severity == severityError {
+					errors++
+				}
+			}
+			if errors != tt.errors {
+				t.Errorf("got %d errors, want %d: %+v", errors, tt.errors, diags)
+			}
+			got := call(t, s, "textDocument/codeLens", CodeLensParams{TextDocumentIdentifier{testURI}})
+			want := fmt.Sprintf(`[{"range":{"start":{"line":0,"character":0},"end":{"line":0,"character":0}},"command":{"title":%q,"command":""}}]`, tt.title)
+			if got != want {
+				t.Errorf("codeLens = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	var in bytes.Buffer
+	for _, body := range []string{
+		`{"jsonrpc":"2.0","id":1,"method":"initialize","params":{}}`,
+		`{"jsonrpc":"2.0","id":2,"method":"unknown/method"}`,
+		`{"jsonrpc":"2.0","method":"$/cancelRequest","params":{"id":1}}`,
+		`{"jsonrpc":"2.0","id":3,"method":"shutdown"}`,
+		`{"jsonrpc":"2.0","method":"exit"}`,
+	} {
+		fmt.Fprintf(&in, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	}
+	out := &bytes.Buffer{}
+	s := &server{conn: newConn(&in, out), docs: make(map[string]*document)}
+	if code := s.run(); code != 0 {
+		t.Errorf("exit code = %d, want 0", code)
+	}
+	msgs := readMessages(t, out)
+	if len(msgs) != 3 {
+		t.Fatalf("got %d messages, want 3", len(msgs))
+	}
+	if !strings.Contains(string(msgs[0]["result"]), `"codeLensProvider"`) {
+		t.Errorf("initialize result = %s", msgs[0]["result"])
+	}
+	if got := string(msgs[1]["error"]); got != `{"code":-32601,"message":"method not found: unknown/method"}` {
+		t.Errorf("unknown method error = %s", got)
+	}
+	if got := string(msgs[2]["result"]); got != "null" {
+		t.Errorf("shutdown result = %s, want null", got)
+	}
+}
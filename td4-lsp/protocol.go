@@ -0,0 +1,223 @@
+package main
+
+// JSON-RPC 2.0 のメッセージ と Language Server Protocol の型 (使用するものだけ)
+// メッセージは "Content-Length: n\r\n\r\n" のヘッダーに続けてJSON本文を送受信する。
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"sync"
+)
+
+// message 受信した要求・通知 (IDのないものが通知)
+type message struct {
+	ID     *json.RawMessage `json:"id"`
+	Method string           `json:"method"`
+	Params json.RawMessage  `json:"params"`
+}
+
+// response 要求に対する応答 (結果がない場合も "result": null を送る)
+type response struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id"`
+	Result  interface{}      `json:"result"`
+}
+
+// errorResponse 要求に対するエラー応答
+type errorResponse struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id"`
+	Error   *responseError   `json:"error"`
+}
+
+// notification サーバーから送る通知
+type notification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+// responseError 応答のエラー
+type responseError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// JSON-RPCのエラーコード
+const (
+	codeParseError     = -32700
+	codeMethodNotFound = -32601
+	codeInvalidParams  = -32602
+)
+
+// conn ヘッダー付きのJSONメッセージを読み書きする接続
+type conn struct {
+	r  *textproto.Reader
+	w  io.Writer
+	mu sync.Mutex
+}
+
+// newConn 接続を作成する
+func newConn(r io.Reader, w io.Writer) *conn {
+	return &conn{r: textproto.NewReader(bufio.NewReader(r)), w: w}
+}
+
+// read メッセージを1件読み込む
+func (c *conn) read() (*message, error) {
+	header, err := c.r.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid Content-Length: %q", header.Get("Content-Length"))
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(c.r.R, body); err != nil {
+		return nil, err
+	}
+	var msg message
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return nil, &responseError{codeParseError, err.Error()}
+	}
+	return &msg, nil
+}
+
+// write メッセージ (response, errorResponse, notification) を1件書き込む
+func (c *conn) write(msg interface{}) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := fmt.Fprintf(c.w, "Content-Length: %d\r\n\r\n", len(body)); err != nil {
+		return err
+	}
+	_, err = c.w.Write(body)
+	return err
+}
+
+// Error error インターフェースの実装
+func (e *responseError) Error() string { return e.Message }
+
+// Position 文書中の位置 (行・桁は0から始まる。桁はUTF-16の単位)
+type Position struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+// Range 文書中の範囲
+type Range struct {
+	Start Position `json:"start"`
+	End   Position `json:"end"`
+}
+
+// Location 文書と範囲
+type Location struct {
+	URI   string `json:"uri"`
+	Range Range  `json:"range"`
+}
+
+// Diagnostic エディタに表示するエラー・警告
+type Diagnostic struct {
+	Range    Range  `json:"range"`
+	Severity int    `json:"severity"` // 1:エラー 2:警告
+	Source   string `json:"source"`
+	Message  string `json:"message"`
+}
+
+// LSPのDiagnosticSeverity
+const (
+	severityError   = 1
+	severityWarning = 2
+)
+
+// LSPのCompletionItemKind
+const (
+	kindFunction  = 3
+	kindVariable  = 6
+	kindKeyword   = 14
+	kindReference = 18
+	kindConstant  = 21
+)
+
+// CompletionItem 入力補完の候補
+type CompletionItem struct {
+	Label  string `json:"label"`
+	Kind   int    `json:"kind"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// MarkupContent Markdown形式の表示内容
+type MarkupContent struct {
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+}
+
+// Hover ホバーの表示内容
+type Hover struct {
+	Contents MarkupContent `json:"contents"`
+}
+
+// Command コードレンズに表示するコマンド
+type Command struct {
+	Title   string `json:"title"`
+	Command string `json:"command"`
+}
+
+// CodeLens コードレンズ
+type CodeLens struct {
+	Range   Range    `json:"range"`
+	Command *Command `json:"command,omitempty"`
+}
+
+// TextDocumentItem didOpen で送られる文書
+type TextDocumentItem struct {
+	URI  string `json:"uri"`
+	Text string `json:"text"`
+}
+
+// TextDocumentIdentifier 文書の指定
+type TextDocumentIdentifier struct {
+	URI string `json:"uri"`
+}
+
+// TextDocumentPositionParams 文書と位置を指定する要求のパラメータ
+type TextDocumentPositionParams struct {
+	TextDocument TextDocumentIdentifier `json:"textDocument"`
+	Position     Position               `json:"position"`
+}
+
+// DidOpenParams textDocument/didOpen のパラメータ
+type DidOpenParams struct {
+	TextDocument TextDocumentItem `json:"textDocument"`
+}
+
+// DidChangeParams textDocument/didChange のパラメータ (文書全体を送る同期方式)
+type DidChangeParams struct {
+	TextDocument   TextDocumentIdentifier `json:"textDocument"`
+	ContentChanges []struct {
+		Text string `json:"text"`
+	} `json:"contentChanges"`
+}
+
+// DidCloseParams textDocument/didClose のパラメータ
+type DidCloseParams struct {
+	TextDocument TextDocumentIdentifier `json:"textDocument"`
+}
+
+// CodeLensParams textDocument/codeLens のパラメータ
+type CodeLensParams struct {
+	TextDocument TextDocumentIdentifier `json:"textDocument"`
+}
+
+// PublishDiagnosticsParams textDocument/publishDiagnostics のパラメータ
+type PublishDiagnosticsParams struct {
+	URI         string       `json:"uri"`
+	Diagnostics []Diagnostic `json:"diagnostics"`
+}
@@ -0,0 +1,163 @@
+// Package td4 4bitCPU td4 のCPUコア
+// レジスタ・ROM・入出力ポートの状態と、命令の実行だけを行う。ファイル・標準入出力・コマンドライン引数には依存しないので、
+// td4emu のほか、WebAssembly版 (td4wasm) などからも使用できる。
+package td4
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Variant 命令セットの動作の違い (キャリーフラグの扱い)
+type Variant int
+
+const (
+	VariantEmu      Variant = iota // td4emu と同じ: ADD で変化し、JMP・JNC で0になり、それ以外の命令では変化しない
+	VariantHardware                // 実機と同じ: ALUの桁上がりを毎クロック取り込むので、ADD 以外の命令では0になる
+)
+
+// variantNames 命令セットの名前 (-isa オプションで指定する)
+var variantNames = []string{"td4emu", "hardware"}
+
+// String 命令セットの名前を返す
+func (v Variant) String() string {
+	if int(v) < len(variantNames) {
+		return variantNames[v]
+	}
+	return fmt.Sprintf("Variant(%d)", int(v))
+}
+
+// ParseVariant 名前から命令セットを返す
+func ParseVariant(name string) (Variant, error) {
+	for i, n := range variantNames {
+		if n == name {
+			return Variant(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown ISA variant %q (%s)", name, VariantNames())
+}
+
+// VariantNames 命令セットの名前の一覧をカンマ区切りで返す
+func VariantNames() string {
+	return strings.Join(variantNames, ", ")
+}
+
+// CPU 構造体: TD4の内部状態を保持
+type CPU struct {
+	A, B    uint8     // 4bit レジスタ
+	PC      uint8     // 4bit プログラムカウンタ
+	BP      uint8     // 4bit ブレイクポイント
+	Breaks  [16]bool  // BP以外に追加したブレイクポイント (GDB等から複数設定する)
+	C       bool      // キャリーフラグ
+	OutPort uint8     // 4bit 出力ポート
+	InPort  uint8     // 4bit 入力ポート
+	ROM     [16]uint8 // 16バイトのプログラムメモリ
+	Variant Variant   // 命令セットの動作
+}
+
+// NewCPU CPUの初期化
+func NewCPU() *CPU {
+	return &CPU{
+		ROM: [16]uint8{}, // ゼロ初期化 (NOP)
+		BP:  255,         // Break point 0-15以外の値は未設定の状態
+	}
+}
+
+// Reset PC・レジスタ・キャリーフラグ・出力ポートを0にする (ROM・入力ポート・ブレイクポイントはそのまま)
+func (cpu *CPU) Reset() {
+	cpu.PC, cpu.A, cpu.B, cpu.C, cpu.OutPort = 0, 0, 0, false, 0
+}
+
+// IsBreakpoint 指定したアドレスにブレイクポイントが設定されていればtrueを返す
+func (cpu *CPU) IsBreakpoint(adr uint8) bool {
+	return adr == cpu.BP || cpu.Breaks[adr&0x0F]
+}
+
+// Execute 1命令実行サイクル
+func (cpu *CPU) Execute() int {
+	if cpu.IsBreakpoint(cpu.PC) { // ブレイクポイントなら、ここで1を返して終了する。
+		return 1
+	}
+	cpu.Step()
+	return 0
+}
+
+// Step ブレイクポイントに関係なく1命令実行する
+func (cpu *CPU) Step() {
+	// フェッチ
+	opcode := cpu.ROM[cpu.PC]
+	// 次のPCを仮計算 (通常は PC+1, 15を超えたら0に戻る)
+	nextPC := (cpu.PC + 1) & 0x0F
+	// 下位4ビット（即値 Im）
+	im := opcode & 0x0F
+
+	// 上位4ビットで命令判定するか、特定のビットパターンで判定
+	// TD4の命令デコードロジック
+	switch {
+	// ADD A, Im (0000xxxx)
+	case (opcode & 0xF0) == 0x00:
+		res := uint16(cpu.A) + uint16(im)
+		cpu.A = uint8(res & 0x0F)
+		cpu.C = res > 15 // キャリー発生判定
+
+	// ADD B, Im (0101xxxx)
+	case (opcode & 0xF0) == 0x50:
+		res := uint16(cpu.B) + uint16(im)
+		cpu.B = uint8(res & 0x0F)
+		cpu.C = res > 15 // キャリー発生判定
+
+	// MOV A, B (00010000) - 0x10
+	case opcode == 0x10:
+		cpu.A = cpu.B
+
+	// MOV B, A (01000000) - 0x40
+	case opcode == 0x40:
+		cpu.B = cpu.A
+
+	// MOV A, Im (0011xxxx)
+	case (opcode & 0xF0) == 0x30:
+		cpu.A = im
+
+	// MOV B, Im (0111xxxx)
+	case (opcode & 0xF0) == 0x70:
+		cpu.B = im
+
+	// JMP Im (1111xxxx)
+	case (opcode & 0xF0) == 0xF0:
+		nextPC = im   // ジャンプ成立時はPCを書き換え
+		cpu.C = false // ※TD4仕様: JMPでCフラグは変化しないことが多いが、実装によってはリセットする場合もある。
+		// ここでは標準的なTD4仕様に従い、Cフラグは保持すべきだが、
+		// 一般的な解説ではJMPでCが変わる記述はないため、保持します。
+		// (ただし、元のCソース実装などでCがリセットされる場合もあるので注意)
+
+	// JNC Im (1110xxxx) - Jump if Not Carry
+	case (opcode & 0xF0) == 0xE0:
+		if !cpu.C {
+			nextPC = im
+		}
+		cpu.C = false // JNC命令実行後は通常Cフラグはクリアされませんが、
+		// 次の演算まで保持されるべきです。ここでは何もしないのが正解。
+
+	// IN A (00100000)
+	case opcode == 0x20:
+		cpu.A = cpu.InPort
+
+	// IN B (01100000)
+	case opcode == 0x60:
+		cpu.B = cpu.InPort
+
+	// OUT B (10010000)
+	case opcode == 0x90:
+		cpu.OutPort = cpu.B
+
+	// OUT Im (1011xxxx)
+	case (opcode & 0xF0) == 0xB0:
+		cpu.OutPort = im
+	}
+	// 実機では ADD 以外の命令で桁上がりは起きないので、キャリーフラグは0になる
+	if cpu.Variant == VariantHardware && opcode&0xF0 != 0x00 && opcode&0xF0 != 0x50 {
+		cpu.C = false
+	}
+	// PC更新
+	cpu.PC = nextPC
+}
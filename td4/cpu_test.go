@@ -0,0 +1,174 @@
+package td4
+
+import "testing"
+
+// state テストで比べるCPUの状態
+type state struct {
+	A, B, PC, Out uint8
+	C             bool
+}
+
+func (cpu *CPU) state() state {
+	return state{cpu.A, cpu.B, cpu.PC, cpu.OutPort, cpu.C}
+}
+
+// stepTest 1命令の実行結果のテストケース
+type stepTest struct {
+	name   string
+	opcode uint8
+	before state // 実行前の状態 (PCは3、入力ポートは0b1010とする)
+	after  state
+}
+
+var stepTests = []stepTest{
+	{"ADD A, Im", 0x03, state{A: 5}, state{A: 8, PC: 4}},
+	{"ADD A, Im carry", 0x0F, state{A: 1}, state{A: 0, PC: 4, C: true}},
+	{"ADD B, Im", 0x52, state{B: 14}, state{B: 0, PC: 4, C: true}},
+	{"MOV A, B", 0x10, state{B: 7}, state{A: 7, B: 7, PC: 4}},
+	{"MOV B, A", 0x40, state{A: 9}, state{A: 9, B: 9, PC: 4}},
+	{"MOV A, Im", 0x3C, state{A: 1}, state{A: 12, PC: 4}},
+	{"MOV B, Im", 0x7C, state{}, state{B: 12, PC: 4}},
+	{"IN A", 0x20, state{}, state{A: 10, PC: 4}},
+	{"IN B", 0x60, state{}, state{B: 10, PC: 4}},
+	{"OUT B", 0x90, state{B: 6}, state{B: 6, Out: 6, PC: 4}},
+	{"OUT Im", 0xB5, state{}, state{Out: 5, PC: 4}},
+	{"JMP", 0xF9, state{}, state{PC: 9}},
+	{"JNC jump", 0xE9, state{}, state{PC: 9}},
+	{"JNC no jump", 0xE9, state{C: true}, state{PC: 4}},
+	{"NOP", 0x00, state{}, state{PC: 4}},
+}
+
+// runStep before の状態で opcode を1つ実行する
+func runStep(v Variant, opcode uint8, before state) *CPU {
+	cpu := NewCPU()
+	cpu.Variant = v
+	cpu.A, cpu.B, cpu.OutPort, cpu.C = before.A, before.B, before.Out, before.C
+	cpu.PC, cpu.InPort = 3, 0b1010
+	cpu.ROM[3] = opcode
+	cpu.Step()
+	return cpu
+}
+
+func TestStep(t *testing.T) {
+	for _, tt := range stepTests {
+		if got := runStep(VariantEmu, tt.opcode, tt.before).state(); got != tt.after {
+			t.Errorf("%s: %+v, want %+v", tt.name, got, tt.after)
+		}
+	}
+}
+
+func TestPCWraps(t *testing.T) {
+	cpu := NewCPU()
+	cpu.PC = 15
+	cpu.Step()
+	if cpu.PC != 0 {
+		t.Errorf("PC after address 15 = %d, want 0", cpu.PC)
+	}
+}
+
+func TestBreakpoints(t *testing.T) {
+	cpu := NewCPU()
+	cpu.ROM = [16]uint8{0x01, 0x01, 0x01, 0xF0}
+	cpu.BP = 2
+	cpu.Breaks[3] = true
+	for i, want := range []int{0, 0, 1, 1} { // ブレイクポイントでは実行せずに1を返す
+		if got := cpu.Execute(); got != want {
+			t.Errorf("Execute %d = %d, want %d", i, got, want)
+		}
+	}
+	if cpu.PC != 2 || cpu.A != 2 {
+		t.Errorf("PC=%d A=%d, want a stop at address 2 with A=2", cpu.PC, cpu.A)
+	}
+	cpu.Step() // Step はブレイクポイントでも実行する
+	if cpu.Execute() != 1 || cpu.PC != 3 {
+		t.Errorf("PC=%d, want a stop at the breakpoint 3 from Breaks", cpu.PC)
+	}
+	if cpu.IsBreakpoint(4) || !cpu.IsBreakpoint(3) || !cpu.IsBreakpoint(2) {
+		t.Error("IsBreakpoint does not match BP and Breaks")
+	}
+}
+
+func TestReset(t *testing.T) {
+	cpu := NewCPU()
+	cpu.A, cpu.B, cpu.PC, cpu.C, cpu.OutPort, cpu.InPort, cpu.BP = 1, 2, 3, true, 4, 5, 6
+	cpu.ROM[0] = 0xB1
+	cpu.Reset()
+	if cpu.state() != (state{}) || cpu.InPort != 5 || cpu.BP != 6 || cpu.ROM[0] != 0xB1 {
+		t.Errorf("after Reset: %+v", *cpu)
+	}
+}
+
+// TestVariants キャリーフラグが1の状態で各命令を実行し、命令セットごとのキャリーフラグの扱いを確かめる
+func TestVariants(t *testing.T) {
+	tests := []struct {
+		name      string
+		opcode    uint8
+		emu, hard bool // 実行後のキャリーフラグ
+	}{
+		{"ADD A, Im", 0x01, false, false},
+		{"ADD A, Im carry", 0x0F, true, true},
+		{"ADD B, Im carry", 0x5F, true, true},
+		{"MOV A, B", 0x10, true, false},
+		{"MOV B, A", 0x40, true, false},
+		{"MOV A, Im", 0x31, true, false},
+		{"MOV B, Im", 0x71, true, false},
+		{"IN A", 0x20, true, false},
+		{"IN B", 0x60, true, false},
+		{"OUT B", 0x90, true, false},
+		{"OUT Im", 0xB1, true, false},
+		{"JMP", 0xF0, false, false},
+		{"JNC", 0xE0, false, false},
+	}
+	for _, tt := range tests {
+		for _, v := range []struct {
+			variant Variant
+			want    bool
+		}{{VariantEmu, tt.emu}, {VariantHardware, tt.hard}} {
+			cpu := runStep(v.variant, tt.opcode, state{A: 1, B: 1, C: true})
+			if cpu.C != v.want {
+				t.Errorf("%s (%v): C = %v, want %v", tt.name, v.variant, cpu.C, v.want)
+			}
+		}
+	}
+	// キャリーフラグ以外の動作は同じ
+	for _, tt := range stepTests {
+		emu, hard := runStep(VariantEmu, tt.opcode, tt.before).state(), runStep(VariantHardware, tt.opcode, tt.before).state()
+		emu.C, hard.C = false, false
+		if emu != hard {
+			t.Errorf("%s: td4emu %+v, hardware %+v", tt.name, emu, hard)
+		}
+	}
+}
+
+// TestVariantCarryLoop ADD・JNC の間に命令を挟んだループは、命令セットによって回数が変わる
+func TestVariantCarryLoop(t *testing.T) {
+	// MOV A, 14 / loop: ADD A, 1 / OUT 1 / JNC loop / OUT 2 / JMP $
+	rom := [16]uint8{0x3E, 0x01, 0xB1, 0xE1, 0xB2, 0xF5}
+	for _, tt := range []struct {
+		variant Variant
+		out     uint8
+	}{{VariantEmu, 2}, {VariantHardware, 1}} { // 実機では OUT 1 でキャリーフラグが0になり、ループを抜けない
+		cpu := NewCPU()
+		cpu.Variant, cpu.ROM = tt.variant, rom
+		for i := 0; i < 20; i++ {
+			cpu.Step()
+		}
+		if cpu.OutPort != tt.out {
+			t.Errorf("%v: OUT = %d, want %d", tt.variant, cpu.OutPort, tt.out)
+		}
+	}
+}
+
+func TestParseVariant(t *testing.T) {
+	for _, v := range []Variant{VariantEmu, VariantHardware} {
+		if got, err := ParseVariant(v.String()); err != nil || got != v {
+			t.Errorf("ParseVariant(%q) = %v, %v", v.String(), got, err)
+		}
+	}
+	if _, err := ParseVariant("z80"); err == nil {
+		t.Error("ParseVariant(z80) succeeded")
+	}
+	if VariantNames() != "td4emu, hardware" || Variant(9).String() != "Variant(9)" {
+		t.Errorf("VariantNames = %q, Variant(9) = %q", VariantNames(), Variant(9).String())
+	}
+}
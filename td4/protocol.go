@@ -0,0 +1,90 @@
+package td4
+
+// モニタのプロトコルモード (PROTO JSON コマンド) の応答とイベント
+// td4emu と TinyGo版 (td4emu_tinygo) で共通の形式なので、ホストのプログラムはどちらのエミュレータも同じように操作できる。
+// 1つのコマンドに必ず1行の応答 (type が ok または error) を返し、連続実行中は step, break のイベントを送る。
+//   {"seq":3,"type":"ok","cmd":"T 2","trace":[{...},{...}],"state":{"pc":2,...},"rom":[...],"speed":0,"running":false}
+//   {"seq":4,"type":"error","cmd":"X","error":"unknown command: X (H for help)","state":{...},...}
+//   {"seq":5,"type":"event","event":"step","state":{...},"speed":0,"running":true}
+// seq は応答とイベントの通し番号で、1ずつ増えるので、受け取れなかった行を検出できる。
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ProtoState プロトコルモードで送るCPUの状態
+type ProtoState struct {
+	PC  int  `json:"pc"`
+	OP  int  `json:"op"` // PC の番地の命令
+	A   int  `json:"a"`
+	B   int  `json:"b"`
+	C   bool `json:"c"`
+	In  int  `json:"in"`
+	Out int  `json:"out"`
+	BP  int  `json:"bp"` // モニタの B コマンドのブレークポイント (なければ -1)
+}
+
+// ProtoMessage プロトコルモードの応答とイベント
+type ProtoMessage struct {
+	Seq     int          `json:"seq"`
+	Type    string       `json:"type"`            // "ok", "error", "event"
+	Event   string       `json:"event,omitempty"` // ready, step, break, exit
+	Cmd     string       `json:"cmd,omitempty"`   // 応答したコマンド
+	Error   string       `json:"error,omitempty"`
+	Output  []string     `json:"output,omitempty"` // テキストモードで表示する内容 (状態の表を除く)
+	Trace   []ProtoState `json:"trace,omitempty"`  // コマンドで表示した状態 (T コマンドでは1命令ごと)
+	State   ProtoState   `json:"state"`
+	ROM     []int        `json:"rom,omitempty"` // 応答にだけ含める
+	Speed   int64        `json:"speed"`
+	Running bool         `json:"running"` // 連続実行中ならtrue
+}
+
+// ProtoState 現在の状態を返す
+func (cpu *CPU) ProtoState() ProtoState {
+	s := ProtoState{
+		PC: int(cpu.PC), OP: int(cpu.ROM[cpu.PC&0x0F]), A: int(cpu.A), B: int(cpu.B), C: cpu.C,
+		In: int(cpu.InPort), Out: int(cpu.OutPort), BP: -1,
+	}
+	if int(cpu.BP) < len(cpu.ROM) {
+		s.BP = int(cpu.BP)
+	}
+	return s
+}
+
+// Protocol プロトコルモードの送信の状態 (モニタごとに1つ持つ)
+type Protocol struct {
+	Trace []ProtoState // 実行中のコマンドが表示した状態 (Response で応答に含める)
+	seq   int
+}
+
+// Response コマンドの応答を作る。output はコマンドが表示した内容で、1行ずつ Output に入れる。
+// State, Speed, Running は送る側で設定する。
+func (p *Protocol) Response(cpu *CPU, line, output string, err error) ProtoMessage {
+	msg := ProtoMessage{Type: "ok", Cmd: strings.TrimSpace(line), Trace: p.Trace, ROM: make([]int, len(cpu.ROM))}
+	if err != nil {
+		msg.Type, msg.Error = "error", err.Error()
+	}
+	for _, s := range strings.Split(strings.TrimRight(output, "\n"), "\n") {
+		if s != "" {
+			msg.Output = append(msg.Output, s)
+		}
+	}
+	for adr, b := range cpu.ROM {
+		msg.ROM[adr] = int(b)
+	}
+	return msg
+}
+
+// Send 応答またはイベントに通し番号を付けて、1行のJSONで書き込む
+func (p *Protocol) Send(w io.Writer, msg ProtoMessage) {
+	p.seq++
+	msg.Seq = p.seq
+	data, err := json.Marshal(msg)
+	if err != nil {
+		data = []byte(fmt.Sprintf(`{"seq":%d,"type":"error","error":%q}`, p.seq, err.Error()))
+	}
+	fmt.Fprintf(w, "%s\n", data)
+}
@@ -0,0 +1,106 @@
+package td4
+
+// CPUの状態のスナップショット (モニタの SAVE, LOAD コマンド)
+// td4emu と TinyGo版 (td4emu_tinygo) で共通のJSON形式なので、どちらで保存したものも読み込める。
+//   {"format":"td4-snapshot","version":1,"rom":[...16個...],"a":0,"b":0,"c":false,
+//    "pc":0,"in":0,"out":0,"breakpoints":[7],"speed":1000}
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// スナップショットの形式と版 (項目を変更したら版を上げる)
+const (
+	SnapshotFormat  = "td4-snapshot"
+	SnapshotVersion = 1
+)
+
+// Snapshot CPUの状態 (ROM・レジスタ・フラグ・ポート・ブレークポイント・実行速度)
+// []uint8 はJSONではBase64の文字列になるので、ROMは数値の配列にする。
+type Snapshot struct {
+	Format      string `json:"format"`
+	Version     int    `json:"version"`
+	ROM         []int  `json:"rom"`
+	A           int    `json:"a"`
+	B           int    `json:"b"`
+	C           bool   `json:"c"`
+	PC          int    `json:"pc"`
+	In          int    `json:"in"`
+	Out         int    `json:"out"`
+	Breakpoints []int  `json:"breakpoints"` // 先頭がモニタの B コマンドのブレークポイント
+	Speed       int64  `json:"speed"`       // 1命令ごとの待ち時間 (ms)
+}
+
+// Snapshot 現在の状態を返す
+func (cpu *CPU) Snapshot(speed int64) Snapshot {
+	s := Snapshot{
+		Format: SnapshotFormat, Version: SnapshotVersion, ROM: make([]int, len(cpu.ROM)),
+		A: int(cpu.A), B: int(cpu.B), C: cpu.C, PC: int(cpu.PC), In: int(cpu.InPort), Out: int(cpu.OutPort),
+		Breakpoints: []int{}, Speed: speed,
+	}
+	for adr, b := range cpu.ROM {
+		s.ROM[adr] = int(b)
+	}
+	if int(cpu.BP) < len(cpu.ROM) {
+		s.Breakpoints = append(s.Breakpoints, int(cpu.BP))
+	}
+	for adr, on := range cpu.Breaks {
+		if on && uint8(adr) != cpu.BP {
+			s.Breakpoints = append(s.Breakpoints, adr)
+		}
+	}
+	return s
+}
+
+// Restore スナップショットの状態に戻す
+func (cpu *CPU) Restore(s Snapshot) error {
+	if !strings.EqualFold(s.Format, SnapshotFormat) {
+		return fmt.Errorf("not a TD4 snapshot (format %q)", s.Format)
+	}
+	if s.Version < 1 || s.Version > SnapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d (this emulator reads up to %d)", s.Version, SnapshotVersion)
+	}
+	if len(s.ROM) > len(cpu.ROM) {
+		return fmt.Errorf("snapshot ROM has %d bytes; this system has only %d bytes", len(s.ROM), len(cpu.ROM))
+	}
+	for _, b := range s.ROM {
+		if b < 0 || b > 255 {
+			return fmt.Errorf("snapshot ROM value %d is out of range (0-255)", b)
+		}
+	}
+	for _, v := range append([]int{s.A, s.B, s.PC, s.In, s.Out}, s.Breakpoints...) {
+		if v < 0 || v > 15 {
+			return fmt.Errorf("snapshot value %d is out of range (0-15)", v)
+		}
+	}
+	if s.Speed < 0 {
+		return fmt.Errorf("snapshot speed %d is negative", s.Speed)
+	}
+	cpu.ROM = [16]uint8{}
+	for adr, b := range s.ROM {
+		cpu.ROM[adr] = uint8(b)
+	}
+	cpu.A, cpu.B, cpu.C, cpu.PC = uint8(s.A), uint8(s.B), s.C, uint8(s.PC)
+	cpu.InPort, cpu.OutPort = uint8(s.In), uint8(s.Out)
+	cpu.BP, cpu.Breaks = 255, [16]bool{}
+	for i, adr := range s.Breakpoints {
+		if i == 0 {
+			cpu.BP = uint8(adr)
+		} else {
+			cpu.Breaks[adr] = true
+		}
+	}
+	return nil
+}
+
+// ReadSnapshot スナップショットを読み込む
+func ReadSnapshot(r io.Reader) (Snapshot, error) {
+	var s Snapshot
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return s, fmt.Errorf("invalid snapshot: %v", err)
+	}
+	return s, nil
+}
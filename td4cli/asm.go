@@ -0,0 +1,103 @@
+package main
+
+// td4 asm: アセンブルして、HEX形式・リスト・シンボル表などを出力する
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"main/asm"
+)
+
+// asmFlags asm サブコマンドのオプション
+var asmFlags struct {
+	output      string
+	list        bool
+	sym         bool
+	dbg         string
+	pad         bool
+	werror      bool
+	wunused     bool
+	includeDirs stringList
+	defines     stringList
+}
+
+func setupAsm(fs *flag.FlagSet) {
+	fs.StringVar(&asmFlags.output, "o", "", "HEX形式でファイルに保存する (省略時は標準出力に出力する)")
+	fs.BoolVar(&asmFlags.list, "list", false, "アドレス・機械語・ソースコードの対応表を表示する")
+	fs.BoolVar(&asmFlags.sym, "sym", false, "シンボル表(ラベル・定数の一覧)を表示する")
+	fs.StringVar(&asmFlags.dbg, "dbg", "", "デバッグ情報をファイルに保存する")
+	fs.BoolVar(&asmFlags.pad, "pad", false, "出力をROM容量(-rom)まで0で埋める")
+	fs.BoolVar(&asmFlags.werror, "Werror", false, "警告をエラーとして扱う")
+	fs.BoolVar(&asmFlags.wunused, "Wunused", false, "参照されていないラベルを警告する")
+	fs.Var(&asmFlags.includeDirs, "I", "INCLUDEするファイルを探すディレクトリ (複数指定可)")
+	fs.Var(&asmFlags.defines, "D", "定数を定義する NAME=値 (値を省略すると1, 複数指定可)")
+}
+
+// asmResult -format json のときの出力
+type asmResult struct {
+	Start int     `json:"start"`
+	ROM   []uint8 `json:"rom"` // []uint8 はBase64になるので、数値の配列として出力する
+	Size  int     `json:"size"`
+}
+
+func runAsm(fs *flag.FlagSet) int {
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+	a := assembleFile(fs.Arg(0), asmFlags.includeDirs, asmFlags.defines, asmFlags.werror, asmFlags.wunused)
+	if a == nil {
+		return exitFail
+	}
+	start, image := a.Image(asmFlags.pad)
+	if asmFlags.pad {
+		image = image[:opts.romSize] // Image は16バイトまで埋める
+	}
+
+	if asmFlags.dbg != "" {
+		if err := writeFile(asmFlags.dbg, a.WriteDebugInfo); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return exitFail
+		}
+	}
+	if asmFlags.output != "" {
+		if err := writeFile(asmFlags.output, func(w io.Writer) error { return asm.WriteHex(w, start, image) }); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return exitFail
+		}
+	}
+	switch {
+	case asmFlags.list:
+		a.WriteListing(os.Stdout)
+	case asmFlags.sym:
+		a.WriteSymbols(os.Stdout, false)
+	case asmFlags.output != "":
+		// ファイルに保存した場合は何も表示しない
+	case jsonOutput():
+		rom := make([]int, len(image))
+		for i, b := range image {
+			rom[i] = int(b)
+		}
+		writeJSON(map[string]interface{}{"start": start, "rom": rom, "size": a.CodeSize()})
+	default:
+		asm.WriteHex(os.Stdout, start, image)
+		fmt.Println()
+	}
+	return exitOK
+}
+
+// writeFile ファイルを作成して書き込む
+func writeFile(name string, write func(w io.Writer) error) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
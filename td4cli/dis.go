@@ -0,0 +1,112 @@
+package main
+
+// td4 dis: ROMの内容を逆アセンブルする
+// シンボルファイル (td4asm -symfile) かデバッグ情報ファイル (-dbg) があれば、ラベル名も表示する。
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"main/asm"
+)
+
+// disFlags dis サブコマンドのオプション
+var disFlags struct {
+	sym string
+}
+
+func setupDis(fs *flag.FlagSet) {
+	fs.StringVar(&disFlags.sym, "sym", "", "ラベル名を読み込むシンボルファイル (td4asm -symfile, -dbg の出力)。省略時はHEXファイルと同じ名前の .sym, .dbg を探す")
+}
+
+// disLine 逆アセンブルした1行 (-format json)
+type disLine struct {
+	Addr  int    `json:"addr"`
+	Byte  int    `json:"byte"`
+	Label string `json:"label,omitempty"`
+	Text  string `json:"text"`
+}
+
+func runDis(fs *flag.FlagSet) int {
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+	rom, a, ok := loadROM(fs.Arg(0))
+	if !ok {
+		return exitFail
+	}
+	labels, ok := loadLabels(fs.Arg(0), a)
+	if !ok {
+		return exitFail
+	}
+	lines := []disLine{}
+	for adr := 0; adr < opts.romSize; adr++ {
+		lines = append(lines, disLine{adr, int(rom[adr]), labels[adr], asm.DisassembleLabel(rom[adr], labels)})
+	}
+	if jsonOutput() {
+		writeJSON(lines)
+		return exitOK
+	}
+	if len(labels) == 0 {
+		fmt.Fprintf(os.Stdout, "ADDR HEX BINARY    CODE\n")
+		for _, l := range lines {
+			fmt.Fprintf(os.Stdout, "%X    %02X  %04b_%04b %s\n", l.Addr, l.Byte, l.Byte>>4, l.Byte&15, l.Text)
+		}
+		return exitOK
+	}
+	width := len("LABEL")
+	for _, l := range lines {
+		width = max(width, len(l.Label)+1)
+	}
+	fmt.Fprintf(os.Stdout, "ADDR HEX BINARY    %-*s CODE\n", width, "LABEL")
+	for _, l := range lines {
+		label := l.Label
+		if label != "" {
+			label += ":"
+		}
+		fmt.Fprintf(os.Stdout, "%X    %02X  %04b_%04b %-*s %s\n", l.Addr, l.Byte, l.Byte>>4, l.Byte&15, width, label, l.Text)
+	}
+	return exitOK
+}
+
+// loadLabels アドレスとラベル名の対応表を返す
+// ソースコードをアセンブルした場合はそのシンボルを、HEXファイルの場合は -sym か同じ名前の .sym, .dbg ファイルを使う。
+func loadLabels(path string, a *asm.Assembler) (map[int]string, bool) {
+	name := disFlags.sym
+	if name == "" {
+		if a != nil {
+			return asm.AddrLabels(a.Symbols()), true
+		}
+		for _, ext := range []string{".sym", ".dbg"} {
+			if p := strings.TrimSuffix(path, filepath.Ext(path)) + ext; fileExists(p) {
+				name = p
+				break
+			}
+		}
+		if name == "" {
+			return nil, true
+		}
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return nil, false
+	}
+	defer f.Close()
+	syms, err := asm.ReadSymFile(f, name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return nil, false
+	}
+	return asm.AddrLabels(syms), true
+}
+
+// fileExists ファイルが存在すればtrueを返す
+func fileExists(name string) bool {
+	info, err := os.Stat(name)
+	return err == nil && !info.IsDir()
+}
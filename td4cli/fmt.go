@@ -0,0 +1,87 @@
+package main
+
+// td4 fmt: ソースコードを整形する (td4fmt と同じ)
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"main/asm"
+)
+
+// fmtFlags fmt サブコマンドのオプション
+var fmtFlags struct {
+	write    bool
+	check    bool
+	caseName string
+}
+
+func setupFmt(fs *flag.FlagSet) {
+	fs.BoolVar(&fmtFlags.write, "w", false, "整形結果を元のファイルに上書きする")
+	fs.BoolVar(&fmtFlags.check, "check", false, "整形されていないファイル名を表示し、1つでもあれば終了コード1で終了する")
+	fs.StringVar(&fmtFlags.caseName, "case", "upper", "命令・レジスタ名などの表記 (upper, lower)")
+}
+
+func runFmt(fs *flag.FlagSet) int {
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return exitUsage
+	}
+	var opt asm.FormatOptions
+	switch fmtFlags.caseName {
+	case "upper":
+	case "lower":
+		opt.Lower = true
+	default:
+		fmt.Fprintf(os.Stderr, "invalid -case option: %s (upper or lower)\n", fmtFlags.caseName)
+		return exitUsage
+	}
+
+	status := exitOK
+	unformatted := []string{}
+	for _, path := range fs.Args() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			status = exitFail
+			continue
+		}
+		lines, err := asm.ReadLines(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			status = exitFail
+			continue
+		}
+		formatted := strings.Join(asm.Format(lines, opt), "\n")
+		if len(lines) > 0 {
+			formatted += "\n"
+		}
+
+		switch {
+		case fmtFlags.check:
+			if formatted != string(data) {
+				unformatted = append(unformatted, path)
+				if !jsonOutput() {
+					fmt.Println(path)
+				}
+				status = exitFail
+			}
+		case fmtFlags.write:
+			if formatted == string(data) {
+				continue
+			}
+			if err := os.WriteFile(path, []byte(formatted), 0644); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				status = exitFail
+			}
+		default:
+			fmt.Print(formatted)
+		}
+	}
+	if fmtFlags.check && jsonOutput() {
+		writeJSON(unformatted)
+	}
+	return status
+}
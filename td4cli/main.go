@@ -0,0 +1,276 @@
+package main
+
+// 4bitCPU td4用の統合コマンド
+// アセンブラ・エミュレータ・逆アセンブラ・テスト・整形の機能を、1つのコマンドのサブコマンドとして提供します。
+//   td4 [共通オプション] <サブコマンド> [オプション] 引数...
+// > go build -o td4.exe .
+//
+// 終了コード:
+//   0  成功
+//   1  アセンブルのエラー、テストの失敗、整形されていないファイルなど
+//   2  コマンドラインの誤り
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"main/asm"
+	"main/td4"
+)
+
+// 終了コード
+const (
+	exitOK    = 0
+	exitFail  = 1
+	exitUsage = 2
+)
+
+// stringList 複数回指定できるオプションの値
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// globalOptions すべてのサブコマンドに共通するオプション
+type globalOptions struct {
+	romSize int
+	isa     string
+	format  string
+	variant td4.Variant // isa から決まる命令セット
+}
+
+var opts = globalOptions{romSize: asm.ROMSize, isa: "td4emu", format: "text"}
+
+// outputFormats -format オプションに指定できる値
+var outputFormats = []string{"text", "gcc", "json"}
+
+// addGlobalFlags 共通オプションを登録する
+// サブコマンドの前後どちらにも書けるように、サブコマンドのオプションにも同じものを登録する。
+func addGlobalFlags(fs *flag.FlagSet) {
+	fs.IntVar(&opts.romSize, "rom", opts.romSize, fmt.Sprintf("ROMの容量 (バイト, 1～%d)", asm.ROMSize))
+	fs.StringVar(&opts.isa, "isa", opts.isa, "命令セットの動作 ("+td4.VariantNames()+")")
+	fs.StringVar(&opts.format, "format", opts.format, "出力形式 ("+strings.Join(outputFormats, ", ")+")")
+}
+
+// checkGlobalFlags 共通オプションの値を確認する
+func checkGlobalFlags() error {
+	if opts.romSize < 1 || opts.romSize > asm.ROMSize {
+		return fmt.Errorf("invalid -rom: %d (1 to %d; the TD4 program counter is 4 bits)", opts.romSize, asm.ROMSize)
+	}
+	v, err := td4.ParseVariant(opts.isa)
+	if err != nil {
+		return fmt.Errorf("invalid -isa: %v", err)
+	}
+	opts.variant = v
+	for _, f := range outputFormats {
+		if f == opts.format {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid -format: %s (%s)", opts.format, strings.Join(outputFormats, ", "))
+}
+
+// command サブコマンド
+type command struct {
+	name  string
+	args  string // 引数の書式
+	short string // 説明
+	run   func(fs *flag.FlagSet) int
+	setup func(fs *flag.FlagSet) // サブコマンドのオプションを登録する
+}
+
+var commands = []*command{
+	{name: "asm", args: "[オプション] ファイル.td4", short: "アセンブルしてHEX形式で出力する", setup: setupAsm, run: runAsm},
+	{name: "run", args: "[オプション] ファイル(.td4|.hex)", short: "プログラムを実行し、出力ポートの変化を表示する", setup: setupRun, run: runRun},
+	{name: "dis", args: "[オプション] ファイル(.hex|.td4)", short: "ROMの内容を逆アセンブルする", setup: setupDis, run: runDis},
+	{name: "test", args: "[オプション] ファイル.td4...", short: "ソースコードの ; @test 行に従って実行し、出力を確認する", setup: setupTest, run: runTest},
+	{name: "fmt", args: "[オプション] ファイル.td4...", short: "ソースコードを整形する", setup: setupFmt, run: runFmt},
+}
+
+func main() {
+	global := flag.NewFlagSet("td4", flag.ExitOnError)
+	addGlobalFlags(global)
+	global.Usage = func() { usage(global) }
+	global.Parse(os.Args[1:])
+
+	args := global.Args()
+	if len(args) < 1 || args[0] == "help" {
+		if len(args) >= 2 {
+			if cmd := findCommand(args[1]); cmd != nil {
+				fs := newFlagSet(cmd)
+				fs.SetOutput(os.Stdout)
+				fs.Usage()
+				os.Exit(exitOK)
+			}
+		}
+		usage(global)
+		if len(args) < 1 {
+			os.Exit(exitUsage)
+		}
+		os.Exit(exitOK)
+	}
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "td4: unknown command %q\n", args[0])
+		fmt.Fprintf(os.Stderr, "Run 'td4 help' for usage.\n")
+		os.Exit(exitUsage)
+	}
+	fs := newFlagSet(cmd)
+	fs.Parse(args[1:])
+	if err := checkGlobalFlags(); err != nil {
+		fmt.Fprintf(os.Stderr, "td4 %s: %v\n", cmd.name, err)
+		os.Exit(exitUsage)
+	}
+	os.Exit(cmd.run(fs))
+}
+
+// findCommand 名前からサブコマンドを返す
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// newFlagSet サブコマンドのオプションを作成する
+func newFlagSet(cmd *command) *flag.FlagSet {
+	fs := flag.NewFlagSet("td4 "+cmd.name, flag.ExitOnError)
+	cmd.setup(fs)
+	addGlobalFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "%s\n\n使い方:\ntd4 %s %s\n\nオプション:\n", cmd.short, cmd.name, cmd.args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// usage コマンド全体の使い方を表示する
+func usage(global *flag.FlagSet) {
+	w := global.Output()
+	fmt.Fprintf(w, "TD4 ツール\n")
+	fmt.Fprintf(w, "4bit CPU td4用のアセンブラ・エミュレータ・逆アセンブラ・テスト・整形ツールです。\n\n")
+	fmt.Fprintf(w, "使い方:\n")
+	fmt.Fprintf(w, "td4 [共通オプション] <サブコマンド> [オプション] 引数...\n\n")
+	fmt.Fprintf(w, "サブコマンド:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-5s %s\n", cmd.name, cmd.short)
+	}
+	fmt.Fprintf(w, "\n共通オプション (サブコマンドの後にも書けます):\n")
+	global.PrintDefaults()
+	fmt.Fprintf(w, "\n終了コード: 0 成功, 1 エラー・テストの失敗など, 2 コマンドラインの誤り\n")
+	fmt.Fprintf(w, "\n使用例:\n")
+	fmt.Fprintf(w, "  td4 asm -o Sample.hex Sample.td4       (アセンブルしてHEXファイルに保存)\n")
+	fmt.Fprintf(w, "  td4 run -cycles 32 -in 0b0101 Sample.td4 (アセンブルして32命令実行)\n")
+	fmt.Fprintf(w, "  td4 dis Sample.hex                     (逆アセンブル)\n")
+	fmt.Fprintf(w, "  td4 test samples/*.td4                 (; @test 行のテストを実行)\n")
+	fmt.Fprintf(w, "  td4 fmt -w Sample.td4                  (整形してファイルに上書き)\n")
+	fmt.Fprintf(w, "  td4 -isa hardware -format json run Sample.td4 (実機の動作で実行し、結果をJSONで出力)\n")
+	fmt.Fprintf(w, "  td4 help run                           (サブコマンドのヘルプ)\n")
+}
+
+// assembleFile ソースファイルをアセンブルし、エラー・警告を -format の形式で標準エラー出力に表示する
+// エラーがあれば、または -rom の容量を超える場合は nil を返す。
+func assembleFile(path string, includeDirs, defines []string, werror, wunused bool) *asm.Assembler {
+	lines, err := asm.ReadLines(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return nil
+	}
+	a := asm.NewAssembler(path, lines)
+	a.IncludeDirs = includeDirs
+	a.Diags.Werror = werror
+	a.WarnUnused = wunused
+	for _, def := range defines {
+		if err := a.Define(def); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -D option: %v\n", err)
+			return nil
+		}
+	}
+	err1 := a.Pass1()
+	err2 := a.Pass2()
+	a.Diags.Sort()
+	if len(a.Diags.List) > 0 {
+		a.Diags.Write(os.Stderr, opts.format)
+	}
+	if err1 != nil || err2 != nil {
+		fmt.Fprintf(os.Stderr, "%s: assembly failed: %d error(s), %d warning(s)\n", path, a.Diags.ErrorCount(), a.Diags.WarningCount())
+		return nil
+	}
+	if start, image := a.Image(false); start+len(image) > opts.romSize {
+		fmt.Fprintf(os.Stderr, "%s: program size %d bytes exceeds the %d-byte ROM (-rom)\n", path, start+len(image), opts.romSize)
+		return nil
+	}
+	return a
+}
+
+// loadROM .td4 ファイルはアセンブルし、それ以外はHEXファイルとして読み込んで、ROMの内容を返す
+// .td4 ファイルの場合は、アセンブラも返す (ソースコードの表示に使う)。
+func loadROM(path string) (rom [16]uint8, a *asm.Assembler, ok bool) {
+	var start int
+	var image []uint8
+	if strings.EqualFold(filepath.Ext(path), ".td4") {
+		if a = assembleFile(path, nil, nil, false, false); a == nil {
+			return rom, nil, false
+		}
+		start, image = a.Image(false)
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return rom, nil, false
+		}
+		defer f.Close()
+		if start, image, err = asm.ReadHex(f); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			return rom, nil, false
+		}
+		for i, b := range image { // -pad で0を埋めた部分は容量を超えてもよい
+			if b != 0 && start+i >= opts.romSize {
+				fmt.Fprintf(os.Stderr, "%s: data at address %d exceeds the %d-byte ROM (-rom)\n", path, start+i, opts.romSize)
+				return rom, nil, false
+			}
+		}
+	}
+	copy(rom[start:], image)
+	return rom, a, true
+}
+
+// newCPU ROMの内容と -isa の命令セットでCPUを作成する
+func newCPU(rom [16]uint8) *td4.CPU {
+	cpu := td4.NewCPU()
+	cpu.ROM = rom
+	cpu.Variant = opts.variant
+	return cpu
+}
+
+// parseNibble 0～15の値を解析する ("0b0101", "0x0A", "10" など)
+func parseNibble(s string) (uint8, error) {
+	v, err := strconv.ParseUint(s, 0, 8)
+	if err != nil || v > 15 {
+		return 0, fmt.Errorf("invalid value %q (0 to 15)", s)
+	}
+	return uint8(v), nil
+}
+
+// writeJSON 結果をJSONで標準出力に書き込む
+func writeJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// jsonOutput -format json が指定されていればtrueを返す
+func jsonOutput() bool {
+	return opts.format == "json"
+}
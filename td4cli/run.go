@@ -0,0 +1,128 @@
+package main
+
+// td4 run: プログラムを実行し、出力ポートの変化を表示する
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"main/asm"
+)
+
+// runFlags run サブコマンドのオプション
+var runFlags struct {
+	cycles int
+	in     string
+	speed  int
+	trace  bool
+}
+
+func setupRun(fs *flag.FlagSet) {
+	fs.IntVar(&runFlags.cycles, "cycles", 100, "実行する命令の数")
+	fs.StringVar(&runFlags.in, "in", "0", "入力ポートの値 (0b0101, 0x5, 5 など)")
+	fs.IntVar(&runFlags.speed, "speed", 0, "1命令ごとの待ち時間 (ms)")
+	fs.BoolVar(&runFlags.trace, "trace", false, "1命令ごとにPC・命令・レジスタを表示する")
+}
+
+// cpuState 実行後の状態 (-format json)
+type cpuState struct {
+	PC  int  `json:"pc"`
+	A   int  `json:"a"`
+	B   int  `json:"b"`
+	C   bool `json:"c"`
+	In  int  `json:"in"`
+	Out int  `json:"out"`
+}
+
+// outputChange 出力ポートの変化 (-format json)
+type outputChange struct {
+	Cycle int `json:"cycle"`
+	Out   int `json:"out"`
+}
+
+// traceEntry 1命令の実行記録 (-format json)
+type traceEntry struct {
+	Cycle int      `json:"cycle"`
+	PC    int      `json:"pc"`
+	Code  int      `json:"code"`
+	Text  string   `json:"text"`
+	State cpuState `json:"state"`
+}
+
+// runResult -format json のときの出力
+type runResult struct {
+	ISA     string         `json:"isa"`
+	Cycles  int            `json:"cycles"`
+	Outputs []outputChange `json:"outputs"`
+	Trace   []traceEntry   `json:"trace,omitempty"`
+	State   cpuState       `json:"state"`
+}
+
+func runRun(fs *flag.FlagSet) int {
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+	in, err := parseNibble(runFlags.in)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -in option: %v\n", err)
+		return exitUsage
+	}
+	if runFlags.cycles < 0 {
+		fmt.Fprintf(os.Stderr, "invalid -cycles option: %d\n", runFlags.cycles)
+		return exitUsage
+	}
+	rom, _, ok := loadROM(fs.Arg(0))
+	if !ok {
+		return exitFail
+	}
+
+	cpu := newCPU(rom)
+	cpu.InPort = in
+	state := func() cpuState {
+		return cpuState{int(cpu.PC), int(cpu.A), int(cpu.B), cpu.C, int(cpu.InPort), int(cpu.OutPort)}
+	}
+	result := runResult{ISA: opts.isa, Cycles: runFlags.cycles, Outputs: []outputChange{}}
+	for cycle := 1; cycle <= runFlags.cycles; cycle++ {
+		pc := cpu.PC
+		code := cpu.ROM[pc]
+		out := cpu.OutPort
+		cpu.Step()
+		if runFlags.trace {
+			entry := traceEntry{cycle, int(pc), int(code), asm.Disassemble(code), state()}
+			if jsonOutput() {
+				result.Trace = append(result.Trace, entry)
+			} else {
+				fmt.Printf("%4d: PC=%X %02X %-10s A=%04b B=%04b C=%d OUT=%04b\n",
+					cycle, pc, code, entry.Text, cpu.A, cpu.B, btoi(cpu.C), cpu.OutPort)
+			}
+		}
+		if cpu.OutPort != out {
+			result.Outputs = append(result.Outputs, outputChange{cycle, int(cpu.OutPort)})
+			if !jsonOutput() {
+				fmt.Printf("%4d: OUT %04b (%d)\n", cycle, cpu.OutPort, cpu.OutPort)
+			}
+		}
+		if runFlags.speed > 0 {
+			time.Sleep(time.Duration(runFlags.speed) * time.Millisecond)
+		}
+	}
+	result.State = state()
+	if jsonOutput() {
+		writeJSON(result)
+	} else {
+		fmt.Printf("%d cycles: PC=%X A=%04b B=%04b C=%d IN=%04b OUT=%04b\n",
+			runFlags.cycles, cpu.PC, cpu.A, cpu.B, btoi(cpu.C), cpu.InPort, cpu.OutPort)
+	}
+	return exitOK
+}
+
+// btoi キャリーフラグを0か1にする
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,196 @@
+package main
+
+// td4 test: ソースコードの ; @test 行に従ってプログラムを実行し、出力ポートの変化を確認する
+//   ; @test [in=値] [cycles=命令数] out=値,値,...
+// リセットしてから最大 cycles 命令 (省略時は100) 実行し、出力ポートが変化した値を順に記録する。
+// 記録した値が out に並べた値と一致すれば成功とする。
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"main/asm"
+)
+
+// testFlags test サブコマンドのオプション
+var testFlags struct {
+	verbose bool
+}
+
+func setupTest(fs *flag.FlagSet) {
+	fs.BoolVar(&testFlags.verbose, "v", false, "成功したテストも表示する")
+}
+
+// testCase ; @test 行から読み込んだテスト
+type testCase struct {
+	line   int
+	in     uint8
+	cycles int
+	expect []int
+}
+
+// testResult テストの結果 (-format json)
+type testResult struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Pass    bool   `json:"pass"`
+	In      int    `json:"in"`
+	Cycles  int    `json:"cycles"`
+	Expect  []int  `json:"expect"`
+	Actual  []int  `json:"actual"`
+	Message string `json:"message,omitempty"`
+}
+
+// parseTests ソースコードから ; @test 行を読み込む
+func parseTests(lines []string) ([]testCase, error) {
+	var tests []testCase
+	for i, line := range lines {
+		_, comment, found := strings.Cut(line, ";")
+		if !found {
+			continue
+		}
+		fields := strings.Fields(comment)
+		if len(fields) == 0 || fields[0] != "@test" {
+			continue
+		}
+		tc := testCase{line: i + 1, cycles: 100}
+		hasOut := false
+		for _, f := range fields[1:] {
+			key, value, ok := strings.Cut(f, "=")
+			if !ok {
+				return nil, fmt.Errorf("%d: invalid @test field %q (key=value)", i+1, f)
+			}
+			switch strings.ToLower(key) {
+			case "in":
+				v, err := parseNibble(value)
+				if err != nil {
+					return nil, fmt.Errorf("%d: in: %v", i+1, err)
+				}
+				tc.in = v
+			case "cycles":
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 1 {
+					return nil, fmt.Errorf("%d: invalid cycles %q", i+1, value)
+				}
+				tc.cycles = n
+			case "out":
+				hasOut = true
+				for _, s := range strings.Split(value, ",") {
+					v, err := parseNibble(s)
+					if err != nil {
+						return nil, fmt.Errorf("%d: out: %v", i+1, err)
+					}
+					tc.expect = append(tc.expect, int(v))
+				}
+			default:
+				return nil, fmt.Errorf("%d: unknown @test field %q (in, cycles, out)", i+1, key)
+			}
+		}
+		if !hasOut {
+			return nil, fmt.Errorf("%d: @test needs out=...", i+1)
+		}
+		tests = append(tests, tc)
+	}
+	return tests, nil
+}
+
+// runTestCase テストを実行して結果を返す
+func runTestCase(path string, rom [16]uint8, tc testCase) testResult {
+	cpu := newCPU(rom)
+	cpu.InPort = tc.in
+	r := testResult{File: path, Line: tc.line, In: int(tc.in), Cycles: tc.cycles, Expect: tc.expect, Actual: []int{}}
+	for cycle := 0; cycle < tc.cycles && len(r.Actual) < len(tc.expect); cycle++ {
+		out := cpu.OutPort
+		cpu.Step()
+		if cpu.OutPort != out {
+			r.Actual = append(r.Actual, int(cpu.OutPort))
+		}
+	}
+	r.Pass = equalInts(r.Actual, tc.expect)
+	if !r.Pass {
+		r.Message = fmt.Sprintf("out = %s, want %s", joinInts(r.Actual), joinInts(tc.expect))
+	}
+	return r
+}
+
+func runTest(fs *flag.FlagSet) int {
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return exitUsage
+	}
+	status := exitOK
+	results := []testResult{}
+	passed, failed := 0, 0
+	for _, path := range fs.Args() {
+		lines, err := asm.ReadLines(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			status = exitFail
+			continue
+		}
+		tests, err := parseTests(lines)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s:%v\n", path, err)
+			status = exitFail
+			continue
+		}
+		if len(tests) == 0 {
+			fmt.Fprintf(os.Stderr, "%s: no @test lines\n", path)
+			continue
+		}
+		rom, _, ok := loadROM(path)
+		if !ok {
+			status = exitFail
+			continue
+		}
+		for _, tc := range tests {
+			r := runTestCase(path, rom, tc)
+			results = append(results, r)
+			if r.Pass {
+				passed++
+			} else {
+				failed++
+				status = exitFail
+			}
+			if jsonOutput() {
+				continue
+			}
+			switch {
+			case !r.Pass:
+				fmt.Printf("FAIL %s:%d: %s\n", r.File, r.Line, r.Message)
+			case testFlags.verbose:
+				fmt.Printf("PASS %s:%d\n", r.File, r.Line)
+			}
+		}
+	}
+	if jsonOutput() {
+		writeJSON(results)
+	} else {
+		fmt.Printf("%d passed, %d failed\n", passed, failed)
+	}
+	return status
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// joinInts 出力ポートの値を4桁の2進数で並べる
+func joinInts(values []int) string {
+	s := make([]string, len(values))
+	for i, v := range values {
+		s[i] = fmt.Sprintf("%04b", v)
+	}
+	return "[" + strings.Join(s, " ") + "]"
+}
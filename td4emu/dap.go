@@ -0,0 +1,551 @@
+package main
+
+// Debug Adapter Protocol (DAP) サーバー
+// VS Code などのエディタから、TD4のプログラムをソースコードの行単位でデバッグするためのモード。
+//   td4emu -dap                     標準入出力で通信する
+//   td4emu -dap-listen 127.0.0.1:4711  TCPで待ち受ける (localhostのみ)
+//
+// launch の引数:
+//   program      .td4 (その場でアセンブルする) または .hex (同じ名前の .dbg か .sym があれば読み込む)
+//   stopOnEntry  trueなら0番地で停止してから開始する
+//   speed        連続実行時の1命令あたりの待ち時間 (ミリ秒。省略時は -speed の値)
+//   input        入力ポートの初期値
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"main/asm"
+)
+
+// dapThreadID TD4はスレッドが1つなので、常にこのIDを使う
+const dapThreadID = 1
+
+// DAPの変数の参照番号
+const (
+	dapRefRegisters = 1
+	dapRefROM       = 2
+)
+
+// dapMessage DAPの要求・応答・イベント
+type dapMessage struct {
+	Seq        int             `json:"seq"`
+	Type       string          `json:"type"`
+	Command    string          `json:"command,omitempty"`
+	Arguments  json.RawMessage `json:"arguments,omitempty"`
+	RequestSeq int             `json:"request_seq,omitempty"`
+	Success    *bool           `json:"success,omitempty"` // 応答のみ
+	Message    string          `json:"message,omitempty"`
+	Event      string          `json:"event,omitempty"`
+	Body       interface{}     `json:"body,omitempty"`
+}
+
+// dapSession 1つのデバッグセッションの状態
+type dapSession struct {
+	r     *textproto.Reader
+	w     io.Writer
+	wmu   sync.Mutex // 書き込みの排他制御
+	seq   int
+	speed int64 // 連続実行時の1命令あたりの待ち時間 (ミリ秒)
+
+	mu          sync.Mutex // 以下のCPUの状態の排他制御
+	cpu         *CPU
+	breakpoints map[string]map[uint8]bool // ソースファイルごとのブレークポイントのアドレス
+	launched    bool
+	configured  bool
+	stopOnEntry bool
+	running     bool
+	pause       bool          // 連続実行の停止要求
+	done        chan struct{} // 連続実行が停止したら閉じる
+}
+
+// serveDAP 標準入出力またはTCPでDAPサーバーを動かす
+// 標準入出力の場合、標準出力はDAPのメッセージだけに使い、それ以外の表示は標準エラー出力に出す。
+func serveDAP(listen string, speed int64) {
+	if listen == "" {
+		out := os.Stdout
+		os.Stdout = os.Stderr
+		newDAPSession(os.Stdin, out, speed).serve()
+		return
+	}
+	ln, err := listenLocal(listen)
+	if err != nil {
+		log.Fatalf("-dap-listen: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "DAP server listening on %s\n", ln.Addr())
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		newDAPSession(c, c, speed).serve()
+		c.Close()
+	}
+}
+
+// newDAPSession セッションを作成する
+func newDAPSession(r io.Reader, w io.Writer, speed int64) *dapSession {
+	return &dapSession{
+		r:           textproto.NewReader(bufio.NewReader(r)),
+		w:           w,
+		speed:       speed,
+		cpu:         NewCPU(),
+		breakpoints: make(map[string]map[uint8]bool),
+	}
+}
+
+// send メッセージを1件送る
+func (s *dapSession) send(msg *dapMessage) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.seq++
+	msg.Seq = s.seq
+	body, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("dap: %v", err)
+		return
+	}
+	fmt.Fprintf(s.w, "Content-Length: %d\r\n\r\n", len(body))
+	s.w.Write(body)
+}
+
+// event イベントを送る
+func (s *dapSession) event(name string, body interface{}) {
+	s.send(&dapMessage{Type: "event", Event: name, Body: body})
+}
+
+// read 要求を1件読み込む
+func (s *dapSession) read() (*dapMessage, error) {
+	header, err := s.r.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid Content-Length: %q", header.Get("Content-Length"))
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(s.r.R, body); err != nil {
+		return nil, err
+	}
+	var msg dapMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// serve 要求を読み込んで処理する。disconnect・terminate を受け取るか、接続が切れたら終了する。
+func (s *dapSession) serve() {
+	defer s.stop()
+	for {
+		req, err := s.read()
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("dap: %v", err)
+			}
+			return
+		}
+		if req.Type != "request" {
+			continue
+		}
+		body, err := s.handle(req)
+		success := err == nil
+		resp := &dapMessage{Type: "response", RequestSeq: req.Seq, Command: req.Command, Success: &success, Body: body}
+		if err != nil {
+			resp.Message = err.Error()
+		}
+		s.send(resp)
+
+		switch req.Command {
+		case "initialize":
+			s.event("initialized", nil)
+		case "launch", "configurationDone":
+			s.start()
+		case "pause":
+			s.event("stopped", map[string]interface{}{"reason": "pause", "threadId": dapThreadID, "allThreadsStopped": true})
+		case "next", "stepIn", "stepOut":
+			s.step()
+		case "disconnect", "terminate":
+			s.stop()
+			s.event("terminated", nil)
+			return
+		}
+	}
+}
+
+// handle 要求を処理し、応答の本文を返す
+func (s *dapSession) handle(req *dapMessage) (interface{}, error) {
+	// args 要求の引数を読み込む
+	args := func(v interface{}) error {
+		if len(req.Arguments) == 0 {
+			return nil
+		}
+		return json.Unmarshal(req.Arguments, v)
+	}
+
+	switch req.Command {
+	case "initialize":
+		return map[string]bool{
+			"supportsConfigurationDoneRequest": true,
+			"supportsSetVariable":              true,
+			"supportsTerminateRequest":         true,
+		}, nil
+
+	case "launch":
+		var a struct {
+			Program     string `json:"program"`
+			StopOnEntry bool   `json:"stopOnEntry"`
+			Speed       *int64 `json:"speed"`
+			Input       int    `json:"input"`
+		}
+		if err := args(&a); err != nil {
+			return nil, err
+		}
+		if err := s.launch(a.Program); err != nil {
+			return nil, err
+		}
+		s.mu.Lock()
+		s.stopOnEntry = a.StopOnEntry
+		s.cpu.InPort = uint8(a.Input & 0x0F)
+		if a.Speed != nil {
+			s.speed = *a.Speed
+		}
+		s.mu.Unlock()
+		return nil, nil
+
+	case "setBreakpoints":
+		var a struct {
+			Source struct {
+				Path string `json:"path"`
+			} `json:"source"`
+			Breakpoints []struct {
+				Line int `json:"line"`
+			} `json:"breakpoints"`
+		}
+		if err := args(&a); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"breakpoints": s.setBreakpoints(a.Source.Path, a.Breakpoints)}, nil
+
+	case "configurationDone":
+		s.mu.Lock()
+		s.configured = true
+		s.mu.Unlock()
+		return nil, nil
+
+	case "threads":
+		return map[string]interface{}{"threads": []map[string]interface{}{{"id": dapThreadID, "name": "TD4"}}}, nil
+
+	case "stackTrace":
+		return s.stackTrace(), nil
+
+	case "scopes":
+		return map[string]interface{}{"scopes": []map[string]interface{}{
+			{"name": "Registers", "variablesReference": dapRefRegisters, "expensive": false},
+			{"name": "ROM", "variablesReference": dapRefROM, "expensive": false},
+		}}, nil
+
+	case "variables":
+		var a struct {
+			Ref int `json:"variablesReference"`
+		}
+		if err := args(&a); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"variables": s.variables(a.Ref)}, nil
+
+	case "setVariable":
+		var a struct {
+			Ref   int    `json:"variablesReference"`
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		}
+		if err := args(&a); err != nil {
+			return nil, err
+		}
+		value, err := s.setVariable(a.Ref, a.Name, a.Value)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{"value": value}, nil
+
+	case "continue":
+		s.resume()
+		return map[string]bool{"allThreadsContinued": true}, nil
+
+	case "pause", "next", "stepIn", "stepOut":
+		s.stop() // 停止のイベントは応答の後に送る
+		return nil, nil
+
+	case "disconnect", "terminate":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported request: %s", req.Command)
+}
+
+// launch プログラムを読み込む
+// .td4 はアセンブルし、デバッグ情報もアセンブル結果から作る。それ以外は HEX ファイルとして読み込む。
+func (s *dapSession) launch(program string) error {
+	if program == "" {
+		return fmt.Errorf("launch requires \"program\"")
+	}
+	cpu := NewCPU() // ブレークポイントはセッションで管理する
+	var info *DebugInfo
+	if strings.EqualFold(filepath.Ext(program), ".td4") {
+		lines, err := asm.ReadLines(program)
+		if err != nil {
+			return err
+		}
+		if info, _, err = cpu.Assemble(program, lines, ""); err != nil {
+			return err
+		}
+	} else {
+		if err := cpu.LoadROM(program); err != nil {
+			return err
+		}
+		if name := findDebugInfo(program); name != "" {
+			var err error
+			if info, err = LoadDebugInfo(name); err != nil {
+				return err
+			}
+		}
+	}
+	// ソースファイルのパスを、プログラムのディレクトリからの絶対パスにする
+	if info != nil {
+		for adr, line := range info.Lines {
+			if !filepath.IsAbs(line.File) {
+				if p := filepath.Join(filepath.Dir(program), line.File); fileExists(p) {
+					line.File = p
+				}
+			}
+			if abs, err := filepath.Abs(line.File); err == nil {
+				line.File = abs
+			}
+			info.Lines[adr] = line
+		}
+	}
+
+	s.mu.Lock()
+	s.cpu = cpu
+	dbg = info
+	s.launched = true
+	s.mu.Unlock()
+	return nil
+}
+
+// start launch と configurationDone の両方を受け取ったら実行を開始する
+func (s *dapSession) start() {
+	s.mu.Lock()
+	ready := s.launched && s.configured
+	entry := s.stopOnEntry
+	if ready {
+		s.configured = false // 2回目以降は開始しない
+	}
+	s.mu.Unlock()
+	if !ready {
+		return
+	}
+	if entry {
+		s.event("stopped", map[string]interface{}{"reason": "entry", "threadId": dapThreadID, "allThreadsStopped": true})
+		return
+	}
+	s.resume()
+}
+
+// setBreakpoints ソースファイルのブレークポイントを設定し直す
+// 行にコードがない場合は、それ以降で最初にコードのある行に設定する。
+func (s *dapSession) setBreakpoints(path string, lines []struct {
+	Line int `json:"line"`
+}) []map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addrs := make(map[uint8]bool)
+	result := []map[string]interface{}{}
+	for _, bp := range lines {
+		adr, err := dbg.Resolve(fmt.Sprintf("%s:%d", path, bp.Line))
+		if err != nil {
+			result = append(result, map[string]interface{}{"verified": false, "line": bp.Line, "message": err.Error()})
+			continue
+		}
+		addrs[adr] = true
+		result = append(result, map[string]interface{}{"verified": true, "line": dbg.Lines[adr].Line})
+	}
+	s.breakpoints[strings.ToUpper(filepath.Base(path))] = addrs
+	return result
+}
+
+// isBreakpoint 番地にブレークポイントが設定されていればtrueを返す
+func (s *dapSession) isBreakpoint(adr uint8) bool {
+	for _, addrs := range s.breakpoints {
+		if addrs[adr] {
+			return true
+		}
+	}
+	return false
+}
+
+// execute 1命令実行し、出力ポートが変化したら output イベントを送る (s.mu をロックして呼び出す)
+func (s *dapSession) execute() {
+	out := s.cpu.OutPort
+	s.cpu.Step()
+	if s.cpu.OutPort != out {
+		s.event("output", map[string]string{"category": "stdout", "output": fmt.Sprintf("OUT: %04b (%d)\n", s.cpu.OutPort, s.cpu.OutPort)})
+	}
+}
+
+// step 1命令実行して停止する
+func (s *dapSession) step() {
+	s.mu.Lock()
+	s.execute()
+	s.mu.Unlock()
+	s.event("stopped", map[string]interface{}{"reason": "step", "threadId": dapThreadID, "allThreadsStopped": true})
+}
+
+// resume ブレークポイントに到達するか、停止要求があるまで連続実行する
+func (s *dapSession) resume() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		return
+	}
+	s.running, s.pause = true, false
+	s.done = make(chan struct{})
+	go s.runLoop(s.done)
+}
+
+// runLoop 連続実行のループ
+// 実行を再開した番地のブレークポイントでは停止しない。
+func (s *dapSession) runLoop(done chan struct{}) {
+	defer close(done)
+	for first := true; ; first = false {
+		s.mu.Lock()
+		if s.pause {
+			s.running = false
+			s.mu.Unlock()
+			return
+		}
+		if !first && s.isBreakpoint(s.cpu.PC) {
+			s.running = false
+			s.mu.Unlock()
+			s.event("stopped", map[string]interface{}{"reason": "breakpoint", "threadId": dapThreadID, "allThreadsStopped": true})
+			return
+		}
+		s.execute()
+		speed := s.speed
+		s.mu.Unlock()
+		time.Sleep(time.Duration(speed) * time.Millisecond)
+	}
+}
+
+// stop 連続実行中であれば停止し、停止するまで待つ
+func (s *dapSession) stop() {
+	s.mu.Lock()
+	done := s.done
+	if s.running {
+		s.pause = true
+	}
+	s.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// stackTrace 現在のPCの位置を1つのフレームとして返す
+func (s *dapSession) stackTrace() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pc := s.cpu.PC
+	frame := map[string]interface{}{
+		"id":                          1,
+		"name":                        fmt.Sprintf("PC=%02d", pc),
+		"line":                        0,
+		"column":                      0,
+		"instructionPointerReference": strconv.Itoa(int(pc)),
+	}
+	if label := dbg.Label(pc); label != "" { // シンボルファイルだけでもラベル名を表示する
+		frame["name"] = fmt.Sprintf("%s (PC=%02d)", label, pc)
+	}
+	if info, ok := dbg.Lines[pc]; dbg != nil && ok {
+		frame["line"] = info.Line
+		frame["column"] = 1
+		frame["source"] = map[string]string{"name": filepath.Base(info.File), "path": info.File}
+	}
+	return map[string]interface{}{"stackFrames": []interface{}{frame}, "totalFrames": 1}
+}
+
+// variables レジスタまたはROMの内容を変数として返す
+func (s *dapSession) variables(ref int) []map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cpu := s.cpu
+	v := func(name, value string) map[string]interface{} {
+		return map[string]interface{}{"name": name, "value": value, "variablesReference": 0}
+	}
+	reg := func(x uint8) string { return fmt.Sprintf("%04b (%d)", x&0x0F, x&0x0F) }
+	var vars []map[string]interface{}
+	switch ref {
+	case dapRefRegisters:
+		c := "0"
+		if cpu.C {
+			c = "1"
+		}
+		vars = append(vars, v("A", reg(cpu.A)), v("B", reg(cpu.B)), v("C", c),
+			v("PC", fmt.Sprintf("%02d", cpu.PC)), v("IN", reg(cpu.InPort)), v("OUT", reg(cpu.OutPort)))
+	case dapRefROM:
+		for adr := MEM_MIN; adr <= MEM_MAX; adr++ {
+			value := fmt.Sprintf("0x%02X %04b_%04b", cpu.ROM[adr], cpu.ROM[adr]>>4, cpu.ROM[adr]&0x0F)
+			if src := dbg.Source(adr); src != "" {
+				value += "  " + src
+			}
+			vars = append(vars, v(fmt.Sprintf("%02d", adr), value))
+		}
+	}
+	return vars
+}
+
+// setVariable レジスタの値を変更する。値は数値 (0b・0x も可) で指定する。
+func (s *dapSession) setVariable(ref int, name, value string) (string, error) {
+	if ref != dapRefRegisters {
+		return "", fmt.Errorf("%s cannot be changed", name)
+	}
+	val, err := strconv.ParseInt(strings.TrimSpace(value), 0, 16)
+	if err != nil || val < 0 || val > 15 {
+		return "", fmt.Errorf("value must be 0-15: %s", value)
+	}
+	x := uint8(val)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch name {
+	case "A":
+		s.cpu.A = x
+	case "B":
+		s.cpu.B = x
+	case "C":
+		if x > 1 {
+			return "", fmt.Errorf("value must be 0 or 1: %s", value)
+		}
+		s.cpu.C = x != 0
+		return strconv.Itoa(int(x)), nil
+	case "PC":
+		s.cpu.PC = x
+		return fmt.Sprintf("%02d", x), nil
+	case "IN":
+		s.cpu.InPort = x
+	case "OUT":
+		s.cpu.OutPort = x
+	default:
+		return "", fmt.Errorf("unknown register: %s", name)
+	}
+	return fmt.Sprintf("%04b (%d)", x, x), nil
+}
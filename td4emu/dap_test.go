@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dapClient テスト用のDAPクライアント
+type dapClient struct {
+	t    *testing.T
+	w    io.Writer
+	msgs chan *dapMessage
+	seq  int
+}
+
+// newDAPClient セッションを起動して、接続したクライアントを返す
+func newDAPClient(t *testing.T) *dapClient {
+	t.Cleanup(func() { dbg = nil }) // launch はデバッグ情報を設定する
+	reqR, reqW := io.Pipe()
+	respR, respW := io.Pipe()
+	c := &dapClient{t: t, w: reqW, msgs: make(chan *dapMessage, 64)}
+	s := newDAPSession(reqR, respW, 0)
+	go func() {
+		s.serve()
+		respW.Close()
+	}()
+	go func() {
+		defer close(c.msgs)
+		r := textproto.NewReader(bufio.NewReader(respR))
+		for {
+			header, err := r.ReadMIMEHeader()
+			if err != nil {
+				return
+			}
+			n, _ := strconv.Atoi(header.Get("Content-Length"))
+			body := make([]byte, n)
+			if _, err := io.ReadFull(r.R, body); err != nil {
+				return
+			}
+			var msg dapMessage
+			if err := json.Unmarshal(body, &msg); err != nil {
+				t.Errorf("invalid message: %v: %s", err, body)
+				return
+			}
+			c.msgs <- &msg
+		}
+	}()
+	t.Cleanup(func() { reqW.Close() })
+	return c
+}
+
+// request 要求を送り、応答を返す (応答の前に受け取ったイベントは読み捨てる)
+func (c *dapClient) request(command string, args interface{}) *dapMessage {
+	c.t.Helper()
+	c.seq++
+	msg := map[string]interface{}{"seq": c.seq, "type": "request", "command": command}
+	if args != nil {
+		msg["arguments"] = args
+	}
+	body, _ := json.Marshal(msg)
+	fmt.Fprintf(c.w, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	resp := c.wait("response", command)
+	if resp.RequestSeq != c.seq {
+		c.t.Fatalf("%s: request_seq = %d, want %d", command, resp.RequestSeq, c.seq)
+	}
+	return resp
+}
+
+// wait 種類 typ (response または event) で、名前が name のメッセージを待つ
+func (c *dapClient) wait(typ, name string) *dapMessage {
+	c.t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg, ok := <-c.msgs:
+			if !ok {
+				c.t.Fatalf("connection closed while waiting for %s %s", typ, name)
+			}
+			if msg.Type == typ && (msg.Command == name || msg.Event == name) {
+				return msg
+			}
+		case <-timeout:
+			c.t.Fatalf("timeout waiting for %s %s", typ, name)
+		}
+	}
+}
+
+// body メッセージの本文を v に読み込む
+func (c *dapClient) body(msg *dapMessage, v interface{}) {
+	c.t.Helper()
+	data, _ := json.Marshal(msg.Body)
+	if err := json.Unmarshal(data, v); err != nil {
+		c.t.Fatalf("%s: %v: %s", msg.Command, err, data)
+	}
+}
+
+// stopped stopped イベントを待ち、停止した理由を返す
+func (c *dapClient) stopped() string {
+	c.t.Helper()
+	var b struct{ Reason string }
+	c.body(c.wait("event", "stopped"), &b)
+	return b.Reason
+}
+
+// frame 現在のスタックフレームを返す
+func (c *dapClient) frame() (name string, line int, path string) {
+	c.t.Helper()
+	var b struct {
+		StackFrames []struct {
+			Name   string
+			Line   int
+			Source struct{ Path string }
+		}
+	}
+	c.body(c.request("stackTrace", map[string]int{"threadId": dapThreadID}), &b)
+	f := b.StackFrames[0]
+	return f.Name, f.Line, f.Source.Path
+}
+
+// registers レジスタの変数を名前と値の対応表で返す
+func (c *dapClient) registers() map[string]string {
+	c.t.Helper()
+	var b struct {
+		Variables []struct{ Name, Value string }
+	}
+	c.body(c.request("variables", map[string]int{"variablesReference": dapRefRegisters}), &b)
+	regs := make(map[string]string)
+	for _, v := range b.Variables {
+		regs[v.Name] = v.Value
+	}
+	return regs
+}
+
+const dapSource = `START:
+    MOV A, 1
+    OUT 3
+LOOP:
+    ADD A, 1
+    JMP LOOP
+`
+
+func TestDAPSession(t *testing.T) {
+	dir := t.TempDir()
+	program := filepath.Join(dir, "test.td4")
+	if err := os.WriteFile(program, []byte(dapSource), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c := newDAPClient(t)
+
+	var caps map[string]bool
+	c.body(c.request("initialize", map[string]string{"adapterID": "td4"}), &caps)
+	if !caps["supportsConfigurationDoneRequest"] || !caps["supportsSetVariable"] {
+		t.Errorf("capabilities = %v", caps)
+	}
+	c.wait("event", "initialized")
+	if resp := c.request("launch", map[string]interface{}{"program": program, "stopOnEntry": true, "input": 5}); !*resp.Success {
+		t.Fatalf("launch: %s", resp.Message)
+	}
+
+	var bps struct {
+		Breakpoints []struct {
+			Verified bool
+			Line     int
+		}
+	}
+	c.body(c.request("setBreakpoints", map[string]interface{}{
+		"source":      map[string]string{"path": program},
+		"breakpoints": []map[string]int{{"line": 4}, {"line": 100}},
+	}), &bps)
+	if len(bps.Breakpoints) != 2 || !bps.Breakpoints[0].Verified || bps.Breakpoints[0].Line != 5 || bps.Breakpoints[1].Verified {
+		t.Errorf("setBreakpoints = %+v, want line 4 moved to line 5 and line 100 unverified", bps.Breakpoints)
+	}
+	c.request("configurationDone", nil)
+	if reason := c.stopped(); reason != "entry" {
+		t.Errorf("stopped reason = %q, want entry", reason)
+	}
+	if name, line, path := c.frame(); name != "START (PC=00)" || line != 2 || filepath.Base(path) != "test.td4" || !filepath.IsAbs(path) {
+		t.Errorf("stackTrace = %q line %d %s", name, line, path)
+	}
+	if regs := c.registers(); regs["A"] != "0000 (0)" || regs["IN"] != "0101 (5)" || regs["PC"] != "00" {
+		t.Errorf("registers = %v", regs)
+	}
+
+	// レジスタの変更
+	for _, tt := range []struct {
+		ref         int
+		name, value string
+		want        string // 空ならエラー
+	}{
+		{dapRefRegisters, "B", "0x9", "1001 (9)"},
+		{dapRefRegisters, "C", "1", "1"},
+		{dapRefRegisters, "C", "2", ""},
+		{dapRefRegisters, "A", "16", ""},
+		{dapRefRegisters, "X", "1", ""},
+		{dapRefROM, "00", "1", ""},
+	} {
+		resp := c.request("setVariable", map[string]interface{}{"variablesReference": tt.ref, "name": tt.name, "value": tt.value})
+		var b struct{ Value string }
+		if *resp.Success {
+			c.body(resp, &b)
+		}
+		if *resp.Success != (tt.want != "") || b.Value != tt.want {
+			t.Errorf("setVariable %s=%s: success=%v value=%q %s, want %q", tt.name, tt.value, *resp.Success, b.Value, resp.Message, tt.want)
+		}
+	}
+	if regs := c.registers(); regs["B"] != "1001 (9)" || regs["C"] != "1" {
+		t.Errorf("registers after setVariable = %v", regs)
+	}
+
+	// ステップ実行と出力ポート
+	c.request("next", map[string]int{"threadId": dapThreadID})
+	if reason := c.stopped(); reason != "step" {
+		t.Errorf("stopped reason = %q, want step", reason)
+	}
+	c.request("stepIn", map[string]int{"threadId": dapThreadID})
+	var out struct{ Output string }
+	c.body(c.wait("event", "output"), &out)
+	if out.Output != "OUT: 0011 (3)\n" {
+		t.Errorf("output = %q", out.Output)
+	}
+	c.stopped()
+
+	// ブレークポイントまで連続実行
+	c.request("continue", map[string]int{"threadId": dapThreadID})
+	if reason := c.stopped(); reason != "breakpoint" {
+		t.Errorf("stopped reason = %q, want breakpoint", reason)
+	}
+	if name, line, _ := c.frame(); name != "LOOP (PC=02)" || line != 5 {
+		t.Errorf("stackTrace = %q line %d, want LOOP at line 5", name, line)
+	}
+	c.request("continue", nil) // 再開した番地では停止しないので、ループを1周して停止する
+	c.stopped()
+	if regs := c.registers(); regs["A"] != "0011 (3)" {
+		t.Errorf("A = %s after one loop, want 3", regs["A"])
+	}
+
+	// 一時停止
+	c.request("setBreakpoints", map[string]interface{}{"source": map[string]string{"path": program}, "breakpoints": []interface{}{}})
+	c.request("continue", nil)
+	time.Sleep(20 * time.Millisecond)
+	c.request("pause", map[string]int{"threadId": dapThreadID})
+	if reason := c.stopped(); reason != "pause" {
+		t.Errorf("stopped reason = %q, want pause", reason)
+	}
+
+	if resp := c.request("evaluate", map[string]string{"expression": "A"}); *resp.Success || !strings.Contains(resp.Message, "unsupported request: evaluate") {
+		t.Errorf("evaluate: success=%v %q", *resp.Success, resp.Message)
+	}
+	c.request("disconnect", nil)
+	c.wait("event", "terminated")
+	select {
+	case _, ok := <-c.msgs:
+		if ok {
+			t.Error("message after terminated")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("session did not end after disconnect")
+	}
+}
+
+func TestDAPLaunchErrors(t *testing.T) {
+	dir := t.TempDir()
+	bad := filepath.Join(dir, "bad.td4")
+	if err := os.WriteFile(bad, []byte("    FOO 1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c := newDAPClient(t)
+	for _, args := range []map[string]string{{}, {"program": filepath.Join(dir, "missing.hex")}, {"program": bad}} {
+		if resp := c.request("launch", args); *resp.Success || resp.Message == "" {
+			t.Errorf("launch %v: success=%v %q", args, *resp.Success, resp.Message)
+		}
+	}
+}
+
+// TestDAPHexProgram HEXファイルでは、同じ名前のシンボルファイルからラベルを読み込む
+func TestDAPHexProgram(t *testing.T) {
+	dir := t.TempDir()
+	program := filepath.Join(dir, "test.hex")
+	os.WriteFile(program, []byte("S 0x00 0x31 0xB3 0x01 0xF2\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "test.sym"), []byte("START\t0\tlabel\ttest.td4\t1\n"), 0o644)
+	c := newDAPClient(t)
+	if resp := c.request("launch", map[string]interface{}{"program": program, "stopOnEntry": true}); !*resp.Success {
+		t.Fatalf("launch: %s", resp.Message)
+	}
+	c.request("configurationDone", nil)
+	c.stopped()
+	if name, line, _ := c.frame(); name != "START (PC=00)" || line != 0 {
+		t.Errorf("stackTrace = %q line %d, want the label without source", name, line)
+	}
+	var rom struct {
+		Variables []struct{ Name, Value string }
+	}
+	c.body(c.request("variables", map[string]int{"variablesReference": dapRefROM}), &rom)
+	if len(rom.Variables) != 16 || rom.Variables[1].Value != "0xB3 1011_0011" {
+		t.Errorf("ROM variables = %v", rom.Variables)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+// td4asm が出力したデバッグ情報ファイル (-dbg) の読み込み
+// アドレスに対応するソースコードの表示と、ラベル名・"ファイル名:行番号" によるアドレスの指定に使用する。
+// シンボルファイル (td4asm -symfile) も読み込める。ソースコードの情報はないので、ラベル名だけを使う。
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SourceInfo 1アドレス分のソースコードの情報
+type SourceInfo struct {
+	File  string
+	Line  int
+	Label string // このアドレスに定義されたラベル (なければ空)
+	Text  string // ソースコード
+}
+
+// DebugInfo デバッグ情報
+type DebugInfo struct {
+	Lines  map[uint8]SourceInfo // アドレスとソースコードの対応
+	Labels map[string]uint8     // ラベル名(大文字)とアドレスの対応
+
+	order []string // 読み込んだ順のラベル名 (ソースコードの情報がないときの Label の表示に使う)
+}
+
+// LoadDebugInfo デバッグ情報ファイルを読み込む
+func LoadDebugInfo(filename string) (*DebugInfo, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ReadDebugInfo(file, filename)
+}
+
+// findDebugInfo ROMファイルと同じ名前のデバッグ情報ファイル (.dbg)、シンボルファイル (.sym) の順に探す (なければ空文字列)
+func findDebugInfo(program string) string {
+	for _, ext := range []string{".dbg", ".sym"} {
+		if name := strings.TrimSuffix(program, filepath.Ext(program)) + ext; fileExists(name) {
+			return name
+		}
+	}
+	return ""
+}
+
+// ReadDebugInfo デバッグ情報を読み込む (name はエラー表示に使う名前)
+func ReadDebugInfo(r io.Reader, name string) (*DebugInfo, error) {
+	dbg := &DebugInfo{
+		Lines:  make(map[uint8]SourceInfo),
+		Labels: make(map[string]uint8),
+	}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if line == "" || line[0] == ';' { // 空行とコメントは読み飛ばす。
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		switch {
+		case fields[0] == "LINE" && len(fields) == 6:
+			adr, err1 := strconv.Atoi(fields[1])
+			num, err2 := strconv.Atoi(fields[3])
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("%s:%d: invalid LINE record", name, n)
+			}
+			if _, exists := dbg.Lines[uint8(adr&0x0F)]; !exists {
+				dbg.Lines[uint8(adr&0x0F)] = SourceInfo{fields[2], num, fields[4], fields[5]}
+			}
+		case fields[0] == "SYM" && len(fields) == 6, len(fields) == 5: // SYM 行と、シンボルファイルの行
+			if fields[0] == "SYM" && len(fields) == 6 {
+				fields = fields[1:]
+			}
+			if fields[2] != "label" {
+				continue
+			}
+			val, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid symbol record", name, n)
+			}
+			if _, exists := dbg.Labels[strings.ToUpper(fields[0])]; !exists {
+				dbg.Labels[strings.ToUpper(fields[0])] = uint8(val & 0x0F)
+				dbg.order = append(dbg.order, fields[0])
+			}
+		}
+	}
+	return dbg, scanner.Err()
+}
+
+// Source アドレスに対応するソースコードを "ファイル名:行番号  ソースコード" の形式で返す
+func (dbg *DebugInfo) Source(adr uint8) string {
+	if dbg == nil {
+		return ""
+	}
+	info, ok := dbg.Lines[adr]
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d  %s", filepath.Base(info.File), info.Line, info.Text)
+}
+
+// Label アドレスに定義されたラベルを返す
+// シンボルファイルを読み込んだ場合は、そのアドレスに定義された最初のラベルを返す。
+func (dbg *DebugInfo) Label(adr uint8) string {
+	if dbg == nil {
+		return ""
+	}
+	if info, ok := dbg.Lines[adr]; ok {
+		return info.Label
+	}
+	for _, name := range dbg.order {
+		if dbg.Labels[strings.ToUpper(name)] == adr {
+			return name
+		}
+	}
+	return ""
+}
+
+// Resolve 数値・ラベル名・"ファイル名:行番号" のいずれかで指定されたアドレスを返す
+// ファイル名は大文字小文字を区別しない。行にコードがない場合は、それ以降で最初にコードのある行とする。
+func (dbg *DebugInfo) Resolve(arg string) (uint8, error) {
+	if val, err := strconv.ParseInt(arg, 0, 16); err == nil {
+		if val < 0 || val > int64(MEM_MAX) { // uint8 に変換する前に判定する (256 以上が折り返さないように)
+			return 0, fmt.Errorf("address %d is out of range (0-15)", val)
+		}
+		return uint8(val), nil
+	}
+	if dbg == nil {
+		return 0, fmt.Errorf("%s: no debug info loaded (use td4asm -dbg)", arg)
+	}
+	if idx := strings.LastIndex(arg, ":"); idx != -1 {
+		name := arg[:idx]
+		num, err := strconv.Atoi(arg[idx+1:])
+		if err != nil {
+			return 0, fmt.Errorf("invalid line number: %s", arg)
+		}
+		found, best := false, SourceInfo{}
+		var bestAdr uint8
+		for adr := MEM_MIN; adr <= MEM_MAX; adr++ {
+			info, ok := dbg.Lines[adr]
+			if !ok || info.Line < num || !strings.EqualFold(filepath.Base(info.File), filepath.Base(name)) {
+				continue
+			}
+			if !found || info.Line < best.Line {
+				found, best, bestAdr = true, info, adr
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("no code at %s", arg)
+		}
+		return bestAdr, nil
+	}
+	if adr, ok := dbg.Labels[strings.ToUpper(arg)]; ok {
+		return adr, nil
+	}
+	return 0, fmt.Errorf("unknown label: %s", arg)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadSymFile(t *testing.T) {
+	const sym = "; td4asm symbol file: test.td4\n; name\tvalue\tkind\tfile\tline\nStart\t0\tlabel\ttest.td4\t2\nLoop\t1\tlabel\ttest.td4\t4\nN\t3\tconst\ttest.td4\t1\n"
+	dbg, err := ReadDebugInfo(strings.NewReader(sym), "test.sym")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dbg.Label(0) != "Start" || dbg.Label(1) != "Loop" || dbg.Label(3) != "" || dbg.Source(0) != "" {
+		t.Errorf("Label = %q %q %q, Source = %q", dbg.Label(0), dbg.Label(1), dbg.Label(3), dbg.Source(0))
+	}
+	for arg, want := range map[string]uint8{"loop": 1, "START": 0, "2": 2} {
+		if adr, err := dbg.Resolve(arg); err != nil || adr != want {
+			t.Errorf("Resolve(%q) = %d, %v; want %d", arg, adr, err, want)
+		}
+	}
+	if _, err := dbg.Resolve("N"); err == nil {
+		t.Error("Resolve succeeded on a constant")
+	}
+	if _, err := ReadDebugInfo(strings.NewReader("Start\tx\tlabel\ttest.td4\t2\n"), "bad.sym"); err == nil {
+		t.Error("ReadDebugInfo succeeded on an invalid value")
+	}
+}
+
+func TestReadDebugInfo(t *testing.T) {
+	const text = "LINE\t0\ttest.td4\t2\tStart\tOUT 1\nSYM\tStart\t0\tlabel\ttest.td4\t2\nSYM\tLoop\t1\tlabel\ttest.td4\t4\n"
+	dbg, err := ReadDebugInfo(strings.NewReader(text), "test.dbg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dbg.Source(0) != "test.td4:2  OUT 1" || dbg.Label(0) != "Start" || dbg.Label(1) != "Loop" {
+		t.Errorf("Source(0) = %q, Label = %q %q", dbg.Source(0), dbg.Label(0), dbg.Label(1))
+	}
+	if adr, err := dbg.Resolve("test.td4:1"); err != nil || adr != 0 {
+		t.Errorf("Resolve(test.td4:1) = %d, %v", adr, err)
+	}
+	for _, arg := range []string{"16", "256", "0x100", "-1", "test.td4:3", "other.td4:1", "Nowhere"} {
+		if adr, err := dbg.Resolve(arg); err == nil {
+			t.Errorf("Resolve(%q) = %d, want an error", arg, adr)
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+// GDB リモートシリアルプロトコル (RSP) のスタブ
+// td4emu -gdb 127.0.0.1:1234 prog.hex で起動し、GDB等から "target remote 127.0.0.1:1234" で接続する。
+//
+// 対応するパケット:
+//   ?  g  G  p  P    停止理由、レジスタの読み書き
+//   m  M             ROMの読み書き (0～15番地)
+//   Z0 z0 Z1 z1      ブレークポイントの設定と解除 (CPU.Breaks に設定する)
+//   s  c             ステップ実行、連続実行 (Ctrl-C で停止)
+//   qSupported  qXfer:features:read  QStartNoAckMode  など
+//
+// レジスタは a, b, c, pc, in, out の順で、それぞれ1バイト(下位4bitが値)として送受信する。
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gdbTargetXML レジスタの構成を GDB に伝えるターゲット記述
+const gdbTargetXML = `<?xml version="1.0"?>
+<!DOCTYPE target SYSTEM "gdb-target.dtd">
+<target version="1.0">
+  <feature name="org.td4.cpu">
+    <reg name="a" bitsize="8" type="uint8" regnum="0"/>
+    <reg name="b" bitsize="8" type="uint8"/>
+    <reg name="c" bitsize="8" type="uint8"/>
+    <reg name="pc" bitsize="8" type="code_ptr"/>
+    <reg name="in" bitsize="8" type="uint8"/>
+    <reg name="out" bitsize="8" type="uint8"/>
+  </feature>
+</target>
+`
+
+// gdbRegCount レジスタの数
+const gdbRegCount = 6
+
+// 停止理由のシグナル番号
+const (
+	gdbSigInt  = 2 // Ctrl-C による停止
+	gdbSigTrap = 5 // ブレークポイント・ステップ実行による停止
+)
+
+// gdbStub 1つの接続の状態
+type gdbStub struct {
+	cpu     *CPU
+	conn    io.ReadWriter
+	speed   int64 // 連続実行時の1命令あたりの待ち時間 (ミリ秒)
+	noAck   bool  // QStartNoAckMode の後は '+' の応答を省略する
+	packets chan string
+	signal  int // 最後に停止した理由
+}
+
+// serveGDB 指定したアドレスで待ち受け、接続ごとにGDBからのパケットを処理する
+func serveGDB(cpu *CPU, addr string, speed int64) {
+	ln, err := listenLocal(addr)
+	if err != nil {
+		log.Fatalf("-gdb: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "GDB stub listening on %s\n", ln.Addr())
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		fmt.Fprintf(os.Stderr, "GDB connected from %s\n", c.RemoteAddr())
+		stub := &gdbStub{cpu: cpu, conn: c, speed: speed, packets: make(chan string, 16), signal: gdbSigTrap}
+		stub.serve()
+		c.Close()
+		fmt.Fprintf(os.Stderr, "GDB disconnected\n")
+	}
+}
+
+// readPackets 受信したデータからパケットを取り出して packets に送る
+// Ctrl-C (0x03) は "\x03" として送る。接続が切れたら packets を閉じる。
+func (g *gdbStub) readPackets() {
+	defer close(g.packets)
+	r := bufio.NewReader(g.conn)
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		switch c {
+		case 0x03:
+			g.packets <- "\x03"
+		case '$':
+			data, err := r.ReadString('#')
+			if err != nil {
+				return
+			}
+			sum := make([]byte, 2)
+			if _, err := io.ReadFull(r, sum); err != nil {
+				return
+			}
+			data = strings.TrimSuffix(data, "#")
+			if want, err := strconv.ParseUint(string(sum), 16, 8); err != nil || uint8(want) != gdbChecksum(data) {
+				g.write("-") // 再送を要求する
+				continue
+			}
+			if !g.noAck {
+				g.write("+")
+			}
+			g.packets <- data
+		}
+		// '+' '-' の応答は読み捨てる
+	}
+}
+
+// gdbChecksum パケットのチェックサムを返す
+func gdbChecksum(data string) uint8 {
+	var sum uint8
+	for i := 0; i < len(data); i++ {
+		sum += data[i]
+	}
+	return sum
+}
+
+// write 生のデータを送る
+func (g *gdbStub) write(s string) {
+	io.WriteString(g.conn, s)
+}
+
+// reply パケットを送る
+func (g *gdbStub) reply(data string) {
+	g.write(fmt.Sprintf("$%s#%02x", data, gdbChecksum(data)))
+}
+
+// serve パケットを処理する。接続が切れるか、k・D を受け取ったら終了する。
+func (g *gdbStub) serve() {
+	go g.readPackets()
+	for pkt := range g.packets {
+		if pkt == "\x03" {
+			continue // 停止中の Ctrl-C は無視する
+		}
+		resp, quit := g.handle(pkt)
+		if resp != nil {
+			g.reply(*resp)
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// handle パケットを1つ処理し、応答を返す (応答しない場合はnil)。接続を終了する場合は quit を返す。
+func (g *gdbStub) handle(pkt string) (resp *string, quit bool) {
+	r := func(s string) *string { return &s }
+	cpu := g.cpu
+	switch {
+	case pkt == "?":
+		return r(fmt.Sprintf("S%02x", g.signal)), false
+	case strings.HasPrefix(pkt, "qSupported"):
+		return r("PacketSize=400;qXfer:features:read+;QStartNoAckMode+"), false
+	case pkt == "QStartNoAckMode":
+		g.noAck = true
+		return r("OK"), false
+	case strings.HasPrefix(pkt, "qXfer:features:read:target.xml:"):
+		return r(gdbXfer(gdbTargetXML, strings.TrimPrefix(pkt, "qXfer:features:read:target.xml:"))), false
+	case pkt == "qAttached":
+		return r("1"), false
+	case pkt == "qfThreadInfo":
+		return r("m1"), false
+	case pkt == "qsThreadInfo":
+		return r("l"), false
+	case pkt == "qC":
+		return r("QC1"), false
+	case strings.HasPrefix(pkt, "H"):
+		return r("OK"), false
+
+	case pkt == "g":
+		var b strings.Builder
+		for n := 0; n < gdbRegCount; n++ {
+			fmt.Fprintf(&b, "%02x", g.register(n))
+		}
+		return r(b.String()), false
+	case strings.HasPrefix(pkt, "G"):
+		data, err := hex.DecodeString(pkt[1:])
+		if err != nil || len(data) < gdbRegCount {
+			return r("E01"), false
+		}
+		for n := 0; n < gdbRegCount; n++ {
+			g.setRegister(n, data[n])
+		}
+		return r("OK"), false
+	case strings.HasPrefix(pkt, "p"):
+		n, err := strconv.ParseUint(pkt[1:], 16, 8)
+		if err != nil || n >= gdbRegCount {
+			return r("E01"), false
+		}
+		return r(fmt.Sprintf("%02x", g.register(int(n)))), false
+	case strings.HasPrefix(pkt, "P"):
+		reg, val, ok := strings.Cut(pkt[1:], "=")
+		n, err1 := strconv.ParseUint(reg, 16, 8)
+		data, err2 := hex.DecodeString(val)
+		if !ok || err1 != nil || err2 != nil || n >= gdbRegCount || len(data) < 1 {
+			return r("E01"), false
+		}
+		g.setRegister(int(n), data[0])
+		return r("OK"), false
+
+	case strings.HasPrefix(pkt, "m"):
+		adr, length, ok := gdbAddrLen(pkt[1:])
+		if !ok || adr > int(MEM_MAX) {
+			return r("E01"), false
+		}
+		var b strings.Builder
+		for i := adr; i < adr+length && i <= int(MEM_MAX); i++ {
+			fmt.Fprintf(&b, "%02x", cpu.ROM[i])
+		}
+		return r(b.String()), false
+	case strings.HasPrefix(pkt, "M"):
+		head, val, _ := strings.Cut(pkt[1:], ":")
+		adr, length, ok := gdbAddrLen(head)
+		data, err := hex.DecodeString(val)
+		if !ok || err != nil || len(data) != length || adr+length > len(cpu.ROM) {
+			return r("E01"), false
+		}
+		copy(cpu.ROM[adr:], data)
+		return r("OK"), false
+
+	case strings.HasPrefix(pkt, "Z0,"), strings.HasPrefix(pkt, "Z1,"), strings.HasPrefix(pkt, "z0,"), strings.HasPrefix(pkt, "z1,"):
+		adr, _, ok := gdbAddrLen(pkt[3:])
+		if !ok || adr > int(MEM_MAX) {
+			return r("E01"), false
+		}
+		cpu.Breaks[adr] = pkt[0] == 'Z'
+		return r("OK"), false
+
+	case strings.HasPrefix(pkt, "s"), strings.HasPrefix(pkt, "c"):
+		if len(pkt) > 1 { // 再開するアドレスの指定
+			adr, err := strconv.ParseUint(pkt[1:], 16, 8)
+			if err != nil || adr > uint64(MEM_MAX) {
+				return r("E01"), false
+			}
+			cpu.PC = uint8(adr)
+		}
+		if pkt[0] == 's' {
+			g.step()
+			g.signal = gdbSigTrap
+		} else {
+			g.signal = g.cont()
+		}
+		return r(fmt.Sprintf("S%02x", g.signal)), false
+
+	case pkt == "D":
+		return r("OK"), true
+	case pkt == "k":
+		return nil, true
+	}
+	return r(""), false // 対応していないパケット
+}
+
+// gdbAddrLen "アドレス,長さ" (16進数) を解析する
+func gdbAddrLen(s string) (adr, length int, ok bool) {
+	a, l, found := strings.Cut(s, ",")
+	av, err1 := strconv.ParseUint(a, 16, 16)
+	lv, err2 := strconv.ParseUint(l, 16, 16)
+	if !found || err1 != nil || err2 != nil {
+		return 0, 0, false
+	}
+	return int(av), int(lv), true
+}
+
+// gdbXfer qXfer の "オフセット,長さ" に従って文書の一部を返す
+func gdbXfer(doc, args string) string {
+	offset, length, ok := gdbAddrLen(args)
+	if !ok {
+		return "E01"
+	}
+	if offset >= len(doc) {
+		return "l"
+	}
+	if end := offset + length; end < len(doc) {
+		return "m" + doc[offset:end]
+	}
+	return "l" + doc[offset:]
+}
+
+// register レジスタの値を返す (a, b, c, pc, in, out の順)
+func (g *gdbStub) register(n int) uint8 {
+	cpu := g.cpu
+	switch n {
+	case 0:
+		return cpu.A
+	case 1:
+		return cpu.B
+	case 2:
+		if cpu.C {
+			return 1
+		}
+		return 0
+	case 3:
+		return cpu.PC
+	case 4:
+		return cpu.InPort
+	default:
+		return cpu.OutPort
+	}
+}
+
+// setRegister レジスタに値を設定する。値は下位4bit (cは下位1bit) だけを使う。
+func (g *gdbStub) setRegister(n int, v uint8) {
+	cpu := g.cpu
+	v &= 0x0F
+	switch n {
+	case 0:
+		cpu.A = v
+	case 1:
+		cpu.B = v
+	case 2:
+		cpu.C = v&1 != 0
+	case 3:
+		cpu.PC = v
+	case 4:
+		cpu.InPort = v
+	default:
+		cpu.OutPort = v
+	}
+}
+
+// step 1命令実行し、出力ポートが変化したらコンソール出力 (O パケット) で知らせる
+func (g *gdbStub) step() {
+	out := g.cpu.OutPort
+	g.cpu.Step()
+	if g.cpu.OutPort != out {
+		g.reply("O" + hex.EncodeToString([]byte(fmt.Sprintf("OUT: %04b (%d)\n", g.cpu.OutPort, g.cpu.OutPort))))
+	}
+}
+
+// cont ブレークポイントに到達するか、Ctrl-C を受け取るまで連続実行し、停止理由を返す
+// 再開したアドレスのブレークポイントでは停止しない。
+func (g *gdbStub) cont() int {
+	for first := true; ; first = false {
+		select {
+		case pkt, ok := <-g.packets:
+			if !ok || pkt == "\x03" {
+				return gdbSigInt
+			}
+		default:
+		}
+		if !first && g.cpu.IsBreakpoint(g.cpu.PC) {
+			return gdbSigTrap
+		}
+		g.step()
+		time.Sleep(time.Duration(g.speed) * time.Millisecond)
+	}
+}
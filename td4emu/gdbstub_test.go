@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestStub ROMに rom を書き込んだCPUのスタブを作成する (送信したデータは返り値のバッファに入る)
+func newTestStub(rom ...uint8) (*gdbStub, *bytes.Buffer) {
+	cpu := NewCPU()
+	copy(cpu.ROM[:], rom)
+	var buf bytes.Buffer
+	return &gdbStub{cpu: cpu, conn: &buf, packets: make(chan string, 16), signal: gdbSigTrap}, &buf
+}
+
+func TestGDBHandle(t *testing.T) {
+	g, buf := newTestStub(0x31, 0xB3, 0x01, 0xF2)
+	tests := []struct {
+		pkt, resp string
+	}{
+		{"?", "S05"},
+		{"qSupported:multiprocess+", "PacketSize=400;qXfer:features:read+;QStartNoAckMode+"},
+		{"qAttached", "1"},
+		{"Hg0", "OK"},
+		{"vMustReplyEmpty", ""}, // 対応していないパケット
+
+		// レジスタ (a, b, c, pc, in, out)
+		{"g", "000000000000"},
+		{"G0102010304050607", "OK"},
+		{"g", "010201030405"},
+		{"p3", "03"},
+		{"P0=1f", "OK"}, // 下位4bitだけを使う
+		{"p0", "0f"},
+		{"P2=02", "OK"}, // c は下位1bit
+		{"p2", "00"},
+		{"p6", "E01"},
+		{"G0102", "E01"},
+		{"G000000000000", "OK"},
+
+		// ROM
+		{"m0,4", "31b301f2"},
+		{"me,4", "0000"}, // 15番地まで
+		{"m10,1", "E01"},
+		{"Me,2:aabb", "OK"},
+		{"me,2", "aabb"},
+		{"Mf,2:aabb", "E01"},
+		{"M0,2:aa", "E01"},
+
+		// ブレークポイント
+		{"Z0,2,1", "OK"},
+		{"Z1,10,1", "E01"},
+		{"c", "S05"}, // 2番地で停止する (OUT 3 を実行して、O パケットを送る)
+		{"p3", "02"},
+		{"s", "S05"},
+		{"p3", "03"},
+		{"z0,2,1", "OK"},
+		{"Z0,1,1", "OK"},
+		{"c0", "S05"}, // 0番地から再開して、1番地で停止する
+		{"g", "010000010003"},
+		{"s", "S05"}, // ブレークポイントでもステップ実行はできる
+		{"p3", "02"},
+		{"s10", "E01"},
+
+		{"D", "OK"},
+	}
+	for _, tt := range tests {
+		resp, _ := g.handle(tt.pkt)
+		if resp == nil || *resp != tt.resp {
+			t.Fatalf("handle(%q) = %v, want %q", tt.pkt, resp, tt.resp)
+		}
+	}
+	if !strings.Contains(buf.String(), "$O"+fmt.Sprintf("%x", "OUT: 0011 (3)\n")) {
+		t.Errorf("no console output packet for OUT: %q", buf.String())
+	}
+	if resp, quit := g.handle("k"); resp != nil || !quit {
+		t.Errorf("handle(k) = %v, %v; want no reply and quit", resp, quit)
+	}
+}
+
+func TestGDBXfer(t *testing.T) {
+	doc := "0123456789"
+	for args, want := range map[string]string{"0,4": "m0123", "8,4": "l89", "a,4": "l", "x": "E01"} {
+		if got := gdbXfer(doc, args); got != want {
+			t.Errorf("gdbXfer(%q) = %q, want %q", args, got, want)
+		}
+	}
+	g, _ := newTestStub()
+	var xml strings.Builder
+	for offset := 0; ; offset += 0x40 {
+		resp, _ := g.handle(fmt.Sprintf("qXfer:features:read:target.xml:%x,40", offset))
+		xml.WriteString((*resp)[1:])
+		if (*resp)[0] == 'l' {
+			break
+		}
+	}
+	if xml.String() != gdbTargetXML {
+		t.Errorf("target.xml = %q", xml.String())
+	}
+}
+
+// gdbPacket パケットの形式にする
+func gdbPacket(data string) string {
+	return fmt.Sprintf("$%s#%02x", data, gdbChecksum(data))
+}
+
+// TestGDBSession 接続を通して、チェックサム・応答・Ctrl-C による停止を確かめる
+func TestGDBSession(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	g, _ := newTestStub(0x01, 0xF0) // 無限ループ
+	g.conn = server
+	done := make(chan bool)
+	go func() {
+		g.serve()
+		done <- true
+	}()
+	r := bufio.NewReader(client)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	send := func(s string) {
+		t.Helper()
+		if _, err := io.WriteString(client, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(want string) {
+		t.Helper()
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(r, got); err != nil || string(got) != want {
+			t.Fatalf("received %q, %v; want %q", got, err, want)
+		}
+	}
+
+	send("$g#00") // チェックサムの誤り
+	expect("-")
+	send(gdbPacket("g"))
+	expect("+" + gdbPacket("000000000000"))
+	send(gdbPacket("QStartNoAckMode"))
+	expect("+" + gdbPacket("OK"))
+	send(gdbPacket("p3"))
+	expect(gdbPacket("00")) // '+' を省略する
+	send(gdbPacket("c"))
+	time.Sleep(50 * time.Millisecond)
+	send("\x03")
+	expect(gdbPacket("S02"))
+	send(gdbPacket("k"))
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return after k")
+	}
+}
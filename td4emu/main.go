@@ -3,29 +3,27 @@ package main
 // 4bitCPU td4用のエミュレータ
 // 16進数テキスト形式で出力されたtd4用のバイナリコードを読み込み、実行するプログラムです。
 // > go fmt .\main.go
-// > go build -o td4emu.exe .\main.go
+// > go build -o td4emu.exe .
 // > td4emu.exe -step .\Hikizan.hex
 
 import (
 	"bufio"
+	"bytes"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"strconv"
 	"strings"
-	"time"
+
+	"main/asm"
+	"main/td4"
 )
 
-// CPU 構造体: TD4の内部状態を保持
+// CPU 構造体: TD4の内部状態 (td4.CPU) に、ファイルの読み込みと画面表示の機能を加えたもの
 type CPU struct {
-	A, B    uint8     // 4bit レジスタ
-	PC      uint8     // 4bit プログラムカウンタ
-	BP      uint8     // 4bit ブレイクポイント
-	C       bool      // キャリーフラグ
-	OutPort uint8     // 4bit 出力ポート
-	InPort  uint8     // 4bit 入力ポート (今回は固定で0)
-	ROM     [16]uint8 // 16バイトのプログラムメモリ
+	td4.CPU
 }
 
 var (
@@ -33,26 +31,30 @@ var (
 	MEM_MAX uint8 = 15
 )
 
+// dbg td4asm が出力したデバッグ情報 (読み込んでいない場合はnil)
+var dbg *DebugInfo
+
 var HelpText = [...]string{
 	"Command list",
 	"\tH :(Help) コマンドの使用方法を表示する。",
 	"\tS [address] [pocode] [pocode] ... :(Setdata) 指定したメモリ番地にオペコードを書き込む。",
-	"\tB [bp] :(Breakpoint) ブレークポイントの設定と削除を行う。",
+	"\tB [bp] :(Breakpoint) ブレークポイントの設定と削除を行う。bp はアドレス・ラベル名・ファイル名:行番号 で指定する。",
 	"\tM :(Memory) 現在の現在のメモリの内容を表示する。",
 	"\tD :(Dump) 現在のCPUのレジスタ内容を表示する。",
 	"\tT [count] :(Trace) プログラムを指定回数だけ命令を実行する（ステップ実行）。",
 	"\tG [address] :(Go) 指定したアドレスからプログラムを実行する。",
 	"\tV [speed] :(Velocity) 実行速度を設定する。",
 	"\tI [bit pattern] :(InPort) 入力ポートの値を設定する。",
+	"\tW [file] :(Write) ROMの内容をファイルに保存する。拡張子が .td4 ならソースコード、それ以外は S 形式で保存する。",
+	"\tSAVE [file] :CPUの状態(ROM・レジスタ・ポート・ブレークポイント・実行速度)をJSON形式で保存する。",
+	"\tLOAD file :SAVE で保存した状態を読み込む。ファイル名の代わりにJSONを書くこともできる。",
+	"\tPROTO [TEXT|JSON] :(Protocol) 応答の形式を切り替える。JSON では1行に1つのJSONで応答する(プログラムからの操作用)。",
 	"\tQ :(Quit) モニタプログラムを終了する。",
 }
 
 // NewCPU CPUの初期化
 func NewCPU() *CPU {
-	return &CPU{
-		ROM: [16]uint8{}, // ゼロ初期化 (NOP)
-		BP:  255,         // Break point 0-15以外の値は未設定の状態
-	}
+	return &CPU{*td4.NewCPU()}
 }
 
 // LoadROM ファイルからHex文字列を読み込んでROMに格納
@@ -87,49 +89,65 @@ func (cpu *CPU) LoadROM(filename string) error {
 			continue
 		}
 		// 要素に分割
-		elements := strings.Split(line, " ")
-		cpu.writeMemory(elements)
+		if err := cpu.writeMemory(strings.Fields(line)); err != nil {
+			return fmt.Errorf("%s: %v", filename, err)
+		}
 		break
 	}
 	return scanner.Err()
 }
 
-func (cpu *CPU) writeMemory(elements []string) {
-	if 3 > len(elements) { // パラメータが足りない場合は、警告して終了
-		fmt.Printf("Insufficient address or opcode information required for writing.\n")
-		return
+// Assemble ソースコードをアセンブルしてROMに格納し、アセンブル結果から作ったデバッグ情報を返す
+// エラーがあればROMは変更しない。診断情報は返した Assembler の Diags で参照できる。
+// includeRoot が空でなければ、INCLUDE できるファイルをそのディレクトリの中に限る。
+func (cpu *CPU) Assemble(name string, lines []string, includeRoot string) (*DebugInfo, *asm.Assembler, error) {
+	a := asm.NewAssembler(name, lines)
+	a.IncludeRoot = includeRoot
+	err1, err2 := a.Pass1(), a.Pass2()
+	if err1 != nil || err2 != nil {
+		var msg strings.Builder
+		a.Diags.Sort()
+		a.Diags.Write(&msg, "gcc")
+		return nil, a, fmt.Errorf("assembly failed:\n%s", msg.String())
+	}
+	var buf bytes.Buffer
+	if err := a.WriteDebugInfo(&buf); err != nil {
+		return nil, a, err
+	}
+	info, err := ReadDebugInfo(&buf, name)
+	if err != nil {
+		return nil, a, err
+	}
+	_, image := a.Image(true)
+	cpu.ROM = [16]uint8{}
+	copy(cpu.ROM[:], image)
+	return info, a, nil
+}
+
+// writeMemory S コマンドの書式 (S adr opc1 opc2 ...) で、ROMに書き込む
+func (cpu *CPU) writeMemory(elements []string) error {
+	if 3 > len(elements) { // パラメータが足りない場合はエラー
+		return fmt.Errorf("insufficient address or opcode information required for writing")
 	} //	書き込み開始アドレスのデコード
-	adr, adr_err := strconv.ParseInt(strings.Trim(elements[1], " \n\r"), 0, 16)
+	adr, adr_err := strconv.ParseInt(elements[1], 0, 16)
 	if adr_err != nil { //	正常に整数値に変換されたかをチェック
-		fmt.Printf("The address is specified incorrectly.\n")
-		return
+		return fmt.Errorf("invalid address: %s", elements[1])
 	}
-	if false == inRange(MEM_MIN, uint8(adr), MEM_MAX) { //	指定されたアドレスがメモリ空間内であるかをチェック
-		fmt.Printf("This system's memory space is limited to 0 to 15 bytes.\n")
-		return
+	if adr < 0 || adr > int64(MEM_MAX) { //	指定されたアドレスがメモリ空間内であるかをチェック (uint8に変換する前に調べる)
+		return fmt.Errorf("address out of range (0-15): %s", elements[1])
 	}
-	index := 2
-	for {
-		val, val_err := strconv.ParseInt(strings.Trim(elements[index], " \n\r"), 0, 16)
-		//	fmt.Printf("%d %T\n",val, val_err)
-		if val_err == nil { //	正常に整数値に変換されたかをチェック
-			//	fmt.Printf("%x %x %T\n", adr, val, val_err)
-			cpu.ROM[uint8(0x0f&adr)] = uint8(val) //	メモリの指定されたアドレスの内容を書換える。
-			adr++
-		} else {
-			fmt.Printf("invalid hex format at %d: %s\n", index, elements[index])
-			break
-		}
-		index++
-		if index >= len(elements) {
-			break
+	for index := 2; index < len(elements); index++ {
+		if adr > int64(MEM_MAX) {
+			return fmt.Errorf("memory overflow: this system has only %d bytes of memory space", len(cpu.ROM))
 		}
-		if uint8(adr) > MEM_MAX {
-			fmt.Printf("Memory overflow!!\nThis system has only %d bytes of memory space.\n", len(cpu.ROM))
-			break
+		val, val_err := strconv.ParseUint(elements[index], 0, 8)
+		if val_err != nil { //	正常に整数値に変換されたかをチェック
+			return fmt.Errorf("invalid hex format at %d: %s", index, elements[index])
 		}
+		cpu.ROM[uint8(0x0f&adr)] = uint8(val) //	メモリの指定されたアドレスの内容を書換える。
+		adr++
 	}
-	return
+	return nil
 }
 
 // DumpMemory 現在のメモリ内容を表示
@@ -142,12 +160,16 @@ func (cpu *CPU) DumpMemory(adress uint8) {
 		return fmt.Sprintf("%04b", v&0xF)
 	}
 	if adress != cpu.BP {
-		fmt.Printf("|   %02d   | 0x%02X 0b%s_%s |\n",
+		fmt.Fprintf(out, "|   %02d   | 0x%02X 0b%s_%s |",
 			adress, cpu.ROM[adress], bin4(cpu.ROM[adress]>>4), bin4(cpu.ROM[adress]))
 	} else {
-		fmt.Printf("|   %02d B | 0x%02X 0b%s_%s |\n",
+		fmt.Fprintf(out, "|   %02d B | 0x%02X 0b%s_%s |",
 			adress, cpu.ROM[adress], bin4(cpu.ROM[adress]>>4), bin4(cpu.ROM[adress]))
 	}
+	if dbg != nil { // デバッグ情報があれば、ラベルとソースコードを表示する。
+		fmt.Fprintf(out, " %-12s | %s |", dbg.Label(adress), dbg.Source(adress))
+	}
+	fmt.Fprintf(out, "\n")
 }
 
 // DumpState 現在のCPU状態を表示
@@ -164,92 +186,18 @@ func (cpu *CPU) DumpState(adress uint8) {
 		return fmt.Sprintf("%04b", v&0xF)
 	}
 	if adress != cpu.BP { // Break pointのある位置にBを表示する。
-		fmt.Printf("| PC:%02d   | OP:%02X | A:%s(%X) | B:%s(%X) | C:%d | IN:%s | OUT:%s |\n",
+		fmt.Fprintf(out, "| PC:%02d   | OP:%02X | A:%s(%X) | B:%s(%X) | C:%d | IN:%s | OUT:%s |",
 			adress, cpu.ROM[adress], bin4(cpu.A), cpu.A, bin4(cpu.B), cpu.B, cInt, bin4(cpu.InPort), bin4(cpu.OutPort))
 	} else {
-		fmt.Printf("| PC:%02d B | OP:%02X | A:%s(%X) | B:%s(%X) | C:%d | IN:%s | OUT:%s |\n",
+		fmt.Fprintf(out, "| PC:%02d B | OP:%02X | A:%s(%X) | B:%s(%X) | C:%d | IN:%s | OUT:%s |",
 			adress, cpu.ROM[adress], bin4(cpu.A), cpu.A, bin4(cpu.B), cpu.B, cInt, bin4(cpu.InPort), bin4(cpu.OutPort))
 	}
-}
-
-// Execute 1命令実行サイクル
-func (cpu *CPU) Execute() int {
-	if cpu.PC == cpu.BP { // ブレイクポイントなら、ここで1を返して終了する。
-		return 1
-	}
-	// フェッチ
-	opcode := cpu.ROM[cpu.PC]
-	// 次のPCを仮計算 (通常は PC+1, 15を超えたら0に戻る)
-	nextPC := (cpu.PC + 1) & 0x0F
-	// 下位4ビット（即値 Im）
-	im := opcode & 0x0F
-
-	// 上位4ビットで命令判定するか、特定のビットパターンで判定
-	// TD4の命令デコードロジック
-	switch {
-	// ADD A, Im (0000xxxx)
-	case (opcode & 0xF0) == 0x00:
-		res := uint16(cpu.A) + uint16(im)
-		cpu.A = uint8(res & 0x0F)
-		cpu.C = res > 15 // キャリー発生判定
-
-	// ADD B, Im (0101xxxx)
-	case (opcode & 0xF0) == 0x50:
-		res := uint16(cpu.B) + uint16(im)
-		cpu.B = uint8(res & 0x0F)
-		cpu.C = res > 15 // キャリー発生判定
-
-	// MOV A, B (00010000) - 0x10
-	case opcode == 0x10:
-		cpu.A = cpu.B
-
-	// MOV B, A (01000000) - 0x40
-	case opcode == 0x40:
-		cpu.B = cpu.A
-
-	// MOV A, Im (0011xxxx)
-	case (opcode & 0xF0) == 0x30:
-		cpu.A = im
-
-	// MOV B, Im (0111xxxx)
-	case (opcode & 0xF0) == 0x70:
-		cpu.B = im
-
-	// JMP Im (1111xxxx)
-	case (opcode & 0xF0) == 0xF0:
-		nextPC = im   // ジャンプ成立時はPCを書き換え
-		cpu.C = false // ※TD4仕様: JMPでCフラグは変化しないことが多いが、実装によってはリセットする場合もある。
-		// ここでは標準的なTD4仕様に従い、Cフラグは保持すべきだが、
-		// 一般的な解説ではJMPでCが変わる記述はないため、保持します。
-		// (ただし、元のCソース実装などでCがリセットされる場合もあるので注意)
-
-	// JNC Im (1110xxxx) - Jump if Not Carry
-	case (opcode & 0xF0) == 0xE0:
-		if !cpu.C {
-			nextPC = im
-		}
-		cpu.C = false // JNC命令実行後は通常Cフラグはクリアされませんが、
-		// 次の演算まで保持されるべきです。ここでは何もしないのが正解。
-
-	// IN A (00100000)
-	case opcode == 0x20:
-		cpu.A = cpu.InPort
-
-	// IN B (01100000)
-	case opcode == 0x60:
-		cpu.B = cpu.InPort
-
-	// OUT B (10010000)
-	case opcode == 0x90:
-		cpu.OutPort = cpu.B
-
-	// OUT Im (1011xxxx)
-	case (opcode & 0xF0) == 0xB0:
-		cpu.OutPort = im
+	if src := dbg.Source(adress); src != "" { // デバッグ情報があれば、次に実行するソースコードを表示する。
+		fmt.Fprintf(out, " %s", src)
+	} else if label := dbg.Label(adress); label != "" { // シンボルファイルだけなら、ラベル名を表示する。
+		fmt.Fprintf(out, " %s:", label)
 	}
-	// PC更新
-	cpu.PC = nextPC
-	return 0
+	fmt.Fprintf(out, "\n")
 }
 
 // TrimLastChar は文字列の最後のルーンを削除します
@@ -263,6 +211,34 @@ func TrimLastChar(s string) string {
 	return string(runes[:len(runes)-1])
 }
 
+// fileExists ファイルが存在すればtrueを返す
+func fileExists(name string) bool {
+	info, err := os.Stat(name)
+	return err == nil && !info.IsDir()
+}
+
+// listenLocal localhostのアドレスだけを受け付けて、TCPで待ち受ける
+func listenLocal(addr string) (net.Listener, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("only localhost addresses are accepted: %s", addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// stringList 複数回指定できるオプションの値
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, "; ") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
 // inRange 指定した値の範囲にあるかを判別する。範囲内であればtrueを返す。
 func inRange(min, value, max uint8) bool {
 	return value >= min && value <= max
@@ -275,6 +251,16 @@ func main() {
 	// 1. オプション（フラグ）の定義
 	stepMode := flag.Bool("step", false, "Enable step execution mode")
 	speed := flag.Int64("speed", 1000, "Execution speed in milliseconds per instruction")
+	dbgFile := flag.String("dbg", "", "Debug info file generated by td4asm -dbg, or a symbol file generated by td4asm -symfile (default: <hex_file>.dbg or <hex_file>.sym if it exists)")
+	dapMode := flag.Bool("dap", false, "Run as a Debug Adapter Protocol server on stdin/stdout")
+	dapListen := flag.String("dap-listen", "", "Run as a Debug Adapter Protocol server on a localhost TCP address (e.g. 127.0.0.1:4711)")
+	webListen := flag.String("web", "", "Serve a web front end on a localhost TCP address (e.g. 127.0.0.1:8080)")
+	tuiMode := flag.Bool("tui", false, "Run in a full-screen terminal UI with LEDs and input switches")
+	gdbListen := flag.String("gdb", "", "Run as a GDB remote stub on a localhost TCP address (e.g. 127.0.0.1:1234)")
+	scriptFile := flag.String("script", "", "Run monitor commands from a file, then exit (implies -step)")
+	protoName := flag.String("proto", "text", "Monitor protocol: text, or json for one JSON object per line (same as the PROTO command)")
+	var exprs stringList
+	flag.Var(&exprs, "e", "Run monitor commands separated by ';', then exit (implies -step, may be repeated)")
 
 	// 2. ヘルプ表示のカスタマイズ
 	flag.Usage = func() {
@@ -293,11 +279,38 @@ func main() {
 		fmt.Fprintf(os.Stderr, "  td4emu timer.hex             (標準実行)\n")
 		fmt.Fprintf(os.Stderr, "  td4emu -step timer.hex       (ステップ実行)\n")
 		fmt.Fprintf(os.Stderr, "  td4emu -speed 500 timer.hex  (実行速度の設定,単位はミリ秒)\n")
+		fmt.Fprintf(os.Stderr, "  td4emu -step -dbg timer.dbg timer.hex (ソースコードを表示しながらステップ実行)\n")
+		fmt.Fprintf(os.Stderr, "  td4emu -tui timer.hex        (LEDとスイッチの画面で操作する)\n")
+		fmt.Fprintf(os.Stderr, "  td4emu -web 127.0.0.1:8080 timer.td4 (ブラウザで編集・実行する)\n")
+		fmt.Fprintf(os.Stderr, "  td4emu -dap                  (エディタからデバッグするためのDAPサーバー)\n")
+		fmt.Fprintf(os.Stderr, "  td4emu -dap-listen 127.0.0.1:4711 (DAPサーバーをTCPで起動)\n")
+		fmt.Fprintf(os.Stderr, "  td4emu -gdb 127.0.0.1:1234 -speed 0 timer.hex (GDBから接続して操作する)\n")
+		fmt.Fprintf(os.Stderr, "  td4emu -speed 0 -e \"S 0 0x30; T 5; D\" timer.hex (モニタのコマンドを実行して終了する)\n")
+		fmt.Fprintf(os.Stderr, "  td4emu -speed 0 -script cmds.txt timer.hex (ファイルに書いたコマンドを実行して終了する)\n")
+		fmt.Fprintf(os.Stderr, "  td4emu -step -proto json timer.hex (プログラムから操作するため、JSONで応答する)\n")
 	}
 
 	// 3. 解析実行
 	flag.Parse()
 
+	// DAPサーバーモード (プログラムは launch 要求で指定する)
+	if *dapMode || *dapListen != "" {
+		serveDAP(*dapListen, *speed)
+		return
+	}
+
+	// Webフロントエンドモード (プログラムは省略できる)
+	if *webListen != "" {
+		serveWeb(*webListen, flag.Arg(0), *speed)
+		return
+	}
+
+	if *protoName != "text" && *protoName != "json" {
+		fmt.Fprintf(os.Stderr, "invalid -proto option: %s (text or json)\n", *protoName)
+		os.Exit(1)
+	}
+	proto := *protoName == "json"
+
 	// 4. 引数チェック（ファイル名がない場合）
 	args := flag.Args()
 	if len(args) < 1 {
@@ -314,6 +327,45 @@ func main() {
 	if err := cpu.LoadROM(filename); err != nil {
 		log.Fatalf("Error loading ROM: %v", err)
 	}
+	// デバッグ情報の読み込み (指定がなければ、HEXファイルと同じ名前の .dbg ファイル、.sym ファイルの順に探す)
+	if *dbgFile == "" {
+		*dbgFile = findDebugInfo(filename)
+	}
+	if *dbgFile != "" {
+		info, err := LoadDebugInfo(*dbgFile)
+		if err != nil {
+			log.Fatalf("Error loading debug info: %v", err)
+		}
+		dbg = info
+		fmt.Printf("Loaded debug info %s.\n", *dbgFile)
+	}
+
+	// GDBリモートスタブモード (操作はGDBから行う)
+	if *gdbListen != "" {
+		serveGDB(cpu, *gdbListen, *speed)
+		return
+	}
+
+	// ターミナルUIモード
+	if *tuiMode {
+		if err := runTUI(cpu, filename, *speed); err != nil {
+			log.Fatalf("%v", err)
+		}
+		return
+	}
+
+	// モニタのコマンド (スクリプトと -e オプションを指定した場合は、最初からステップ実行モードにする)
+	input, err := newCommandReader(*scriptFile, exprs, os.Stdin)
+	if err != nil {
+		log.Fatalf("Error loading script: %v", err)
+	}
+	if input.batch {
+		*stepMode = true
+	}
+	if proto { // 起動時の表示の代わりに、ready イベントを送る
+		runMonitor(cpu, input, speed, stepMode, proto)
+		return
+	}
 
 	fmt.Printf("4bit CPU TD4 emulator\n")
 	fmt.Printf("Reading from the serial port...\n")
@@ -323,162 +375,8 @@ func main() {
 	fmt.Printf("|:--------|:-----:|:---------:|:---------:|:---:|:-------:|:--------:|\n")
 	//	現在の状態を表示
 	cpu.DumpState(cpu.PC)
-	//	fmt.Printf("\n")
-	//	入力待ち用のリーダー
-	stdin := bufio.NewReader(os.Stdin)
-	execStatus := true
-	for execStatus {
-		//	loop = 1
-		//	ステップ実行モードの場合
-		if *stepMode {
-			fmt.Printf("> ")
-			//	stdin.ReadBytes('\n')
-			//	改行文字 '\n' が現れるまでバイトを読み込む
-			//	ReadBytesは区切り文字 '\n' も含めて返却する
-			data, _ := stdin.ReadBytes('\n')
-			line := strings.ToUpper(string(data))
-			line = strings.Replace(line, ",", " ", -1)
-			line = strings.Trim(line, " \n\r")
-			elements := strings.Split(strings.Trim(line, " \n\r"), " ")
-			firstWord := line[0]
-			switch firstWord {
-			/* 実装予定
-			Xコマンド	レジスタ、カウンタ、フラグ類の検査と変更
-			*/
-			case 'H': //	ヘルプの表示(help)
-				if len(elements) == 1 {
-					for i := 0; i < len(HelpText); i++ {
-						fmt.Printf("%s\n", HelpText[i])
-					}
-				}
-
-			case 'S': //	メモリの指定されたアドレスに値を書き込む。
-				// S 0 0x30 0x01 0x02 0x04 0x08 0x40 0x90 0xF7
-				// S 8 0x30 0x01 0x02 0x04 0x08 0x40 0x90 0xF7
-				// S 9 0x30 0x01 0x02 0x04 0x08 0x40 0x90 0xF7
-				// S 8 0x30 0x01 0x02 0x04 0x08 0x40 0x90 0xF7 0x40 0x90 0xF7
-				cpu.writeMemory(elements)
-
-			case 'B': //	ブレークポイントの参照、設定と解除
-				if len(elements) == 1 { // パラメータがなければ、現在の設定を表示する。
-					if inRange(MEM_MIN, cpu.BP, MEM_MAX) {
-						fmt.Printf("Break point: %d\n", cpu.BP)
-					} else {
-						fmt.Printf("Break point: none\n")
-					}
-				} else if len(elements) > 1 {
-					//	数値変換
-					val, err := strconv.ParseInt(strings.Trim(elements[1], " \n\r"), 0, 8)
-					if err == nil { //	文字列=>数値変換にエラーがなければ、次のステップへ
-						cpu.BP = uint8(val)
-						if inRange(MEM_MIN, uint8(val), MEM_MAX) { // アドレスの範囲であれば、BPに値を設定する。
-							fmt.Printf("Break point: %d\n", cpu.BP)
-						} else {
-							fmt.Printf("Break point: none\n")
-						}
-					}
-				}
-
-			case 'D': //	現在のCPUのレジスタ内容を表示する。
-				if 1 == len(elements) {
-					cpu.DumpState(cpu.PC)
-				}
-	
-			case 'M': //	現在の現在のメモリ内容を表示
-				if 1 == len(elements) {
-					fmt.Printf("| Adress | OP-code          |\n")
-					fmt.Printf("|:-------|:----------------:|\n")
-					for adr := 0; adr < 16; adr++ {
-						cpu.DumpMemory(uint8(adr))
-					}
-				}
-
-			case 'T': //	レジスタ表示しながらトレース実行する回数を設定する。
-				if len(elements) == 1 { //	引数がない場合は、1ステップだけ実行する。
-					cpu.Execute()
-					cpu.DumpState(cpu.PC)
-				} else if len(elements) > 1 {
-					//	数値変換
-					val, err := strconv.ParseInt(strings.Trim(elements[1], " \n\r"), 0, 64)
-					if err == nil {
-						//	fmt.Printf("|\n")
-						loop := int(val)
-						//	命令実行
-						for i := 0; i < loop; i++ {
-							state := cpu.Execute()
-							if state != 0 {
-								break //	Breakpointに到達したら、停止する。
-							}
-							time.Sleep(time.Duration(*speed) * time.Millisecond)
-							cpu.DumpState(cpu.PC)
-						}
-					}
-				}
-
-			case 'G': //	ユーザプログラムの連続実行
-				if len(elements) == 1 {
-					*stepMode = false
-					cpu.DumpState(cpu.PC)
-				} else if len(elements) > 1 {
-					//	数値変換
-					val, err := strconv.ParseInt(strings.Trim(elements[1], " \n\r"), 0, 8)
-					if err == nil { // 文字列=>数値変換にエラーがなければ、設定速度を更新
-						if inRange(MEM_MIN, uint8(val), MEM_MAX) { // アドレスの範囲であれば、PCのアドレスを更新して、連続実行モードに移行する。
-							cpu.PC = uint8(val)
-							*stepMode = false
-							cpu.DumpState(cpu.PC)
-						} else {
-							fmt.Printf("The address space that can be set by the program counter ranges from 0 to 15.")
-							*stepMode = true
-						}
-					} else {
-						fmt.Printf("G command parameter is invalid.\n")
-					}
-				}
-
-			case 'V': //	実行速度の設定(velocity)
-				if len(elements) == 1 { // パラメータがなければ、現在の設定を表示する。
-					fmt.Printf("Speed=%5dms/inst\n", *speed)
-				} else if len(elements) > 1 {
-					//	数値変換
-					val, err := strconv.ParseInt(strings.Trim(elements[1], " \n\r"), 0, 64)
-					if err == nil { // 文字列=>数値変換にエラーがなければ、設定速度を更新
-						*speed = int64(val)
-						fmt.Printf("Speed=%5dms/inst\n", *speed)
-					} else {
-						fmt.Printf("Failed to set execution speed.\n")
-						fmt.Printf("Please set the execution time for one step in milliseconds.\n")
-					}
-				}
-
-			case 'I': //	入力ポートの値を設定する。
-				if len(elements) > 1 {
-					//	数値変換
-					val, err := strconv.ParseInt(strings.Trim(elements[1], " \n\r"), 0, 8)
-					if err == nil {
-						cpu.InPort = uint8(0x0f & val)
-						cpu.DumpState(cpu.PC)
-					} else {
-						fmt.Printf("Only integer values ​​between 0 and 15 can be set.\n")
-					}
-				}
-
-			case 'Q': //	終了
-				// 	fmt.Printf("\n")
-				execStatus = false // プログラムを終了する。
-			}
-		} else {
-			// fmt.Println()
-			//	通常実行モードの場合、指定時間待機
-			//	命令実行
-			result := cpu.Execute()
-			if 0 != result {
-				*stepMode = true
-				continue
-			}
-			time.Sleep(time.Duration(*speed) * time.Millisecond)
-			cpu.DumpState(cpu.PC)
-		}
+	if err := runMonitor(cpu, input, speed, stepMode, proto); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
 	}
-	fmt.Printf("program terminated !\n")
 }
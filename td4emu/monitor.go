@@ -0,0 +1,385 @@
+package main
+
+// モニタプログラム
+// ステップ実行モードで受け付けるコマンド (H/S/B/M/D/T/G/V/I/W/SAVE/LOAD/PROTO/Q) を解析して実行する。
+// コマンドは、端末からの入力のほか、スクリプトファイル (-script)、コマンドラインの -e オプション、
+// パイプからも与えることができる。端末以外から与えたコマンドは、プロンプトの後に表示(エコー)し、
+// エラーになった時点で終了コード1で終了する。プロトコルモード (protocol.go) では、応答をJSONで返す。
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"main/td4"
+)
+
+// monitor モニタプログラムの状態
+type monitor struct {
+	cpu      *CPU
+	speed    *int64       // 1命令ごとの待ち時間 (ms)
+	stepMode *bool        // trueならコマンドを受け付け、falseなら連続実行する
+	quit     bool         // Q コマンドで終了する
+	proto    bool         // プロトコルモード (PROTO JSON) ならtrue
+	protocol td4.Protocol // プロトコルモードの応答とイベントの通し番号、コマンドが表示した状態
+}
+
+// execute 1行のコマンドを実行する。空行は何もしない。
+func (m *monitor) execute(line string) error {
+	line = strings.TrimSpace(line)
+	args := strings.Fields(line) // ファイル名は大文字小文字を変えずに使う
+	if len(args) == 0 {
+		return nil
+	}
+	switch strings.ToUpper(args[0]) { // 1文字目が S のコマンドと区別する
+	case "SAVE":
+		return m.save(args[1:])
+	case "LOAD":
+		return m.load(strings.TrimSpace(line[len(args[0]):]))
+	case "PROTO":
+		return m.setProtocol(args[1:])
+	}
+	line = strings.ToUpper(line)
+	line = strings.Replace(line, ",", " ", -1)
+	elements := strings.Fields(line)
+	if len(elements) == 0 {
+		return nil
+	}
+	cpu := m.cpu
+	switch elements[0][0] {
+	/* 実装予定
+	Xコマンド	レジスタ、カウンタ、フラグ類の検査と変更
+	*/
+	case 'H': //	ヘルプの表示(help)
+		for i := 0; i < len(HelpText); i++ {
+			fmt.Fprintf(out, "%s\n", HelpText[i])
+		}
+
+	case 'S': //	メモリの指定されたアドレスに値を書き込む。
+		// S 0 0x30 0x01 0x02 0x04 0x08 0x40 0x90 0xF7
+		return cpu.writeMemory(elements)
+
+	case 'B': //	ブレークポイントの参照、設定と解除
+		if len(elements) == 1 { // パラメータがなければ、現在の設定を表示する。
+			if inRange(MEM_MIN, cpu.BP, MEM_MAX) {
+				fmt.Fprintf(out, "Break point: %d %s\n", cpu.BP, dbg.Source(cpu.BP))
+			} else {
+				fmt.Fprintf(out, "Break point: none\n")
+			}
+			return nil
+		}
+		//	数値変換
+		if val, err := strconv.ParseInt(elements[1], 0, 16); err == nil {
+			cpu.BP = uint8(val) // 0～15以外の値で、ブレークポイントを解除する。
+			if val >= 0 && val <= int64(MEM_MAX) {
+				fmt.Fprintf(out, "Break point: %d\n", cpu.BP)
+			} else {
+				cpu.BP = 255
+				fmt.Fprintf(out, "Break point: none\n")
+			}
+			return nil
+		}
+		adr, err := dbg.Resolve(elements[1]) // ラベル名、ファイル名:行番号
+		if err != nil {
+			return err
+		}
+		cpu.BP = adr
+		fmt.Fprintf(out, "Break point: %d %s\n", cpu.BP, dbg.Source(cpu.BP))
+
+	case 'D': //	現在のCPUのレジスタ内容を表示する。
+		if len(elements) > 1 {
+			return fmt.Errorf("D command takes no parameters")
+		}
+		m.showState()
+
+	case 'M': //	現在の現在のメモリ内容を表示
+		if len(elements) > 1 {
+			return fmt.Errorf("M command takes no parameters")
+		}
+		if dbg != nil {
+			fmt.Fprintf(out, "| Adress | OP-code          | Label        | Source |\n")
+			fmt.Fprintf(out, "|:-------|:----------------:|:-------------|:-------|\n")
+		} else {
+			fmt.Fprintf(out, "| Adress | OP-code          |\n")
+			fmt.Fprintf(out, "|:-------|:----------------:|\n")
+		}
+		for adr := 0; adr < 16; adr++ {
+			cpu.DumpMemory(uint8(adr))
+		}
+
+	case 'T': //	レジスタ表示しながらトレース実行する回数を設定する。
+		if len(elements) == 1 { //	引数がない場合は、1ステップだけ実行する。
+			cpu.Execute()
+			m.showState()
+			return nil
+		}
+		//	数値変換
+		loop, err := strconv.ParseInt(elements[1], 0, 64)
+		if err != nil || loop < 0 {
+			return fmt.Errorf("invalid T command parameter: %s", elements[1])
+		}
+		//	命令実行
+		for i := int64(0); i < loop; i++ {
+			if cpu.Execute() != 0 {
+				break //	Breakpointに到達したら、停止する。
+			}
+			time.Sleep(time.Duration(*m.speed) * time.Millisecond)
+			m.showState()
+		}
+
+	case 'G': //	ユーザプログラムの連続実行
+		if len(elements) > 1 {
+			adr, err := dbg.Resolve(elements[1]) // 数値、ラベル名、ファイル名:行番号
+			if err != nil {
+				return fmt.Errorf("invalid G command parameter: %v", err)
+			}
+			cpu.PC = adr // PCのアドレスを更新して、連続実行モードに移行する。
+		}
+		*m.stepMode = false
+		m.showState()
+
+	case 'V': //	実行速度の設定(velocity)
+		if len(elements) > 1 {
+			//	数値変換
+			val, err := strconv.ParseInt(elements[1], 0, 64)
+			if err != nil || val < 0 {
+				return fmt.Errorf("invalid speed: %s (set the execution time for one step in milliseconds)", elements[1])
+			}
+			*m.speed = val
+		}
+		fmt.Fprintf(out, "Speed=%5dms/inst\n", *m.speed)
+
+	case 'I': //	入力ポートの値を設定する。
+		if len(elements) == 1 {
+			return fmt.Errorf("I command requires a bit pattern (e.g. I 0b0101)")
+		}
+		//	数値変換
+		val, err := strconv.ParseUint(elements[1], 0, 8)
+		if err != nil || val > 15 {
+			return fmt.Errorf("input value out of range (0-15): %s", elements[1])
+		}
+		cpu.InPort = uint8(val)
+		m.showState()
+
+	case 'W': //	ROMの内容をファイルに保存する。
+		if len(args) == 1 { // ファイル名がなければ、S 形式で表示する。
+			return cpu.WriteROM(out, "")
+		}
+		name := args[1]
+		if err := saveFile(name, func(w io.Writer) error { return cpu.WriteROM(w, name) }); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Wrote ROM to %s\n", name)
+
+	case 'Q': //	終了
+		m.quit = true // プログラムを終了する。
+
+	default:
+		return fmt.Errorf("unknown command: %s (H for help)", elements[0])
+	}
+	return nil
+}
+
+// save CPUの状態をスナップショットとしてファイルに保存する (ファイル名がなければ1行で表示する)
+func (m *monitor) save(args []string) error {
+	snap := m.cpu.Snapshot(*m.speed)
+	if len(args) == 0 {
+		data, err := json.Marshal(snap)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s\n", data)
+		return nil
+	}
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(args[0], append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Saved snapshot to %s\n", args[0])
+	return nil
+}
+
+// load ファイル、またはコマンドに続けて書いたJSONからスナップショットを読み込み、CPUの状態を戻す
+func (m *monitor) load(arg string) error {
+	if arg == "" {
+		return fmt.Errorf("LOAD command requires a snapshot file name or JSON")
+	}
+	var r io.Reader = strings.NewReader(arg)
+	if arg[0] != '{' {
+		file, err := os.Open(arg)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+	snap, err := td4.ReadSnapshot(r)
+	if err != nil {
+		return err
+	}
+	if err := m.cpu.Restore(snap); err != nil {
+		return err
+	}
+	*m.speed = snap.Speed
+	fmt.Fprintf(out, "Loaded snapshot. Speed=%5dms/inst\n", *m.speed)
+	m.showState()
+	return nil
+}
+
+// monitorCommand モニタのコマンド1つと、その位置 (エラーの表示に使う)
+type monitorCommand struct {
+	text string
+	pos  string // "ファイル名:行番号" または "-e"。端末からの入力は ""
+}
+
+// commandReader モニタのコマンドを、スクリプト・-e オプション・標準入力から順に読み込む
+type commandReader struct {
+	queue       []monitorCommand // -script と -e のコマンド
+	batch       bool             // trueならキューのコマンドを実行し終えたら終了する
+	stdin       *bufio.Reader
+	interactive bool // 標準入力が端末ならtrue
+	lineNo      int  // 標準入力の行番号
+	quiet       bool // trueならプロンプトとコマンドを表示しない (プロトコルモード)
+}
+
+// newCommandReader スクリプトファイルと -e オプションのコマンドを読み込む
+// どちらかを指定した場合は、それらを実行し終えた時点で終了する (標準入力 stdin は読まない)。
+func newCommandReader(script string, exprs []string, stdin *os.File) (*commandReader, error) {
+	r := &commandReader{stdin: bufio.NewReader(stdin), interactive: isTerminal(stdin)}
+	if script != "" {
+		lines, err := readScript(script)
+		if err != nil {
+			return nil, err
+		}
+		r.queue = append(r.queue, lines...)
+		r.batch = true
+	}
+	for _, e := range exprs {
+		for _, cmd := range strings.Split(e, ";") {
+			if cmd = strings.TrimSpace(cmd); cmd != "" {
+				r.queue = append(r.queue, monitorCommand{text: cmd, pos: "-e"})
+			}
+		}
+		r.batch = true
+	}
+	return r, nil
+}
+
+// readScript スクリプトファイルを読み込む。空行と # で始まるコメント行は読み飛ばす。
+func readScript(name string) ([]monitorCommand, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var cmds []monitorCommand
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		cmds = append(cmds, monitorCommand{text: line, pos: fmt.Sprintf("%s:%d", name, n)})
+	}
+	return cmds, scanner.Err()
+}
+
+// next プロンプトを表示して、次のコマンドを返す。コマンドがなくなったらfalseを返す。
+// 端末以外から読み込んだコマンドは、プロンプトの後に表示する。
+func (r *commandReader) next() (monitorCommand, bool) {
+	r.print("> ")
+	if len(r.queue) > 0 {
+		cmd := r.queue[0]
+		r.queue = r.queue[1:]
+		r.print(cmd.text + "\n")
+		return cmd, true
+	}
+	if r.batch {
+		r.print("\n")
+		return monitorCommand{}, false
+	}
+	//	改行文字 '\n' が現れるまでバイトを読み込む
+	data, err := r.stdin.ReadString('\n')
+	if err != nil && (err != io.EOF || data == "") { // 入力の終わり
+		r.print("\n")
+		return monitorCommand{}, false
+	}
+	r.lineNo++
+	cmd := monitorCommand{text: strings.Trim(data, " \n\r")}
+	if !r.interactive {
+		cmd.pos = fmt.Sprintf("<stdin>:%d", r.lineNo)
+		r.print(cmd.text + "\n")
+	}
+	return cmd, true
+}
+
+// print プロンプトとコマンドを表示する (プロトコルモードでは表示しない)
+func (r *commandReader) print(s string) {
+	if !r.quiet {
+		fmt.Printf("%s", s)
+	}
+}
+
+// isTerminal ファイルが端末(キャラクタデバイス)ならtrueを返す
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// runMonitor コマンドの入力と、連続実行を繰り返す
+// 端末以外から与えたコマンドがエラーになったら、そこで終了して、コマンドの位置を付けたエラーを返す。
+// proto がtrueなら、プロトコルモードで始める (ready イベントを送る)。
+func runMonitor(cpu *CPU, input *commandReader, speed *int64, stepMode *bool, proto bool) error {
+	m := &monitor{cpu: cpu, speed: speed, stepMode: stepMode, proto: proto}
+	if m.proto {
+		m.event("ready")
+	}
+	for !m.quit {
+		//	ステップ実行モードの場合
+		if *stepMode {
+			input.quiet = m.proto
+			cmd, ok := input.next()
+			if !ok {
+				break
+			}
+			if err := m.command(cmd.text); err != nil {
+				if cmd.pos == "" {
+					fmt.Printf("%v\n", err)
+					continue
+				}
+				return fmt.Errorf("%s: %s: %v", cmd.pos, cmd.text, err)
+			}
+		} else {
+			//	通常実行モードの場合、指定時間待機
+			//	命令実行
+			if cpu.Execute() != 0 {
+				*stepMode = true
+				if m.proto {
+					m.event("break")
+				}
+				continue
+			}
+			time.Sleep(time.Duration(*speed) * time.Millisecond)
+			if m.proto {
+				m.event("step")
+			} else {
+				cpu.DumpState(cpu.PC)
+			}
+		}
+	}
+	if m.proto {
+		m.event("exit")
+		return nil
+	}
+	fmt.Printf("program terminated !\n")
+	return nil
+}
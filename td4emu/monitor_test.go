@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"main/td4"
+)
+
+// captureStdout f を実行している間に標準出力 (とモニタの表示の出力先 out) へ書いた内容を返す
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout, out = w, w
+	done := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		done <- string(data)
+	}()
+	defer func() { os.Stdout, out = stdout, stdout }()
+	f()
+	w.Close()
+	return <-done
+}
+
+// pipeStdin text を書き込んだパイプを返す (端末でない標準入力の代わり)
+func pipeStdin(t *testing.T, text string) *os.File {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	go func() {
+		io.WriteString(w, text)
+		w.Close()
+	}()
+	return r
+}
+
+// monitorRun モニタでコマンドを実行し、CPU・標準出力・エラーを返す
+func monitorRun(t *testing.T, script string, exprs []string, stdin *os.File) (*CPU, string, error) {
+	t.Helper()
+	dbg = nil
+	cpu := NewCPU()
+	input, err := newCommandReader(script, exprs, stdin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	speed, stepMode := int64(0), true
+	var runErr error
+	out := captureStdout(t, func() { runErr = runMonitor(cpu, input, &speed, &stepMode, false) })
+	return cpu, out, runErr
+}
+
+// writeScript スクリプトファイルを作成する
+func writeScript(t *testing.T, text string) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "cmds.txt")
+	if err := os.WriteFile(name, []byte(text), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestMonitorBatch(t *testing.T) {
+	script := writeScript(t, "# ROMに書き込んで2命令実行する\nS 0 0x31 0x40\n\n  T 2  \n")
+	tests := []struct {
+		name   string
+		script string
+		exprs  []string
+		echo   []string // プロンプトの後に表示するコマンド (実行した順)
+		b      uint8
+	}{
+		{"script", script, nil, []string{"> S 0 0x31 0x40", "> T 2"}, 1},
+		{"-e", "", []string{"S 0 0x33 0x40; T 2", "V 0"}, []string{"> S 0 0x33 0x40", "> T 2", "> V 0"}, 3},
+		{"script then -e", script, []string{"I 5; S 2 0x10 0x40; T 2"}, []string{"> S 0 0x31 0x40", "> T 2", "> I 5", "> S 2 0x10 0x40", "> T 2"}, 1},
+		{"empty -e", "", []string{" ; "}, nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 標準入力は読まない
+			cpu, out, err := monitorRun(t, tt.script, tt.exprs, pipeStdin(t, "S 0 0xFF\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var echo []string
+			for _, line := range strings.Split(out, "\n") {
+				if strings.HasPrefix(line, "> ") && len(line) > 2 {
+					echo = append(echo, line)
+				}
+			}
+			if strings.Join(echo, "\n") != strings.Join(tt.echo, "\n") {
+				t.Errorf("commands:\n%s\nwant\n%s", strings.Join(echo, "\n"), strings.Join(tt.echo, "\n"))
+			}
+			if cpu.B != tt.b || cpu.ROM[0] == 0xFF {
+				t.Errorf("B = %d ROM[0] = %02X, want B = %d", cpu.B, cpu.ROM[0], tt.b)
+			}
+			if !strings.HasSuffix(out, "program terminated !\n") {
+				t.Errorf("output does not end with the termination message:\n%s", out)
+			}
+		})
+	}
+}
+
+func TestMonitorPipe(t *testing.T) {
+	cpu, out, err := monitorRun(t, "", nil, pipeStdin(t, "S 0 0xB6\r\n\nT\nQ\nS 0 0x00\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// パイプからのコマンドもプロンプトの後に表示し、Q で終了する
+	for _, want := range []string{"> S 0 0xB6\n", "> \n", "> T\n", "> Q\n"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output does not contain %q:\n%s", want, out)
+		}
+	}
+	if cpu.OutPort != 6 || cpu.ROM[0] != 0xB6 {
+		t.Errorf("OUT = %d ROM[0] = %02X, want OUT 6 and no command after Q", cpu.OutPort, cpu.ROM[0])
+	}
+
+	// 入力の終わり (最後の行に改行がなくても実行する)
+	cpu, _, err = monitorRun(t, "", nil, pipeStdin(t, "S 0 0xB7\nT"))
+	if err != nil || cpu.OutPort != 7 {
+		t.Errorf("OUT = %d, err = %v, want OUT 7", cpu.OutPort, err)
+	}
+}
+
+func TestMonitorStopsAtFirstError(t *testing.T) {
+	script := writeScript(t, "S 0 0xB1\n# comment\nX 1\nS 0 0xB2\n")
+	tests := []struct {
+		name   string
+		script string
+		exprs  []string
+		stdin  string
+		err    string
+	}{
+		{"script", script, []string{"S 0 0xB3"}, "", script + ":3: X 1: unknown command: X (H for help)"},
+		{"-e", "", []string{"S 0 0xB1; I 16; S 0 0xB2"}, "", "-e: I 16: input value out of range (0-15): 16"},
+		{"stdin", "", nil, "S 0 0xB1\nS 99 1\nS 0 0xB2\n", "<stdin>:2: S 99 1: address out of range (0-15): 99"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cpu, out, err := monitorRun(t, tt.script, tt.exprs, pipeStdin(t, tt.stdin))
+			if err == nil || err.Error() != tt.err {
+				t.Fatalf("error = %v, want %q", err, tt.err)
+			}
+			if cpu.ROM[0] != 0xB1 {
+				t.Errorf("ROM[0] = %02X, want the commands after the error not to run", cpu.ROM[0])
+			}
+			if strings.Contains(out, "program terminated") {
+				t.Errorf("output contains the normal termination message:\n%s", out)
+			}
+		})
+	}
+}
+
+func TestMonitorCommandErrors(t *testing.T) {
+	tests := []struct {
+		cmd, err string
+	}{
+		{"S 0", "insufficient address or opcode information required for writing"},
+		{"S x 1", "invalid address: X"},
+		{"S 16 1", "address out of range (0-15): 16"},
+		{"S 256 1", "address out of range (0-15): 256"}, // uint8 に変換すると0になる値
+		{"S -1 1", "address out of range (0-15): -1"},
+		{"S 15 1 2", "memory overflow: this system has only 16 bytes of memory space"},
+		{"S 0 0x100", "invalid hex format at 2: 0X100"},
+		{"D 1", "D command takes no parameters"},
+		{"M 1", "M command takes no parameters"},
+		{"T -1", "invalid T command parameter: -1"},
+		{"G NOLABEL", "invalid G command parameter: NOLABEL: no debug info loaded (use td4asm -dbg)"},
+		{"V -5", "invalid speed: -5 (set the execution time for one step in milliseconds)"},
+		{"I", "I command requires a bit pattern (e.g. I 0b0101)"},
+		{"I 0b10000", "input value out of range (0-15): 0B10000"},
+		{"Z", "unknown command: Z (H for help)"},
+	}
+	dbg = nil
+	for _, tt := range tests {
+		speed, stepMode := int64(0), true
+		m := &monitor{cpu: NewCPU(), speed: &speed, stepMode: &stepMode}
+		var err error
+		captureStdout(t, func() { err = m.execute(tt.cmd) })
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("%q: error = %v, want %q", tt.cmd, err, tt.err)
+		}
+	}
+}
+
+func TestMonitorBreakpoint(t *testing.T) {
+	tests := []struct {
+		arg string
+		bp  uint8 // 255 はブレークポイントなし
+	}{
+		{"3", 3},
+		{"0x0F", 15},
+		{"16", 255},
+		{"256", 255}, // uint8 に変換すると0になる値
+		{"0x103", 255},
+		{"-1", 255},
+	}
+	dbg = nil
+	for _, tt := range tests {
+		speed, stepMode := int64(0), true
+		m := &monitor{cpu: NewCPU(), speed: &speed, stepMode: &stepMode}
+		var err error
+		out := captureStdout(t, func() { err = m.execute("B " + tt.arg) })
+		if err != nil || m.cpu.BP != tt.bp {
+			t.Errorf("B %s: BP = %d, err = %v, want %d", tt.arg, m.cpu.BP, err, tt.bp)
+		}
+		if want := "Break point: none\n"; tt.bp == 255 && out != want {
+			t.Errorf("B %s printed %q, want %q", tt.arg, out, want)
+		}
+	}
+}
+
+func TestMonitorSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	snap, hex, src := filepath.Join(dir, "State.json"), filepath.Join(dir, "Rom.hex"), filepath.Join(dir, "Rom.td4")
+	cpu, out, err := monitorRun(t, "", []string{
+		"S 0 0x31 0x40 0xB5 0xF0; B 2; T 2; I 9; V 7",
+		"SAVE " + snap + "; W " + hex + "; W " + src,
+		"S 0 0 0 0 0; I 0; V 0; T 3", // 状態を変えてから LOAD で戻す
+		"LOAD " + snap,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cpu.A != 1 || cpu.B != 1 || cpu.PC != 2 || cpu.InPort != 9 || cpu.BP != 2 || cpu.ROM[2] != 0xB5 {
+		t.Errorf("after LOAD: A=%d B=%d PC=%d IN=%d BP=%d ROM=%X, want A=1 B=1 PC=2 IN=9 BP=2",
+			cpu.A, cpu.B, cpu.PC, cpu.InPort, cpu.BP, cpu.ROM)
+	}
+	if !strings.Contains(out, "Loaded snapshot. Speed=    7ms/inst") {
+		t.Errorf("LOAD does not restore the speed:\n%s", out)
+	}
+
+	// W で保存したファイルは、そのまま読み込める
+	rom := NewCPU()
+	if err := rom.LoadROM(hex); err != nil || rom.ROM != cpu.ROM {
+		t.Errorf("LoadROM(%s) = %X, %v, want %X", hex, rom.ROM, err, cpu.ROM)
+	}
+	data, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"MOV A, 1", "MOV B, A", "OUT 5", "JMP 0"} {
+		if !strings.Contains(string(data), line) {
+			t.Errorf("%s does not contain %q:\n%s", src, line, data)
+		}
+	}
+
+	// JSON を直接書く場合とエラー
+	tests := []struct {
+		cmd, err string
+	}{
+		{`LOAD {"format":"td4-snapshot","version":1,"rom":[179],"a":3}`, ""},
+		{"LOAD", "LOAD command requires a snapshot file name or JSON"},
+		{`LOAD {"format":"other","version":1}`, `not a TD4 snapshot (format "other")`},
+		{`LOAD {"format":"td4-snapshot","version":2}`, "unsupported snapshot version 2 (this emulator reads up to 1)"},
+		{`LOAD {"format":"td4-snapshot","version":1,"a":16}`, "snapshot value 16 is out of range (0-15)"},
+		{`LOAD {"format":"td4-snapshot","version":1,"rom":[256]}`, "snapshot ROM value 256 is out of range (0-255)"},
+		{`LOAD {"format":`, "invalid snapshot: unexpected EOF"},
+	}
+	for _, tt := range tests {
+		speed, stepMode := int64(0), true
+		m := &monitor{cpu: NewCPU(), speed: &speed, stepMode: &stepMode}
+		var err error
+		captureStdout(t, func() { err = m.execute(tt.cmd) })
+		if got := fmt.Sprint(err); tt.err == "" && err != nil || tt.err != "" && got != tt.err {
+			t.Errorf("%s: error = %v, want %q", tt.cmd, err, tt.err)
+		}
+	}
+}
+
+func TestMonitorProtocol(t *testing.T) {
+	_, text, err := monitorRun(t, "", []string{"PROTO JSON; S 0 0x31 0xB3; T 2; X; PROTO XML; PROTO TEXT; V 0"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// PROTO JSON の応答から PROTO TEXT の前までは、1行に1つのJSON
+	lines := strings.Split(text, "\n")
+	start := slices.IndexFunc(lines, func(s string) bool { return strings.HasPrefix(s, "{") })
+	if start < 0 || len(lines) < start+6 {
+		t.Fatalf("no JSON responses:\n%s", text)
+	}
+	tests := []struct {
+		cmd, typ, err string
+		trace         int
+	}{
+		{"PROTO JSON", "ok", "", 0},
+		{"S 0 0x31 0xB3", "ok", "", 0},
+		{"T 2", "ok", "", 2},
+		{"X", "error", "unknown command: X (H for help)", 0},
+		{"PROTO XML", "error", "invalid PROTO command parameter: XML (TEXT or JSON)", 0},
+	}
+	for i, tt := range tests {
+		var msg td4.ProtoMessage
+		if err := json.Unmarshal([]byte(lines[start+i]), &msg); err != nil {
+			t.Fatalf("%s: %v", lines[start+i], err)
+		}
+		if msg.Seq != i+1 || msg.Cmd != tt.cmd || msg.Type != tt.typ || msg.Error != tt.err || len(msg.Trace) != tt.trace {
+			t.Errorf("response %d = %+v, want cmd %q type %s error %q trace %d", i+1, msg, tt.cmd, tt.typ, tt.err, tt.trace)
+		}
+		if tt.cmd == "T 2" && (msg.State.PC != 2 || msg.State.A != 1 || msg.State.Out != 3 || msg.ROM[1] != 0xB3) {
+			t.Errorf("T 2: state = %+v ROM = %v", msg.State, msg.ROM)
+		}
+	}
+	if lines[start+5] != "Protocol: text" || !strings.Contains(text, "> V 0\nSpeed=    0ms/inst\n") {
+		t.Errorf("PROTO TEXT does not return to the text mode:\n%s", strings.Join(lines[start+5:], "\n"))
+	}
+}
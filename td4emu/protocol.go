@@ -0,0 +1,92 @@
+package main
+
+// プロトコルモード (PROTO JSON コマンド、-proto json オプション)
+// プログラムからモニタを操作するためのモードで、プロンプトとエコーを表示せず、1行に1つのJSONで応答する。
+// コマンドはテキストモードと同じ書式で1行ずつ送り、1つのコマンドに必ず1行の応答 (type が ok または error) を返す。
+// 連続実行中は、1命令ごとに step、ブレークポイントで停止したときに break のイベントを送る。
+// 応答とイベントの形式は td4/protocol.go を参照 (TinyGo版 (td4emu_tinygo) と共通)。
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"main/td4"
+)
+
+// out モニタの表示の出力先 (プロトコルモードでは、応答の output に含めるために切り替える)
+var out io.Writer = os.Stdout
+
+// send 応答またはイベントに、現在の状態を付けて送る
+func (m *monitor) send(msg td4.ProtoMessage) {
+	msg.State, msg.Speed, msg.Running = m.cpu.ProtoState(), *m.speed, !*m.stepMode
+	m.protocol.Send(os.Stdout, msg)
+}
+
+// event イベントを送る
+func (m *monitor) event(name string) {
+	m.send(td4.ProtoMessage{Type: "event", Event: name})
+}
+
+// showState コマンドの実行後の状態を表示する (プロトコルモードでは応答の trace に加える)
+func (m *monitor) showState() {
+	if m.proto {
+		m.protocol.Trace = append(m.protocol.Trace, m.cpu.ProtoState())
+		return
+	}
+	m.cpu.DumpState(m.cpu.PC)
+}
+
+// command 1行のコマンドを実行する
+// プロトコルモードでは、表示を応答に含めて送り、エラーも応答として送る (エラーを返さない)。
+func (m *monitor) command(line string) error {
+	if strings.TrimSpace(line) == "" {
+		return nil
+	}
+	if !m.proto {
+		err := m.execute(line)
+		if err == nil && m.proto { // PROTO JSON でプロトコルモードに切り替えた
+			m.respond(line, "", nil)
+		}
+		return err
+	}
+	var buf bytes.Buffer
+	out, m.protocol.Trace = &buf, nil
+	err := m.execute(line)
+	out = os.Stdout
+	if !m.proto { // PROTO TEXT でテキストモードに戻した
+		fmt.Fprint(out, buf.String())
+		return err
+	}
+	m.respond(line, buf.String(), err)
+	return nil
+}
+
+// respond コマンドの応答を送る
+func (m *monitor) respond(line, output string, err error) {
+	m.send(m.protocol.Response(&m.cpu.CPU, line, output, err))
+}
+
+// setProtocol PROTO コマンド: モニタの応答の形式を切り替える (引数がなければ、現在の形式を表示する)
+func (m *monitor) setProtocol(args []string) error {
+	if len(args) == 0 {
+		if m.proto {
+			fmt.Fprintf(out, "Protocol: json\n")
+		} else {
+			fmt.Fprintf(out, "Protocol: text\n")
+		}
+		return nil
+	}
+	switch strings.ToUpper(args[0]) {
+	case "JSON":
+		m.proto = true
+	case "TEXT":
+		m.proto = false
+		fmt.Fprintf(out, "Protocol: text\n")
+	default:
+		return fmt.Errorf("invalid PROTO command parameter: %s (TEXT or JSON)", args[0])
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+// ROMの保存 (W コマンド) と、スナップショットのファイルへの保存 (SAVE, LOAD コマンド)
+// スナップショットの形式は td4/snapshot.go を参照 (TinyGo版 (td4emu_tinygo) と共通)。
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"main/asm"
+)
+
+// WriteROM ROMの内容を書き込む
+// 拡張子が .td4 ならアセンブルできるソースコード、それ以外は LoadROM で読み込める S 形式で書き込む。
+func (cpu *CPU) WriteROM(w io.Writer, name string) error {
+	if !strings.EqualFold(filepath.Ext(name), ".td4") {
+		if err := asm.WriteHex(w, 0, cpu.ROM[:]); err != nil {
+			return err
+		}
+		_, err := fmt.Fprintln(w)
+		return err
+	}
+	fmt.Fprintf(w, "; ROM saved by td4emu\n")
+	for adr, b := range cpu.ROM {
+		label := dbg.Label(uint8(adr))
+		if label != "" {
+			label += ":"
+		}
+		if _, err := fmt.Fprintf(w, "%-8s%-16s; %02X\n", label, asm.Disassemble(b), adr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveFile ファイルを作成して書き込む
+func saveFile(name string, write func(w io.Writer) error) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,9 @@
+package main
+
+import "syscall"
+
+// 端末の設定を読み書きする ioctl の要求
+const (
+	ioctlGetTermios = syscall.TIOCGETA
+	ioctlSetTermios = syscall.TIOCSETA
+)
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+import (
+	"errors"
+	"runtime"
+)
+
+// makeRaw この環境では端末の設定を変更できない
+func makeRaw() (restore func(), err error) {
+	return nil, errors.New("terminal UI is not supported on " + runtime.GOOS)
+}
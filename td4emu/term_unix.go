@@ -0,0 +1,38 @@
+//go:build linux || darwin
+
+package main
+
+// 端末の設定 (Linux・macOS)
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// makeRaw 標準入力の端末を、1文字ずつエコーなしで読み込むモードにする
+// 元の設定に戻す関数を返す。
+func makeRaw() (restore func(), err error) {
+	fd := os.Stdin.Fd()
+	var old syscall.Termios
+	if err := termios(fd, ioctlGetTermios, &old); err != nil {
+		return nil, err
+	}
+	raw := old
+	raw.Iflag &^= syscall.ICRNL | syscall.IXON
+	raw.Lflag &^= syscall.ICANON | syscall.ECHO | syscall.ISIG | syscall.IEXTEN
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if err := termios(fd, ioctlSetTermios, &raw); err != nil {
+		return nil, err
+	}
+	return func() { termios(fd, ioctlSetTermios, &old) }, nil
+}
+
+// termios 端末の設定を読み書きする
+func termios(fd uintptr, req uintptr, t *syscall.Termios) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(unsafe.Pointer(t))); errno != 0 {
+		return errno
+	}
+	return nil
+}
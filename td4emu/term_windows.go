@@ -0,0 +1,53 @@
+package main
+
+// 端末の設定 (Windows)
+
+import (
+	"os"
+	"syscall"
+)
+
+// コンソールモードのフラグ
+const (
+	enableProcessedInput            = 0x0001
+	enableLineInput                 = 0x0002
+	enableEchoInput                 = 0x0004
+	enableVirtualTerminalInput      = 0x0200
+	enableVirtualTerminalProcessing = 0x0004
+)
+
+var procSetConsoleMode = syscall.NewLazyDLL("kernel32.dll").NewProc("SetConsoleMode")
+
+// setConsoleMode コンソールモードを設定する
+func setConsoleMode(h syscall.Handle, mode uint32) error {
+	if r, _, err := procSetConsoleMode.Call(uintptr(h), uintptr(mode)); r == 0 {
+		return err
+	}
+	return nil
+}
+
+// makeRaw 標準入力のコンソールを、1文字ずつエコーなしで読み込むモードにする
+// 標準出力ではANSIエスケープシーケンスを有効にする。元の設定に戻す関数を返す。
+func makeRaw() (restore func(), err error) {
+	in := syscall.Handle(os.Stdin.Fd())
+	out := syscall.Handle(os.Stdout.Fd())
+	var inMode, outMode uint32
+	if err := syscall.GetConsoleMode(in, &inMode); err != nil {
+		return nil, err
+	}
+	if err := syscall.GetConsoleMode(out, &outMode); err != nil {
+		return nil, err
+	}
+	raw := inMode&^(enableProcessedInput|enableLineInput|enableEchoInput) | enableVirtualTerminalInput
+	if err := setConsoleMode(in, raw); err != nil {
+		return nil, err
+	}
+	if err := setConsoleMode(out, outMode|enableVirtualTerminalProcessing); err != nil {
+		setConsoleMode(in, inMode)
+		return nil, err
+	}
+	return func() {
+		setConsoleMode(in, inMode)
+		setConsoleMode(out, outMode)
+	}, nil
+}
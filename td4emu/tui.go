@@ -0,0 +1,344 @@
+package main
+
+// 全画面のターミナルUI (-tui)
+// 画面を書き換えながら、ROMの内容・レジスタ・出力LED・入力スイッチ・クロックを
+// TD4の基板のように表示し、キー操作で実行・停止・ステップ実行などを行う。
+//
+// キー操作:
+//   Space, s   ステップ実行          r, g   連続実行/停止
+//   x          リセット              ↑ ↓ (k j)  カーソルの移動
+//   b          カーソル位置のブレークポイントの設定と解除
+//   1～4       入力スイッチの切り替え (左から bit3～bit0)
+//   + -        クロックの変更        q, Ctrl-C  終了
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ANSIエスケープシーケンス
+const (
+	ansiReset   = "\x1b[0m"
+	ansiReverse = "\x1b[7m"
+	ansiDim     = "\x1b[2m"
+	ansiRed     = "\x1b[1;31m"
+	ansiGreen   = "\x1b[1;32m"
+	ansiYellow  = "\x1b[1;33m"
+)
+
+// tuiSpeeds +/- キーで切り替えるクロック (1命令あたりのミリ秒)
+var tuiSpeeds = []int64{2000, 1000, 500, 200, 100, 50, 20, 10, 0}
+
+// frameInterval 連続実行中に画面を書き換える最短の間隔
+const frameInterval = 30 * time.Millisecond
+
+// tui ターミナルUIの状態
+type tui struct {
+	cpu     *CPU
+	name    string // 表示するファイル名
+	speed   int64  // 1命令あたりの待ち時間 (ミリ秒)
+	running bool
+	cursor  uint8  // ブレークポイントを設定するアドレス
+	message string // 最下行に表示するメッセージ
+}
+
+// runTUI ターミナルUIを起動し、q キーで終了するまで操作を受け付ける
+func runTUI(cpu *CPU, filename string, speed int64) error {
+	restore, err := makeRaw()
+	if err != nil {
+		return fmt.Errorf("-tui: %v", err)
+	}
+	defer restore()
+	fmt.Print("\x1b[?1049h\x1b[?25l") // 代替画面に切り替え、カーソルを隠す
+	defer fmt.Print("\x1b[?25h\x1b[?1049l")
+
+	t := &tui{cpu: cpu, name: filepath.Base(filename), speed: max(speed, 0)}
+	keys := make(chan string, 16)
+	go readKeys(keys)
+
+	var lastDraw time.Time
+	t.draw()
+	for {
+		var tick <-chan time.Time
+		if t.running {
+			tick = time.After(time.Duration(t.speed) * time.Millisecond)
+		}
+		select {
+		case key, ok := <-keys:
+			if !ok || !t.handleKey(key) {
+				return nil
+			}
+		case <-tick:
+			t.tick()
+			if t.running && time.Since(lastDraw) < frameInterval {
+				continue // 高速で実行している間は、画面の書き換えを間引く
+			}
+		}
+		t.draw()
+		lastDraw = time.Now()
+	}
+}
+
+// readKeys 標準入力から読み込んだキーを送る。矢印キーは "up" "down" として送る。
+func readKeys(keys chan<- string) {
+	defer close(keys)
+	buf := make([]byte, 16)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return
+		}
+		for i := 0; i < n; i++ {
+			if buf[i] == 0x1b && i+2 < n && (buf[i+1] == '[' || buf[i+1] == 'O') {
+				switch buf[i+2] {
+				case 'A':
+					keys <- "up"
+				case 'B':
+					keys <- "down"
+				}
+				i += 2
+				continue
+			}
+			keys <- string(buf[i])
+		}
+	}
+}
+
+// handleKey キー操作を処理する。終了する場合はfalseを返す。
+func (t *tui) handleKey(key string) bool {
+	cpu := t.cpu
+	t.message = ""
+	switch key {
+	case "q", "Q", "\x03":
+		return false
+	case " ", "s", "S":
+		t.running = false
+		t.step()
+	case "r", "R", "g", "G":
+		t.running = !t.running
+		if t.running && cpu.IsBreakpoint(cpu.PC) {
+			t.step() // 停止しているブレークポイントから再開する
+		}
+	case "x", "X":
+		t.running = false
+		cpu.Reset()
+		t.message = "リセットしました。"
+	case "up", "k", "K":
+		t.cursor = (t.cursor - 1) & MEM_MAX
+	case "down", "j", "J":
+		t.cursor = (t.cursor + 1) & MEM_MAX
+	case "b", "B":
+		if cpu.IsBreakpoint(t.cursor) {
+			cpu.Breaks[t.cursor] = false
+			if cpu.BP == t.cursor {
+				cpu.BP = 255
+			}
+		} else {
+			cpu.Breaks[t.cursor] = true
+		}
+	case "1", "2", "3", "4":
+		cpu.InPort ^= 0x08 >> (key[0] - '1')
+	case "+", "=":
+		t.speed = t.nextSpeed(+1)
+	case "-", "_":
+		t.speed = t.nextSpeed(-1)
+	}
+	return true
+}
+
+// nextSpeed 今より速い (dir > 0) または遅い (dir < 0) 次のクロックを返す
+func (t *tui) nextSpeed(dir int) int64 {
+	if dir > 0 {
+		for _, s := range tuiSpeeds {
+			if s < t.speed {
+				return s
+			}
+		}
+		return t.speed
+	}
+	for i := len(tuiSpeeds) - 1; i >= 0; i-- {
+		if tuiSpeeds[i] > t.speed {
+			return tuiSpeeds[i]
+		}
+	}
+	return t.speed
+}
+
+// step 1命令実行する
+func (t *tui) step() {
+	t.cpu.Step()
+	if t.cpu.IsBreakpoint(t.cpu.PC) {
+		t.message = fmt.Sprintf("ブレークポイント %02d に到達しました。", t.cpu.PC)
+	}
+}
+
+// tick 連続実行中に1命令実行し、ブレークポイントに到達したら停止する
+func (t *tui) tick() {
+	if !t.running {
+		return
+	}
+	t.step()
+	if t.cpu.IsBreakpoint(t.cpu.PC) {
+		t.running = false
+	}
+}
+
+// draw 画面全体を書き換える
+func (t *tui) draw() {
+	cpu := t.cpu
+	state := "STOP"
+	if t.running {
+		state = ansiGreen + "RUN" + ansiReset
+	}
+	lines := []string{fmt.Sprintf(" %sTD4 EMULATOR%s  %s", ansiReverse, ansiReset, t.name)}
+
+	left := box("ROM", 50, t.romRows())
+	right := box("REGISTER", 24, []string{
+		fmt.Sprintf(" A   %s  %X", leds(cpu.A, 4, ansiGreen), cpu.A),
+		fmt.Sprintf(" B   %s  %X", leds(cpu.B, 4, ansiGreen), cpu.B),
+		fmt.Sprintf(" C   %s", leds(boolBit(cpu.C), 1, ansiGreen)),
+		fmt.Sprintf(" PC  %s  %X", leds(cpu.PC, 4, ansiGreen), cpu.PC),
+	})
+	right = append(right, box("OUT", 24, []string{
+		"   " + leds(cpu.OutPort, 4, ansiRed),
+		ansiDim + "   3   2   1   0" + ansiReset,
+	})...)
+	right = append(right, box("IN", 24, []string{
+		ansiDim + "   3   2   1   0" + ansiReset,
+		"  " + switches(cpu.InPort),
+		ansiDim + "  [1] [2] [3] [4]  key" + ansiReset,
+	})...)
+	clock := "max"
+	if t.speed > 0 {
+		clock = fmt.Sprintf("%dms", t.speed)
+	}
+	right = append(right, box("CLOCK", 24, []string{
+		fmt.Sprintf(" %-8s %s", clock, state),
+		ansiDim + " +/- : speed" + ansiReset,
+	})...)
+	for i := range left {
+		line := left[i]
+		if i < len(right) {
+			line += " " + right[i]
+		}
+		lines = append(lines, line)
+	}
+
+	lines = append(lines,
+		" Space:ステップ r:実行/停止 x:リセット ↑↓:移動 b:ブレークポイント 1-4:入力 q:終了",
+		" "+t.message)
+
+	var b strings.Builder
+	b.WriteString("\x1b[H")
+	for _, line := range lines {
+		b.WriteString(line + "\x1b[K\r\n")
+	}
+	b.WriteString("\x1b[J")
+	os.Stdout.WriteString(b.String())
+}
+
+// romRows ROMの内容を1番地ずつ返す
+// カーソルの位置に ">"、ブレークポイントに "●" を表示し、PCの位置を反転表示する。
+func (t *tui) romRows() []string {
+	cpu := t.cpu
+	rows := []string{ansiDim + "    ADR HEX BINARY    LABEL    SOURCE" + ansiReset}
+	for adr := MEM_MIN; adr <= MEM_MAX; adr++ {
+		cur, bp := " ", " "
+		if adr == t.cursor {
+			cur = ">"
+		}
+		if cpu.IsBreakpoint(adr) {
+			bp = ansiRed + "●" + ansiReset
+		}
+		src := ""
+		if dbg != nil {
+			src = strings.Join(strings.Fields(dbg.Lines[adr].Text), " ")
+		}
+		op := cpu.ROM[adr]
+		row := fmt.Sprintf("%02d  %02X  %04b_%04b %-8s %s", adr, op, op>>4, op&0x0F, truncate(dbg.Label(adr), 8), src)
+		row = truncate(row, 44)
+		if adr == cpu.PC {
+			row = ansiReverse + pad(row, 44) + ansiReset
+		}
+		rows = append(rows, cur+bp+" "+row)
+	}
+	return rows
+}
+
+// box 罫線で囲んだ枠を返す (width は枠の内側の幅)
+func box(title string, width int, rows []string) []string {
+	lines := []string{"┌─ " + title + " " + strings.Repeat("─", max(width-len(title)-3, 0)) + "┐"}
+	for _, row := range rows {
+		lines = append(lines, "│"+pad(row, width)+"│")
+	}
+	return append(lines, "└"+strings.Repeat("─", width)+"┘")
+}
+
+// leds 値の下位 n bit をLEDとして表示する (上位bitから)
+func leds(v uint8, n int, color string) string {
+	s := make([]string, n)
+	for i := 0; i < n; i++ {
+		if v&(1<<(n-1-i)) != 0 {
+			s[i] = color + "●" + ansiReset
+		} else {
+			s[i] = ansiDim + "○" + ansiReset
+		}
+	}
+	return strings.Join(s, "   ")
+}
+
+// switches 入力ポートの値をDIPスイッチとして表示する (上位bitから)
+func switches(v uint8) string {
+	s := make([]string, 4)
+	for i := 0; i < 4; i++ {
+		if v&(0x08>>i) != 0 {
+			s[i] = "[" + ansiYellow + "■" + ansiReset + "]"
+		} else {
+			s[i] = "[ ]"
+		}
+	}
+	return strings.Join(s, " ")
+}
+
+// boolBit trueを1、falseを0として返す
+func boolBit(b bool) uint8 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// visibleWidth エスケープシーケンスを除いた文字数を返す
+func visibleWidth(s string) int {
+	n, esc := 0, false
+	for _, r := range s {
+		switch {
+		case esc:
+			esc = r < '@' || r > '~' || r == '['
+		case r == 0x1b:
+			esc = true
+		default:
+			n++
+		}
+	}
+	return n
+}
+
+// pad 表示幅が width になるまで空白を追加する
+func pad(s string, width int) string {
+	if n := visibleWidth(s); n < width {
+		return s + strings.Repeat(" ", width-n)
+	}
+	return s
+}
+
+// truncate エスケープシーケンスを含まない文字列を width 文字までに切り詰める
+func truncate(s string, width int) string {
+	if r := []rune(s); len(r) > width {
+		return string(r[:width])
+	}
+	return s
+}
@@ -0,0 +1,355 @@
+package main
+
+// ブラウザから操作するWebフロントエンド (-web)
+// td4emu -web 127.0.0.1:8080 [prog.td4|prog.hex] で起動し、ブラウザで http://127.0.0.1:8080/ を開く。
+// ページ(web/ディレクトリ)は実行ファイルに埋め込んでいるので、ネットワークに接続していなくても動作する。
+//
+// ページとは /ws のWebSocketでJSONのメッセージをやり取りする。CPUは1つで、接続しているすべてのページに状態を送る。
+//   ページ → サーバー  {"cmd": "assemble", "source": "..."}  ソースコードをアセンブルしてROMに書き込む
+//                      {"cmd": "step"} {"cmd": "run"} {"cmd": "stop"} {"cmd": "reset"}
+//                      {"cmd": "rom", "addr": n, "value": v}    ROMの1バイトを書き換える
+//                      {"cmd": "in", "value": v}                入力ポートを設定する
+//                      {"cmd": "speed", "value": ms}            クロック (1命令あたりのミリ秒)
+//                      {"cmd": "break", "addr": n}              ブレークポイントの設定と解除
+//   サーバー → ページ  {"type": "state", ...}      CPUの状態 (変化するたびに送る)
+//                      {"type": "source", ...}     エディタに表示するソースコード (接続時に送る)
+//                      {"type": "assembled", ...}  アセンブルの結果と診断情報 (要求したページにだけ送る)
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:embed web
+var webAssets embed.FS
+
+// webCommand ページから送られる操作
+type webCommand struct {
+	Cmd    string `json:"cmd"`
+	Source string `json:"source"`
+	Addr   int    `json:"addr"`
+	Value  int    `json:"value"`
+}
+
+// webState ページに送るCPUの状態
+type webState struct {
+	Type    string     `json:"type"`
+	A       uint8      `json:"a"`
+	B       uint8      `json:"b"`
+	C       bool       `json:"c"`
+	PC      uint8      `json:"pc"`
+	In      uint8      `json:"in"`
+	Out     uint8      `json:"out"`
+	ROM     [16]uint8  `json:"rom"`
+	Breaks  [16]bool   `json:"breaks"`
+	Labels  [16]string `json:"labels"` // デバッグ情報のラベル
+	Code    [16]string `json:"code"`   // デバッグ情報のソースコード
+	Running bool       `json:"running"`
+	Speed   int64      `json:"speed"`
+}
+
+// webSource ページのエディタに表示するソースコード
+type webSource struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+	Text string `json:"text"`
+}
+
+// webAssembled アセンブルの結果
+type webAssembled struct {
+	Type        string          `json:"type"`
+	OK          bool            `json:"ok"`
+	Diagnostics []webDiagnostic `json:"diagnostics"`
+}
+
+// webDiagnostic エディタに表示するエラー・警告 (Line が0の場合は行を特定できない)
+type webDiagnostic struct {
+	Line     int    `json:"line"`
+	Col      int    `json:"col"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// webServer Webフロントエンドの状態
+type webServer struct {
+	mu      sync.Mutex // 以下の状態の排他制御
+	cpu     *CPU
+	name    string // エディタのソースコードのファイル名 (INCLUDE の検索と診断情報に使う)
+	source  string
+	speed   int64
+	running bool
+	clients map[*wsConn]bool
+	wake    chan struct{} // 連続実行を開始したことを実行ループに知らせる
+}
+
+// serveWeb Webフロントエンドを起動する
+// program が .td4 ならエディタに読み込んでアセンブルし、.hex ならROMに読み込む。
+func serveWeb(addr, program string, speed int64) {
+	s := &webServer{
+		cpu:     NewCPU(),
+		name:    "program.td4",
+		speed:   max(speed, 0),
+		clients: make(map[*wsConn]bool),
+		wake:    make(chan struct{}, 1),
+	}
+	switch {
+	case strings.EqualFold(filepath.Ext(program), ".td4"):
+		data, err := os.ReadFile(program)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		s.name, s.source = program, string(data)
+		if _, err := s.assemble(s.source); err != nil {
+			fmt.Fprintf(os.Stderr, "%v", err)
+		}
+	case program != "":
+		if err := s.cpu.LoadROM(program); err != nil {
+			log.Fatalf("Error loading ROM: %v", err)
+		}
+		if name := findDebugInfo(program); name != "" {
+			info, err := LoadDebugInfo(name)
+			if err != nil {
+				log.Fatalf("Error loading debug info: %v", err)
+			}
+			dbg = info
+		}
+	}
+
+	assets, err := fs.Sub(webAssets, "web")
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.FS(assets)))
+	mux.HandleFunc("/ws", s.handleWS)
+
+	ln, err := listenLocal(addr)
+	if err != nil {
+		log.Fatalf("-web: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "TD4 web front end: open http://%s/ in your browser\n", ln.Addr())
+	go s.run()
+	log.Fatal(http.Serve(ln, localHostOnly(mux)))
+}
+
+// localHostOnly Host ヘッダーが localhost のアドレスでない要求を拒否する
+// 他のサイトのドメイン名を127.0.0.1に向ける攻撃 (DNS rebinding) で、ページやWebSocketを使われないようにする。
+func localHostOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isLocalHost(r.Host) {
+			http.Error(w, "host not allowed", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// isLocalHost "ホスト[:ポート]" が localhost またはループバックアドレスであればtrueを返す
+func isLocalHost(hostport string) bool {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(hostport, "["), "]") // ポートの指定がない
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// handleWS WebSocketで接続したページからの操作を処理する
+func (s *webServer) handleWS(w http.ResponseWriter, r *http.Request) {
+	ws, err := wsUpgrade(w, r)
+	if err != nil {
+		log.Printf("websocket: %v", err)
+		return
+	}
+	defer ws.Close()
+
+	s.mu.Lock()
+	s.clients[ws] = true
+	src := webSource{"source", filepath.Base(s.name), s.source}
+	state := s.state()
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, ws)
+		s.mu.Unlock()
+	}()
+	sendJSON(ws, src)
+	sendJSON(ws, state)
+
+	for {
+		data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		var cmd webCommand
+		if err := json.Unmarshal(data, &cmd); err != nil {
+			log.Printf("websocket: %v", err)
+			continue
+		}
+		if reply := s.handle(&cmd); reply != nil {
+			sendJSON(ws, reply)
+		}
+		s.broadcast()
+	}
+}
+
+// handle 操作を1つ処理し、操作したページにだけ送る応答を返す (応答しない場合はnil)
+func (s *webServer) handle(cmd *webCommand) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cpu := s.cpu
+	inROM := cmd.Addr >= int(MEM_MIN) && cmd.Addr <= int(MEM_MAX)
+	switch cmd.Cmd {
+	case "assemble":
+		s.running = false
+		s.source = cmd.Source
+		result, _ := s.assemble(cmd.Source)
+		return result
+	case "step":
+		s.running = false
+		cpu.Step()
+	case "run":
+		if !s.running {
+			if cpu.IsBreakpoint(cpu.PC) {
+				cpu.Step() // 停止しているブレークポイントから再開する
+			}
+			s.running = true
+			select {
+			case s.wake <- struct{}{}:
+			default:
+			}
+		}
+	case "stop":
+		s.running = false
+	case "reset":
+		s.running = false
+		cpu.Reset()
+	case "rom":
+		if inROM && cmd.Value >= 0 && cmd.Value <= 0xFF {
+			cpu.ROM[cmd.Addr] = uint8(cmd.Value)
+		}
+	case "in":
+		cpu.InPort = uint8(cmd.Value) & 0x0F
+	case "speed":
+		s.speed = int64(max(cmd.Value, 0))
+	case "break":
+		if inROM {
+			adr := uint8(cmd.Addr)
+			if cpu.IsBreakpoint(adr) {
+				cpu.Breaks[adr] = false
+				if cpu.BP == adr {
+					cpu.BP = 255
+				}
+			} else {
+				cpu.Breaks[adr] = true
+			}
+		}
+	default:
+		log.Printf("websocket: unknown command %q", cmd.Cmd)
+	}
+	return nil
+}
+
+// assemble ソースコードをアセンブルし、エラーがなければROMに書き込んでリセットする (s.mu をロックして呼び出す)
+// ページから任意のファイルを読み出せないように、INCLUDE できるのはソースコードのファイルと同じディレクトリの中に限る。
+func (s *webServer) assemble(source string) (*webAssembled, error) {
+	lines := strings.Split(strings.ReplaceAll(source, "\r\n", "\n"), "\n")
+	info, a, err := s.cpu.Assemble(s.name, lines, filepath.Dir(s.name))
+	result := &webAssembled{Type: "assembled", OK: err == nil, Diagnostics: []webDiagnostic{}}
+	a.Diags.Sort()
+	for _, d := range a.Diags.List {
+		wd := webDiagnostic{d.Line, d.Col, d.Severity.String(), d.Message}
+		if d.File != s.name { // INCLUDE したファイルの診断情報
+			wd.Line, wd.Col = 0, 0
+			wd.Message = fmt.Sprintf("%s:%d: %s", filepath.Base(d.File), d.Line, d.Message)
+		}
+		result.Diagnostics = append(result.Diagnostics, wd)
+	}
+	if err != nil {
+		return result, err
+	}
+	dbg = info
+	s.cpu.Reset()
+	s.cpu.Breaks = [16]bool{}
+	s.cpu.BP = 255
+	return result, nil
+}
+
+// run 連続実行のループ
+// 高速で実行している間は、ページに状態を送る回数を間引く。
+func (s *webServer) run() {
+	var lastSent time.Time
+	for {
+		s.mu.Lock()
+		if !s.running {
+			s.mu.Unlock()
+			<-s.wake
+			continue
+		}
+		s.cpu.Step()
+		if s.cpu.IsBreakpoint(s.cpu.PC) {
+			s.running = false
+		}
+		running, speed := s.running, s.speed
+		s.mu.Unlock()
+		if !running || time.Since(lastSent) >= frameInterval {
+			s.broadcast()
+			lastSent = time.Now()
+		}
+		time.Sleep(time.Duration(speed) * time.Millisecond)
+	}
+}
+
+// state 現在の状態を返す (s.mu をロックして呼び出す)
+func (s *webServer) state() *webState {
+	cpu := s.cpu
+	st := &webState{
+		Type: "state", A: cpu.A, B: cpu.B, C: cpu.C, PC: cpu.PC, In: cpu.InPort, Out: cpu.OutPort,
+		ROM: cpu.ROM, Running: s.running, Speed: s.speed,
+	}
+	for adr := MEM_MIN; adr <= MEM_MAX; adr++ {
+		st.Breaks[adr] = cpu.IsBreakpoint(adr)
+		if dbg != nil {
+			st.Labels[adr] = dbg.Label(adr)
+			st.Code[adr] = dbg.Lines[adr].Text
+		}
+	}
+	return st
+}
+
+// broadcast 接続しているすべてのページに状態を送る
+func (s *webServer) broadcast() {
+	s.mu.Lock()
+	state := s.state()
+	clients := make([]*wsConn, 0, len(s.clients))
+	for ws := range s.clients {
+		clients = append(clients, ws)
+	}
+	s.mu.Unlock()
+	for _, ws := range clients {
+		sendJSON(ws, state)
+	}
+}
+
+// sendJSON メッセージをJSONにして送る
+func sendJSON(ws *wsConn, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("websocket: %v", err)
+		return
+	}
+	ws.WriteMessage(data)
+}
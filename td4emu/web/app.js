@@ -0,0 +1,202 @@
+// TD4 Emulator Webフロントエンド
+// サーバーとは /ws のWebSocketでJSONのメッセージをやり取りする (web.go を参照)。
+"use strict";
+
+const $ = (id) => document.getElementById(id);
+
+let ws = null;
+let state = null;
+
+// send 操作をサーバーに送る
+function send(cmd) {
+  if (ws && ws.readyState === WebSocket.OPEN) {
+    ws.send(JSON.stringify(cmd));
+  }
+}
+
+// connect サーバーに接続する (切断されたら1秒後に接続し直す)
+function connect() {
+  const proto = location.protocol === "https:" ? "wss:" : "ws:";
+  ws = new WebSocket(`${proto}//${location.host}/ws`);
+  ws.onopen = () => {
+    $("status").textContent = "接続しました";
+    $("status").classList.add("connected");
+  };
+  ws.onclose = () => {
+    $("status").textContent = "切断されました。再接続しています...";
+    $("status").classList.remove("connected");
+    setTimeout(connect, 1000);
+  };
+  ws.onmessage = (ev) => {
+    const msg = JSON.parse(ev.data);
+    switch (msg.type) {
+      case "state":
+        state = msg;
+        render();
+        break;
+      case "source":
+        $("filename").textContent = msg.name;
+        $("source").value = msg.text;
+        break;
+      case "assembled":
+        showDiagnostics(msg);
+        break;
+    }
+  };
+}
+
+// hex 値を2桁の16進数にする
+const hex = (v) => v.toString(16).toUpperCase().padStart(2, "0");
+
+// leds 値の下位 n bit をLEDとして表示する (上位bitから)
+function leds(el, value, n) {
+  if (el.children.length !== n) {
+    el.replaceChildren(...Array.from({ length: n }, () => {
+      const led = document.createElement("span");
+      led.className = "led";
+      return led;
+    }));
+  }
+  for (let i = 0; i < n; i++) {
+    el.children[i].classList.toggle("on", (value >> (n - 1 - i)) & 1);
+  }
+}
+
+// buildROM ROMの表を作る (各行に8個のDIPスイッチ)
+function buildROM() {
+  const tbody = $("rom");
+  for (let adr = 0; adr < 16; adr++) {
+    const tr = document.createElement("tr");
+    const tdAdr = document.createElement("td");
+    tdAdr.className = "adr";
+    tdAdr.textContent = hex(adr);
+    tdAdr.title = "クリックでブレークポイントを設定・解除";
+    tdAdr.onclick = () => send({ cmd: "break", addr: adr });
+    tr.appendChild(tdAdr);
+    for (let bit = 7; bit >= 0; bit--) {
+      const td = document.createElement("td");
+      const sw = document.createElement("button");
+      sw.className = "bit";
+      sw.title = `bit${bit}`;
+      sw.onclick = () => {
+        if (state) {
+          send({ cmd: "rom", addr: adr, value: state.rom[adr] ^ (1 << bit) });
+        }
+      };
+      td.appendChild(sw);
+      tr.appendChild(td);
+    }
+    for (const cls of ["hex", "label", "code"]) {
+      const td = document.createElement("td");
+      td.className = cls;
+      tr.appendChild(td);
+    }
+    tbody.appendChild(tr);
+  }
+}
+
+// buildInputs 入力ポートのスイッチを作る (左から bit3～bit0)
+function buildInputs() {
+  for (let bit = 3; bit >= 0; bit--) {
+    const sw = document.createElement("button");
+    sw.className = "switch";
+    sw.title = `IN bit${bit}`;
+    sw.onclick = () => {
+      if (state) {
+        send({ cmd: "in", value: state.in ^ (1 << bit) });
+      }
+    };
+    $("in").appendChild(sw);
+  }
+}
+
+// render 受け取った状態を表示する
+function render() {
+  const rows = $("rom").children;
+  for (let adr = 0; adr < 16; adr++) {
+    const tr = rows[adr];
+    const v = state.rom[adr];
+    tr.classList.toggle("pc", adr === state.pc);
+    tr.classList.toggle("break", state.breaks[adr]);
+    const switches = tr.querySelectorAll(".bit");
+    switches.forEach((sw, i) => sw.classList.toggle("on", (v >> (7 - i)) & 1));
+    tr.querySelector(".hex").textContent = hex(v);
+    tr.querySelector(".label").textContent = state.labels[adr];
+    tr.querySelector(".code").textContent = state.code[adr];
+  }
+  leds($("reg-a"), state.a, 4);
+  leds($("reg-b"), state.b, 4);
+  leds($("reg-c"), state.c ? 1 : 0, 1);
+  leds($("reg-pc"), state.pc, 4);
+  $("val-a").textContent = state.a.toString(16).toUpperCase();
+  $("val-b").textContent = state.b.toString(16).toUpperCase();
+  $("val-pc").textContent = state.pc.toString(16).toUpperCase();
+  leds($("out"), state.out, 4);
+  Array.from($("in").children).forEach((sw, i) => sw.classList.toggle("on", (state.in >> (3 - i)) & 1));
+
+  const run = $("run");
+  run.textContent = state.running ? "STOP" : "RUN";
+  run.classList.toggle("running", state.running);
+  const speed = $("speed");
+  if (!Array.from(speed.options).some((o) => Number(o.value) === state.speed)) {
+    speed.add(new Option(`${state.speed} ms`, state.speed));
+  }
+  speed.value = String(state.speed);
+}
+
+// showDiagnostics アセンブルの結果を表示する。クリックするとエディタのその行を選択する。
+function showDiagnostics(msg) {
+  const list = $("diagnostics");
+  list.replaceChildren();
+  if (msg.ok && msg.diagnostics.length === 0) {
+    const li = document.createElement("li");
+    li.className = "ok";
+    li.textContent = "アセンブルしました。";
+    list.appendChild(li);
+    return;
+  }
+  for (const d of msg.diagnostics) {
+    const li = document.createElement("li");
+    li.className = d.severity;
+    li.textContent = d.line > 0 ? `${d.line}:${d.col > 0 ? d.col + ":" : ""} ${d.severity}: ${d.message}` : `${d.severity}: ${d.message}`;
+    if (d.line > 0) {
+      li.onclick = () => selectLine(d.line);
+    }
+    list.appendChild(li);
+  }
+}
+
+// selectLine エディタの指定した行 (1から始まる) を選択する
+function selectLine(line) {
+  const src = $("source");
+  const lines = src.value.split("\n");
+  let start = 0;
+  for (let i = 0; i < line - 1 && i < lines.length; i++) {
+    start += lines[i].length + 1;
+  }
+  const end = start + (lines[line - 1] || "").length;
+  src.focus();
+  src.setSelectionRange(start, end);
+}
+
+function assemble() {
+  send({ cmd: "assemble", source: $("source").value });
+}
+
+buildROM();
+buildInputs();
+$("assemble").onclick = assemble;
+$("source").addEventListener("keydown", (ev) => {
+  if (ev.key === "Enter" && (ev.ctrlKey || ev.metaKey)) {
+    ev.preventDefault();
+    assemble();
+  } else if (ev.key === "Tab") { // Tabキーでフォーカスを移動せず、タブ文字を入力する
+    ev.preventDefault();
+    ev.target.setRangeText("\t", ev.target.selectionStart, ev.target.selectionEnd, "end");
+  }
+});
+$("run").onclick = () => send({ cmd: state && state.running ? "stop" : "run" });
+$("step").onclick = () => send({ cmd: "step" });
+$("reset").onclick = () => send({ cmd: "reset" });
+$("speed").onchange = (ev) => send({ cmd: "speed", value: Number(ev.target.value) });
+connect();
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalHostOnly(t *testing.T) {
+	h := localHostOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tests := []struct {
+		host string
+		ok   bool
+	}{
+		{"127.0.0.1:8080", true},
+		{"127.0.0.2:8080", true},
+		{"localhost:8080", true},
+		{"LocalHost", true},
+		{"[::1]:8080", true},
+		{"[::1]", true},
+		{"evil.example:8080", false}, // DNS rebinding で127.0.0.1に向けた名前
+		{"localhost.evil.example", false},
+		{"127.0.0.1.nip.io:8080", false},
+		{"192.168.0.10:8080", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		for _, path := range []string{"/", "/ws"} {
+			r := httptest.NewRequest("GET", path, nil)
+			r.Host = tt.host
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if got := w.Code != http.StatusForbidden; got != tt.ok {
+				t.Errorf("%s with Host %q: status %d, want allowed=%v", path, tt.host, w.Code, tt.ok)
+			}
+		}
+	}
+}
+
+func TestWebAssembleInclude(t *testing.T) {
+	t.Cleanup(func() { dbg = nil }) // assemble はデバッグ情報を設定する
+	dir := t.TempDir()
+	for name, text := range map[string]string{
+		"src/lib/out.td4": "    OUT 5",
+		"secret.td4":      "    OUT 9",
+	} {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0o755)
+		if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &webServer{cpu: NewCPU(), name: filepath.Join(dir, "src", "main.td4")}
+
+	result, err := s.assemble("INCLUDE \"lib/out.td4\"\n    JMP 0")
+	if err != nil || !result.OK || s.cpu.ROM[0] != 0xB5 {
+		t.Errorf("include in the source directory: ok=%v err=%v rom[0]=%02X", result.OK, err, s.cpu.ROM[0])
+	}
+
+	for _, name := range []string{"../secret.td4", filepath.Join(dir, "secret.td4")} {
+		result, err := s.assemble("INCLUDE \"" + name + "\"\n    JMP 0")
+		if err == nil || result.OK {
+			t.Errorf("INCLUDE %q: assembled, want error", name)
+			continue
+		}
+		if len(result.Diagnostics) != 1 || result.Diagnostics[0].Line != 1 || !strings.Contains(result.Diagnostics[0].Message, "include file is outside of") {
+			t.Errorf("INCLUDE %q: diagnostics = %+v", name, result.Diagnostics)
+		}
+	}
+	if s.cpu.ROM[0] != 0xB5 {
+		t.Errorf("rom[0] = %02X, want the ROM unchanged after errors", s.cpu.ROM[0])
+	}
+}
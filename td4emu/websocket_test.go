@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// echoServer 受信したメッセージをそのまま送り返すWebSocketのサーバーを起動する
+func echoServer(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := wsUpgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		for {
+			msg, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			ws.WriteMessage(msg)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// wsDial サーバーに接続してハンドシェイクの要求を送り、応答を返す
+// headers の値が空のヘッダーは送らない。
+func wsDial(t *testing.T, srv *httptest.Server, headers map[string]string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	h := map[string]string{
+		"Connection":        "Upgrade",
+		"Upgrade":           "websocket",
+		"Sec-WebSocket-Key": "dGhlIHNhbXBsZSBub25jZQ==",
+	}
+	for k, v := range headers {
+		h[k] = v
+	}
+	var req strings.Builder
+	fmt.Fprintf(&req, "GET /ws HTTP/1.1\r\nHost: %s\r\n", srv.Listener.Addr())
+	for k, v := range h {
+		if v != "" {
+			fmt.Fprintf(&req, "%s: %s\r\n", k, v)
+		}
+	}
+	req.WriteString("\r\n")
+	if _, err := io.WriteString(conn, req.String()); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, r, resp
+}
+
+// clientFrame クライアントからのフレームを作る (mask が false ならマスクしない)
+func clientFrame(fin bool, op byte, payload []byte, mask bool) []byte {
+	head := []byte{op}
+	if fin {
+		head[0] |= 0x80
+	}
+	var m byte
+	if mask {
+		m = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		head = append(head, m|byte(n))
+	case n <= 0xFFFF:
+		head = append(head, m|126)
+		head = binary.BigEndian.AppendUint16(head, uint16(n))
+	default:
+		head = append(head, m|127)
+		head = binary.BigEndian.AppendUint64(head, uint64(n))
+	}
+	if !mask {
+		return append(head, payload...)
+	}
+	key := [4]byte{0x37, 0xFA, 0x21, 0x3D}
+	head = append(head, key[:]...)
+	for i, c := range payload {
+		head = append(head, c^key[i%4])
+	}
+	return head
+}
+
+// serverFrame サーバーからのフレームを1つ読み込む
+func serverFrame(t *testing.T, r *bufio.Reader) (fin bool, op byte, payload []byte) {
+	t.Helper()
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		t.Fatalf("read frame: %v", err)
+	}
+	if head[1]&0x80 != 0 {
+		t.Fatalf("server frame is masked")
+	}
+	n := uint64(head[1] & 0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(r, ext[:])
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(r, ext[:])
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatalf("read payload: %v", err)
+	}
+	return head[0]&0x80 != 0, head[0] & 0x0F, payload
+}
+
+func TestWSHandshake(t *testing.T) {
+	srv := echoServer(t)
+	tests := []struct {
+		name    string
+		headers map[string]string
+		status  int
+	}{
+		{"valid", nil, http.StatusSwitchingProtocols},
+		{"same origin", map[string]string{"Origin": "http://" + srv.Listener.Addr().String()}, http.StatusSwitchingProtocols},
+		{"header tokens", map[string]string{"Connection": "keep-alive, Upgrade", "Upgrade": "WebSocket"}, http.StatusSwitchingProtocols},
+		{"other origin", map[string]string{"Origin": "http://evil.example"}, http.StatusForbidden},
+		{"no upgrade", map[string]string{"Upgrade": ""}, http.StatusBadRequest},
+		{"no connection", map[string]string{"Connection": ""}, http.StatusBadRequest},
+		{"no key", map[string]string{"Sec-WebSocket-Key": ""}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, resp := wsDial(t, srv, tt.headers)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.status != http.StatusSwitchingProtocols {
+				return
+			}
+			// RFC 6455 1.3 の例
+			if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+				t.Errorf("Sec-WebSocket-Accept = %q", got)
+			}
+			if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+				t.Errorf("Upgrade = %q", resp.Header.Get("Upgrade"))
+			}
+		})
+	}
+}
+
+func TestWSFrames(t *testing.T) {
+	srv := echoServer(t)
+	for _, n := range []int{0, 5, 125, 126, 300, 0xFFFF, 0x10000} { // 長さの3種類の表し方の境界
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			conn, r, _ := wsDial(t, srv, nil)
+			msg := bytes.Repeat([]byte("td4"), n/3+1)[:n]
+			conn.Write(clientFrame(true, wsText, msg, true))
+			fin, op, payload := serverFrame(t, r)
+			if !fin || op != wsText || !bytes.Equal(payload, msg) {
+				t.Errorf("echo: fin=%v op=%d len=%d, want text of %d bytes", fin, op, len(payload), n)
+			}
+		})
+	}
+
+	t.Run("fragmented with ping", func(t *testing.T) {
+		conn, r, _ := wsDial(t, srv, nil)
+		conn.Write(clientFrame(false, wsText, []byte(`{"cmd":`), true))
+		conn.Write(clientFrame(true, wsPing, []byte("hi"), true)) // 分割したメッセージの間の制御フレーム
+		conn.Write(clientFrame(true, wsContinuation, []byte(`"step"}`), true))
+		if _, op, payload := serverFrame(t, r); op != wsPong || string(payload) != "hi" {
+			t.Errorf("got op=%d %q, want pong \"hi\"", op, payload)
+		}
+		if _, op, payload := serverFrame(t, r); op != wsText || string(payload) != `{"cmd":"step"}` {
+			t.Errorf("got op=%d %q, want joined message", op, payload)
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		conn, r, _ := wsDial(t, srv, nil)
+		conn.Write(clientFrame(true, wsClose, nil, true))
+		if _, op, _ := serverFrame(t, r); op != wsClose {
+			t.Errorf("got op=%d, want close", op)
+		}
+	})
+
+	// 切断されるフレーム
+	for _, tt := range []struct {
+		name  string
+		frame []byte
+	}{
+		{"unmasked", clientFrame(true, wsText, []byte("x"), false)},
+		{"unknown opcode", clientFrame(true, 0x3, []byte("x"), true)},
+		{"too large", clientFrame(true, wsText, make([]byte, wsMaxMessage+1), true)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, r, _ := wsDial(t, srv, nil)
+			conn.Write(tt.frame)
+			if _, err := r.ReadByte(); err == nil { // EOF または (送信中のデータがあれば) リセット
+				t.Errorf("connection is still open")
+			}
+		})
+	}
+}
@@ -1,3 +1,5 @@
+//go:build tinygo
+
 package main
 
 // go fmt .\main.go
@@ -8,48 +10,26 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"machine"
 	"os"
-	"strconv"
 	"strings"
 	"time"
+
+	"main/td4"
+	"main/td4emu_tinygo/monitor"
+	"main/td4emu_tinygo/romstore"
 	/*
 		"flag"
 		"log"
 		"time"
 	*/)
 
-// CPU 構造体: TD4の内部状態を保持
+// CPU 構造体: TD4の内部状態 (td4.CPU) に、ボードの入出力ポートのPin情報を加えたもの
 type CPU struct {
-	A, B    uint8          // 4bit レジスタ
-	PC      uint8          // 4bit プログラムカウンタ
-	BP      uint8          // 4bit ブレイクポイント
-	C       bool           // キャリーフラグ
-	OutPort uint8          // 4bit 出力ポート
-	InPort  uint8          // 4bit 入力ポート (今回は固定で0)
-	ROM     [16]uint8      // 16バイトのプログラムメモリ
-	led     [4]machine.Pin // ハードウェア上に接続されているledのPin情報
-	sw      [2]machine.Pin // ハードウェア上に接続されているswのPin情報
-}
-
-var (
-	MEM_MIN uint8 = 0
-	MEM_MAX uint8 = 15
-)
-
-// var led machine.Pin // ledが接続されているピン
-var HelpText = [...]string{
-	"Command list",
-	"\tH :(Help) コマンドの使用方法を表示する。",
-	"\tS [address] [pocode] [pocode] ... :(Setdata) 指定したメモリ番地にオペコードを書き込む。",
-	"\tB [address] :(Breakpoint) ブレークポイントの設定と削除を行う。",
-	"\tM :(Memory) 現在の現在のメモリの内容を表示する。",
-	"\tD :(Dump) 現在のCPUのレジスタ内容を表示する。",
-	"\tT [count] :(Trace) プログラムを指定回数だけ命令を実行する（ステップ実行）。",
-	"\tG [address] :(Go) 指定したアドレスからプログラムを実行する。",
-	"\tV [speed] :(Velocity) 実行速度を設定する。",
-	"\tI [bit pattern] :(InPort) 入力ポートの値を設定する。",
-	"\tQ :(Quit) モニタプログラムを終了する。",
+	td4.CPU
+	led [4]machine.Pin // ハードウェア上に接続されているledのPin情報
+	sw  [2]machine.Pin // ハードウェア上に接続されているswのPin情報
 }
 
 // NewCPU CPUの初期化
@@ -72,8 +52,7 @@ func NewCPU() *CPU {
 	sw[1].Configure(machine.PinConfig{Mode: machine.PinInput})
 
 	return &CPU{
-		ROM: [16]uint8{}, // ゼロ初期化 (NOP)
-		BP:  255,         // Break point 0-15以外の値は未設定の状態
+		CPU: *td4.NewCPU(), // ROMはゼロ初期化 (NOP)、ブレイクポイントは未設定の状態
 		led: led,
 		sw:  sw,
 	}
@@ -111,94 +90,17 @@ func (cpu *CPU) LoadROM(filename string) error {
 			continue
 		}
 		// 要素に分割
-		elements := strings.Split(line, " ")
-		cpu.writeMemory(elements)
+		if err := monitor.WriteMemory(&cpu.CPU, strings.Fields(line)); err != nil {
+			return err
+		}
 		break
 	}
 	return scanner.Err()
 }
 
-func (cpu *CPU) writeMemory(elements []string) {
-	if 3 > len(elements) { // パラメータが足りない場合は、警告して終了
-		fmt.Printf("Insufficient address or opcode information required for writing.\n")
-		return
-	} //	書き込み開始アドレスのデコード
-	adr, adr_err := strconv.ParseInt(strings.Trim(elements[1], " \n\r"), 0, 16)
-	if adr_err != nil { //	正常に整数値に変換されたかをチェック
-		fmt.Printf("The address is specified incorrectly.\n")
-		return
-	}
-	if false == inRange(MEM_MIN, uint8(adr), MEM_MAX) { //	指定されたアドレスがメモリ空間内であるかをチェック
-		fmt.Printf("This system's memory space is limited to 0 to 15 bytes.\n")
-		return
-	}
-	index := 2
-	for {
-		val, val_err := strconv.ParseInt(strings.Trim(elements[index], " \n\r"), 0, 16)
-		//	fmt.Printf("%d %T\n",val, val_err)
-		if val_err == nil { //	正常に整数値に変換されたかをチェック
-			//	fmt.Printf("%x %x %T\n", adr, val, val_err)
-			cpu.ROM[uint8(0x0f&adr)] = uint8(val) //	メモリの指定されたアドレスの内容を書換える。
-			adr++
-		} else {
-			fmt.Printf("invalid hex format at %d: %s\n", index, elements[index])
-			break
-		}
-		index++
-		if index >= len(elements) {
-			break
-		}
-		if uint8(adr) > MEM_MAX {
-			fmt.Printf("Memory overflow!!\nThis system has only %d bytes of memory space.\n", len(cpu.ROM))
-			break
-		}
-	}
-	return
-}
-
-// DumpMemory 現在のメモリ内容を表示
-func (cpu *CPU) DumpMemory(adress uint8) {
-	// コンソール画面をクリア（ANSIエスケープシーケンス）
-	// Windowsの古いコマンドプロンプトでは効かない場合がありますが、PowerShellやVSCodeなら動作します
-	// fmt.Print("\033[H\033[2J")
-	// 2進数表記のヘルパー
-	bin4 := func(v uint8) string {
-		return fmt.Sprintf("%04b", v&0xF)
-	}
-	if adress != cpu.BP {
-		fmt.Printf("|   %02d   | 0x%02X 0b%s_%s |\n",
-			adress, cpu.ROM[adress], bin4(cpu.ROM[adress]>>4), bin4(cpu.ROM[adress]))
-	} else {
-		fmt.Printf("|   %02d B | 0x%02X 0b%s_%s |\n",
-			adress, cpu.ROM[adress], bin4(cpu.ROM[adress]>>4), bin4(cpu.ROM[adress]))
-	}
-}
-
-// DumpState 現在のCPU状態を表示
-func (cpu *CPU) DumpState(adress uint8) {
-	// コンソール画面をクリア（ANSIエスケープシーケンス）
-	// Windowsの古いコマンドプロンプトでは効かない場合がありますが、PowerShellやVSCodeなら動作します
-	// fmt.Print("\033[H\033[2J")
-	cInt := 0
-	if cpu.C {
-		cInt = 1
-	}
-	// 2進数表記のヘルパー
-	bin4 := func(v uint8) string {
-		return fmt.Sprintf("%04b", v&0xF)
-	}
-	if adress != cpu.BP { // Break pointのある位置にBを表示する。
-		fmt.Printf("| PC:%02d   | OP:%02X | A:%s(%X) | B:%s(%X) | C:%d | IN:%s | OUT:%s |\n",
-			adress, cpu.ROM[adress], bin4(cpu.A), cpu.A, bin4(cpu.B), cpu.B, cInt, bin4(cpu.InPort), bin4(cpu.OutPort))
-	} else {
-		fmt.Printf("| PC:%02d B | OP:%02X | A:%s(%X) | B:%s(%X) | C:%d | IN:%s | OUT:%s |\n",
-			adress, cpu.ROM[adress], bin4(cpu.A), cpu.A, bin4(cpu.B), cpu.B, cInt, bin4(cpu.InPort), bin4(cpu.OutPort))
-	}
-}
-
-// Execute 1命令実行サイクル
+// Execute 1命令実行サイクル (td4.CPU の Execute に、ボードの入出力ポートの操作を加えたもの)
 func (cpu *CPU) Execute() int {
-	if cpu.PC == cpu.BP { // ブレイクポイントなら、ここで1を返して終了する。
+	if cpu.IsBreakpoint(cpu.PC) { // ブレイクポイントなら、ここで1を返して終了する。
 		return 1
 	}
 	// フェッチ
@@ -316,6 +218,85 @@ func (cpu *CPU) Execute() int {
 	return 0
 }
 
+// flash ROMを保存するフラッシュメモリ (書き込んだプログラムの後ろの領域の、先頭のブロックを使う)
+// romstore.NewMemory(4096, 256, 4096) で作成した Memory に置き換えると、フラッシュメモリに書き込まずに動作を確認できる。
+var flash romstore.Device = machine.Flash
+
+// flashHelp FLASH コマンドの説明 (H コマンドで表示する)
+const flashHelp = "\tFLASH [SAVE|LOAD|ERASE|AUTO ON|OFF] :(Flash) ROMをフラッシュメモリに保存する。AUTO ON で起動時に読み込む。"
+
+// flashCommand フラッシュメモリへのROMの保存 (FLASH コマンド)
+//
+//	FLASH              保存の状態を表示する
+//	FLASH SAVE         ROMを保存する
+//	FLASH LOAD         保存したROMを読み込む
+//	FLASH ERASE        保存したROMを消去する
+//	FLASH AUTO ON|OFF  起動時に保存したROMを読み込むかを設定する
+func (cpu *CPU) flashCommand(w io.Writer, elements []string) error {
+	rec, err := romstore.Load(flash)
+	if err != nil && err != romstore.ErrEmpty {
+		return err
+	}
+	saved := err == nil
+	sub := ""
+	if len(elements) > 1 {
+		sub = elements[1]
+	}
+	switch sub {
+	case "":
+		if !saved {
+			fmt.Fprintf(w, "Flash: empty\n")
+			return nil
+		}
+		fmt.Fprintf(w, "Flash: saved, autoload=%v\n", rec.Autoload)
+		fmt.Fprintf(w, "S 0x00")
+		for _, b := range rec.ROM {
+			fmt.Fprintf(w, " 0x%02X", b)
+		}
+		fmt.Fprintf(w, "\n")
+
+	case "SAVE":
+		if !saved {
+			rec.Autoload = true // 初めて保存したときは、起動時に読み込む設定にする
+		}
+		rec.ROM = cpu.ROM
+		if err := romstore.Save(flash, rec); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Saved ROM to flash. autoload=%v\n", rec.Autoload)
+
+	case "LOAD":
+		if !saved {
+			return romstore.ErrEmpty
+		}
+		cpu.ROM = rec.ROM
+		fmt.Fprintf(w, "Loaded ROM from flash.\n")
+
+	case "ERASE":
+		if err := romstore.Erase(flash); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Erased ROM in flash.\n")
+
+	case "AUTO":
+		if !saved {
+			return romstore.ErrEmpty
+		}
+		if len(elements) < 3 || (elements[2] != "ON" && elements[2] != "OFF") {
+			return fmt.Errorf("usage: FLASH AUTO ON|OFF")
+		}
+		rec.Autoload = elements[2] == "ON"
+		if err := romstore.Save(flash, rec); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Flash: autoload=%v\n", rec.Autoload)
+
+	default:
+		return fmt.Errorf("unknown FLASH command: %s (SAVE, LOAD, ERASE, AUTO)", sub)
+	}
+	return nil
+}
+
 // TrimLastChar は文字列の最後のルーンを削除します
 func TrimLastChar(s string) string {
 	if s == "" {
@@ -327,11 +308,6 @@ func TrimLastChar(s string) string {
 	return string(runes[:len(runes)-1])
 }
 
-// inRange 指定した値の範囲にあるかを判別する。範囲内であればtrueを返す。
-func inRange(min, value, max uint8) bool {
-	return value >= min && value <= max
-}
-
 func main() {
 	stepMode := true
 	speed := 1000
@@ -355,15 +331,24 @@ func main() {
 	fmt.Printf("4bit CPU TD4 emulator\n")
 	fmt.Printf("Reading from the serial port...\n")
 	fmt.Printf("Mode: Step=%v, Speed=%5dms/inst\n", stepMode, speed)
+	// フラッシュメモリに保存したROMを読み込む (FLASH AUTO ON のとき)
+	if rec, err := romstore.Load(flash); err == nil && rec.Autoload {
+		cpu.ROM = rec.ROM
+		fmt.Printf("Loaded ROM from flash.\n")
+	}
 	fmt.Printf("| PC   BP |OP-code|A register |B register |Cflag| IN port | OUT port |\n")
 	fmt.Printf("|:--------|:-----:|:---------:|:---------:|:---:|:-------:|:--------:|\n")
-	cpu.DumpState(cpu.PC)
+	monitor.DumpState(os.Stdout, &cpu.CPU, cpu.PC)
 
-	execStatus := true
-	for execStatus {
+	m := &monitor.Monitor{CPU: &cpu.CPU, Speed: speed, StepMode: stepMode}
+	m.Step = cpu.Execute // 入力ポートをボードのスイッチに、出力ポートをLEDに接続する
+	m.Commands = map[byte]monitor.Command{'F': {Help: flashHelp, Run: cpu.flashCommand}}
+	for !m.Quit {
 		//	ステップ実行モードの場合
-		if stepMode {
-			fmt.Printf("> ")
+		if m.StepMode {
+			if !m.Proto { // プロトコルモードでは、プロンプトとエコーを表示しない
+				fmt.Printf("> ")
+			}
 			readbuffer = ""
 			for { // キー入力待ち
 				// PCからの受信データをチェック
@@ -378,26 +363,34 @@ func main() {
 								enter_flag = true // machine.Serial.WriteByte('\n')
 							case '\b':
 								if len(readbuffer) > 0 { // バックスペースで、最後尾の１文字を削除
-									machine.Serial.WriteByte('\b') // 表示部分の最後の1文字を消去
-									machine.Serial.WriteByte(' ')
-									machine.Serial.WriteByte('\b')
+									if !m.Proto {
+										machine.Serial.WriteByte('\b') // 表示部分の最後の1文字を消去
+										machine.Serial.WriteByte(' ')
+										machine.Serial.WriteByte('\b')
+									}
 									readbuffer = TrimLastChar(readbuffer) // すでに取り込んでいる文字列データの最後の1文字を消去
 								}
 							default:
 								// println(c)	  -- >  BS=8, Enter=13
 								// Convert nonprintable control characters to
 								// ^A, ^B, etc.
-								machine.Serial.WriteByte('^')
-								machine.Serial.WriteByte(c + '@')
+								if !m.Proto {
+									machine.Serial.WriteByte('^')
+									machine.Serial.WriteByte(c + '@')
+								}
 							}
 						} else if c >= 127 {
 							// Anything equal or above ASCII 127, print ^?.
-							machine.Serial.WriteByte('^')
-							machine.Serial.WriteByte('?')
+							if !m.Proto {
+								machine.Serial.WriteByte('^')
+								machine.Serial.WriteByte('?')
+							}
 						} else {
 							// Echo the printable character back to the
 							// host computer.
-							machine.Serial.WriteByte(c)
+							if !m.Proto {
+								machine.Serial.WriteByte(c)
+							}
 							// 読み込んだ文字をエコーバックし、文字列バッファーに保存する。
 							readbuffer = readbuffer + string(c)
 						}
@@ -415,163 +408,29 @@ func main() {
 					// 改行コードを検出したら、ループを抜け、次のコマンド解析に移る。
 					// 同時に改行コードを出力し、次行より、実行結果を表示できるようにする。
 					enter_flag = false
-					fmt.Printf("\n")
+					if !m.Proto {
+						fmt.Printf("\n")
+					}
 					break
 				}
-				time.Sleep(time.Millisecond * 8)
-			}
-			// コマンドの解析を開始
-			if len(readbuffer) > 0 {
-				line := strings.Replace(readbuffer, "\t", " ", -1) // タブをスペースに置換えて、区切り文字として使えるようにする。
-				line = strings.Replace(line, ",", " ", -1)
-				line = strings.ToUpper(line)
-				line = strings.Trim(line, " \n\r")
-				elements := strings.Split(line, " ")
-				firstWord := line[0]
-				// コマンド解析の開始
-				switch firstWord {
-				/*
-					実装予定
-					Xコマンド	レジスタ、カウンタ、フラグ類の検査と変更
-				*/
-				case 'H': //	ヘルプの表示(help)
-					if len(elements) == 1 {
-						for i := 0; i < len(HelpText); i++ {
-							fmt.Printf("%s\n", HelpText[i])
-						}
-					}
-
-				case 'S': //	メモリの指定されたアドレスに値を書き込む。
-					// S 0 0x30 0x01 0x02 0x04 0x08 0x40 0x90 0xF7
-					// S 8 0x30 0x01 0x02 0x04 0x08 0x40 0x90 0xF7
-					// S 9 0x30 0x01 0x02 0x04 0x08 0x40 0x90 0xF7
-					// S 8 0x30 0x01 0x02 0x04 0x08 0x40 0x90 0xF7 0x40 0x90 0xF7
-					cpu.writeMemory(elements)
-
-				case 'B': //	ブレークポイントの参照、設定と解除
-					if len(elements) == 1 {
-						if (cpu.BP >= MEM_MIN) && (cpu.BP <= MEM_MAX) {
-							fmt.Printf("Break point: %d\n", cpu.BP)
-						} else {
-							fmt.Printf("Break point: none\n")
-						}
-					} else if len(elements) > 1 {
-						//	数値変換
-						val, err := strconv.ParseInt(strings.Trim(elements[1], " \n\r"), 0, 8)
-						if err == nil { //	文字列=>数値変換にエラーがなければ、次のステップへ
-							cpu.BP = uint8(val)
-							if inRange(MEM_MIN, uint8(val), MEM_MAX) { // アドレスの範囲であれば、BPに値を設定する。
-								fmt.Printf("Break point: %d\n", cpu.BP)
-							} else {
-								fmt.Printf("Break point: none\n")
-							}
-						}
-					}
-
-				case 'M': //	現在の現在のメモリ内容を表示
-					if 1 == len(elements) {
-						fmt.Printf("| Adress | OP-code          |\n")
-						fmt.Printf("|:------:|:----------------:|\n")
-						for adr := 0; adr < 16; adr++ {
-							cpu.DumpMemory(uint8(adr))
-						}
-					}
-
-				case 'D': //	現在のCPUのレジスタ内容を表示する。
-					if 1 == len(elements) {
-						cpu.DumpState(cpu.PC)
-					}
-
-				case 'T': //	レジスタ表示しながらトレース実行する回数を設定する。
-					if len(elements) == 1 {
-						cpu.Execute()
-						cpu.DumpState(cpu.PC)
-					} else if len(elements) > 1 {
-						//	数値変換
-						val, err := strconv.ParseInt(strings.Trim(elements[1], " \n\r"), 0, 64)
-						if err == nil {
-							//	fmt.Printf("|\n")
-							loop := int(val)
-							//	命令実行
-							for i := 0; i < loop; i++ {
-								state := cpu.Execute()
-								if state != 0 {
-									break //	Breakpointに到達したら、停止する。
-								}
-								time.Sleep(time.Duration(speed) * time.Millisecond)
-								cpu.DumpState(cpu.PC)
-							}
-						}
-					}
-
-				case 'G': //	ユーザプログラムの連続実行
-					if len(elements) == 1 {
-						stepMode = false
-						cpu.DumpState(cpu.PC)
-					} else if len(elements) > 1 {
-						//	数値変換
-						val, err := strconv.ParseInt(strings.Trim(elements[1], " \n\r"), 0, 8)
-						if err == nil { // 文字列=>数値変換にエラーがなければ、設定速度を更新
-							if inRange(MEM_MIN, uint8(val), MEM_MAX) { // アドレスの範囲であれば、PCのアドレスを更新して、連続実行モードに移行する。
-								cpu.PC = uint8(val)
-								stepMode = false
-								cpu.DumpState(cpu.PC)
-							} else {
-								fmt.Printf("The address space that can be set by the program counter ranges from 0 to 15.")
-								stepMode = true
-							}
-						} else {
-							fmt.Printf("G command parameter is invalid.\n")
-						}
-					}
-
-				case 'V': //	実行速度の設定(velocity)
-					if len(elements) == 1 {
-						fmt.Printf("Speed=%5dms/inst\n", speed)
-					} else if len(elements) > 1 {
-						//	数値変換
-						val, err := strconv.ParseInt(strings.Trim(elements[1], " \n\r"), 0, 64)
-						if err == nil { // 文字列=>数値変換にエラーがなければ、設定速度を更新
-							speed = int(val)
-							fmt.Printf("Speed=%5dms/inst\n", speed)
-						} else {
-							fmt.Printf("Failed to set execution speed.\n")
-							fmt.Printf("Please set the execution time for one step in milliseconds.\n")
-						}
-					}
-
-				case 'I': //	入力ポートの値を設定する。
-					if len(elements) == 1 {
-						cpu.DumpState(cpu.PC)
-					} else if len(elements) > 1 {
-						//	数値変換
-						val, err := strconv.ParseInt(strings.Trim(elements[1], " \n\r"), 0, 8)
-						if err == nil {
-							cpu.InPort = uint8(0x0f & val)
-							cpu.DumpState(cpu.PC)
-						} else {
-							fmt.Printf("The input value is incorrect.")
-						}
-					}
-
-				case 'Q':
-					// 	fmt.Printf("\n")
-					execStatus = false // プログラムを終了する。
+				if machine.Serial.Buffered() == 0 { // 貼り付けた長い行(LOAD など)を取りこぼさないように、受信データがあれば待たずに読む
+					time.Sleep(time.Millisecond * 8)
 				}
 			}
-		} else {
-			//	通常実行モードの場合、指定時間待機
-			//	命令実行
-			result := cpu.Execute()
-			if 0 != result {
-				stepMode = true
-				continue
+			// コマンドの解析と実行 (プロトコルモードでは、エラーも応答として送る)
+			if err := m.Command(readbuffer); err != nil {
+				fmt.Printf("%v\n", err)
 			}
-			time.Sleep(time.Duration(speed) * time.Millisecond)
-			cpu.DumpState(cpu.PC)
+		} else {
+			//	通常実行モードの場合、1命令実行して指定時間待機する (ブレークポイントでステップ実行モードに戻る)
+			m.Run()
 		}
 	}
-	fmt.Printf("program terminated !\n")
+	if m.Proto {
+		m.Event("exit")
+	} else {
+		fmt.Printf("program terminated !\n")
+	}
 	for {
 		time.Sleep(time.Millisecond * 5000)
 	}
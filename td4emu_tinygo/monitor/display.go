@@ -0,0 +1,83 @@
+package monitor
+
+// メモリとCPUの状態の表示と、S コマンドの書式によるROMへの書き込み
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+
+	"main/td4"
+)
+
+// MEM_MAX ROMの最後のアドレス
+const MEM_MAX uint8 = 15
+
+// WriteMemory S コマンドの書式 (S adr opc1 opc2 ...) で、ROMに書き込む
+func WriteMemory(cpu *td4.CPU, elements []string) error {
+	if 3 > len(elements) { // パラメータが足りない場合はエラー
+		return fmt.Errorf("insufficient address or opcode information required for writing")
+	} //	書き込み開始アドレスのデコード
+	adr, adr_err := strconv.ParseInt(elements[1], 0, 16)
+	if adr_err != nil { //	正常に整数値に変換されたかをチェック
+		return fmt.Errorf("invalid address: %s", elements[1])
+	}
+	if adr < 0 || adr > int64(MEM_MAX) { //	指定されたアドレスがメモリ空間内であるかをチェック
+		return fmt.Errorf("address out of range (0-15): %s", elements[1])
+	}
+	for index := 2; index < len(elements); index++ {
+		if adr > int64(MEM_MAX) {
+			return fmt.Errorf("memory overflow: this system has only %d bytes of memory space", len(cpu.ROM))
+		}
+		val, val_err := strconv.ParseUint(elements[index], 0, 8)
+		if val_err != nil { //	正常に整数値に変換されたかをチェック
+			return fmt.Errorf("invalid hex format at %d: %s", index, elements[index])
+		}
+		cpu.ROM[uint8(0x0f&adr)] = uint8(val) //	メモリの指定されたアドレスの内容を書換える。
+		adr++
+	}
+	return nil
+}
+
+// DumpMemory 現在のメモリ内容を表示
+func DumpMemory(w io.Writer, cpu *td4.CPU, adress uint8) {
+	// 2進数表記のヘルパー
+	bin4 := func(v uint8) string {
+		return fmt.Sprintf("%04b", v&0xF)
+	}
+	if adress != cpu.BP {
+		fmt.Fprintf(w, "|   %02d   | 0x%02X 0b%s_%s |\n",
+			adress, cpu.ROM[adress], bin4(cpu.ROM[adress]>>4), bin4(cpu.ROM[adress]))
+	} else {
+		fmt.Fprintf(w, "|   %02d B | 0x%02X 0b%s_%s |\n",
+			adress, cpu.ROM[adress], bin4(cpu.ROM[adress]>>4), bin4(cpu.ROM[adress]))
+	}
+}
+
+// DumpState 現在のCPU状態を表示
+func DumpState(w io.Writer, cpu *td4.CPU, adress uint8) {
+	cInt := 0
+	if cpu.C {
+		cInt = 1
+	}
+	// 2進数表記のヘルパー
+	bin4 := func(v uint8) string {
+		return fmt.Sprintf("%04b", v&0xF)
+	}
+	if adress != cpu.BP { // Break pointのある位置にBを表示する。
+		fmt.Fprintf(w, "| PC:%02d   | OP:%02X | A:%s(%X) | B:%s(%X) | C:%d | IN:%s | OUT:%s |\n",
+			adress, cpu.ROM[adress], bin4(cpu.A), cpu.A, bin4(cpu.B), cpu.B, cInt, bin4(cpu.InPort), bin4(cpu.OutPort))
+	} else {
+		fmt.Fprintf(w, "| PC:%02d B | OP:%02X | A:%s(%X) | B:%s(%X) | C:%d | IN:%s | OUT:%s |\n",
+			adress, cpu.ROM[adress], bin4(cpu.A), cpu.A, bin4(cpu.B), cpu.B, cInt, bin4(cpu.InPort), bin4(cpu.OutPort))
+	}
+}
+
+// WriteROM ROMの内容を、S コマンドと同じ書式で表示する (PCの端末からコピーしてHEXファイルにできる)
+func WriteROM(w io.Writer, cpu *td4.CPU) {
+	fmt.Fprintf(w, "S 0x00")
+	for _, b := range cpu.ROM {
+		fmt.Fprintf(w, " 0x%02X", b)
+	}
+	fmt.Fprintf(w, "\n")
+}
@@ -0,0 +1,264 @@
+// Package monitor TinyGo版 TD4 エミュレータ (td4emu_tinygo) のモニタプログラム
+// 各ボード (core, RasPiPico, MAKER-PI-RP2040) で共通の部分で、ステップ実行モードで受け付けるコマンド
+// (H/S/B/M/D/T/G/V/I/W/SAVE/LOAD/PROTO/Q) を解析して実行する。machine パッケージを使わないので、PC上でもテストできる。
+// 入出力ポートの処理はボードごとに異なるので、1命令の実行 (Step) とボード固有のコマンド (Commands) は各ボードで設定する。
+// エラーは表示せずに返す (テキストモードでは main で表示し、プロトコルモードでは error の応答にする)。
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"main/td4"
+)
+
+// HelpText H コマンドで表示するコマンドの一覧 (ボード固有のコマンドは、この後に表示する)
+var HelpText = [...]string{
+	"Command list",
+	"\tH :(Help) コマンドの使用方法を表示する。",
+	"\tS [address] [pocode] [pocode] ... :(Setdata) 指定したメモリ番地にオペコードを書き込む。",
+	"\tB [address] :(Breakpoint) ブレークポイントの設定と削除を行う。",
+	"\tM :(Memory) 現在の現在のメモリの内容を表示する。",
+	"\tD :(Dump) 現在のCPUのレジスタ内容を表示する。",
+	"\tT [count] :(Trace) プログラムを指定回数だけ命令を実行する（ステップ実行）。",
+	"\tG [address] :(Go) 指定したアドレスからプログラムを実行する。",
+	"\tV [speed] :(Velocity) 実行速度を設定する。",
+	"\tI [bit pattern] :(InPort) 入力ポートの値を設定する。",
+	"\tW :(Write) ROMの内容を S コマンドの書式で表示する。",
+	"\tSAVE :CPUの状態(ROM・レジスタ・ポート・ブレークポイント・実行速度)をJSON形式で表示する。",
+	"\tLOAD {json} :SAVE で表示した状態(td4emu で保存したものも可)を読み込む。",
+	"\tPROTO [TEXT|JSON] :(Protocol) 応答の形式を切り替える。JSON では1行に1つのJSONで応答する(プログラムからの操作用)。",
+	"\tQ :(Quit) モニタプログラムを終了する。",
+}
+
+// Command ボード固有のコマンド (FLASH など)
+type Command struct {
+	Help string                                     // H コマンドで表示する説明
+	Run  func(w io.Writer, elements []string) error // elements は大文字に変換して区切ったコマンド行
+}
+
+// Monitor モニタプログラムの状態
+type Monitor struct {
+	CPU      *td4.CPU
+	Step     func() int       // ボードの入出力ポートを操作しながら1命令実行する (nil なら CPU.Execute)
+	Commands map[byte]Command // ボード固有のコマンド (コマンドの先頭の1文字で選ぶ)
+	Out      io.Writer        // 表示と応答の出力先 (nil なら os.Stdout。USBシリアルで接続したPCに送られる)
+	Speed    int              // 1命令ごとの待ち時間 (ms)
+	StepMode bool             // trueならコマンドを受け付け、falseなら連続実行する
+	Quit     bool             // Q コマンドで終了する
+	Proto    bool             // プロトコルモード (PROTO JSON) ならtrue
+
+	protocol td4.Protocol // プロトコルモードの応答とイベントの通し番号、コマンドが表示した状態
+	out      io.Writer    // 実行中のコマンドの表示の出力先
+}
+
+// writer 表示と応答の出力先を返す
+func (m *Monitor) writer() io.Writer {
+	if m.Out != nil {
+		return m.Out
+	}
+	return os.Stdout
+}
+
+// step 1命令実行する。ブレークポイントに到達したら、実行せずに1を返す。
+func (m *Monitor) step() int {
+	if m.Step != nil {
+		return m.Step()
+	}
+	return m.CPU.Execute()
+}
+
+// Run 連続実行モードで1命令実行して、状態を表示する (プロトコルモードでは step のイベントを送る)
+// ブレークポイントに到達したら、ステップ実行モードに戻る。
+func (m *Monitor) Run() {
+	if m.step() != 0 {
+		m.StepMode = true
+		if m.Proto {
+			m.Event("break")
+		}
+		return
+	}
+	time.Sleep(time.Duration(m.Speed) * time.Millisecond)
+	if m.Proto {
+		m.Event("step")
+	} else {
+		DumpState(m.writer(), m.CPU, m.CPU.PC)
+	}
+}
+
+// execute 1行のコマンドを実行する。空行は何もしない。
+func (m *Monitor) execute(readbuffer string) error {
+	cpu := m.CPU
+	fields := strings.Fields(readbuffer)
+	if len(fields) == 0 {
+		return nil
+	}
+	switch strings.ToUpper(fields[0]) { // SAVE, LOAD はJSONを扱うので、大文字に変換する前に解析する
+	case "SAVE":
+		data, err := json.Marshal(cpu.Snapshot(int64(m.Speed)))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(m.out, "%s\n", data)
+		return nil
+	case "LOAD":
+		var snap td4.Snapshot
+		if err := json.Unmarshal([]byte(strings.TrimSpace(readbuffer)[len(fields[0]):]), &snap); err != nil {
+			return fmt.Errorf("invalid snapshot: %v", err)
+		}
+		if err := cpu.Restore(snap); err != nil {
+			return err
+		}
+		m.Speed = int(snap.Speed)
+		fmt.Fprintf(m.out, "Loaded snapshot. Speed=%5dms/inst\n", m.Speed)
+		m.showState()
+		return nil
+	case "PROTO":
+		return m.setProtocol(fields[1:])
+	}
+	line := strings.Replace(readbuffer, "\t", " ", -1) // タブをスペースに置換えて、区切り文字として使えるようにする。
+	line = strings.Replace(line, ",", " ", -1)
+	line = strings.ToUpper(line)
+	elements := strings.Fields(line)
+	if len(elements) == 0 { // "," だけの行など
+		return nil
+	}
+	// コマンド解析の開始
+	switch elements[0][0] {
+	/*
+		実装予定
+		Xコマンド	レジスタ、カウンタ、フラグ類の検査と変更
+	*/
+	case 'H': //	ヘルプの表示(help)
+		for i := 0; i < len(HelpText); i++ {
+			fmt.Fprintf(m.out, "%s\n", HelpText[i])
+		}
+		keys := make([]int, 0, len(m.Commands))
+		for c := range m.Commands {
+			keys = append(keys, int(c))
+		}
+		sort.Ints(keys)
+		for _, c := range keys {
+			fmt.Fprintf(m.out, "%s\n", m.Commands[byte(c)].Help)
+		}
+
+	case 'S': //	メモリの指定されたアドレスに値を書き込む。
+		// S 0 0x30 0x01 0x02 0x04 0x08 0x40 0x90 0xF7
+		// S 8 0x30 0x01 0x02 0x04 0x08 0x40 0x90 0xF7
+		return WriteMemory(cpu, elements)
+
+	case 'B': //	ブレークポイントの参照、設定と解除
+		if len(elements) == 1 {
+			if cpu.BP <= MEM_MAX {
+				fmt.Fprintf(m.out, "Break point: %d\n", cpu.BP)
+			} else {
+				fmt.Fprintf(m.out, "Break point: none\n")
+			}
+			return nil
+		}
+		//	数値変換
+		val, err := strconv.ParseInt(elements[1], 0, 16)
+		if err != nil {
+			return fmt.Errorf("invalid B command parameter: %s", elements[1])
+		}
+		if val >= 0 && val <= int64(MEM_MAX) { // アドレスの範囲であれば、BPに値を設定する。
+			cpu.BP = uint8(val)
+			fmt.Fprintf(m.out, "Break point: %d\n", cpu.BP)
+		} else { // 0～15以外の値で、ブレークポイントを解除する。
+			cpu.BP = 255
+			fmt.Fprintf(m.out, "Break point: none\n")
+		}
+
+	case 'M': //	現在の現在のメモリ内容を表示
+		if len(elements) > 1 {
+			return fmt.Errorf("M command takes no parameters")
+		}
+		fmt.Fprintf(m.out, "| Adress | OP-code          |\n")
+		fmt.Fprintf(m.out, "|:------:|:----------------:|\n")
+		for adr := 0; adr < 16; adr++ {
+			DumpMemory(m.out, cpu, uint8(adr))
+		}
+
+	case 'D': //	現在のCPUのレジスタ内容を表示する。
+		if len(elements) > 1 {
+			return fmt.Errorf("D command takes no parameters")
+		}
+		m.showState()
+
+	case 'T': //	レジスタ表示しながらトレース実行する回数を設定する。
+		if len(elements) == 1 {
+			m.step()
+			m.showState()
+			return nil
+		}
+		//	数値変換
+		loop, err := strconv.ParseInt(elements[1], 0, 64)
+		if err != nil || loop < 0 {
+			return fmt.Errorf("invalid T command parameter: %s", elements[1])
+		}
+		//	命令実行
+		for i := int64(0); i < loop; i++ {
+			if m.step() != 0 {
+				break //	Breakpointに到達したら、停止する。
+			}
+			time.Sleep(time.Duration(m.Speed) * time.Millisecond)
+			m.showState()
+		}
+
+	case 'G': //	ユーザプログラムの連続実行
+		if len(elements) > 1 {
+			//	数値変換
+			val, err := strconv.ParseInt(elements[1], 0, 16)
+			if err != nil {
+				return fmt.Errorf("invalid G command parameter: %s", elements[1])
+			}
+			if val < 0 || val > int64(MEM_MAX) {
+				return fmt.Errorf("address out of range (0-15): %s", elements[1])
+			}
+			cpu.PC = uint8(val) // PCのアドレスを更新して、連続実行モードに移行する。
+		}
+		m.StepMode = false
+		m.showState()
+
+	case 'V': //	実行速度の設定(velocity)
+		if len(elements) > 1 {
+			//	数値変換
+			val, err := strconv.ParseInt(elements[1], 0, 64)
+			if err != nil || val < 0 {
+				return fmt.Errorf("invalid speed: %s (set the execution time for one step in milliseconds)", elements[1])
+			}
+			m.Speed = int(val)
+		}
+		fmt.Fprintf(m.out, "Speed=%5dms/inst\n", m.Speed)
+
+	case 'I': //	入力ポートの値を設定する。
+		if len(elements) > 1 {
+			//	数値変換
+			val, err := strconv.ParseInt(elements[1], 0, 8)
+			if err != nil {
+				return fmt.Errorf("invalid input value: %s", elements[1])
+			}
+			cpu.InPort = uint8(0x0f & val)
+		}
+		m.showState()
+
+	case 'W': //	ROMの内容を S コマンドの書式で表示する。
+		WriteROM(m.out, cpu)
+
+	case 'Q':
+		m.Quit = true // プログラムを終了する。
+
+	default:
+		if c, ok := m.Commands[elements[0][0]]; ok { // ボード固有のコマンド
+			return c.Run(m.out, elements)
+		}
+		return fmt.Errorf("unknown command: %s (H for help)", elements[0])
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"main/td4"
+)
+
+// newTestMonitor 待ち時間なしのモニタを作成する
+func newTestMonitor() (*Monitor, *bytes.Buffer) {
+	var buf bytes.Buffer
+	return &Monitor{CPU: td4.NewCPU(), Out: &buf, StepMode: true}, &buf
+}
+
+func TestSeparatorOnly(t *testing.T) {
+	for _, line := range []string{"", " ", ",", " , ,", "\t,\t"} {
+		m, buf := newTestMonitor()
+		if err := m.Command(line); err != nil {
+			t.Errorf("Command(%q) = %v", line, err)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("Command(%q) printed %q", line, buf.String())
+		}
+	}
+}
+
+func TestAddressRange(t *testing.T) {
+	tests := []struct {
+		line string
+		bp   uint8  // 実行後のブレークポイント
+		err  string // 空ならエラーにならない
+	}{
+		{"B 3", 3, ""},
+		{"B 0x0F", 15, ""},
+		{"B 16", 255, ""},
+		{"B 0x100", 255, ""}, // uint8 に変換すると 0 になる値
+		{"B 259", 255, ""},
+		{"B -1", 255, ""},
+		{"B X", 255, "invalid B command parameter: X"},
+		{"G 0x100", 255, "address out of range (0-15): 0X100"},
+		{"G 16", 255, "address out of range (0-15): 16"},
+		{"G X", 255, "invalid G command parameter: X"},
+		{"S 0x100 0x01", 255, "address out of range (0-15): 0X100"},
+		{"S 0x110 0x01", 255, "address out of range (0-15): 0X110"},
+		{"S X 0x01", 255, "invalid address: X"},
+		{"S 0", 255, "insufficient address or opcode information required for writing"},
+	}
+	for _, tt := range tests {
+		m, _ := newTestMonitor()
+		err := m.Command(tt.line)
+		if got := fmt.Sprint(err); tt.err == "" && err != nil || tt.err != "" && got != tt.err {
+			t.Errorf("Command(%q) = %v, want %q", tt.line, err, tt.err)
+		}
+		if m.CPU.BP != tt.bp {
+			t.Errorf("Command(%q): BP = %d, want %d", tt.line, m.CPU.BP, tt.bp)
+		}
+		if m.CPU.PC != 0 || m.CPU.ROM != [16]uint8{} || !m.StepMode {
+			t.Errorf("Command(%q) changed PC=%d ROM=%v StepMode=%v", tt.line, m.CPU.PC, m.CPU.ROM, m.StepMode)
+		}
+	}
+}
+
+func TestWriteMemory(t *testing.T) {
+	m, buf := newTestMonitor()
+	if err := m.Command("S 14, 0x31, 0xB3"); err != nil {
+		t.Fatal(err)
+	}
+	if m.CPU.ROM[14] != 0x31 || m.CPU.ROM[15] != 0xB3 {
+		t.Errorf("ROM = %v", m.CPU.ROM)
+	}
+	// あふれる前の 0x01 は書き込まれる
+	if err := m.Command("S 15 0x01 0x02"); fmt.Sprint(err) != "memory overflow: this system has only 16 bytes of memory space" {
+		t.Errorf("writing past address 15: %v", err)
+	}
+	if err := m.Command("W"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "S 0x00 0x00") || !strings.HasSuffix(buf.String(), " 0x31 0x01\n") {
+		t.Errorf("W printed %q", buf.String())
+	}
+}
+
+func TestTrace(t *testing.T) {
+	m, buf := newTestMonitor()
+	steps := 0
+	m.Step = func() int { // ボードの Execute の代わり
+		steps++
+		return m.CPU.Execute()
+	}
+	for _, line := range []string{"S 0 0x31 0x52 0xF0", "B 2", "T 5"} {
+		if err := m.Command(line); err != nil {
+			t.Fatalf("Command(%q) = %v", line, err)
+		}
+	}
+	if steps != 3 || m.CPU.PC != 2 || m.CPU.A != 1 || m.CPU.B != 2 {
+		t.Errorf("after T 5: steps=%d PC=%d A=%d B=%d, want a stop at the breakpoint 2", steps, m.CPU.PC, m.CPU.A, m.CPU.B)
+	}
+	if n := strings.Count(buf.String(), "| PC:"); n != 2 {
+		t.Errorf("T 5 printed %d states, want 2:\n%s", n, buf.String())
+	}
+}
+
+func TestRun(t *testing.T) {
+	m, _ := newTestMonitor()
+	if err := m.Command("S 0 0x01 0xF0"); err != nil {
+		t.Fatal(err)
+	}
+	m.CPU.Breaks[1] = true // LOAD で読み込んだ2つ目以降のブレークポイント
+	if err := m.Command("G"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3 && !m.StepMode; i++ {
+		m.Run()
+	}
+	if !m.StepMode || m.CPU.PC != 1 {
+		t.Errorf("Run: StepMode=%v PC=%d, want a stop at address 1", m.StepMode, m.CPU.PC)
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	m, buf := newTestMonitor()
+	for _, line := range []string{"S 0 0x31 0xB3", "B 1", "I 5", "V 7", "T"} {
+		if err := m.Command(line); err != nil {
+			t.Fatalf("Command(%q) = %v", line, err)
+		}
+	}
+	buf.Reset()
+	if err := m.Command("save"); err != nil {
+		t.Fatal(err)
+	}
+	saved := strings.TrimSpace(buf.String())
+
+	n, _ := newTestMonitor()
+	if err := n.Command("LOAD " + saved); err != nil {
+		t.Fatal(err)
+	}
+	if *n.CPU != *m.CPU || n.Speed != 7 {
+		t.Errorf("LOAD restored %+v speed %d, want %+v speed 7", *n.CPU, n.Speed, *m.CPU)
+	}
+	for _, line := range []string{"LOAD", "LOAD {", `LOAD {"format":"td4-snapshot","version":9}`, `LOAD {"format":"td4-snapshot","version":1,"a":16}`} {
+		if err := n.Command(line); err == nil {
+			t.Errorf("Command(%q) succeeded", line)
+		}
+	}
+}
+
+func TestBoardCommand(t *testing.T) {
+	m, buf := newTestMonitor()
+	var got []string
+	m.Commands = map[byte]Command{'F': {Help: "\tFLASH :test", Run: func(w io.Writer, elements []string) error {
+		got = elements
+		io.WriteString(w, "flash\n")
+		return nil
+	}}}
+	if err := m.Command("flash save"); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, " ") != "FLASH SAVE" || buf.String() != "flash\n" {
+		t.Errorf("FLASH: elements=%q output=%q", got, buf.String())
+	}
+	buf.Reset()
+	if err := m.Command("H"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(buf.String(), "\tFLASH :test\n") {
+		t.Errorf("H does not show the board command:\n%s", buf.String())
+	}
+	if err := m.Command("X"); err == nil {
+		t.Error("unknown command succeeded")
+	}
+}
+
+func TestProtocol(t *testing.T) {
+	m, buf := newTestMonitor()
+	for _, line := range []string{"PROTO JSON", "S 0 0x31", "T 1", "X", ", ,", "PROTO TEXT", "D"} {
+		if err := m.Command(line); err != nil {
+			t.Fatalf("Command(%q) = %v", line, err)
+		}
+	}
+	lines := strings.Split(strings.TrimRight(buf.String(), "\n"), "\n")
+	if len(lines) != 7 {
+		t.Fatalf("got %d lines, want 5 responses and 2 text lines:\n%s", len(lines), buf.String())
+	}
+	for i, want := range []struct {
+		cmd, typ string
+		trace    int
+	}{
+		{"PROTO JSON", "ok", 0},
+		{"S 0 0x31", "ok", 0},
+		{"T 1", "ok", 1},
+		{"X", "error", 0},
+		{", ,", "ok", 0}, // 1つのコマンドに必ず1行の応答を返す
+	} {
+		var msg td4.ProtoMessage
+		if err := json.Unmarshal([]byte(lines[i]), &msg); err != nil {
+			t.Fatalf("line %d: %v: %s", i, err, lines[i])
+		}
+		if msg.Seq != i+1 || msg.Cmd != want.cmd || msg.Type != want.typ || len(msg.Trace) != want.trace || len(msg.ROM) != 16 {
+			t.Errorf("line %d = %+v, want seq %d cmd %q type %s trace %d", i, msg, i+1, want.cmd, want.typ, want.trace)
+		}
+	}
+	if lines[5] != "Protocol: text" || !strings.HasPrefix(lines[6], "| PC:01") {
+		t.Errorf("after PROTO TEXT: %q", lines[5:])
+	}
+}
@@ -0,0 +1,87 @@
+package monitor
+
+// プロトコルモード (PROTO JSON コマンド)
+// プログラムからモニタを操作するためのモードで、プロンプトとエコーを表示せず、1行に1つのJSONで応答する。
+// 応答とイベントの形式は td4/protocol.go を参照 (td4emu (PC版) と共通なので、ホストのプログラムはどちらも同じように操作できる)。
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"main/td4"
+)
+
+// send 応答またはイベントに、現在の状態を付けて送る
+func (m *Monitor) send(msg td4.ProtoMessage) {
+	msg.State, msg.Speed, msg.Running = m.CPU.ProtoState(), int64(m.Speed), !m.StepMode
+	m.protocol.Send(m.writer(), msg)
+}
+
+// Event イベント (ready, step, break, exit) を送る
+func (m *Monitor) Event(name string) {
+	m.send(td4.ProtoMessage{Type: "event", Event: name})
+}
+
+// showState コマンドの実行後の状態を表示する (プロトコルモードでは応答の trace に加える)
+func (m *Monitor) showState() {
+	if m.Proto {
+		m.protocol.Trace = append(m.protocol.Trace, m.CPU.ProtoState())
+		return
+	}
+	DumpState(m.out, m.CPU, m.CPU.PC)
+}
+
+// Command 1行のコマンドを実行する
+// プロトコルモードでは、表示を応答に含めて送り、エラーも応答として送る (エラーを返さない)。
+func (m *Monitor) Command(line string) error {
+	if strings.TrimSpace(line) == "" {
+		return nil
+	}
+	w := m.writer()
+	if !m.Proto {
+		m.out = w
+		err := m.execute(line)
+		if err == nil && m.Proto { // PROTO JSON でプロトコルモードに切り替えた
+			m.respond(line, "", nil)
+		}
+		return err
+	}
+	var buf bytes.Buffer
+	m.out, m.protocol.Trace = &buf, nil
+	err := m.execute(line)
+	m.out = w
+	if !m.Proto { // PROTO TEXT でテキストモードに戻した
+		fmt.Fprint(w, buf.String())
+		return err
+	}
+	m.respond(line, buf.String(), err)
+	return nil
+}
+
+// respond コマンドの応答を送る
+func (m *Monitor) respond(line, output string, err error) {
+	m.send(m.protocol.Response(m.CPU, line, output, err))
+}
+
+// setProtocol PROTO コマンド: モニタの応答の形式を切り替える (引数がなければ、現在の形式を表示する)
+func (m *Monitor) setProtocol(args []string) error {
+	if len(args) == 0 {
+		if m.Proto {
+			fmt.Fprintf(m.out, "Protocol: json\n")
+		} else {
+			fmt.Fprintf(m.out, "Protocol: text\n")
+		}
+		return nil
+	}
+	switch strings.ToUpper(args[0]) {
+	case "JSON":
+		m.Proto = true
+	case "TEXT":
+		m.Proto = false
+		fmt.Fprintf(m.out, "Protocol: text\n")
+	default:
+		return fmt.Errorf("invalid PROTO command parameter: %s (TEXT or JSON)", args[0])
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+// Package romstore TD4のROMを不揮発メモリ(フラッシュメモリ)の先頭のブロックに保存する
+// machine パッケージを使わないので、Memory を使ってPC上でも動作を確認できる。
+//
+// 保存する形式 (23バイト。書き込みの単位まで0xFFで埋める):
+//
+//	0-3   "TD4R"
+//	4     版 (1)
+//	5     フラグ (bit0: 起動時に読み込む)
+//	6-21  ROM (16バイト)
+//	22    チェックサム (0～22バイト目の合計が0になる値)
+package romstore
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Device ROMを保存する不揮発メモリ
+// TinyGo の machine.Flash と同じメソッドなので、そのまま渡すことができる。
+type Device interface {
+	ReadAt(p []byte, off int64) (n int, err error)
+	WriteAt(p []byte, off int64) (n int, err error)
+	Size() int64
+	WriteBlockSize() int64
+	EraseBlockSize() int64
+	EraseBlocks(start, length int64) error
+}
+
+// Record 保存するROMと設定
+type Record struct {
+	ROM      [16]uint8
+	Autoload bool // trueなら起動時にROMに読み込む
+}
+
+// ErrEmpty ROMが保存されていない (消去した状態)
+var ErrEmpty = errors.New("no ROM saved in flash")
+
+const (
+	magic      = "TD4R"
+	version    = 1
+	recordSize = 23
+	flagAuto   = 0x01
+)
+
+// encode 保存する形式に変換する
+func (r Record) encode() []byte {
+	buf := make([]byte, recordSize)
+	copy(buf, magic)
+	buf[4] = version
+	if r.Autoload {
+		buf[5] |= flagAuto
+	}
+	copy(buf[6:22], r.ROM[:])
+	var sum byte
+	for _, b := range buf[:22] {
+		sum += b
+	}
+	buf[22] = -sum
+	return buf
+}
+
+// Load 保存したROMを読み込む。保存されていなければ ErrEmpty を返す。
+func Load(dev Device) (Record, error) {
+	var r Record
+	buf := make([]byte, recordSize)
+	if _, err := dev.ReadAt(buf, 0); err != nil {
+		return r, err
+	}
+	if string(buf[:4]) != magic {
+		return r, ErrEmpty
+	}
+	if buf[4] != version {
+		return r, fmt.Errorf("unsupported ROM record version %d", buf[4])
+	}
+	var sum byte
+	for _, b := range buf {
+		sum += b
+	}
+	if sum != 0 {
+		return r, errors.New("saved ROM is corrupted (checksum error)")
+	}
+	r.Autoload = buf[5]&flagAuto != 0
+	copy(r.ROM[:], buf[6:22])
+	return r, nil
+}
+
+// Save 先頭のブロックを消去してからROMを書き込み、読み直して確認する
+func Save(dev Device, r Record) error {
+	if err := dev.EraseBlocks(0, 1); err != nil {
+		return err
+	}
+	data := r.encode()
+	if n := dev.WriteBlockSize(); n > 1 { // 書き込みの単位にそろえる
+		size := (int64(len(data)) + n - 1) / n * n
+		for int64(len(data)) < size {
+			data = append(data, 0xFF)
+		}
+	}
+	if _, err := dev.WriteAt(data, 0); err != nil {
+		return err
+	}
+	saved, err := Load(dev)
+	if err != nil {
+		return fmt.Errorf("verify failed: %v", err)
+	}
+	if saved != r {
+		return errors.New("verify failed: saved ROM differs")
+	}
+	return nil
+}
+
+// Erase 保存したROMを消去する
+func Erase(dev Device) error {
+	return dev.EraseBlocks(0, 1)
+}
+
+// Memory メモリ上の Device (PC上での確認や、フラッシュメモリのないボード用)
+// フラッシュメモリと同じく、消去すると0xFFになり、書き込みではビットを0にすることしかできない。
+type Memory struct {
+	data       []byte
+	writeBlock int64
+	eraseBlock int64
+}
+
+// NewMemory 消去した状態の Memory を作成する
+// 書き込みと消去の単位は1以上で、容量は先頭のブロック (消去の単位) 以上でなければならない。
+func NewMemory(size, writeBlockSize, eraseBlockSize int64) (*Memory, error) {
+	if writeBlockSize <= 0 || eraseBlockSize <= 0 {
+		return nil, fmt.Errorf("block sizes must be positive (write %d, erase %d)", writeBlockSize, eraseBlockSize)
+	}
+	if size < eraseBlockSize {
+		return nil, fmt.Errorf("size %d is smaller than the erase block size %d", size, eraseBlockSize)
+	}
+	m := &Memory{data: make([]byte, size), writeBlock: writeBlockSize, eraseBlock: eraseBlockSize}
+	for i := range m.data {
+		m.data[i] = 0xFF
+	}
+	return m, nil
+}
+
+func (m *Memory) Size() int64           { return int64(len(m.data)) }
+func (m *Memory) WriteBlockSize() int64 { return m.writeBlock }
+func (m *Memory) EraseBlockSize() int64 { return m.eraseBlock }
+
+// ReadAt off から len(p) バイト読み込む
+func (m *Memory) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > m.Size() {
+		return 0, errors.New("read out of range")
+	}
+	return copy(p, m.data[off:]), nil
+}
+
+// WriteAt off から p を書き込む。off と len(p) は書き込みの単位の倍数でなければならない。
+func (m *Memory) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > m.Size() {
+		return 0, errors.New("write out of range")
+	}
+	if off%m.writeBlock != 0 || int64(len(p))%m.writeBlock != 0 {
+		return 0, errors.New("write is not aligned to the write block size")
+	}
+	for i, b := range p {
+		m.data[off+int64(i)] &= b
+	}
+	return len(p), nil
+}
+
+// EraseBlocks start 番目のブロックから length 個のブロックを消去する
+func (m *Memory) EraseBlocks(start, length int64) error {
+	from, to := start*m.eraseBlock, (start+length)*m.eraseBlock
+	if start < 0 || length < 0 || to > m.Size() {
+		return errors.New("erase out of range")
+	}
+	for i := from; i < to; i++ {
+		m.data[i] = 0xFF
+	}
+	return nil
+}
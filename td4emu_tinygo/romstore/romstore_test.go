@@ -0,0 +1,162 @@
+package romstore
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// newTestMemory RP2040 と同じブロックの大きさの Memory を作成する
+func newTestMemory(t *testing.T) *Memory {
+	t.Helper()
+	m, err := NewMemory(2*4096, 256, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestSaveLoad(t *testing.T) {
+	for _, r := range []Record{
+		{ROM: [16]uint8{0x30, 0x01, 0x02, 0x04, 0x08, 0x40, 0x90, 0xF7}, Autoload: true},
+		{ROM: [16]uint8{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}},
+		{},
+	} {
+		m := newTestMemory(t)
+		if err := Save(m, r); err != nil {
+			t.Fatalf("Save(%v): %v", r, err)
+		}
+		got, err := Load(m)
+		if err != nil {
+			t.Fatalf("Load: %v", err)
+		}
+		if got != r {
+			t.Errorf("Load = %v, want %v", got, r)
+		}
+		if !bytes.Equal(m.data[recordSize:256], bytes.Repeat([]byte{0xFF}, 256-recordSize)) {
+			t.Errorf("padding after the record is not 0xFF")
+		}
+	}
+}
+
+// TestSaveOverwrite 書き込みではビットを0にすることしかできないので、Save は消去してから書き込む
+func TestSaveOverwrite(t *testing.T) {
+	m := newTestMemory(t)
+	first := Record{ROM: [16]uint8{0x00, 0x00, 0x00}, Autoload: true}
+	second := Record{ROM: [16]uint8{0xB3, 0xF0, 0xFF}}
+	for _, r := range []Record{first, second} {
+		if err := Save(m, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, err := Load(m); err != nil || got != second {
+		t.Errorf("Load = %v, %v; want %v", got, err, second)
+	}
+}
+
+func TestLoadEmpty(t *testing.T) {
+	m := newTestMemory(t)
+	if _, err := Load(m); err != ErrEmpty {
+		t.Errorf("Load on erased memory: err = %v, want ErrEmpty", err)
+	}
+	if err := Save(m, Record{Autoload: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Erase(m); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(m); err != ErrEmpty {
+		t.Errorf("Load after Erase: err = %v, want ErrEmpty", err)
+	}
+}
+
+func TestLoadCorrupt(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(data []byte)
+		empty   bool // ErrEmpty (保存されていない) と判定するならtrue
+	}{
+		{"magic", func(data []byte) { data[0] = 'X' }, true},
+		{"version", func(data []byte) { data[4] = version + 1 }, false},
+		{"rom", func(data []byte) { data[6] ^= 0x01 }, false},
+		{"flags", func(data []byte) { data[5] ^= flagAuto }, false},
+		{"checksum", func(data []byte) { data[22]++ }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestMemory(t)
+			if err := Save(m, Record{ROM: [16]uint8{0x31, 0xB1}, Autoload: true}); err != nil {
+				t.Fatal(err)
+			}
+			tt.corrupt(m.data)
+			_, err := Load(m)
+			if err == nil {
+				t.Fatal("Load succeeded on corrupted data")
+			}
+			if (err == ErrEmpty) != tt.empty {
+				t.Errorf("Load: err = %v, want ErrEmpty=%v", err, tt.empty)
+			}
+		})
+	}
+}
+
+func TestNewMemory(t *testing.T) {
+	tests := []struct {
+		size, write, erase int64
+		ok                 bool
+	}{
+		{4096, 256, 4096, true},
+		{4096, 1, 4096, true},
+		{4096, 0, 4096, false},
+		{4096, 256, 0, false},
+		{4096, -1, 4096, false},
+		{1024, 256, 4096, false},
+	}
+	for _, tt := range tests {
+		m, err := NewMemory(tt.size, tt.write, tt.erase)
+		if (err == nil) != tt.ok {
+			t.Errorf("NewMemory(%d, %d, %d): err = %v, want ok=%v", tt.size, tt.write, tt.erase, err, tt.ok)
+			continue
+		}
+		if err == nil && (m.Size() != tt.size || m.WriteBlockSize() != tt.write || m.EraseBlockSize() != tt.erase) {
+			t.Errorf("NewMemory(%d, %d, %d) = size %d, write %d, erase %d",
+				tt.size, tt.write, tt.erase, m.Size(), m.WriteBlockSize(), m.EraseBlockSize())
+		}
+	}
+}
+
+func TestMemoryWrite(t *testing.T) {
+	m := newTestMemory(t)
+	if _, err := m.WriteAt(make([]byte, 10), 0); err == nil {
+		t.Error("unaligned WriteAt succeeded")
+	}
+	if _, err := m.WriteAt(make([]byte, 256), m.Size()); err == nil {
+		t.Error("WriteAt past the end succeeded")
+	}
+	if err := m.EraseBlocks(2, 1); err == nil {
+		t.Error("EraseBlocks past the end succeeded")
+	}
+	data := bytes.Repeat([]byte{0xF0}, 256)
+	if _, err := m.WriteAt(data, 256); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.WriteAt(bytes.Repeat([]byte{0x3C}, 256), 256); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1)
+	if _, err := m.ReadAt(buf, 300); err != nil || buf[0] != 0x30 {
+		t.Errorf("ReadAt after two writes = %#x, %v; want 0x30 (bits are only cleared)", buf[0], err)
+	}
+}
+
+// failDevice 書き込んだ内容を読み直せない Device
+type failDevice struct{ *Memory }
+
+func (d failDevice) WriteAt(p []byte, off int64) (int, error) { return len(p), nil }
+
+func TestSaveVerify(t *testing.T) {
+	err := Save(failDevice{newTestMemory(t)}, Record{ROM: [16]uint8{1}})
+	if err == nil || errors.Is(err, ErrEmpty) {
+		t.Errorf("Save without writing: err = %v, want a verify error", err)
+	}
+}
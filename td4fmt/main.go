@@ -0,0 +1,88 @@
+package main
+
+// 4bitCPU td4用のソースコード整形ツール
+// ラベル・命令・オペランド・コメントの桁をそろえ、大文字小文字と数値の表記を統一します。
+// > go build -o td4fmt.exe .
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"main/asm"
+)
+
+func main() {
+	var writeFlag bool
+	flag.BoolVar(&writeFlag, "w", false, "整形結果を元のファイルに上書きする")
+	var checkFlag bool
+	flag.BoolVar(&checkFlag, "check", false, "整形されていないファイル名を表示し、1つでもあれば終了コード1で終了する")
+	var caseFlag string
+	flag.StringVar(&caseFlag, "case", "upper", "命令・レジスタ名などの表記 (upper, lower)")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "TD4 ソースコード整形ツール\n")
+		fmt.Fprintf(os.Stderr, "td4用のソースコードを一定の書式に整形します。\n\n")
+		fmt.Fprintf(os.Stderr, "使い方:\n")
+		fmt.Fprintf(os.Stderr, "td4fmt [オプション] ファイル名...\n\n")
+		fmt.Fprintf(os.Stderr, "オプション:\n")
+		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\n使用例:\n")
+		fmt.Fprintf(os.Stderr, "  td4fmt Sample.td4                (整形結果を表示)\n")
+		fmt.Fprintf(os.Stderr, "  td4fmt -w *.td4                  (整形してファイルに上書き)\n")
+		fmt.Fprintf(os.Stderr, "  td4fmt -check *.td4              (整形されていないファイルを確認)\n")
+		fmt.Fprintf(os.Stderr, "  td4fmt -case lower Sample.td4    (命令を小文字で整形)\n")
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	var opt asm.FormatOptions
+	switch caseFlag {
+	case "upper":
+	case "lower":
+		opt.Lower = true
+	default:
+		fmt.Fprintf(os.Stderr, "invalid -case option: %s (upper or lower)\n", caseFlag)
+		os.Exit(1)
+	}
+
+	status := 0
+	for _, path := range args {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			status = 1
+			continue
+		}
+		src := string(data)
+		lines := asm.SplitLines(data)
+		formatted := strings.Join(asm.Format(lines, opt), "\n")
+		if len(lines) > 0 {
+			formatted += "\n"
+		}
+
+		switch {
+		case checkFlag:
+			if formatted != src {
+				fmt.Println(path)
+				status = 1
+			}
+		case writeFlag:
+			if formatted == src {
+				continue
+			}
+			if err := os.WriteFile(path, []byte(formatted), 0644); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				status = 1
+			}
+		default:
+			fmt.Print(formatted)
+		}
+	}
+	os.Exit(status)
+}
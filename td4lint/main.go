@@ -0,0 +1,89 @@
+package main
+
+// 4bitCPU td4用のプログラム検査ツール
+// ソースコードをアセンブルし、制御フローを解析して、TD4のプログラムによくある誤りを警告します。
+// > go build -o td4lint.exe .
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"main/asm"
+)
+
+// stringList 複数回指定できるオプションの値
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+func main() {
+	var includeDirs stringList
+	flag.Var(&includeDirs, "I", "INCLUDEするファイルを探すディレクトリ (複数指定可)")
+	var defines stringList
+	flag.Var(&defines, "D", "定数を定義する NAME=値 (値を省略すると1, 複数指定可)")
+	var werrorFlag bool
+	flag.BoolVar(&werrorFlag, "Werror", false, "警告をエラーとして扱う")
+	var diagFormat string
+	flag.StringVar(&diagFormat, "diag", "text", "エラー・警告の表示形式 ("+strings.Join(asm.DiagFormats, ", ")+")")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "TD4 プログラム検査ツール\n")
+		fmt.Fprintf(os.Stderr, "td4用のプログラムを解析し、誤りの可能性がある箇所を警告します。\n\n")
+		fmt.Fprintf(os.Stderr, "使い方:\n")
+		fmt.Fprintf(os.Stderr, "td4lint [オプション] ファイル名...\n\n")
+		fmt.Fprintf(os.Stderr, "オプション:\n")
+		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\n使用例:\n")
+		fmt.Fprintf(os.Stderr, "  td4lint Sample.td4                (プログラムを検査)\n")
+		fmt.Fprintf(os.Stderr, "  td4lint -D PICO Sample.td4        (定数を定義して検査)\n")
+		fmt.Fprintf(os.Stderr, "  td4lint -diag gcc *.td4           (警告をGCC形式で表示)\n")
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	status := 0
+	for _, filePath := range args {
+		lines, err := asm.ReadLines(filePath)
+		if err != nil {
+			log.Fatalf("Failed to read file: %v", err)
+		}
+		a := asm.NewAssembler(filePath, lines)
+		a.IncludeDirs = includeDirs
+		a.Diags.Werror = werrorFlag
+		a.WarnUnused = true
+		for _, def := range defines {
+			if err := a.Define(def); err != nil {
+				fmt.Fprintf(os.Stderr, "invalid -D option: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		pass1Err := a.Pass1()
+		pass2Err := a.Pass2()
+		if pass1Err == nil && pass2Err == nil {
+			a.Lint()
+		}
+		a.Diags.Sort()
+		if len(a.Diags.List) > 0 || diagFormat == "json" {
+			if err := a.Diags.Write(os.Stderr, diagFormat); err != nil {
+				log.Fatalf("%v", err)
+			}
+		}
+		if len(a.Diags.List) > 0 {
+			status = 1
+		}
+	}
+	os.Exit(status)
+}
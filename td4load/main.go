@@ -0,0 +1,161 @@
+package main
+
+// 4bitCPU td4用のプログラム転送ツール
+// シリアルポートで接続したTinyGo版エミュレータ (td4emu_tinygo) のモニタに、プログラムを書き込みます。
+// モニタのプロンプト "> " を待ってから S コマンドでROMを書き込み、M コマンドの表示で内容を確認します。
+// > go build -o td4load.exe .
+//
+// 終了コード:
+//   0  成功
+//   1  通信・アセンブルのエラー、書き込んだ内容の不一致
+//   2  コマンドラインの誤り
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"main/asm"
+)
+
+// 終了コード
+const (
+	exitOK    = 0
+	exitFail  = 1
+	exitUsage = 2
+)
+
+func main() {
+	port := flag.String("port", "", "シリアルポートのデバイス名 (例: /dev/ttyACM0, COM4)")
+	baud := flag.Int("baud", 115200, "通信速度 (USB接続のボードでは無視される)")
+	timeout := flag.Duration("timeout", 5*time.Second, "モニタの応答を待つ時間")
+	charDelay := flag.Duration("char-delay", 5*time.Millisecond, "1文字ごとの送信間隔 (受信の遅いボード用)")
+	goFlag := flag.Bool("go", false, "書き込んだ後に G 0 コマンドで実行を開始する")
+	flashFlag := flag.Bool("flash", false, "書き込んだ後に FLASH SAVE コマンドでフラッシュメモリに保存する")
+	verbose := flag.Bool("v", false, "送受信したデータを標準エラー出力に表示する")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "TD4 プログラム転送ツール\n")
+		fmt.Fprintf(os.Stderr, "シリアルポートで接続したTD4エミュレータのモニタに、プログラムを書き込みます。\n\n")
+		fmt.Fprintf(os.Stderr, "使い方:\n")
+		fmt.Fprintf(os.Stderr, "td4load -port デバイス名 [オプション] ファイル(.td4|.hex)\n\n")
+		fmt.Fprintf(os.Stderr, "オプション:\n")
+		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\n終了コード: 0 成功, 1 通信エラー・内容の不一致など, 2 コマンドラインの誤り\n")
+		fmt.Fprintf(os.Stderr, "\n使用例:\n")
+		fmt.Fprintf(os.Stderr, "  td4load -port /dev/ttyACM0 KnightRider.td4     (アセンブルして書き込む)\n")
+		fmt.Fprintf(os.Stderr, "  td4load -port COM4 -go KnightRider.hex         (書き込んで実行する)\n")
+		fmt.Fprintf(os.Stderr, "  td4load -port /dev/ttyACM0 -flash InOut.td4    (書き込んでフラッシュメモリに保存する)\n")
+	}
+	flag.Parse()
+
+	if *port == "" || flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+	rom, err := loadROM(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitFail)
+	}
+
+	f, err := openPort(*port, *baud)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitFail)
+	}
+	defer f.Close()
+	c := newMonitorConn(f, *timeout, *charDelay)
+	if *verbose {
+		c.log = os.Stderr
+	}
+	if err := upload(c, rom, *flashFlag, *goFlag); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *port, err)
+		os.Exit(exitFail)
+	}
+	os.Exit(exitOK)
+}
+
+// loadROM .td4 ファイルはアセンブルし、それ以外はHEXファイルとして読み込んで、ROMの内容を返す
+func loadROM(path string) (rom [16]uint8, err error) {
+	var start int
+	var image []uint8
+	if strings.EqualFold(filepath.Ext(path), ".td4") {
+		lines, err := asm.ReadLines(path)
+		if err != nil {
+			return rom, err
+		}
+		a := asm.NewAssembler(path, lines)
+		err1 := a.Pass1()
+		err2 := a.Pass2()
+		a.Diags.Sort()
+		a.Diags.Write(os.Stderr, "text")
+		if err1 != nil || err2 != nil {
+			return rom, fmt.Errorf("%s: assembly failed: %d error(s)", path, a.Diags.ErrorCount())
+		}
+		start, image = a.Image(false)
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return rom, err
+		}
+		defer f.Close()
+		if start, image, err = asm.ReadHex(f); err != nil {
+			return rom, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	if start+len(image) > len(rom) {
+		return rom, fmt.Errorf("%s: program size %d bytes exceeds the %d-byte ROM", path, start+len(image), len(rom))
+	}
+	copy(rom[start:], image)
+	return rom, nil
+}
+
+// upload ROMを書き込み、M コマンドで確認する
+func upload(c *monitorConn, rom [16]uint8, flash, run bool) error {
+	if err := c.sync(); err != nil {
+		return err
+	}
+	// 書き込まない番地も0にするために、16バイトすべてを送る
+	cmd := "S 0x00"
+	for _, b := range rom {
+		cmd += fmt.Sprintf(" 0x%02X", b)
+	}
+	if _, err := c.command(cmd); err != nil {
+		return err
+	}
+	out, err := c.command("M")
+	if err != nil {
+		return err
+	}
+	got, err := parseMemory(out)
+	if err != nil {
+		return err
+	}
+	for adr := range rom {
+		if got[adr] != rom[adr] {
+			return fmt.Errorf("verify failed at address %d: read 0x%02X, want 0x%02X", adr, got[adr], rom[adr])
+		}
+	}
+	fmt.Printf("Wrote and verified 16 bytes.\n")
+	if flash {
+		out, err := c.command("FLASH SAVE")
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(out, "Saved ROM to flash") {
+			return fmt.Errorf("FLASH SAVE failed: %s", strings.TrimSpace(out))
+		}
+		fmt.Printf("Saved ROM to flash.\n")
+	}
+	if run {
+		if err := c.send("G 0"); err != nil {
+			return err
+		}
+		fmt.Printf("Started the program.\n")
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBoard TinyGo版のモニタを動かすボードの代わり (シリアルポートとして使う)
+// 受け取った文字をエコーし、改行で S・M・G・FLASH SAVE コマンドを実行してから、プロンプト "> " を表示する。
+type fakeBoard struct {
+	rom     [16]uint8
+	pc      uint8
+	running bool // G コマンドで連続実行を始めたらtrue
+	line    []byte
+	flash   []uint8 // FLASH SAVE で保存したROM
+	corrupt int     // 0以上なら、S コマンドの後にこの番地の値を変える (書き込みの失敗)
+	silent  bool    // trueなら何も表示しない (連続実行中のボード)
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	out    bytes.Buffer // PCに送る出力
+	closed bool
+}
+
+func newFakeBoard() *fakeBoard {
+	b := &fakeBoard{corrupt: -1}
+	b.cond = sync.NewCond(&b.mu)
+	b.print("> ")
+	return b
+}
+
+func (b *fakeBoard) print(s string) {
+	if b.silent {
+		return
+	}
+	b.mu.Lock()
+	b.out.WriteString(s)
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// command モニタのコマンドを実行する (TinyGo版と同じ形式で表示する)
+func (b *fakeBoard) command(line string) error {
+	elements := strings.Fields(strings.ToUpper(line))
+	if len(elements) == 0 {
+		return nil
+	}
+	switch elements[0] {
+	case "S":
+		if len(elements) < 3 {
+			return errors.New("insufficient address or opcode information required for writing")
+		}
+		adr, err := strconv.ParseUint(elements[1], 0, 8)
+		if err != nil || int(adr)+len(elements)-2 > len(b.rom) {
+			return fmt.Errorf("invalid address: %s", elements[1])
+		}
+		for i, e := range elements[2:] {
+			v, err := strconv.ParseUint(e, 0, 8)
+			if err != nil {
+				return fmt.Errorf("invalid hex format at %d: %s", i+2, e)
+			}
+			b.rom[int(adr)+i] = uint8(v)
+		}
+		if b.corrupt >= 0 {
+			b.rom[b.corrupt] ^= 0xFF
+		}
+	case "M":
+		b.print("| Adress | OP-code          |\n|:------:|:----------------:|\n")
+		for adr, v := range b.rom {
+			bits := fmt.Sprintf("%08b", v)
+			b.print(fmt.Sprintf("|   %02d   | 0x%02X 0b%s_%s |\n", adr, v, bits[:4], bits[4:]))
+		}
+	case "G":
+		b.pc, b.running = 0, true
+	case "FLASH":
+		if len(elements) < 2 || elements[1] != "SAVE" {
+			return errors.New("unsupported FLASH command")
+		}
+		b.flash = append([]uint8(nil), b.rom[:]...)
+		b.print("Saved ROM to flash. autoload=true\n")
+	default:
+		return fmt.Errorf("unknown command: %s (H for help)", elements[0])
+	}
+	return nil
+}
+
+func (b *fakeBoard) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.out.Len() == 0 && !b.closed {
+		b.cond.Wait()
+	}
+	if b.closed {
+		return 0, io.EOF
+	}
+	return b.out.Read(p)
+}
+
+func (b *fakeBoard) Write(p []byte) (int, error) {
+	for _, c := range p {
+		if c != '\r' && c != '\n' {
+			b.line = append(b.line, c)
+			b.print(string(c))
+			continue
+		}
+		b.print("\n")
+		line := string(b.line)
+		b.line = nil
+		if err := b.command(line); err != nil {
+			b.print(err.Error() + "\n")
+		}
+		if !b.running {
+			b.print("> ")
+		}
+	}
+	return len(p), nil
+}
+
+func (b *fakeBoard) Close() {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+var testROM = [16]uint8{0x31, 0xB3, 0x01, 0xE0, 0xF1}
+
+func TestUpload(t *testing.T) {
+	tests := []struct {
+		name       string
+		flash, run bool
+	}{
+		{"write", false, false},
+		{"go", false, true},
+		{"flash", true, false},
+		{"flash and go", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newFakeBoard()
+			defer b.Close()
+			b.rom = [16]uint8{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+			b.pc = 7
+			c := newMonitorConn(b, time.Second, 0)
+			if err := upload(c, testROM, tt.flash, tt.run); err != nil {
+				t.Fatal(err)
+			}
+			if b.rom != testROM {
+				t.Errorf("ROM = % X, want % X", b.rom, testROM)
+			}
+			if tt.flash != (b.flash != nil) || (b.flash != nil && !bytes.Equal(b.flash, testROM[:])) {
+				t.Errorf("flash = % X, want saved=%v", b.flash, tt.flash)
+			}
+			if b.running != tt.run || (tt.run && b.pc != 0) {
+				t.Errorf("running=%v PC=%d, want running=%v from address 0", b.running, b.pc, tt.run)
+			}
+		})
+	}
+}
+
+func TestUploadVerifyFailed(t *testing.T) {
+	b := newFakeBoard()
+	defer b.Close()
+	b.corrupt = 3
+	err := upload(newMonitorConn(b, time.Second, 0), testROM, true, true)
+	if err == nil || !strings.Contains(err.Error(), "verify failed at address 3") {
+		t.Fatalf("upload = %v, want a verify error at address 3", err)
+	}
+	if b.flash != nil || b.running {
+		t.Errorf("upload continued after the verify error: flash=% X running=%v", b.flash, b.running)
+	}
+}
+
+func TestUploadNoPrompt(t *testing.T) {
+	b := newFakeBoard()
+	defer b.Close()
+	b.silent = true
+	b.out.Reset() // 起動時のプロンプトも表示していない
+	c := newMonitorConn(b, 300*time.Millisecond, 0)
+	if err := upload(c, testROM, false, false); err != errNoPrompt {
+		t.Fatalf("upload = %v, want errNoPrompt", err)
+	}
+}
+
+func TestParseMemory(t *testing.T) {
+	var table strings.Builder
+	table.WriteString("| Adress | OP-code          |\n|:------:|:----------------:|\n")
+	for adr := 0; adr < 16; adr++ {
+		mark := " "
+		if adr == 2 {
+			mark = "B" // ブレークポイント
+		}
+		fmt.Fprintf(&table, "|   %02d %s | 0x%02X 0b0000_0000 |\r\n", adr, mark, testROM[adr])
+	}
+	rom, err := parseMemory(table.String())
+	if err != nil || rom != testROM {
+		t.Errorf("parseMemory = % X, %v; want % X", rom, err, testROM)
+	}
+	if _, err := parseMemory(strings.Join(strings.Split(table.String(), "\n")[:10], "\n")); err == nil {
+		t.Error("parseMemory succeeded on a partial table")
+	}
+}
+
+func TestLoadROM(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, text string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	tests := []struct {
+		path string
+		rom  [16]uint8
+		err  bool
+	}{
+		{write("blink.td4", "START:\n    OUT 1\n    OUT 0\n    JMP START\n"), [16]uint8{0xB1, 0xB0, 0xF0}, false},
+		{write("blink.hex", "; comment\nS 0x00 0xB1 0xB0 0xF0\n"), [16]uint8{0xB1, 0xB0, 0xF0}, false},
+		{write("offset.hex", "S 0x0E 0x12 0x34\n"), [16]uint8{14: 0x12, 15: 0x34}, false},
+		{write("large.hex", "S 0x0F 0x12 0x34\n"), [16]uint8{}, true},
+		{write("bad.td4", "    FOO 1\n"), [16]uint8{}, true},
+		{filepath.Join(dir, "missing.hex"), [16]uint8{}, true},
+	}
+	for _, tt := range tests {
+		rom, err := loadROM(tt.path)
+		if (err != nil) != tt.err || (err == nil && rom != tt.rom) {
+			t.Errorf("loadROM(%s) = % X, %v; want % X, error=%v", filepath.Base(tt.path), rom, err, tt.rom, tt.err)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+// モニタプログラムとのやり取り
+// コマンドを送り、次のプロンプト "> " が表示されるまでの出力を受け取る。
+// コマンドの終わりには "\n" を送る (TinyGo版は "\r" と "\n"、PC版は "\n" で1行の終わりとみなす)。
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errNoPrompt モニタがコマンドを待っていないときのエラー
+var errNoPrompt = errors.New("timeout waiting for the monitor prompt \"> \" (is the emulator running? stop it or reset the board)")
+
+// monitorConn シリアルポートの先のモニタプログラムとの接続
+type monitorConn struct {
+	port      io.ReadWriter
+	data      chan []byte // 受信したデータ
+	errc      chan error  // 受信のエラー
+	received  string      // 受信したが、まだ取り出していない出力
+	timeout   time.Duration
+	charDelay time.Duration
+	log       io.Writer // nil でなければ、送受信したデータを表示する
+}
+
+// newMonitorConn 受信を始める
+func newMonitorConn(port io.ReadWriter, timeout time.Duration, charDelay time.Duration) *monitorConn {
+	c := &monitorConn{port: port, data: make(chan []byte, 16), errc: make(chan error, 1), timeout: timeout, charDelay: charDelay}
+	go func() {
+		for {
+			buf := make([]byte, 256)
+			n, err := port.Read(buf)
+			if n > 0 {
+				c.data <- buf[:n]
+			}
+			if err != nil {
+				c.errc <- err
+				return
+			}
+		}
+	}()
+	return c
+}
+
+// receive 受信したデータを d の間待って、received に加える。何も受信しなければfalseを返す。
+func (c *monitorConn) receive(d time.Duration) (bool, error) {
+	select {
+	case b := <-c.data:
+		if c.log != nil {
+			c.log.Write(b)
+		}
+		c.received += string(b)
+		return true, nil
+	case err := <-c.errc:
+		return false, err
+	case <-time.After(d):
+		return false, nil
+	}
+}
+
+// atPrompt 最後の行がプロンプト "> " で終わっていればtrueを返す
+// 改行をエコーしないモニタでは、空行を送ると "> > " のようにプロンプトが並ぶ。
+func (c *monitorConn) atPrompt() bool {
+	last := c.received[strings.LastIndex(c.received, "\n")+1:]
+	return strings.HasSuffix(last, "> ")
+}
+
+// waitPrompt プロンプトが表示されるまで受信し、それまでの出力を返す
+func (c *monitorConn) waitPrompt() (string, error) {
+	deadline := time.Now().Add(c.timeout)
+	for !c.atPrompt() {
+		left := time.Until(deadline)
+		if left <= 0 {
+			return "", errNoPrompt
+		}
+		if _, err := c.receive(left); err != nil {
+			return "", err
+		}
+	}
+	out := strings.TrimSuffix(c.received, "> ")
+	c.received = ""
+	return out, nil
+}
+
+// sync 改行を送ってプロンプトを表示させ、それ以降の出力がなくなるまで待つ
+// 送る前に表示されていたプロンプトと区別するため、受信したデータは捨てる。
+func (c *monitorConn) sync() error {
+	if err := c.send(""); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(c.timeout)
+	for {
+		more, err := c.receive(200 * time.Millisecond)
+		if err != nil {
+			return err
+		}
+		if !more && c.atPrompt() {
+			c.received = ""
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errNoPrompt
+		}
+	}
+}
+
+// send コマンドを1文字ずつ送る
+func (c *monitorConn) send(cmd string) error {
+	for _, b := range []byte(cmd + "\n") {
+		if _, err := c.port.Write([]byte{b}); err != nil {
+			return err
+		}
+		if c.charDelay > 0 {
+			time.Sleep(c.charDelay)
+		}
+	}
+	return nil
+}
+
+// command コマンドを送り、その出力を返す (先頭のエコーされたコマンドの行は除く)
+func (c *monitorConn) command(cmd string) (string, error) {
+	if err := c.send(cmd); err != nil {
+		return "", err
+	}
+	out, err := c.waitPrompt()
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", cmd, err)
+	}
+	if i := strings.Index(out, "\n"); i >= 0 && strings.Contains(out[:i], cmd) {
+		out = out[i+1:]
+	}
+	return out, nil
+}
+
+// memoryRow M コマンドの表の1行 (|   00   | 0x30 0b0011_0000 | ...)
+var memoryRow = regexp.MustCompile(`^\|\s*(\d+)\s*B?\s*\|\s*0x([0-9A-Fa-f]{2})\s`)
+
+// parseMemory M コマンドの表からROMの内容を読み取る
+func parseMemory(out string) (rom [16]uint8, err error) {
+	var found [16]bool
+	for _, line := range strings.Split(out, "\n") {
+		m := memoryRow.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		adr, _ := strconv.Atoi(m[1])
+		v, _ := strconv.ParseUint(m[2], 16, 8)
+		if adr < len(rom) {
+			rom[adr], found[adr] = uint8(v), true
+		}
+	}
+	for adr, ok := range found {
+		if !ok {
+			return rom, fmt.Errorf("cannot read address %d from the M command output", adr)
+		}
+	}
+	return rom, nil
+}
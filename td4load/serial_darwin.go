@@ -0,0 +1,14 @@
+package main
+
+import "syscall"
+
+// 端末の設定を読み書きする ioctl の要求
+const (
+	ioctlGetTermios = syscall.TIOCGETA
+	ioctlSetTermios = syscall.TIOCSETA
+)
+
+// setSpeed 通信速度を設定する
+func setSpeed(t *syscall.Termios, speed uint64) {
+	t.Ispeed, t.Ospeed = speed, speed
+}
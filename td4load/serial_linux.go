@@ -0,0 +1,19 @@
+package main
+
+import "syscall"
+
+// 端末の設定を読み書きする ioctl の要求
+const (
+	ioctlGetTermios = syscall.TCGETS
+	ioctlSetTermios = syscall.TCSETS
+)
+
+// cbaud 通信速度のビット (syscall.CBAUD は一部のアーキテクチャにしか定義されていない)
+const cbaud = 0x100f
+
+// setSpeed 通信速度を設定する
+func setSpeed(t *syscall.Termios, speed uint64) {
+	t.Cflag &^= cbaud
+	t.Cflag |= uint32(speed)
+	t.Ispeed, t.Ospeed = uint32(speed), uint32(speed)
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package main
+
+import "os"
+
+// openPort シリアルポートを開く
+// この環境では通信速度などを設定しない (USB接続のボードは設定に関係なく通信できる)。
+func openPort(name string, baud int) (*os.File, error) {
+	return os.OpenFile(name, os.O_RDWR, 0)
+}
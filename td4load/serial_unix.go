@@ -0,0 +1,57 @@
+//go:build linux || darwin
+
+package main
+
+// シリアルポートの設定 (Linux・macOS)
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// baudRates 通信速度と termios の値
+var baudRates = map[int]uint64{
+	9600: syscall.B9600, 19200: syscall.B19200, 38400: syscall.B38400,
+	57600: syscall.B57600, 115200: syscall.B115200, 230400: syscall.B230400,
+}
+
+// openPort シリアルポートを開き、1バイトずつエコーなし・変換なしで送受信するように設定する
+// 擬似端末 (pty) も同じように開くことができる。
+func openPort(name string, baud int) (*os.File, error) {
+	speed, ok := baudRates[baud]
+	if !ok {
+		return nil, fmt.Errorf("unsupported baud rate: %d", baud)
+	}
+	f, err := os.OpenFile(name, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+	var t syscall.Termios
+	if err := termios(f.Fd(), ioctlGetTermios, &t); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: not a serial port: %v", name, err)
+	}
+	t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	t.Oflag &^= syscall.OPOST
+	t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	t.Cflag &^= syscall.CSIZE | syscall.PARENB
+	t.Cflag |= syscall.CS8 | syscall.CREAD | syscall.CLOCAL
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+	setSpeed(&t, speed)
+	if err := termios(f.Fd(), ioctlSetTermios, &t); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// termios 端末の設定を読み書きする
+func termios(fd uintptr, req uintptr, t *syscall.Termios) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(unsafe.Pointer(t))); errno != 0 {
+		return errno
+	}
+	return nil
+}
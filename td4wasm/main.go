@@ -0,0 +1,169 @@
+//go:build js && wasm
+
+package main
+
+// 4bitCPU td4用の WebAssembly版 アセンブラ・エミュレータ
+// ブラウザのJavaScriptから、グローバルオブジェクト td4 の関数として呼び出す。サーバーは不要です。
+// > GOOS=js GOARCH=wasm go build -o playground/td4.wasm .
+// > tinygo build -target wasm -o playground/td4.wasm .
+//
+// JavaScriptから使用できる関数:
+//   td4.assemble(source)     アセンブルし {ok, rom, diagnostics, listing} を返す (ROMには書き込まない)
+//   td4.load(rom)            ROMに書き込み、リセットする (rom は16個以下の数値の配列)
+//   td4.reset()              PC・レジスタ・キャリーフラグ・出力ポートを0にする
+//   td4.step()               1命令実行し、状態を返す
+//   td4.run(count)           count 命令実行し、状態を返す。ブレークポイントに到達したら停止し、halted を true にする
+//   td4.getState()           状態 {a, b, c, pc, in, out, rom, breaks, halted} を返す
+//   td4.setInput(value)      入力ポートを設定する
+//   td4.setBreakpoint(addr, on)  ブレークポイントの設定と解除
+
+import (
+	"strings"
+	"syscall/js"
+
+	"main/asm"
+	"main/td4"
+)
+
+// cpu 実行中のCPU (1つだけ)
+var cpu = td4.NewCPU()
+
+func main() {
+	js.Global().Set("td4", js.ValueOf(map[string]interface{}{
+		"assemble":      js.FuncOf(assemble),
+		"load":          js.FuncOf(load),
+		"reset":         js.FuncOf(reset),
+		"step":          js.FuncOf(step),
+		"run":           js.FuncOf(run),
+		"getState":      js.FuncOf(getState),
+		"setInput":      js.FuncOf(setInput),
+		"setBreakpoint": js.FuncOf(setBreakpoint),
+	}))
+	select {} // JavaScriptから呼び出されるのを待ち続ける
+}
+
+// arg 引数を返す (省略された場合は undefined)
+func arg(args []js.Value, n int) js.Value {
+	if n < len(args) {
+		return args[n]
+	}
+	return js.Undefined()
+}
+
+// assemble ソースコードをアセンブルし、機械語・診断情報・リストを返す
+// エラーがなければ、td4lint と同じ検査も行う。
+func assemble(this js.Value, args []js.Value) interface{} {
+	source := ""
+	if v := arg(args, 0); v.Type() == js.TypeString {
+		source = v.String()
+	}
+	lines := strings.Split(strings.ReplaceAll(source, "\r\n", "\n"), "\n")
+	a := asm.NewAssembler("program.td4", lines)
+	err1 := a.Pass1()
+	err2 := a.Pass2()
+	ok := err1 == nil && err2 == nil
+	if ok {
+		a.Lint()
+	}
+	a.Diags.Sort()
+	diags := []interface{}{}
+	for _, d := range a.Diags.List {
+		diags = append(diags, map[string]interface{}{
+			"line": d.Line, "col": d.Col, "severity": d.Severity.String(), "message": d.Message,
+		})
+	}
+	result := map[string]interface{}{"ok": ok, "diagnostics": diags, "rom": []interface{}{}, "listing": ""}
+	if ok {
+		_, image := a.Image(true)
+		result["rom"] = bytesToJS(image)
+		var listing strings.Builder
+		a.WriteListing(&listing)
+		result["listing"] = listing.String()
+	}
+	return result
+}
+
+// load ROMに書き込み、リセットする
+func load(this js.Value, args []js.Value) interface{} {
+	v := arg(args, 0)
+	cpu.ROM = [16]uint8{}
+	if v.Type() == js.TypeObject {
+		for i := 0; i < v.Length() && i < len(cpu.ROM); i++ {
+			cpu.ROM[i] = uint8(v.Index(i).Int())
+		}
+	}
+	cpu.Reset()
+	return state(false)
+}
+
+// reset PC・レジスタ・キャリーフラグ・出力ポートを0にする
+func reset(this js.Value, args []js.Value) interface{} {
+	cpu.Reset()
+	return state(false)
+}
+
+// step ブレークポイントに関係なく1命令実行する
+func step(this js.Value, args []js.Value) interface{} {
+	cpu.Step()
+	return state(cpu.IsBreakpoint(cpu.PC))
+}
+
+// run 指定した数の命令を実行する (省略時は1命令)
+// 実行を始めた番地のブレークポイントでは停止しない。
+func run(this js.Value, args []js.Value) interface{} {
+	count := 1
+	if v := arg(args, 0); v.Type() == js.TypeNumber {
+		count = v.Int()
+	}
+	for i := 0; i < count; i++ {
+		if i > 0 && cpu.IsBreakpoint(cpu.PC) {
+			return state(true)
+		}
+		cpu.Step()
+	}
+	return state(cpu.IsBreakpoint(cpu.PC))
+}
+
+// getState 現在の状態を返す
+func getState(this js.Value, args []js.Value) interface{} {
+	return state(false)
+}
+
+// setInput 入力ポートを設定する
+func setInput(this js.Value, args []js.Value) interface{} {
+	if v := arg(args, 0); v.Type() == js.TypeNumber {
+		cpu.InPort = uint8(v.Int()) & 0x0F
+	}
+	return state(false)
+}
+
+// setBreakpoint ブレークポイントの設定と解除
+func setBreakpoint(this js.Value, args []js.Value) interface{} {
+	adr, on := arg(args, 0), arg(args, 1)
+	if adr.Type() == js.TypeNumber && adr.Int() >= 0 && adr.Int() < len(cpu.Breaks) {
+		cpu.Breaks[adr.Int()] = on.Truthy()
+	}
+	return state(false)
+}
+
+// state CPUの状態をJavaScriptのオブジェクトにして返す
+func state(halted bool) map[string]interface{} {
+	breaks := make([]interface{}, len(cpu.Breaks))
+	for i, b := range cpu.Breaks {
+		breaks[i] = b
+	}
+	return map[string]interface{}{
+		"a": int(cpu.A), "b": int(cpu.B), "c": cpu.C, "pc": int(cpu.PC),
+		"in": int(cpu.InPort), "out": int(cpu.OutPort),
+		"rom": bytesToJS(cpu.ROM[:]), "breaks": breaks, "halted": halted,
+	}
+}
+
+// bytesToJS バイト列をJavaScriptの数値の配列にする
+func bytesToJS(data []uint8) []interface{} {
+	a := make([]interface{}, len(data))
+	for i, b := range data {
+		a[i] = int(b)
+	}
+	return a
+}